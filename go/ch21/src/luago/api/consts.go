@@ -57,4 +57,35 @@ const (
 	LUA_ERRGCMM
 	LUA_ERRERR
 	LUA_ERRFILE
+	LUA_ERRLIMIT // 超出了执行限制(指令数或者上下文)
+)
+
+/* options for GC */
+const (
+	LUA_GCSTOP       = 0 // 停止垃圾回收
+	LUA_GCRESTART    = 1 // 重新开始垃圾回收
+	LUA_GCCOLLECT    = 2 // 执行一次完整的垃圾回收
+	LUA_GCCOUNT      = 3 // 使用中的内存(KB)
+	LUA_GCCOUNTB     = 4 // 使用中的内存除以1024的余数(字节)
+	LUA_GCSTEP       = 5 // 执行一步垃圾回收
+	LUA_GCSETPAUSE   = 6 // 设置间歇率，返回原来的值
+	LUA_GCSETSTEPMUL = 7 // 设置步进倍率，返回原来的值
+	LUA_GCISRUNNING  = 9 // 垃圾回收器是否在运行
+)
+
+/* Event codes */
+const (
+	LUA_HOOKCALL = iota
+	LUA_HOOKRET
+	LUA_HOOKLINE
+	LUA_HOOKCOUNT
+	LUA_HOOKTAILCALL
+)
+
+/* Event masks */
+const (
+	LUA_MASKCALL  = 1 << LUA_HOOKCALL  // 调用函数时
+	LUA_MASKRET   = 1 << LUA_HOOKRET   // 函数返回时
+	LUA_MASKLINE  = 1 << LUA_HOOKLINE  // 开始执行新的一行时
+	LUA_MASKCOUNT = 1 << LUA_HOOKCOUNT // 每执行count条指令
 )
@@ -1,5 +1,7 @@
 package api
 
+import "io/fs"
+
 type FuncReg map[string]GoFunction
 
 // auxiliary library
@@ -7,6 +9,7 @@ type AuxLib interface {
 	/* Error-report functions */
 	Error2(fmt string, a ...interface{}) int
 	ArgError(arg int, extraMsg string) int
+	Where(level int)
 	/* Argument check functions */
 	CheckStack2(sz int, msg string)
 	ArgCheck(cond bool, arg int, extraMsg string)
@@ -15,6 +18,8 @@ type AuxLib interface {
 	CheckInteger(arg int) int64
 	CheckNumber(arg int) float64
 	CheckString(arg int) string
+	CheckUdata(arg int, tname string) interface{}
+	TestUdata(arg int, tname string) interface{}
 	OptInteger(arg int, d int64) int64
 	OptNumber(arg int, d float64) float64
 	OptString(arg int, d string) string
@@ -24,6 +29,7 @@ type AuxLib interface {
 	LoadFile(filename string) int
 	LoadFileX(filename, mode string) int
 	LoadString(s string) int
+	OpenFile(filename string) (fs.File, error) // 打开文件，状态机有虚拟文件系统时在其中打开
 	/* Other functions */
 	TypeName2(idx int) string
 	ToString2(idx int) string
@@ -32,8 +38,11 @@ type AuxLib interface {
 	GetMetafield(obj int, e string) LuaType
 	CallMeta(obj int, e string) bool
 	OpenLibs()
+	OpenLib(name string) bool
 	RequireF(modname string, openf GoFunction, glb bool)
 	NewLib(l FuncReg)
 	NewLibTable(l FuncReg)
 	SetFuncs(l FuncReg, nup int)
+	NewMetatable(tname string) bool
+	Traceback(l1 LuaState, msg string, level int)
 }
@@ -1,5 +1,7 @@
 package api
 
+import "context"
+
 type LuaType = int
 type ArithOp = int
 type CompareOp = int
@@ -59,6 +61,7 @@ type BasicAPI interface {
 	SetField(idx int, k string)                    // 设置指定索引处的表中指定键的值
 	SetI(idx int, n int64)                         // 设置指定索引处的表中指定键的值
 	Load(chunk []byte, chunkName, mode string) int // 加载一个块
+	Dump(strip bool) []byte                        // 把栈顶的Lua函数序列化成二进制chunk
 	Call(nArgs, nResults int)                      // 调用一个函数
 	PushGoFunction(f GoFunction)                   // 将Go函数压入栈顶
 	IsGoFunction(idx int) bool                     // 判断指定索引处的值是否是Go函数
@@ -68,6 +71,8 @@ type BasicAPI interface {
 	SetGlobal(name string)                         // 设置全局变量的值
 	Register(name string, f GoFunction)            // 注册一个Go函数
 	PushGoClosure(f GoFunction, n int)             // 将Go闭包压入栈顶
+	GetUpvalue(funcIdx, n int) (string, bool)      // 将函数的第n个upvalue压入栈顶
+	SetUpvalue(funcIdx, n int) (string, bool)      // 从栈顶弹出一个值，设置为函数的第n个upvalue
 	GetMetatable(idx int) bool                     // 获取指定索引处的值的元表
 	SetMetatable(idx int)                          // 设置指定索引处的值的元表
 	RawLen(idx int) uint                           // 获取指定索引处的值的长度
@@ -78,6 +83,7 @@ type BasicAPI interface {
 	RawSetI(idx int, i int64)                      // 设置指定索引处的表中指定键的值
 	Next(idx int) bool                             // 将指定索引处的表中的下一个键值对压入栈顶
 	Error() int                                    // 将栈顶的值作为错误对象抛出
+	ErrorStatus(status int) int                    // 将栈顶的值作为错误对象抛出，错误码是status
 	PCall(nArgs, nResults, msgh int) int           // 调用一个函数
 	StringToNumber(s string) bool                  // 将字符串转换成数字并压入栈顶
 	ToPointer(idx int) interface{}                 // 将指定索引处的值转换成指针
@@ -85,12 +91,50 @@ type BasicAPI interface {
 	Resume(from LuaState, nArgs int) int           // 恢复一个协程
 	Yield(nResults int) int                        // 挂起一个协程
 	Status() int                                   // 获取协程的状态
+	GC(what, data int) int                         // 控制垃圾回收器，循环引用中的对象的__gc在完整的回收(LUA_GCCOLLECT)时才调用
+	CloseThread() int                              // 关闭一个挂起或者已经死亡的协程
+
+	CallK(nArgs, nResults int, ctx KContext, k KFunction)            // 调用一个函数，被调函数挂起后通过k继续执行
+	PCallK(nArgs, nResults, msgh int, ctx KContext, k KFunction) int // 以保护模式调用一个函数，被调函数挂起后通过k继续执行
+	YieldK(nResults int, ctx KContext, k KFunction) int              // 挂起一个协程，恢复运行后通过k继续执行
 
 	IsYieldable() bool         // 判断当前协程是否可以挂起
 	ToThread(idx int) LuaState // 将指定索引处的值转换成协程
 	PushThread() bool          // 将当前协程压入栈顶
 	XMove(to LuaState, n int)  // 用于在两个协程栈之间移动元素
-	GetStack() bool            // 获取栈帧
+
+	NewUserdata(data interface{})    // 创建一个包装Go值的用户数据并压入栈顶
+	PushLightUserdata(p interface{}) // 将轻量用户数据压入栈顶
+	IsUserdata(idx int) bool         // 判断指定索引处的值是否是用户数据
+	IsLightUserdata(idx int) bool    // 判断指定索引处的值是否是轻量用户数据
+	ToUserdata(idx int) interface{}  // 获取指定索引处的用户数据所包装的Go值
+	SetUserValue(idx int)            // 从栈顶弹出一个值，设置为用户数据的用户值
+	GetUserValue(idx int) LuaType    // 把用户数据的用户值压入栈顶
+
+	PushGoValue(v interface{})              // 把Go值转换成Lua值压入栈顶，map、切片、数组和结构体转换成表
+	ToGoValue(idx int) (interface{}, error) // 把指定索引处的值转换成Go值，表转换成切片或者map
+
+	/* Debug API */
+	GetStack(level int, ar *LuaDebug) bool       // 获取第level层调用帧，0是当前正在执行的函数
+	GetInfo(what string, ar *LuaDebug) bool      // 获取函数或者调用帧的调试信息
+	GetLocal(ar *LuaDebug, n int) (string, bool) // 把调用帧的第n个局部变量推入栈顶，返回变量名
+	SetLocal(ar *LuaDebug, n int) (string, bool) // 从栈顶弹出一个值，设置为调用帧的第n个局部变量
+	UpvalueId(funcIdx, n int) interface{}        // 返回函数的第n个upvalue的唯一标识
+	UpvalueJoin(funcIdx1, n1, funcIdx2, n2 int)  // 让第一个函数的第n1个upvalue引用第二个函数的第n2个upvalue
+	SetHook(f LuaHook, mask, count int)          // 设置调试钩子，mask是事件掩码，count是计数钩子的间隔
+	GetHook() LuaHook                            // 获取调试钩子
+	GetHookMask() int                            // 获取调试钩子的事件掩码
+	GetHookCount() int                           // 获取计数钩子的间隔
+
+	/* Execution limits */
+	SetContext(ctx context.Context) // 设置执行上下文，上下文被取消或者超时后脚本因LUA_ERRLIMIT错误而停止
+	SetInstructionLimit(n int64)    // 限制最多执行的指令数并重新开始计数，0表示不限制
+	SetCallDepthLimit(n int)        // 限制最大调用深度，超出时抛出"stack overflow"运行时错误，0表示使用默认值
+
+	/* Memory limits */
+	SetMemoryLimit(n int64) // 限制估算的内存使用量(字节)，超出时抛出LUA_ERRMEM错误，0表示不限制
+	MemoryInUse() int64     // 估算的内存使用量(字节)，和collectgarbage("count")一致
+	CheckMemory(n int)      // 检查还能不能再分配n字节，不能时抛出LUA_ERRMEM错误
 }
 
 type LuaState interface {
@@ -100,3 +144,35 @@ type LuaState interface {
 
 // Go函数类型
 type GoFunction func(LuaState) int
+
+// 延续函数的上下文
+type KContext int
+
+// 延续函数类型，Go函数调用的函数挂起之后，协程恢复运行时通过延续函数继续执行原来的Go函数
+// http://www.lua.org/manual/5.3/manual.html#lua_KFunction
+type KFunction func(ls LuaState, status int, ctx KContext) int
+
+// 调试信息，GetInfo的what参数中的字母决定填充哪些字段
+// http://www.lua.org/manual/5.3/manual.html#lua_Debug
+type LuaDebug struct {
+	Event           int    // 触发钩子的事件 LUA_HOOKCALL/LUA_HOOKRET...
+	Name            string // (n) 函数名
+	NameWhat        string // (n) 'global', 'local', 'field', 'method'...
+	What            string // (S) 'Lua', 'C', 'main'
+	Source          string // (S) 源文件名
+	ShortSrc        string // (S) 适合在错误消息中显示的源文件名
+	CurrentLine     int    // (l) 当前正在执行的行号
+	LineDefined     int    // (S) 起始行号
+	LastLineDefined int    // (S) 最后行号
+	NUps            int    // (u) upvalue数量
+	NParams         int    // (u) 固定参数个数
+	IsVararg        bool   // (u) 是否有变长参数
+	IsTailCall      bool   // (t) 是否是尾调用
+	/* private part */
+	CallInfo interface{} // GetStack找到的调用帧
+}
+
+// 调试钩子，虚拟机在调用、返回、执行新的一行和每执行若干条指令时调用它，ar.Event指明是哪种事件
+// 钩子执行期间不会再触发钩子，钩子可以抛出错误中止脚本的执行
+// http://www.lua.org/manual/5.3/manual.html#lua_Hook
+type LuaHook func(ls LuaState, ar *LuaDebug)
@@ -1,5 +1,10 @@
 package binchunk
 
+import (
+	"fmt"
+	"strings"
+)
+
 // 二进制 chunk 定义
 type binaryChunk struct {
 	header                  // 头部
@@ -83,6 +88,33 @@ func Undump(data []byte) *Prototype {
 	return reader.readProto("") // 读取主函数原型
 }
 
+// 把函数原型序列化成二进制chunk，strip为true时不写入调试信息
+func Dump(proto *Prototype, strip bool) []byte {
+	writer := &writer{strip: strip}
+	writer.writeHeader()                        // 写入头部
+	writer.writeByte(byte(len(proto.Upvalues))) // 写入upvalue数量
+	writer.writeProto(proto, "")                // 写入主函数原型
+	return writer.data
+}
+
 func IsBinaryChunk(data []byte) bool {
 	return len(data) > 4 && string(data[:4]) == LUA_SIGNATURE
 }
+
+// 把chunk名字转换成适合在错误消息中显示的形式
+// lua-5.3.4/src/lobject.c#luaO_chunkid()
+func ChunkID(source string) string {
+	if source == "" { // 去掉调试信息的二进制chunk没有源文件名
+		return "?"
+	}
+	if strings.HasPrefix(source, "=") || strings.HasPrefix(source, "@") {
+		return source[1:]
+	}
+	if i := strings.IndexByte(source, '\n'); i >= 0 {
+		source = source[:i] + "..."
+	}
+	if len(source) > 45 {
+		source = source[:42] + "..."
+	}
+	return fmt.Sprintf("[string \"%s\"]", source)
+}
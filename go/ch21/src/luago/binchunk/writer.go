@@ -0,0 +1,184 @@
+package binchunk
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// 短字符串的最大长度，超过这个长度的字符串常量作为长字符串写入
+const LUAI_MAXSHORTLEN = 40
+
+// 把函数原型序列化成二进制chunk，和reader互为逆过程
+type writer struct {
+	data  []byte
+	strip bool // 是否去掉调试信息
+}
+
+// 写入头部
+func (self *writer) writeHeader() {
+	self.writeBytes([]byte(LUA_SIGNATURE))
+	self.writeByte(LUAC_VERSION)
+	self.writeByte(LUAC_FORMAT)
+	self.writeBytes([]byte(LUAC_DATA))
+	self.writeByte(CINT_SIZE)
+	self.writeByte(CSIZET_SIZE)
+	self.writeByte(INSTRUCTION_SIZE)
+	self.writeByte(LUA_INTEGER_SIZE)
+	self.writeByte(LUA_NUMBER_SIZE)
+	self.writeLuaInteger(LUAC_INT)
+	self.writeLuaNumber(LUAC_NUM)
+}
+
+// 写入函数原型，子函数的源文件名和父函数相同时不重复写入
+func (self *writer) writeProto(proto *Prototype, parentSource string) {
+	if self.strip || proto.Source == parentSource {
+		self.writeString("")
+	} else {
+		self.writeString(proto.Source)
+	}
+	self.writeUint32(proto.LineDefined)
+	self.writeUint32(proto.LastLineDefined)
+	self.writeByte(proto.NumParams)
+	self.writeByte(proto.IsVararg)
+	self.writeByte(proto.MaxStackSize)
+	self.writeCode(proto.Code)
+	self.writeConstants(proto.Constants)
+	self.writeUpvalues(proto.Upvalues)
+	self.writeProtos(proto.Protos, proto.Source)
+	self.writeDebug(proto)
+}
+
+// 写入基本数据类型
+
+// 写入一个字节
+func (self *writer) writeByte(b byte) {
+	self.data = append(self.data, b)
+}
+
+// 写入n个字节
+func (self *writer) writeBytes(bytes []byte) {
+	self.data = append(self.data, bytes...)
+}
+
+// 用小端的方式写入一个cint存储类型
+func (self *writer) writeUint32(i uint32) {
+	self.data = binary.LittleEndian.AppendUint32(self.data, i)
+}
+
+// 用小端的方式写入一个size_t存储类型
+func (self *writer) writeUint64(i uint64) {
+	self.data = binary.LittleEndian.AppendUint64(self.data, i)
+}
+
+// 写入Lua整数
+func (self *writer) writeLuaInteger(i int64) {
+	self.writeUint64(uint64(i))
+}
+
+// 写入Lua浮点数
+func (self *writer) writeLuaNumber(f float64) {
+	self.writeUint64(math.Float64bits(f))
+}
+
+// 写入Lua字符串，长度加一之后写入，0表示NULL
+func (self *writer) writeString(s string) {
+	if s == "" {
+		self.writeByte(0)
+		return
+	}
+	size := len(s) + 1
+	if size < 0xFF {
+		self.writeByte(byte(size))
+	} else {
+		self.writeByte(0xFF)
+		self.writeUint64(uint64(size))
+	}
+	self.writeBytes([]byte(s))
+}
+
+// 写入指令表
+func (self *writer) writeCode(code []uint32) {
+	self.writeUint32(uint32(len(code)))
+	for _, inst := range code {
+		self.writeUint32(inst)
+	}
+}
+
+// 写入一个常量
+func (self *writer) writeConstant(k interface{}) {
+	switch x := k.(type) {
+	case nil:
+		self.writeByte(TAG_NIL)
+	case bool:
+		self.writeByte(TAG_BOOLEAN)
+		if x {
+			self.writeByte(1)
+		} else {
+			self.writeByte(0)
+		}
+	case float64:
+		self.writeByte(TAG_NUMBER)
+		self.writeLuaNumber(x)
+	case int64:
+		self.writeByte(TAG_INTEGER)
+		self.writeLuaInteger(x)
+	case string:
+		if len(x) <= LUAI_MAXSHORTLEN {
+			self.writeByte(TAG_SHORT_STR)
+		} else {
+			self.writeByte(TAG_LONG_STR)
+		}
+		self.writeString(x)
+	default:
+		panic("unknown constant type!")
+	}
+}
+
+// 写入常量表
+func (self *writer) writeConstants(k []interface{}) {
+	self.writeUint32(uint32(len(k)))
+	for _, c := range k {
+		self.writeConstant(c)
+	}
+}
+
+// 写入Upvalue表
+func (self *writer) writeUpvalues(upvalues []Upvalue) {
+	self.writeUint32(uint32(len(upvalues)))
+	for _, uv := range upvalues {
+		self.writeByte(uv.Instack)
+		self.writeByte(uv.Idx)
+	}
+}
+
+// 写入子函数原型表
+func (self *writer) writeProtos(protos []*Prototype, source string) {
+	self.writeUint32(uint32(len(protos)))
+	for _, p := range protos {
+		self.writeProto(p, source)
+	}
+}
+
+// 写入调试信息：行号表、局部变量表和Upvalue名表，strip时全部写成空表
+func (self *writer) writeDebug(proto *Prototype) {
+	if self.strip {
+		self.writeUint32(0)
+		self.writeUint32(0)
+		self.writeUint32(0)
+		return
+	}
+	self.writeUint32(uint32(len(proto.LineInfo)))
+	for _, line := range proto.LineInfo {
+		self.writeUint32(line)
+	}
+	self.writeUint32(uint32(len(proto.LocVars)))
+	for _, locVar := range proto.LocVars {
+		self.writeString(locVar.VarName)
+		self.writeUint32(locVar.StartPC)
+		self.writeUint32(locVar.EndPC)
+	}
+	self.writeUint32(uint32(len(proto.UpvalueNames)))
+	for _, name := range proto.UpvalueNames {
+		self.writeString(name)
+	}
+}
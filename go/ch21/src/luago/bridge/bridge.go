@@ -0,0 +1,410 @@
+// bridge包通过反射把任意的Go值交给Lua使用
+//
+// 布尔值、数字和字符串转换成对应的Lua值，Go函数包装成Lua函数，参数和返回值自动转换；
+// 结构体、指针、map、切片、数组和通道包装成用户数据，通过元方法访问字段、方法和元素。
+// 结构体和数组按值推入时会先复制一份，Lua里修改的是这份副本
+package bridge
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	. "go/ch21/src/luago/api"
+	"go/ch21/src/luago/internal/structs"
+)
+
+/* key, in the registry, for the metatable of Go values */
+const GO_VALUE = "luago.bridge"
+
+// Go值的元方法，元方法会推入新的Go值，所以在init()里初始化
+var goValueMethods map[string]GoFunction
+
+func init() {
+	goValueMethods = map[string]GoFunction{
+		"__index":    goIndex,
+		"__newindex": goNewIndex,
+		"__len":      goLen,
+		"__pairs":    goPairs,
+		"__eq":       goEq,
+		"__tostring": goToString,
+	}
+}
+
+var (
+	goFunctionType = reflect.TypeOf(GoFunction(nil))
+	errorType      = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// 把Go值推入栈顶
+func Push(ls LuaState, v interface{}) {
+	pushValue(ls, reflect.ValueOf(v))
+}
+
+// 把Go值设置为全局变量
+func Register(ls LuaState, name string, v interface{}) {
+	Push(ls, v)
+	ls.SetGlobal(name)
+}
+
+func pushValue(ls LuaState, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Invalid:
+		ls.PushNil()
+	case reflect.Bool:
+		ls.PushBoolean(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		ls.PushInteger(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		ls.PushInteger(int64(v.Uint()))
+	case reflect.Float32, reflect.Float64:
+		ls.PushNumber(v.Float())
+	case reflect.String:
+		ls.PushString(v.String())
+	case reflect.Interface:
+		pushValue(ls, v.Elem())
+	case reflect.Func:
+		if v.IsNil() {
+			ls.PushNil()
+		} else if v.Type().ConvertibleTo(goFunctionType) { // 已经是GoFunction了，不需要转换参数
+			ls.PushGoFunction(v.Convert(goFunctionType).Interface().(GoFunction))
+		} else {
+			ls.PushGoFunction(func(ls LuaState) int {
+				return callFunc(ls, v, 1)
+			})
+		}
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Chan:
+		if v.IsNil() {
+			ls.PushNil()
+		} else {
+			pushUserdata(ls, v)
+		}
+	case reflect.Struct, reflect.Array: // 复制一份，这样字段和元素才是可以修改的
+		p := reflect.New(v.Type())
+		p.Elem().Set(v)
+		pushUserdata(ls, p)
+	default:
+		pushUserdata(ls, v)
+	}
+}
+
+// 把Go值包装成用户数据推入栈顶
+func pushUserdata(ls LuaState, v reflect.Value) {
+	ls.NewUserdata(v.Interface())
+	if ls.NewMetatable(GO_VALUE) {
+		ls.SetFuncs(goValueMethods, 0)
+	}
+	ls.SetMetatable(-2)
+}
+
+// 取出用户数据包装的Go值，指针会被解引用(结构体和数组按值推入时也是指针)
+func checkValue(ls LuaState) (reflect.Value, reflect.Value) {
+	v := reflect.ValueOf(ls.CheckUdata(1, GO_VALUE))
+	elem := v
+	if v.Kind() == reflect.Ptr {
+		elem = v.Elem()
+	}
+	return v, elem
+}
+
+// 调用Go函数，栈中从first开始的值是它的参数
+// 最后一个返回值是error时，它不为nil就抛出Lua错误，否则不返回它
+func callFunc(ls LuaState, fn reflect.Value, first int) int {
+	t := fn.Type()
+	nIn := t.NumIn()
+	top := ls.GetTop()
+	args := make([]reflect.Value, 0, nIn)
+	for i := 0; i < nIn; i++ {
+		if t.IsVariadic() && i == nIn-1 { // 剩下的参数都属于变长参数
+			for idx := first + i; idx <= top; idx++ {
+				args = append(args, checkArg(ls, idx, t.In(i).Elem()))
+			}
+			break
+		}
+		args = append(args, checkArg(ls, first+i, t.In(i)))
+	}
+
+	results := call(ls, fn, args)
+	if n := len(results); n > 0 && t.Out(n-1) == errorType {
+		if err := results[n-1]; !err.IsNil() {
+			return ls.Error2("%s", err.Interface().(error).Error())
+		}
+		results = results[:n-1]
+	}
+	ls.CheckStack2(len(results), "too many results")
+	for _, r := range results {
+		pushValue(ls, r)
+	}
+	return len(results)
+}
+
+// 调用Go函数，把它引发的panic转换成Lua错误
+func call(ls LuaState, fn reflect.Value, args []reflect.Value) []reflect.Value {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(interface{ Status() int }); ok { // Go函数调用的Lua代码出错了，原样抛出
+				panic(r)
+			}
+			ls.Error2("%v", r)
+		}
+	}()
+	return fn.Call(args)
+}
+
+// 把参数转换成类型t，不能转换时报参数错误
+func checkArg(ls LuaState, arg int, t reflect.Type) reflect.Value {
+	v, err := To(ls, arg, t)
+	if err != nil {
+		ls.ArgError(arg, err.Error())
+	}
+	return v
+}
+
+// __index(obj, key)
+// 依次查找方法、结构体字段、map的键和切片的元素(从1开始)
+func goIndex(ls LuaState) int {
+	v, elem := checkValue(ls)
+	if name, ok := keyName(ls); ok {
+		if m, ok := v.Type().MethodByName(name); ok {
+			ls.PushGoFunction(func(ls LuaState) int { // 方法的第一个参数是接收者，所以要用obj:method()调用
+				return callFunc(ls, m.Func, 1)
+			})
+			return 1
+		}
+		if elem.Kind() == reflect.Chan {
+			if f := chanMethod(name); f != nil {
+				ls.PushGoFunction(f)
+				return 1
+			}
+		}
+	}
+
+	switch elem.Kind() {
+	case reflect.Struct:
+		if name, ok := keyName(ls); ok {
+			if index, ok := fieldIndex(elem.Type(), name); ok {
+				field, _ := elem.FieldByIndexErr(index) // 嵌入的结构体指针为nil时字段不存在
+				pushElem(ls, field)
+				return 1
+			}
+		}
+	case reflect.Map:
+		if k, err := To(ls, 2, elem.Type().Key()); err == nil {
+			pushValue(ls, elem.MapIndex(k))
+			return 1
+		}
+	case reflect.Slice, reflect.Array, reflect.String:
+		if i, ok := ls.ToIntegerX(2); ok && i >= 1 && i <= int64(elem.Len()) {
+			pushElem(ls, elem.Index(int(i-1)))
+			return 1
+		}
+		ls.PushNil()
+		return 1
+	}
+	if ls.Type(2) == LUA_TSTRING {
+		return ls.Error2("no field or method '%s' in Go value of type %s", ls.ToString(2), v.Type())
+	}
+	ls.PushNil()
+	return 1
+}
+
+// 只有字符串键才能用来查找方法和字段
+func keyName(ls LuaState) (string, bool) {
+	if ls.Type(2) != LUA_TSTRING {
+		return "", false
+	}
+	return ls.ToString(2), true
+}
+
+// 推入字段或者元素，可以修改的结构体和数组推入它的指针，这样在Lua里修改的就是原来的值
+func pushElem(ls LuaState, v reflect.Value) {
+	if k := v.Kind(); (k == reflect.Struct || k == reflect.Array) && v.CanAddr() {
+		pushUserdata(ls, v.Addr())
+	} else {
+		pushValue(ls, v)
+	}
+}
+
+// __newindex(obj, key, val)
+// 修改结构体字段、map的键(值为nil时删除)和切片的元素
+func goNewIndex(ls LuaState) int {
+	v, elem := checkValue(ls)
+	switch elem.Kind() {
+	case reflect.Struct:
+		if name, ok := keyName(ls); ok && elem.CanAddr() {
+			if index, ok := fieldIndex(elem.Type(), name); ok {
+				field := fieldByIndexAlloc(elem, index) // 嵌入的结构体指针为nil时分配一个
+				field.Set(checkArg(ls, 3, field.Type()))
+				return 0
+			}
+		}
+	case reflect.Map:
+		k := checkArg(ls, 2, elem.Type().Key())
+		if ls.IsNil(3) {
+			elem.SetMapIndex(k, reflect.Value{})
+		} else {
+			elem.SetMapIndex(k, checkArg(ls, 3, elem.Type().Elem()))
+		}
+		return 0
+	case reflect.Slice, reflect.Array:
+		i, ok := ls.ToIntegerX(2)
+		if !ok || i < 1 || i > int64(elem.Len()) {
+			return ls.Error2("index out of range")
+		}
+		if e := elem.Index(int(i - 1)); e.CanSet() {
+			e.Set(checkArg(ls, 3, e.Type()))
+			return 0
+		}
+	}
+	return ls.Error2("cannot set field '%s' in Go value of type %s", ls.ToString2(2), v.Type())
+}
+
+// __len(obj)
+func goLen(ls LuaState) int {
+	v, elem := checkValue(ls)
+	switch elem.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.Chan, reflect.String:
+		ls.PushInteger(int64(elem.Len()))
+		return 1
+	}
+	return ls.Error2("attempt to get length of a Go value of type %s", v.Type())
+}
+
+// __pairs(obj)
+// 遍历结构体的字段、map的键值对和切片的元素，map按键排序后遍历
+func goPairs(ls LuaState) int {
+	v, elem := checkValue(ls)
+	var keys []reflect.Value
+	var get func(i int) (k, v reflect.Value)
+	switch elem.Kind() {
+	case reflect.Struct:
+		fields := structs.Fields(elem.Type())
+		get = func(i int) (reflect.Value, reflect.Value) {
+			field, _ := elem.FieldByIndexErr(fields[i].Index)
+			return reflect.ValueOf(fields[i].Name), field
+		}
+		keys = make([]reflect.Value, len(fields))
+	case reflect.Map:
+		keys = elem.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+		get = func(i int) (reflect.Value, reflect.Value) {
+			return keys[i], elem.MapIndex(keys[i])
+		}
+	case reflect.Slice, reflect.Array:
+		keys = make([]reflect.Value, elem.Len())
+		get = func(i int) (reflect.Value, reflect.Value) {
+			return reflect.ValueOf(i + 1), elem.Index(i)
+		}
+	default:
+		return ls.Error2("cannot iterate over a Go value of type %s", v.Type())
+	}
+
+	i := 0
+	ls.PushGoFunction(func(ls LuaState) int {
+		for ; i < len(keys); i++ {
+			k, v := get(i)
+			if v.IsValid() { // 遍历时删除的键
+				i++
+				pushValue(ls, k)
+				pushElem(ls, v)
+				return 2
+			}
+		}
+		ls.PushNil()
+		return 1
+	})
+	ls.PushValue(1)
+	ls.PushNil()
+	return 3
+}
+
+// __eq(a, b)
+// 可以比较的值直接比较，map、切片和函数比较它们是否引用同一个对象
+func goEq(ls LuaState) int {
+	a := reflect.ValueOf(ls.ToUserdata(1))
+	b := reflect.ValueOf(ls.ToUserdata(2))
+	eq := false
+	if a.IsValid() && b.IsValid() && a.Type() == b.Type() {
+		if a.Type().Comparable() {
+			eq = a.Interface() == b.Interface()
+		} else {
+			eq = a.Pointer() == b.Pointer() && (a.Kind() != reflect.Slice || a.Len() == b.Len())
+		}
+	}
+	ls.PushBoolean(eq)
+	return 1
+}
+
+// __tostring(obj)
+func goToString(ls LuaState) int {
+	v, _ := checkValue(ls)
+	switch x := v.Interface().(type) {
+	case error:
+		ls.PushString(x.Error())
+	case fmt.Stringer:
+		ls.PushString(x.String())
+	default:
+		switch v.Kind() {
+		case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Chan:
+			ls.PushString(fmt.Sprintf("%s: %p", v.Type(), x))
+		default:
+			ls.PushString(fmt.Sprintf("%s: %v", v.Type(), x))
+		}
+	}
+	return 1
+}
+
+// 通道的方法
+func chanMethod(name string) GoFunction {
+	switch name {
+	case "send":
+		return chanSend
+	case "recv":
+		return chanRecv
+	case "close":
+		return chanClose
+	}
+	return nil
+}
+
+// ch:send(v)
+func chanSend(ls LuaState) int {
+	ch := checkChan(ls)
+	ch.Send(checkArg(ls, 2, ch.Type().Elem()))
+	return 0
+}
+
+// ch:recv() 返回收到的值和通道是否还没有关闭
+func chanRecv(ls LuaState) int {
+	ch := checkChan(ls)
+	v, ok := ch.Recv()
+	pushValue(ls, v)
+	ls.PushBoolean(ok)
+	return 2
+}
+
+// ch:close()
+func chanClose(ls LuaState) int {
+	checkChan(ls).Close()
+	return 0
+}
+
+func checkChan(ls LuaState) reflect.Value {
+	_, ch := checkValue(ls)
+	if ch.Kind() != reflect.Chan {
+		ls.ArgError(1, "channel expected")
+	}
+	return ch
+}
+
+// 根据Lua里使用的字段名查找字段
+func fieldIndex(t reflect.Type, name string) ([]int, bool) {
+	for _, f := range structs.Fields(t) {
+		if f.Name == name {
+			return f.Index, true
+		}
+	}
+	return nil, false
+}
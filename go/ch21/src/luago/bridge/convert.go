@@ -0,0 +1,414 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"sync"
+
+	. "go/ch21/src/luago/api"
+	"go/ch21/src/luago/internal/structs"
+)
+
+var errCycle = errors.New("cannot convert a table that contains itself")
+
+/* key, in the registry, for the Lua functions converted to Go functions */
+const LUA_FUNCS = "luago.bridge.funcs"
+
+// 把栈中idx处的Lua值转换成类型为t的Go值
+// 用户数据包装的Go值直接使用，表可以转换成结构体、map、切片和数组，Lua函数可以转换成Go函数，
+// 转换成interface{}时使用LuaState.ToGoValue()：序列转换成[]interface{}，
+// 键都是字符串的表转换成map[string]interface{}，其他的表转换成map[interface{}]interface{}
+func To(ls LuaState, idx int, t reflect.Type) (reflect.Value, error) {
+	return toValue(ls, ls.AbsIndex(idx), t, map[interface{}]bool{})
+}
+
+// 把栈中idx处的Lua值转换后保存到ptr指向的变量里
+func Decode(ls LuaState, idx int, ptr interface{}) error {
+	p := reflect.ValueOf(ptr)
+	if p.Kind() != reflect.Ptr || p.IsNil() {
+		return errors.New("non-nil pointer expected")
+	}
+	v, err := To(ls, idx, p.Type().Elem())
+	if err == nil {
+		p.Elem().Set(v)
+	}
+	return err
+}
+
+// visiting记录正在转换的表，用来发现引用了自己的表
+func toValue(ls LuaState, idx int, t reflect.Type, visiting map[interface{}]bool) (reflect.Value, error) {
+	tp := ls.Type(idx)
+	if tp == LUA_TUSERDATA || tp == LUA_TLIGHTUSERDATA {
+		if v, ok := fromUserdata(ls.ToUserdata(idx), t); ok {
+			return v, nil
+		}
+	}
+	if tp <= LUA_TNIL {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface, reflect.Func, reflect.Chan:
+			return reflect.Zero(t), nil
+		}
+	}
+
+	v := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Interface:
+		if t.NumMethod() == 0 {
+			x, err := ls.ToGoValue(idx)
+			if err == nil && x != nil {
+				v.Set(reflect.ValueOf(x))
+			}
+			return v, err
+		}
+	case reflect.Bool:
+		if tp == LUA_TBOOLEAN {
+			v.SetBool(ls.ToBoolean(idx))
+			return v, nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n, err := toInteger(ls, idx); err != nil {
+			return v, err
+		} else if v.OverflowInt(n) {
+			return v, fmt.Errorf("number out of range for %s", t)
+		} else {
+			v.SetInt(n)
+			return v, nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n, err := toInteger(ls, idx); err != nil {
+			return v, err
+		} else if n < 0 || v.OverflowUint(uint64(n)) {
+			return v, fmt.Errorf("number out of range for %s", t)
+		} else {
+			v.SetUint(uint64(n))
+			return v, nil
+		}
+	case reflect.Float32, reflect.Float64:
+		if f, ok := ls.ToNumberX(idx); ok {
+			v.SetFloat(f)
+			return v, nil
+		}
+	case reflect.String:
+		if tp == LUA_TSTRING || tp == LUA_TNUMBER {
+			v.SetString(toString(ls, idx))
+			return v, nil
+		}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 && tp == LUA_TSTRING { // []byte
+			v.SetBytes([]byte(ls.ToString(idx)))
+			return v, nil
+		}
+		if tp == LUA_TTABLE {
+			return toSlice(ls, idx, t, visiting)
+		}
+	case reflect.Array:
+		if tp == LUA_TTABLE {
+			return toArray(ls, idx, t, visiting)
+		}
+	case reflect.Map:
+		if tp == LUA_TTABLE {
+			return toMap(ls, idx, t, visiting)
+		}
+	case reflect.Struct:
+		if tp == LUA_TTABLE {
+			return toStruct(ls, idx, t, visiting)
+		}
+	case reflect.Func:
+		if tp == LUA_TFUNCTION {
+			if f := ls.ToGoFunction(idx); f != nil && t == goFunctionType {
+				v.Set(reflect.ValueOf(f))
+				return v, nil
+			}
+			return toFunc(ls, idx, t), nil
+		}
+	case reflect.Ptr:
+		if tp == LUA_TTABLE {
+			elem, err := toValue(ls, idx, t.Elem(), visiting)
+			if err == nil {
+				v = reflect.New(t.Elem())
+				v.Elem().Set(elem)
+			}
+			return v, err
+		}
+	}
+	return v, fmt.Errorf("%s expected, got %s", t, ls.TypeName2(idx))
+}
+
+// 转换成Go函数的Lua函数保存在注册表的LUA_FUNCS表里，键是从1开始的整数，
+// 表的[0]是包装了funcRefs的用户数据。终结器不能操作Lua状态，所以Go函数被回收后
+// 只把它的键记在dead里，下次转换函数时再从表里删除
+type funcRefs struct {
+	mu   sync.Mutex
+	next int64   // 最后用过的键
+	dead []int64 // Go函数已经被回收的键
+}
+
+// 把LUA_FUNCS表推入栈顶，还没有时创建它
+func pushFuncs(ls LuaState) *funcRefs {
+	if ls.GetField(LUA_REGISTRYINDEX, LUA_FUNCS) == LUA_TTABLE {
+		ls.RawGetI(-1, 0)
+		refs := ls.ToUserdata(-1).(*funcRefs)
+		ls.Pop(1)
+		return refs
+	}
+	ls.Pop(1)
+	refs := &funcRefs{}
+	ls.NewTable()
+	ls.NewUserdata(refs)
+	ls.RawSetI(-2, 0)
+	ls.PushValue(-1)
+	ls.SetField(LUA_REGISTRYINDEX, LUA_FUNCS)
+	return refs
+}
+
+// 包装了Lua函数的Go函数
+type luaFunc struct {
+	ls  LuaState     // 通过这个线程调用Lua函数
+	key int64        // Lua函数在LUA_FUNCS表里的键
+	t   reflect.Type // Go函数的类型
+}
+
+// 把栈中idx处的Lua函数转换成类型为t的Go函数，Go函数要在转换它的线程运行时调用
+func toFunc(ls LuaState, idx int, t reflect.Type) reflect.Value {
+	refs := pushFuncs(ls)
+	refs.mu.Lock()
+	for _, key := range refs.dead {
+		ls.PushNil()
+		ls.RawSetI(-2, key)
+	}
+	refs.dead = refs.dead[:0]
+	refs.next++
+	f := &luaFunc{ls: ls, key: refs.next, t: t}
+	refs.mu.Unlock()
+	ls.PushValue(idx)
+	ls.RawSetI(-2, f.key)
+	ls.Pop(1)
+
+	runtime.SetFinalizer(f, func(f *luaFunc) {
+		refs.mu.Lock()
+		refs.dead = append(refs.dead, f.key)
+		refs.mu.Unlock()
+	})
+	return reflect.MakeFunc(t, f.call)
+}
+
+// 调用Lua函数，参数和返回值按照Go函数的类型转换
+// 最后一个返回值是error时，在保护模式下调用，Lua错误和不能转换的返回值通过它返回，否则抛出Lua错误
+func (self *luaFunc) call(args []reflect.Value) []reflect.Value {
+	ls, t := self.ls, self.t
+	if t.IsVariadic() { // 展开变长参数
+		last := args[len(args)-1]
+		args = args[:len(args)-1]
+		for i := 0; i < last.Len(); i++ {
+			args = append(args, last.Index(i))
+		}
+	}
+	results := make([]reflect.Value, t.NumOut())
+	nResults := len(results)
+	withErr := nResults > 0 && t.Out(nResults-1) == errorType
+	if withErr {
+		nResults--
+	}
+
+	ls.CheckStack2(len(args)+2, "too many arguments")
+	pushFuncs(ls)
+	ls.RawGetI(-1, self.key)
+	ls.Remove(-2)
+	for _, arg := range args {
+		pushValue(ls, arg)
+	}
+	var err error
+	if !withErr {
+		ls.Call(len(args), nResults)
+	} else if ls.PCall(len(args), nResults, 0) != LUA_OK {
+		err = errors.New(ls.ToString2(-1))
+		ls.Pop(2) // 错误对象和它的字符串
+	}
+	if err == nil {
+		for i := 0; i < nResults; i++ {
+			v, e := To(ls, i-nResults, t.Out(i))
+			if e != nil {
+				err = fmt.Errorf("result #%d: %w", i+1, e)
+				break
+			}
+			results[i] = v
+		}
+		ls.Pop(nResults)
+	}
+	if err != nil && !withErr {
+		ls.Error2("%s", err.Error())
+	}
+
+	for i, r := range results {
+		if !r.IsValid() {
+			results[i] = reflect.Zero(t.Out(i))
+		}
+	}
+	if withErr && err != nil {
+		results[nResults] = reflect.ValueOf(&err).Elem()
+	}
+	return results
+}
+
+// 用户数据包装的值可以赋给t，或者是指向这种值的指针
+func fromUserdata(data interface{}, t reflect.Type) (reflect.Value, bool) {
+	if data == nil {
+		return reflect.Value{}, false
+	}
+	dv := reflect.ValueOf(data)
+	if dv.Type().AssignableTo(t) {
+		v := reflect.New(t).Elem()
+		v.Set(dv)
+		return v, true
+	}
+	if dv.Kind() == reflect.Ptr && !dv.IsNil() && dv.Type().Elem().AssignableTo(t) { // 按值推入的结构体和数组
+		v := reflect.New(t).Elem()
+		v.Set(dv.Elem())
+		return v, true
+	}
+	return reflect.Value{}, false
+}
+
+func toInteger(ls LuaState, idx int) (int64, error) {
+	if n, ok := ls.ToIntegerX(idx); ok {
+		return n, nil
+	}
+	if ls.Type(idx) == LUA_TNUMBER {
+		return 0, errors.New("number has no integer representation")
+	}
+	return 0, fmt.Errorf("number expected, got %s", ls.TypeName2(idx))
+}
+
+// ToString()会把栈中的数字替换成字符串，遍历表时会破坏Next()需要的键，所以转换它的副本
+func toString(ls LuaState, idx int) string {
+	ls.PushValue(idx)
+	s := ls.ToString(-1)
+	ls.Pop(1)
+	return s
+}
+
+// 开始转换表，发现表引用了自己时返回错误
+func enterTable(ls LuaState, idx int, visiting map[interface{}]bool) (interface{}, error) {
+	t := ls.ToPointer(idx)
+	if visiting[t] {
+		return nil, errCycle
+	}
+	visiting[t] = true
+	return t, nil
+}
+
+// 把表的序列部分转换成切片
+func toSlice(ls LuaState, idx int, t reflect.Type, visiting map[interface{}]bool) (reflect.Value, error) {
+	key, err := enterTable(ls, idx, visiting)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	defer delete(visiting, key)
+
+	n := int(ls.RawLen(idx))
+	v := reflect.MakeSlice(t, n, n)
+	for i := 0; i < n; i++ {
+		if err := toElem(ls, idx, int64(i+1), v.Index(i), visiting); err != nil {
+			return v, err
+		}
+	}
+	return v, nil
+}
+
+func toArray(ls LuaState, idx int, t reflect.Type, visiting map[interface{}]bool) (reflect.Value, error) {
+	key, err := enterTable(ls, idx, visiting)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	defer delete(visiting, key)
+
+	v := reflect.New(t).Elem()
+	for i := 0; i < t.Len(); i++ {
+		if err := toElem(ls, idx, int64(i+1), v.Index(i), visiting); err != nil {
+			return v, err
+		}
+	}
+	return v, nil
+}
+
+// 把t[i]转换后保存到elem里
+func toElem(ls LuaState, idx int, i int64, elem reflect.Value, visiting map[interface{}]bool) error {
+	ls.RawGetI(idx, i)
+	defer ls.Pop(1)
+	v, err := toValue(ls, ls.GetTop(), elem.Type(), visiting)
+	if err != nil {
+		return fmt.Errorf("[%d]: %w", i, err)
+	}
+	elem.Set(v)
+	return nil
+}
+
+// 把表中所有的键值对转换成map
+func toMap(ls LuaState, idx int, t reflect.Type, visiting map[interface{}]bool) (reflect.Value, error) {
+	key, err := enterTable(ls, idx, visiting)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	defer delete(visiting, key)
+
+	v := reflect.MakeMap(t)
+	ls.PushNil()
+	for ls.Next(idx) {
+		top := ls.GetTop()
+		k, err := toValue(ls, top-1, t.Key(), visiting)
+		if err == nil {
+			var e reflect.Value
+			if e, err = toValue(ls, top, t.Elem(), visiting); err == nil {
+				v.SetMapIndex(k, e)
+				ls.Pop(1)
+				continue
+			}
+			err = fmt.Errorf("[%s]: %w", toString(ls, top-1), err)
+		}
+		ls.Pop(2)
+		return v, err
+	}
+	return v, nil
+}
+
+// 按照字段名从表中取值，表中没有的字段保持零值
+func toStruct(ls LuaState, idx int, t reflect.Type, visiting map[interface{}]bool) (reflect.Value, error) {
+	key, err := enterTable(ls, idx, visiting)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	defer delete(visiting, key)
+
+	v := reflect.New(t).Elem()
+	for _, f := range structs.Fields(t) {
+		ls.PushString(f.Name)
+		if ls.RawGet(idx) != LUA_TNIL {
+			field := fieldByIndexAlloc(v, f.Index)
+			fv, err := toValue(ls, ls.GetTop(), field.Type(), visiting)
+			if err != nil {
+				ls.Pop(1)
+				return v, fmt.Errorf("field '%s': %w", f.Name, err)
+			}
+			field.Set(fv)
+		}
+		ls.Pop(1)
+	}
+	return v, nil
+}
+
+// 按照索引序列取字段，途中遇到nil的嵌入结构体指针时分配一个新的结构体
+// go/src/encoding/json/decode.go#object()
+func fieldByIndexAlloc(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
@@ -0,0 +1,128 @@
+package bridge
+
+import (
+	"strings"
+	"testing"
+
+	"go/ch21/src/luago/state"
+)
+
+// Lua函数可以作为Go函数类型的参数，参数和返回值自动转换
+func TestLuaFunctionArgument(t *testing.T) {
+	ls := state.New()
+	ls.OpenLibs()
+	Register(ls, "apply", func(f func(int) int) int { return f(21) })
+	Register(ls, "join", func(f func(sep string, xs ...string) string) string { return f("-", "a", "b") })
+	Register(ls, "try", func(f func(int) (string, error)) string {
+		s, err := f(1)
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		return s
+	})
+	Register(ls, "each", func(xs []int, f func(int)) {
+		for _, x := range xs {
+			f(x)
+		}
+	})
+	if ls.DoString(`
+		assert(apply(function(x) return x * 2 end) == 42)
+		assert(join(function(sep, ...) return table.concat({...}, sep) end) == "a-b")
+		assert(try(function(n) return "ok" .. n end) == "ok1")
+		assert(try(function(n) error("oops", 0) end) == "error: oops")
+		assert(try(function(n) return {} end) == "error: result #1: string expected, got table")
+		local sum = 0
+		each({1, 2, 3}, function(x) sum = sum + x end)
+		assert(sum == 6)
+		local ok, err = pcall(apply, function(x) error("inner", 0) end)
+		assert(not ok and err == "inner", err)
+		local ok, err = pcall(apply, function(x) return "x" end)
+		assert(not ok and err:find("result #1"), err)`) {
+		t.Fatal(ls.ToString(-1))
+	}
+}
+
+// Go代码可以把Lua函数解码成Go函数再调用
+func TestDecodeFunction(t *testing.T) {
+	ls := state.New()
+	ls.OpenLibs()
+	ls.DoString(`return function(a, b) return a .. b, #a + #b end`)
+	var f func(a, b string) (string, int)
+	if err := Decode(ls, -1, &f); err != nil {
+		t.Fatal(err)
+	}
+	ls.Pop(1)
+	if s, n := f("foo", "bar"); s != "foobar" || n != 6 {
+		t.Fatalf("f() = %q, %d", s, n)
+	}
+	var g func() error
+	ls.DoString(`return function() error("bad") end`)
+	if err := Decode(ls, -1, &g); err != nil {
+		t.Fatal(err)
+	}
+	ls.Pop(1)
+	if err := g(); err == nil || !strings.HasSuffix(err.Error(), "bad") {
+		t.Fatalf("g() = %v", err)
+	}
+	if ls.GetTop() != 0 {
+		t.Fatalf("stack not balanced: %d", ls.GetTop())
+	}
+}
+
+// 转换成interface{}和LuaState.ToGoValue()的结果一样
+func TestDecodeInterface(t *testing.T) {
+	ls := state.New()
+	ls.DoString(`return {1, 2, x = {a = true}}`)
+	var v interface{}
+	if err := Decode(ls, -1, &v); err != nil {
+		t.Fatal(err)
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok || len(m) != 3 || m[int64(2)] != int64(2) {
+		t.Fatalf("v = %#v", v)
+	}
+	if x, ok := m["x"].(map[string]interface{}); !ok || x["a"] != true {
+		t.Fatalf("v.x = %#v", m["x"])
+	}
+}
+
+type Base struct{ ID int }
+
+type Node struct {
+	*Base
+	Name string `lua:"name"`
+}
+
+// 嵌入的结构体的字段提升到外层，解码时为nil的嵌入结构体指针分配一个新的结构体
+func TestEmbeddedStruct(t *testing.T) {
+	ls := state.New()
+	ls.OpenLibs()
+	Push(ls, &Node{Base: &Base{ID: 1}, Name: "a"})
+	ls.SetGlobal("n")
+	if ls.DoString(`
+		assert(n.ID == 1 and n.name == "a")
+		assert(not pcall(function() return n.Base end))
+		n.ID = 2
+		local keys = {}
+		for k, v in pairs(n) do keys[#keys + 1] = k .. "=" .. tostring(v) end
+		assert(table.concat(keys, ",") == "ID=2,name=a", table.concat(keys, ","))`) {
+		t.Fatal(ls.ToString(-1))
+	}
+
+	var n Node
+	ls.DoString(`return {ID = 3, name = "b", Base = {ID = 4}}`)
+	if err := Decode(ls, -1, &n); err != nil {
+		t.Fatal(err)
+	}
+	if n.Base == nil || n.ID != 3 || n.Name != "b" {
+		t.Fatalf("n = %+v", n)
+	}
+	Push(ls, &Node{})
+	ls.SetGlobal("empty")
+	if ls.DoString(`
+		assert(empty.ID == nil)
+		empty.ID = 5
+		assert(empty.ID == 5)`) {
+		t.Fatal(ls.ToString(-1))
+	}
+}
@@ -4,5 +4,6 @@ package ast
 type Block struct {
 	LastLine int    // 末尾行号
 	Stats    []Stat // 语句列表
+	RetLine  int    // return关键字所在行号，没有return语句时是0
 	RetExps  []Exp  // 表达式列表
 }
@@ -1,13 +1,19 @@
 package ast
 
 type Stat interface{}
-type EmptyStat struct{}              // 空语句 `;`
-type BreakStat struct{ Line int }    // break语句，会生成跳转指令，所以需要记录行号
-type LabelStat struct{ Name string } // 标签语句 `::label::` 记录标签名
-type GotoStat struct{ Name string }  // goto语句 `goto label` 记录标签名
-type DoStat struct{ Block *Block }   // do语句 `do block end` 给语句块引入新的作用域，所以需要记录语句块
-type FuncCallStat = FuncCallExp      // 函数调用语句 既可以是语句也可以是表达式，所以起了别名
-type WhileStat struct {              // while语句 `while exp do block end` 记录条件表达式和语句块
+type EmptyStat struct{}           // 空语句 `;`
+type BreakStat struct{ Line int } // break语句，会生成跳转指令，所以需要记录行号
+type LabelStat struct {           // 标签语句 `::label::` 记录标签名和行号
+	Line int
+	Name string
+}
+type GotoStat struct { // goto语句 `goto label` 记录标签名和行号
+	Line int
+	Name string
+}
+type DoStat struct{ Block *Block } // do语句 `do block end` 给语句块引入新的作用域，所以需要记录语句块
+type FuncCallStat = FuncCallExp    // 函数调用语句 既可以是语句也可以是表达式，所以起了别名
+type WhileStat struct {            // while语句 `while exp do block end` 记录条件表达式和语句块
 	Exp   Exp
 	Block *Block
 }
@@ -3,17 +3,41 @@ package codegen
 import "go/ch21/src/luago/compiler/ast"
 
 func cgBlock(fi *funcInfo, node *ast.Block) {
-	for _, stat := range node.Stats { // 遍历语句序列
+	_cgBlock(fi, node, true)
+}
+
+// 生成块，endsBlock表示块的末尾是否就是作用域的末尾
+func _cgBlock(fi *funcInfo, node *ast.Block, endsBlock bool) {
+	nactvar := fi.usedRegs            // 块开始时活跃的局部变量数量
+	for i, stat := range node.Stats { // 遍历语句序列
+		if label, ok := stat.(*ast.LabelStat); ok && endsBlock && _isLastStats(node, i) {
+			fi.addLabel(label.Name, label.Line, nactvar) // 块末尾的标签不在块内局部变量的作用域中
+			continue
+		}
 		cgStat(fi, stat) // 生成语句
 	}
 
 	if node.RetExps != nil { // 如果有返回值
-		cgRetStat(fi, node.RetExps) // 生成返回指令
+		cgRetStat(fi, node.RetLine, node.RetExps) // 生成返回指令
+	}
+}
+
+// 判断从第i条语句开始是否只剩下标签语句
+func _isLastStats(node *ast.Block, i int) bool {
+	if node.RetExps != nil {
+		return false
+	}
+	for _, stat := range node.Stats[i:] {
+		if _, ok := stat.(*ast.LabelStat); !ok {
+			return false
+		}
 	}
+	return true
 }
 
 // 处理并生成返回指令
-func cgRetStat(fi *funcInfo, exps []ast.Exp) {
+func cgRetStat(fi *funcInfo, line int, exps []ast.Exp) {
+	fi.setLine(line) // 返回指令对应return所在行
 	nExps := len(exps)
 	if nExps == 0 { // 如果没有返回值
 		fi.emitReturn(0, 0) // 生成返回指令
@@ -7,6 +7,7 @@ import (
 )
 
 func cgExp(fi *funcInfo, node Exp, a, n int) {
+	fi.setLine(lineOf(node))
 	switch exp := node.(type) {
 	case *NilExp:
 		fi.emitLoadNil(a, n)
@@ -61,9 +62,10 @@ func cgFuncDefExp(fi *funcInfo, node *FuncDefExp, a int) {
 	for _, param := range node.ParList { // 参数列表
 		subFI.addLocVar(param)
 	}
-	cgBlock(subFI, node.Block) // 函数体
-	subFI.exitScope()          // 退出作用域
-	subFI.emitReturn(0, 0)     // 返回
+	cgBlock(subFI, node.Block)   // 函数体
+	subFI.exitScope()            // 退出作用域
+	subFI.setLine(node.LastLine) // 末尾的return指令对应`end`所在行
+	subFI.emitReturn(0, 0)       // 返回
 
 	bx := len(fi.subFuncs) - 1
 	fi.emitClosure(a, bx)
@@ -130,8 +132,9 @@ func cgTableConstructorExp(fi *funcInfo, node *TableConstructorExp, a int) {
 
 // 生成一元表达式
 func cgUnopExp(fi *funcInfo, node *UnopExp, a int) {
-	b := fi.allocReg()            // 申请一个寄存器
-	cgExp(fi, node.Exp, b, 1)     // 处理右侧表达式
+	b := fi.allocReg()        // 申请一个寄存器
+	cgExp(fi, node.Exp, b, 1) // 处理右侧表达式
+	fi.setLine(node.Line)
 	fi.emitUnaryOp(node.Op, a, b) // 生成一元操作指令
 	fi.freeReg()                  // 释放寄存器
 }
@@ -146,6 +149,7 @@ func cgConcatExp(fi *funcInfo, node *ConcatExp, a int) {
 	c := fi.usedRegs - 1
 	b := c - len(node.Exps) + 1
 	fi.freeRegs(c - b + 1)
+	fi.setLine(node.Line)
 	fi.emitABC(OP_CONCAT, a, b, c)
 }
 
@@ -173,6 +177,7 @@ func cgBinopExp(fi *funcInfo, node *BinopExp, a int) {
 		cgExp(fi, node.Exp1, b, 1) // 处理左侧表达式
 		c := fi.allocReg()
 		cgExp(fi, node.Exp2, c, 1) // 处理右侧表达式
+		fi.setLine(node.Line)
 		fi.emitBinaryOp(node.Op, a, b, c)
 		fi.freeRegs(2)
 	}
@@ -199,6 +204,7 @@ func cgTableAccessExp(fi *funcInfo, node *TableAccessExp, a int) {
 	cgExp(fi, node.PrefixExp, b, 1) // 处理前缀表达式
 	c := fi.allocReg()
 	cgExp(fi, node.KeyExp, c, 1) // 处理键表达式
+	fi.setLine(node.LastLine)
 	fi.emitGetTable(a, b, c)
 	fi.freeRegs(2)
 }
@@ -206,12 +212,14 @@ func cgTableAccessExp(fi *funcInfo, node *TableAccessExp, a int) {
 // 函数调用表达式
 func cgFuncCallExp(fi *funcInfo, node *FuncCallExp, a, n int) {
 	nArgs := prepFuncCall(fi, node, a) // 准备函数调用
+	fi.setLine(node.Line)
 	fi.emitCall(a, nArgs, n)
 }
 
 // 尾调用
 func cgTailCallExp(fi *funcInfo, node *FuncCallExp, a int) {
 	nArgs := prepFuncCall(fi, node, a)
+	fi.setLine(node.Line)
 	fi.emitTailCall(a, nArgs)
 }
 
@@ -221,6 +229,7 @@ func prepFuncCall(fi *funcInfo, node *FuncCallExp, a int) int {
 
 	cgExp(fi, node.PrefixExp, a, 1) // 处理前缀表达式
 	if node.NameExp != nil {        // 处理语法糖
+		fi.allocReg() // 为self参数分配寄存器
 		c := 0x100 + fi.indexOfConstant(node.NameExp.Name)
 		fi.emitSelf(a, a, c)
 	}
@@ -236,6 +245,7 @@ func prepFuncCall(fi *funcInfo, node *FuncCallExp, a int) int {
 	fi.freeRegs(nArgs)
 
 	if node.NameExp != nil { // 如果是语法糖(self)参数，需要多传递一个self参数
+		fi.freeReg()
 		nArgs++
 	}
 	if lastArgIsVarargOrFuncCall {
@@ -5,6 +5,7 @@ import (
 )
 
 func cgStat(fi *funcInfo, node ast.Stat) {
+	fi.setLine(lineOfStat(node))
 	switch stat := node.(type) {
 	case *ast.FuncCallStat:
 		cgFuncCallStat(fi, stat)
@@ -28,11 +29,34 @@ func cgStat(fi *funcInfo, node ast.Stat) {
 		cgLocalVarDeclStat(fi, stat)
 	case *ast.LocalFuncDefStat:
 		cgLocalFuncDefStat(fi, stat)
-	case *ast.LabelStat, *ast.GotoStat:
-		panic("label and goto statements are not supported!")
+	case *ast.LabelStat:
+		fi.addLabel(stat.Name, stat.Line, fi.usedRegs)
+	case *ast.GotoStat:
+		fi.addGoto(stat.Name, stat.Line)
 	}
 }
 
+// 返回语句所在的行号，无法确定时返回0
+func lineOfStat(node ast.Stat) int {
+	switch stat := node.(type) {
+	case *ast.FuncCallStat:
+		return stat.Line
+	case *ast.BreakStat:
+		return stat.Line
+	case *ast.LabelStat:
+		return stat.Line
+	case *ast.GotoStat:
+		return stat.Line
+	case *ast.ForNumStat:
+		return stat.LineOfFor
+	case *ast.ForInStat:
+		return stat.LineOfDo
+	case *ast.LocalFuncDefStat:
+		return stat.Exp.Line
+	}
+	return 0
+}
+
 // 生成局部函数定义语句
 func cgLocalFuncDefStat(fi *funcInfo, node *ast.LocalFuncDefStat) {
 	r := fi.addLocVar(node.Name)  // 为函数名分配一个寄存器
@@ -80,7 +104,7 @@ func cgWhileStat(fi *funcInfo, node *ast.WhileStat) {
 func cgRepeatStat(fi *funcInfo, node *ast.RepeatStat) {
 	fi.enterScope(true)                    // 进入循环块
 	pcBeforeBlock := fi.pc()               // 记录下repeat语句的起始位置
-	cgBlock(fi, node.Block)                // 生成块
+	_cgBlock(fi, node.Block, false)        // 生成块(until表达式仍能看到块内的局部变量)
 	r := fi.allocReg()                     // 为repeat表达式分配一个寄存器
 	cgExp(fi, node.Exp, r, 1)              // 生成repeat表达式
 	fi.freeReg()                           // 释放寄存器
@@ -126,14 +150,16 @@ func cgIfStat(fi *funcInfo, node *ast.IfStat) {
 func cgForNumStat(fi *funcInfo, node *ast.ForNumStat) {
 	fi.enterScope(true)                           // 进入循环块
 	cgLocalVarDeclStat(fi, &ast.LocalVarDeclStat{ // 生成局部变量声明语句。三个特殊的局部变量分别是循环变量、循环变量的初始值、循环变量的终止值
-		NameList: []string{"(for index)", "for limit", "for step"},
+		NameList: []string{"(for index)", "(for limit)", "(for step)"},
 		ExpList:  []ast.Exp{node.InitExp, node.LimitExp, node.StepExp},
 	})
 	fi.addLocVar(node.VarName) // 添加循环变量
 	a := fi.usedRegs - 4
-	pcForPrep := fi.emitForPrep(a, 0)           // 生成for prep指令(等到确定跳转位置时再填充跳转偏移)
-	cgBlock(fi, node.Block)                     // 生成块
-	fi.closeOpenUpvals()                        // 关闭未关闭的upvalue
+	fi.setLine(node.LineOfDo)
+	pcForPrep := fi.emitForPrep(a, 0) // 生成for prep指令(等到确定跳转位置时再填充跳转偏移)
+	cgBlock(fi, node.Block)           // 生成块
+	fi.closeOpenUpvals()              // 关闭未关闭的upvalue
+	fi.setLine(node.LineOfFor)
 	pcForLoop := fi.emitForLoop(a, 0)           // 生成for loop指令(等到确定跳转位置时再填充跳转偏移)
 	fi.fixSbx(pcForPrep, pcForLoop-pcForPrep-1) // 填充for prep指令的跳转偏移
 	fi.fixSbx(pcForLoop, pcForPrep-pcForLoop)   // 填充for loop指令的跳转偏移
@@ -154,6 +180,7 @@ func cgForInStat(fi *funcInfo, node *ast.ForInStat) {
 	cgBlock(fi, node.Block)                   // 生成块
 	fi.fixSbx(pcJmpToTFC, fi.pc()-pcJmpToTFC) // 填充跳转指令的跳转偏移
 	rGenerator := fi.slotOfLocVar("(for generator)")
+	fi.setLine(node.LineOfDo)
 	fi.emitTForCall(rGenerator, len(node.NameList))
 	fi.emitTForLoop(rGenerator+2, pcJmpToTFC-fi.pc()-1)
 
@@ -3,9 +3,10 @@ package codegen
 import . "go/ch21/src/luago/binchunk"
 import . "go/ch21/src/luago/compiler/ast"
 
-func GenProto(chunk *Block) *Prototype {
+func GenProto(chunk *Block, chunkName string) *Prototype {
 	fd := &FuncDefExp{IsVararg: true, Block: chunk}
 	fi := newFuncInfo(nil, fd)
+	fi.source = chunkName
 	fi.addLocVar("_ENV")
 	cgFuncDefExp(fi, fd, 0)
 	return toProto(fi.subFuncs[0])
@@ -20,3 +20,42 @@ func removeTailNils(exps []Exp) []Exp {
 	}
 	return nil
 }
+
+// 返回表达式所在的行号，无法确定时返回0
+func lineOf(exp Exp) int {
+	switch x := exp.(type) {
+	case *NilExp:
+		return x.Line
+	case *TrueExp:
+		return x.Line
+	case *FalseExp:
+		return x.Line
+	case *VarargExp:
+		return x.Line
+	case *IntegerExp:
+		return x.Line
+	case *FloatExp:
+		return x.Line
+	case *StringExp:
+		return x.Line
+	case *NameExp:
+		return x.Line
+	case *UnopExp:
+		return x.Line
+	case *BinopExp:
+		return x.Line
+	case *ConcatExp:
+		return x.Line
+	case *TableConstructorExp:
+		return x.Line
+	case *FuncDefExp:
+		return x.Line
+	case *ParensExp:
+		return lineOf(x.Exp)
+	case *TableAccessExp:
+		return x.LastLine
+	case *FuncCallExp:
+		return x.Line
+	}
+	return 0
+}
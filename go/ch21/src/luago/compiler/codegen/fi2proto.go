@@ -4,15 +4,18 @@ import . "go/ch21/src/luago/binchunk"
 
 func toProto(fi *funcInfo) *Prototype {
 	proto := &Prototype{
-		NumParams:    byte(fi.numParams),    // 参数个数
-		MaxStackSize: byte(fi.maxRegs),      // 最大栈空间
-		Code:         fi.insts,              // 指令表
-		Constants:    getConstants(fi),      // 常量表
-		Upvalues:     getUpvalues(fi),       // upvalue表
-		Protos:       toProtos(fi.subFuncs), // 子函数原型表
-		LineInfo:     []uint32{},            // debug info
-		LocVars:      []LocVar{},            // debug info
-		UpvalueNames: []string{},            // debug info
+		Source:          fi.source,             // 源文件名
+		LineDefined:     uint32(fi.lineDef),    // 起始行号
+		LastLineDefined: uint32(fi.lastLine),   // 末尾行号
+		NumParams:       byte(fi.numParams),    // 参数个数
+		MaxStackSize:    byte(fi.maxRegs),      // 最大栈空间
+		Code:            fi.insts,              // 指令表
+		Constants:       getConstants(fi),      // 常量表
+		Upvalues:        getUpvalues(fi),       // upvalue表
+		Protos:          toProtos(fi.subFuncs), // 子函数原型表
+		LineInfo:        fi.lineNums,           // debug info
+		LocVars:         getLocVars(fi),        // debug info
+		UpvalueNames:    getUpvalueNames(fi),   // debug info
 	}
 
 	if proto.MaxStackSize < 2 {
@@ -52,3 +55,28 @@ func getUpvalues(fi *funcInfo) []Upvalue {
 	}
 	return upvals
 }
+
+// 局部变量按照定义的顺序排列，某条指令处第n个生效的变量占用第n-1个寄存器
+func getLocVars(fi *funcInfo) []LocVar {
+	locVars := make([]LocVar, len(fi.locVars))
+	for i, locVar := range fi.locVars {
+		endPC := locVar.endPC
+		if endPC == 0 { // 直到函数结束都没有离开作用域
+			endPC = len(fi.insts)
+		}
+		locVars[i] = LocVar{
+			VarName: locVar.name,
+			StartPC: uint32(locVar.startPC),
+			EndPC:   uint32(endPC),
+		}
+	}
+	return locVars
+}
+
+func getUpvalueNames(fi *funcInfo) []string {
+	names := make([]string, len(fi.upvalues))
+	for name, uv := range fi.upvalues {
+		names[uv.index] = name
+	}
+	return names
+}
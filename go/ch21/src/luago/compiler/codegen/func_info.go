@@ -1,7 +1,9 @@
 package codegen
 
 import (
+	"fmt"
 	"go/ch16/src/luago/compiler/lexer"
+	"go/ch21/src/luago/binchunk"
 	"go/ch21/src/luago/compiler/ast"
 	"go/ch21/src/luago/vm"
 )
@@ -29,15 +31,26 @@ type funcInfo struct {
 	locVars   []*locVarInfo          // 局部变量表
 	locNames  map[string]*locVarInfo // 局部变量名表
 	breaks    [][]int                // 记录break指令的跳转位置
+	labels    []map[string]labelInfo // 记录每层作用域中定义的标签
+	gotos     []*gotoInfo            // 记录还未找到对应标签的goto语句
 	parent    *funcInfo              // 父函数
 	upvalues  map[string]upvalInfo   // Upvalue表
 	insts     []uint32               // 指令表
+	lineNums  []uint32               // 行号表，和指令表一一对应
+	line      int                    // 当前正在生成的指令对应的行号
 	subFuncs  []*funcInfo            // 子函数表
 	numParams int                    // 参数数量
 	isVararg  bool                   // 是否是可变参数
+	source    string                 // 源文件名
+	lineDef   int                    // 函数起始行号
+	lastLine  int                    // 函数末尾行号
 }
 
 func newFuncInfo(parent *funcInfo, fd *ast.FuncDefExp) *funcInfo {
+	source := ""
+	if parent != nil {
+		source = parent.source // 子函数和外围函数来自同一个源文件
+	}
 	return &funcInfo{
 		parent:    parent,
 		subFuncs:  []*funcInfo{},
@@ -46,9 +59,15 @@ func newFuncInfo(parent *funcInfo, fd *ast.FuncDefExp) *funcInfo {
 		locNames:  map[string]*locVarInfo{},
 		locVars:   make([]*locVarInfo, 0, 8),
 		breaks:    make([][]int, 1),
+		labels:    make([]map[string]labelInfo, 1),
 		insts:     make([]uint32, 1, 8),
+		lineNums:  make([]uint32, 1, 8),
+		line:      fd.Line,
 		isVararg:  fd.IsVararg,
 		numParams: len(fd.ParList),
+		lineDef:   fd.Line,
+		lastLine:  fd.LastLine,
+		source:    source,
 	}
 }
 
@@ -58,6 +77,8 @@ type locVarInfo struct {
 	scopeLv  int         // 变量的作用域层级
 	slot     int         // 变量的寄存器索引
 	captured bool        // 是否被闭包捕获
+	startPC  int         // 变量开始生效的指令索引
+	endPC    int         // 变量失效的指令索引
 }
 
 type upvalInfo struct {
@@ -66,6 +87,21 @@ type upvalInfo struct {
 	index      int // 记录Upvalue在函数中出现的顺序
 }
 
+type labelInfo struct {
+	line    int // 标签所在行号
+	pc      int // 标签对应的指令位置
+	nactvar int // 标签处活跃的局部变量数量
+}
+
+type gotoInfo struct {
+	name    string // 要跳转的标签名
+	line    int    // goto语句所在行号
+	pc      int    // 跳转指令的位置
+	scopeLv int    // goto语句当前所在的作用域层级
+	nactvar int    // goto语句处活跃的局部变量数量(移出作用域时会减少)
+	close   bool   // 跳出作用域时是否需要关闭Upvalue
+}
+
 // 返回常量在表中的索引
 func (self *funcInfo) indexOfConstant(k interface{}) int {
 	if idx, found := self.constants[k]; found {
@@ -88,9 +124,9 @@ func (self *funcInfo) indexOfUpval(name string) int {
 			locVar.captured = true
 			return idx
 		}
-		if idx := self.parent.indexOfUpval(name); idx >= 0 { // 如果是在外围函数的Upvalue表中(不用捕获)
+		if uvIdx := self.parent.indexOfUpval(name); uvIdx >= 0 { // 如果是在外围函数的Upvalue表中(不用捕获)
 			idx := len(self.upvalues)
-			self.upvalues[name] = upvalInfo{-1, idx, idx}
+			self.upvalues[name] = upvalInfo{-1, uvIdx, idx}
 			return idx
 		}
 	}
@@ -135,6 +171,7 @@ func (self *funcInfo) enterScope(breakable bool) {
 	} else {
 		self.breaks = append(self.breaks, nil) // 非循环块
 	}
+	self.labels = append(self.labels, nil)
 }
 
 // 在当前作用域中添加一个局部变量，返回其分配的寄存器索引
@@ -144,6 +181,10 @@ func (self *funcInfo) addLocVar(name string) int {
 		name:    name,
 		scopeLv: self.scopeLv,
 		slot:    self.allocReg(),
+		startPC: self.pc() + 1,
+	}
+	if newVar.startPC == 1 { // 指令表的第0条是占位指令，函数开头定义的变量(参数)从0开始生效，和luac一致
+		newVar.startPC = 0
 	}
 	self.locVars = append(self.locVars, newVar)
 	self.locNames[name] = newVar
@@ -168,17 +209,117 @@ func (self *funcInfo) exitScope() {
 		i := (sBx+vm.MAXARG_sBx)<<14 | a<<6 | vm.OP_JMP // 组装指令
 		self.insts[pc] = uint32(i)                      // 修改指令(break的时候会生成指令，但不能确定跳转偏移量，所以先用0占位)
 	}
+	self.labels = self.labels[:len(self.labels)-1] // 块内的标签对外不可见
 	self.scopeLv--
 	for _, locVar := range self.locNames { // 遍历并判断变量的作用域层级
 		if locVar.scopeLv > self.scopeLv {
 			self.removeLocVar(locVar)
 		}
 	}
+	self.moveGotosOut()
+}
+
+// 把当前块中还未匹配的goto语句移动到外层块，并尝试匹配外层块中已经定义的标签
+func (self *funcInfo) moveGotosOut() {
+	pending := self.gotos[:0]
+	for _, gt := range self.gotos {
+		if gt.scopeLv > self.scopeLv {
+			gt.scopeLv = self.scopeLv
+			if gt.nactvar > self.usedRegs { // 跳出了局部变量的作用域
+				gt.nactvar = self.usedRegs
+				gt.close = true
+			}
+			if self.scopeLv < 0 { // 已经离开函数体
+				self.semError(gt.line, "no visible label '%s' for <goto> at line %d", gt.name, gt.line)
+			}
+			if label, found := self.labels[self.scopeLv][gt.name]; found {
+				self.closeGoto(gt, label)
+				continue
+			}
+		}
+		pending = append(pending, gt)
+	}
+	self.gotos = pending
+}
+
+// 在当前块中定义标签，并匹配当前块中等待该标签的goto语句
+// nactvar是标签处活跃的局部变量数量，块末尾的标签不在块内局部变量的作用域中
+func (self *funcInfo) addLabel(name string, line, nactvar int) {
+	labels := self.labels[self.scopeLv]
+	if label, found := labels[name]; found {
+		self.semError(line, "label '%s' already defined on line %d", name, label.line)
+	}
+	if labels == nil {
+		labels = map[string]labelInfo{}
+		self.labels[self.scopeLv] = labels
+	}
+	label := labelInfo{line: line, pc: self.pc() + 1, nactvar: nactvar}
+	labels[name] = label
+
+	pending := self.gotos[:0]
+	for _, gt := range self.gotos {
+		if gt.scopeLv == self.scopeLv && gt.name == name {
+			self.closeGoto(gt, label)
+		} else {
+			pending = append(pending, gt)
+		}
+	}
+	self.gotos = pending
+}
+
+// 生成goto语句的跳转指令，如果标签已经在当前块中定义，直接向后跳转，否则等待标签出现
+func (self *funcInfo) addGoto(name string, line int) {
+	gt := &gotoInfo{
+		name:    name,
+		line:    line,
+		pc:      self.emitJmp(0, 0),
+		scopeLv: self.scopeLv,
+		nactvar: self.usedRegs,
+	}
+	if label, found := self.labels[self.scopeLv][name]; found {
+		self.closeGoto(gt, label)
+	} else {
+		self.gotos = append(self.gotos, gt)
+	}
+}
+
+// 填充goto语句的跳转指令
+func (self *funcInfo) closeGoto(gt *gotoInfo, label labelInfo) {
+	if gt.nactvar < label.nactvar { // 不能跳进局部变量的作用域
+		self.semError(label.line, "<goto %s> at line %d jumps into the scope of local '%s'",
+			gt.name, gt.line, self.nameOfLocVar(gt.nactvar))
+	}
+	a := 0
+	if gt.close || gt.nactvar > label.nactvar { // 关闭离开作用域的局部变量所对应的Upvalue
+		a = label.nactvar + 1
+	}
+	sBx := label.pc - gt.pc - 1
+	self.insts[gt.pc] = uint32((sBx+vm.MAXARG_sBx)<<14 | a<<6 | vm.OP_JMP)
+}
+
+// 报告语义错误，和词法分析器报告的语法错误一样带有chunk名字和行号
+// lua-5.3.4/src/lparser.c#semerror()
+func (self *funcInfo) semError(line int, f string, a ...interface{}) {
+	msg := fmt.Sprintf(f, a...)
+	panic(fmt.Sprintf("%s:%d: %s", binchunk.ChunkID(self.source), line, msg))
+}
+
+// 返回占用指定寄存器的活跃局部变量的名字
+func (self *funcInfo) nameOfLocVar(slot int) string {
+	for _, locVar := range self.locNames {
+		for v := locVar; v != nil; v = v.prev {
+			if v.slot == slot {
+				return v.name
+			}
+		}
+	}
+	return "?"
 }
 
 // 移除一个局部变量:解绑局部变量名，回收寄存器
 func (self *funcInfo) removeLocVar(locVar *locVarInfo) {
 	self.freeReg() // 回收寄存器
+	locVar.endPC = self.pc() + 1
 	if locVar.prev == nil {
 		delete(self.locNames, locVar.name) // 解绑局部变量名
 	} else if locVar.prev.scopeLv == locVar.scopeLv {
@@ -222,6 +363,13 @@ func (self *funcInfo) getJmpArgA() int {
 	}
 }
 
+// 设置后续生成的指令对应的行号
+func (self *funcInfo) setLine(line int) {
+	if line > 0 {
+		self.line = line
+	}
+}
+
 // 返回已经生成的最后一条指令的程序计数器
 func (self *funcInfo) pc() int {
 	return len(self.insts) - 1
@@ -248,24 +396,28 @@ func (self *funcInfo) closeOpenUpvals() {
 func (self *funcInfo) emitABC(op, a, b, c int) {
 	i := b<<23 | c<<14 | a<<6 | op
 	self.insts = append(self.insts, uint32(i))
+	self.lineNums = append(self.lineNums, uint32(self.line))
 }
 
 // ABx
 func (self *funcInfo) emitABx(op, a, bx int) {
 	i := bx<<14 | a<<6 | op
 	self.insts = append(self.insts, uint32(i))
+	self.lineNums = append(self.lineNums, uint32(self.line))
 }
 
 // AsBx
 func (self *funcInfo) emitAsBx(op, a, sbx int) {
 	i := (sbx+vm.MAXARG_sBx)<<14 | a<<6 | op
 	self.insts = append(self.insts, uint32(i))
+	self.lineNums = append(self.lineNums, uint32(self.line))
 }
 
 // Ax
 func (self *funcInfo) emitAx(op, ax int) {
 	i := ax<<6 | op
 	self.insts = append(self.insts, uint32(i))
+	self.lineNums = append(self.lineNums, uint32(self.line))
 }
 
 // r[a] = r[b]
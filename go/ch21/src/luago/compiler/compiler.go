@@ -8,5 +8,5 @@ import (
 
 func Compile(chunk, chunkname string) *binchunk.Prototype {
 	ast := parser.Parse(chunk, chunkname)
-	return codegen.GenProto(ast)
+	return codegen.GenProto(ast, chunkname)
 }
@@ -0,0 +1,22 @@
+package compiler
+
+import (
+	"testing"
+
+	"go/ch21/src/luago/binchunk"
+)
+
+// 内层函数通过外层函数的upvalue引用更外层的局部变量时，Idx应该是外层函数的upvalue索引
+func TestNestedUpvalueIndex(t *testing.T) {
+	proto := Compile(`
+		local a, b = 1, 2
+		local function f()
+			local x = a -- f的upvalue: a是0，b是1
+			return function() return b end
+		end`, "test")
+	inner := proto.Protos[0].Protos[0]
+	want := binchunk.Upvalue{Instack: 0, Idx: 1}
+	if len(inner.Upvalues) != 1 || inner.Upvalues[0] != want {
+		t.Fatalf("inner upvalues = %v, want [%v]", inner.Upvalues, want)
+	}
+}
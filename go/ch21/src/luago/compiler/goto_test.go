@@ -0,0 +1,82 @@
+package compiler_test
+
+import (
+	"testing"
+
+	"go/ch21/src/luago/api"
+	"go/ch21/src/luago/state"
+)
+
+// 用goto实现continue，以及向后跳转时每次循环的局部变量都是新的upvalue
+func TestGoto(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+	}{
+		{"continue", `
+			local sum = 0
+			for i = 1, 10 do
+				if i % 2 == 0 then goto continue end
+				sum = sum + i
+				::continue::
+			end
+			assert(sum == 25, sum)`},
+		{"backward with closures", `
+			local fs = {}
+			local i = 1
+			::top::
+			local x = i
+			fs[i] = function() return x end
+			i = i + 1
+			if i <= 3 then goto top end
+			assert(fs[1]() == 1 and fs[2]() == 2 and fs[3]() == 3)`},
+		{"nested loops", `
+			local n = 0
+			for i = 1, 3 do
+				for j = 1, 3 do
+					if j == 2 then goto next end
+					n = n + 1
+				end
+				::next::
+			end
+			assert(n == 3, n)`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ls := state.New()
+			ls.OpenLibs()
+			if ls.DoString(tt.script) {
+				t.Fatal(ls.ToString(-1))
+			}
+		})
+	}
+}
+
+// goto和标签的错误是带有chunk名字和行号的语法错误
+func TestGotoErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   string
+	}{
+		{"duplicate label", "::a::\nlocal x\n::a::",
+			"test:3: label 'a' already defined on line 1"},
+		{"missing label", "local x = 1\ngoto nowhere",
+			"test:2: no visible label 'nowhere' for <goto> at line 2"},
+		{"label in nested block", "do ::inner:: end\ngoto inner",
+			"test:2: no visible label 'inner' for <goto> at line 2"},
+		{"into local scope", "do\n  goto f\n  local x = 1\n  ::f::\n  print(x)\nend",
+			"test:4: <goto f> at line 2 jumps into the scope of local 'x'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ls := state.New()
+			if status := ls.Load([]byte(tt.script), "=test", "t"); status != api.LUA_ERRSYNTAX {
+				t.Fatalf("status = %d, want LUA_ERRSYNTAX", status)
+			}
+			if msg, _ := ls.ToStringX(-1); msg != tt.want {
+				t.Errorf("error = %q, want %q", msg, tt.want)
+			}
+		})
+	}
+}
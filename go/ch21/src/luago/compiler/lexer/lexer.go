@@ -6,6 +6,8 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+
+	"go/ch21/src/luago/binchunk"
 )
 
 var reNewLine = regexp.MustCompile("\r\n|\n\r|\n|\r")
@@ -345,7 +347,7 @@ func (self *Lexer) scanLongString() string {
 // 抛出错误信息
 func (self *Lexer) error(f string, a ...interface{}) {
 	err := fmt.Sprintf(f, a...)
-	err = fmt.Sprintf("%s:%d: %s", self.chunkName, self.line, err)
+	err = fmt.Sprintf("%s:%d: %s", binchunk.ChunkID(self.chunkName), self.line, err)
 	panic(err)
 }
 
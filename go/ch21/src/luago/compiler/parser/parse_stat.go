@@ -49,17 +49,17 @@ func parseBreakStat(l *lexer.Lexer) *ast.BreakStat {
 
 // label语句 跳过分隔符并记录标签名
 func parseLabelStat(l *lexer.Lexer) *ast.LabelStat {
-	l.NextTokenOfKind(lexer.TOKEN_SEP_LABEL)             // skip `::`
-	_, name := l.NextTokenOfKind(lexer.TOKEN_IDENTIFIER) // name
-	l.NextTokenOfKind(lexer.TOKEN_SEP_LABEL)             // skip `::`
-	return &ast.LabelStat{Name: name}
+	l.NextTokenOfKind(lexer.TOKEN_SEP_LABEL)                // skip `::`
+	line, name := l.NextTokenOfKind(lexer.TOKEN_IDENTIFIER) // name
+	l.NextTokenOfKind(lexer.TOKEN_SEP_LABEL)                // skip `::`
+	return &ast.LabelStat{Line: line, Name: name}
 }
 
 // goto语句 跳过关键字并记录标签名
 func parseGotoStat(l *lexer.Lexer) *ast.GotoStat {
-	l.NextTokenOfKind(lexer.TOKEN_KW_GOTO)               // skip `goto`
+	line, _ := l.NextTokenOfKind(lexer.TOKEN_KW_GOTO)    // skip `goto`
 	_, name := l.NextTokenOfKind(lexer.TOKEN_IDENTIFIER) // name
-	return &ast.GotoStat{Name: name}
+	return &ast.GotoStat{Line: line, Name: name}
 }
 
 // do语句 跳过关键字并解析块
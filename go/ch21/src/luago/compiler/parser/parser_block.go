@@ -5,11 +5,10 @@ import "go/ch21/src/luago/compiler/ast"
 
 // 创建Block结构体实例
 func parseBlock(l *lexer.Lexer) *ast.Block {
-	return &ast.Block{
-		Stats:    parseStats(l),
-		RetExps:  parseRetExps(l),
-		LastLine: l.Line(),
-	}
+	block := &ast.Block{Stats: parseStats(l)}
+	block.RetLine, block.RetExps = parseRetExps(l)
+	block.LastLine = l.Line()
+	return block
 }
 
 // 解析语句序列
@@ -33,27 +32,27 @@ func _isReturnOrBlockEnd(tokenKind int) bool {
 	return false
 }
 
-// 解析返回值表达式
-func parseRetExps(l *lexer.Lexer) []ast.Exp {
+// 解析返回值表达式，同时返回return关键字所在的行号
+func parseRetExps(l *lexer.Lexer) (int, []ast.Exp) {
 	// 如果不是return说明没有返回值
 	if l.LookAhead() != lexer.TOKEN_KW_RETURN {
-		return nil
+		return 0, nil
 	}
 
-	l.NextToken() // skip `return`
+	line, _, _ := l.NextToken() // skip `return`
 	switch l.LookAhead() {
 	// 如果发现是分号或者块结束符号，说明没有返回值
 	case lexer.TOKEN_EOF, lexer.TOKEN_KW_END, lexer.TOKEN_KW_ELSE, lexer.TOKEN_KW_ELSEIF, lexer.TOKEN_KW_UNTIL:
-		return []ast.Exp{}
+		return line, []ast.Exp{}
 	case lexer.TOKEN_SEP_SEMI:
 		l.NextToken() // 跳过分号
-		return []ast.Exp{}
+		return line, []ast.Exp{}
 	default:
 		// 解析返回值序列
 		exps := parseExpList(l)
 		if l.LookAhead() == lexer.TOKEN_SEP_SEMI {
 			l.NextToken()
 		}
-		return exps
+		return line, exps
 	}
 }
@@ -0,0 +1,106 @@
+// structs包给出Go结构体的字段在Lua里对应的名字，state包的PushGoValue()和bridge包都按照它转换结构体
+package structs
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// 结构体的字段在Lua里对应的名字
+type Field struct {
+	Name  string // Lua里使用的字段名，默认是Go的字段名，可以用`lua:"name"`标签修改
+	Index []int  // 字段的索引序列，用于reflect.Value.FieldByIndexErr()
+
+	tagged bool // 名字是不是来自标签
+}
+
+var fieldCache sync.Map // reflect.Type -> []Field
+
+// 结构体中所有可以访问的字段，规则和encoding/json一样：
+// 嵌入的结构体本身不是字段，它的字段被提升到外层；嵌入的结构体带有名字标签时作为普通字段；
+// 标签为"-"的字段被跳过；名字相同的字段中嵌入层次最浅的那个有效，
+// 同一层次有多个时只有唯一带标签的那个有效，否则这个名字的字段都被忽略
+func Fields(t reflect.Type) []Field {
+	if fields, ok := fieldCache.Load(t); ok {
+		return fields.([]Field)
+	}
+	var all []Field
+	collect(t, nil, map[reflect.Type]bool{}, &all)
+
+	// 按名字选出有效的字段，保持字段声明的顺序
+	byName := map[string][]int{}
+	for i, f := range all {
+		byName[f.Name] = append(byName[f.Name], i)
+	}
+	var fields []Field
+	for i, f := range all {
+		if dominantField(all, byName[f.Name]) == i {
+			fields = append(fields, f)
+		}
+	}
+	fieldCache.Store(t, fields)
+	return fields
+}
+
+// 按照声明的顺序收集字段，遇到嵌入的结构体时展开它的字段，visiting用来避免结构体指针互相嵌入时无限展开
+func collect(t reflect.Type, index []int, visiting map[reflect.Type]bool, fields *[]Field) {
+	if visiting[t] {
+		return
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		ft := sf.Type
+		if sf.Anonymous && ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		promote := sf.Anonymous && ft.Kind() == reflect.Struct // 是否把嵌入的结构体的字段提升到外层
+		if !sf.IsExported() && !(promote && sf.Type.Kind() == reflect.Struct) {
+			continue // 未导出的嵌入类型只提升非指针结构体的字段，因为转换时没法分配未导出的指针
+		}
+
+		name, tagged := sf.Name, false
+		if tag, ok := sf.Tag.Lookup("lua"); ok {
+			if tag = strings.Split(tag, ",")[0]; tag == "-" {
+				continue
+			} else if tag != "" && sf.IsExported() {
+				name, tagged, promote = tag, true, false
+			}
+		}
+		idx := append(append([]int(nil), index...), i)
+		if promote {
+			collect(ft, idx, visiting, fields)
+			continue
+		}
+		*fields = append(*fields, Field{name, idx, tagged})
+	}
+}
+
+// 从同名的字段all[i](i∈same)中选出有效的那个，返回它在all中的位置，没有有效的字段时返回-1
+// go/src/encoding/json/encode.go#dominantField()
+func dominantField(all []Field, same []int) int {
+	depth := len(all[same[0]].Index)
+	for _, i := range same[1:] {
+		if n := len(all[i].Index); n < depth {
+			depth = n
+		}
+	}
+	dominant, n := -1, 0
+	for _, i := range same {
+		if f := all[i]; len(f.Index) == depth {
+			switch {
+			case dominant < 0 || f.tagged && !all[dominant].tagged:
+				dominant, n = i, 1
+			case f.tagged == all[dominant].tagged:
+				n++
+			}
+		}
+	}
+	if n > 1 {
+		return -1
+	}
+	return dominant
+}
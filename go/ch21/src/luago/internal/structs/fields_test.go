@@ -0,0 +1,75 @@
+package structs
+
+import (
+	"reflect"
+	"testing"
+)
+
+type Base struct {
+	ID   int
+	Name string
+}
+
+type inner struct{ Hidden int }
+
+type Named struct{ Value int }
+
+type Other struct{ Name string }
+
+type Node struct {
+	Base
+	*Other               // Name和Base.Name在同一层次冲突，都被忽略
+	inner                // 未导出的嵌入结构体也提升字段
+	Named  `lua:"named"` // 带名字标签的嵌入结构体是普通字段
+	Skip   Base          `lua:"-"`
+	X      int           `lua:"x"`
+	y      int
+}
+
+type Shadow struct {
+	Base
+	ID int // 外层的字段优先
+}
+
+type Tagged struct {
+	Base
+	Other
+	Title string `lua:"Name"` // 外层的字段优先于嵌入的同名字段
+}
+
+type Recursive struct {
+	*Recursive
+	N int
+}
+
+// 嵌入的结构体本身不是字段，只提升它的字段，名字冲突时的规则和encoding/json一样
+func TestFields(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		want []Field
+	}{
+		{Node{}, []Field{
+			{"ID", []int{0, 0}, false},
+			{"Hidden", []int{2, 0}, false},
+			{"named", []int{3}, true},
+			{"x", []int{5}, true},
+		}},
+		{Shadow{}, []Field{
+			{"Name", []int{0, 1}, false},
+			{"ID", []int{1}, false},
+		}},
+		{Tagged{}, []Field{
+			{"ID", []int{0, 0}, false},
+			{"Name", []int{2}, true},
+		}},
+		{Recursive{}, []Field{
+			{"N", []int{1}, false},
+		}},
+	}
+	for _, tt := range tests {
+		typ := reflect.TypeOf(tt.v)
+		if got := Fields(typ); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Fields(%s) = %v, want %v", typ, got, tt.want)
+		}
+	}
+}
@@ -1,13 +1,79 @@
 package main
 
-import "os"
-import "go/ch21/src/luago/state"
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 
+	"go/ch21/src/luago/api"
+	"go/ch21/src/luago/state"
+)
+
+// 用法：
+//
+//	luago script.lua|script.luac        运行脚本或者预编译的二进制chunk
+//	luago -c [-s] [-o output] script.lua 像luac一样把脚本编译成二进制chunk，-s去掉调试信息
 func main() {
+	if len(os.Args) > 2 && os.Args[1] == "-c" {
+		luac(os.Args[2:])
+		return
+	}
 	if len(os.Args) > 1 {
 		ls := state.New()
 		ls.OpenLibs()
-		ls.LoadFile(os.Args[1])
+		if ls.LoadFile(os.Args[1]) != api.LUA_OK {
+			fmt.Fprintln(os.Stderr, "luago:", ls.ToString(-1))
+			os.Exit(1)
+		}
+		defer func() {
+			if err := recover(); err != nil {
+				if luaErr, ok := err.(*state.LuaError); ok {
+					fmt.Fprintf(os.Stderr, "luago: %s\n%s\n", luaErr.Error(), luaErr.Traceback())
+					os.Exit(1)
+				}
+				panic(err)
+			}
+		}()
 		ls.Call(0, -1)
 	}
 }
+
+// 编译脚本并写入二进制chunk，默认输出文件和脚本同名，扩展名为.luac
+func luac(args []string) {
+	strip, output := false, ""
+	for len(args) > 1 {
+		switch args[0] {
+		case "-s":
+			strip = true
+			args = args[1:]
+		case "-o":
+			output = args[1]
+			args = args[2:]
+		default:
+			luacUsage("unrecognized option '" + args[0] + "'")
+		}
+	}
+	if len(args) != 1 || strings.HasPrefix(args[0], "-") {
+		luacUsage("no input file given")
+	}
+	filename := args[0]
+	if output == "" {
+		output = strings.TrimSuffix(filename, filepath.Ext(filename)) + ".luac"
+	}
+
+	ls := state.New()
+	if ls.LoadFileX(filename, "t") != api.LUA_OK {
+		fmt.Fprintln(os.Stderr, "luago:", ls.ToString(-1))
+		os.Exit(1)
+	}
+	if err := os.WriteFile(output, ls.Dump(strip), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, "luago:", err)
+		os.Exit(1)
+	}
+}
+
+func luacUsage(msg string) {
+	fmt.Fprintf(os.Stderr, "luago: %s\nusage: luago -c [-s] [-o output] script.lua\n", msg)
+	os.Exit(1)
+}
@@ -7,7 +7,7 @@ import (
 
 func (self *luaState) RawLen(idx int) uint {
 	val := self.stack.get(idx)
-	switch x := val.(type) {
+	switch x := val.p.(type) {
 	case string:
 		return uint(len(x))
 	case *luaTable:
@@ -19,6 +19,15 @@ func (self *luaState) RawLen(idx int) uint {
 
 // 把给定Lua类型转换成对应的字符串表示
 func (self *luaState) TypeName(tp LuaType) string {
+	return typeNameOf(tp)
+}
+
+// 返回值的类型名
+func typeName(val luaValue) string {
+	return typeNameOf(typeOf(val))
+}
+
+func typeNameOf(tp LuaType) string {
 	switch tp {
 	case LUA_TNONE:
 		return "no value"
@@ -81,9 +90,7 @@ func (self *luaState) IsNumber(idx int) bool {
 }
 
 func (self *luaState) IsInteger(idx int) bool {
-	val := self.stack.get(idx)
-	_, ok := val.(int64)
-	return ok
+	return self.stack.get(idx).tt == LUA_TNUMINT
 }
 
 // [-0, +0, –]
@@ -104,6 +111,19 @@ func (self *luaState) IsThread(idx int) bool {
 	return self.Type(idx) == LUA_TTHREAD
 }
 
+// [-0, +0, –]
+// http://www.lua.org/manual/5.3/manual.html#lua_isuserdata
+func (self *luaState) IsUserdata(idx int) bool {
+	t := self.Type(idx)
+	return t == LUA_TUSERDATA || t == LUA_TLIGHTUSERDATA
+}
+
+// [-0, +0, –]
+// http://www.lua.org/manual/5.3/manual.html#lua_islightuserdata
+func (self *luaState) IsLightUserdata(idx int) bool {
+	return self.Type(idx) == LUA_TLIGHTUSERDATA
+}
+
 // 在索引处取出一个布尔值，如果索引处的值不是布尔值，那么进行类型转换
 func (self *luaState) ToBoolean(idx int) bool {
 	val := self.stack.get(idx)
@@ -111,11 +131,11 @@ func (self *luaState) ToBoolean(idx int) bool {
 }
 
 func convertToBoolean(val luaValue) bool {
-	switch x := val.(type) {
-	case nil:
+	switch val.tt {
+	case LUA_TNIL:
 		return false
-	case bool:
-		return x
+	case LUA_TBOOLEAN:
+		return val.n != 0
 	default:
 		return true
 	}
@@ -151,12 +171,12 @@ func (self *luaState) ToString(idx int) string {
 
 func (self *luaState) ToStringX(idx int) (string, bool) {
 	val := self.stack.get(idx)
-	switch x := val.(type) {
-	case string:
-		return x, true
-	case int64, float64:
-		s := fmt.Sprintf("%v", x)
-		self.stack.set(idx, s)
+	switch val.tt {
+	case LUA_TSTRING:
+		return val.p.(string), true
+	case LUA_TNUMINT, LUA_TNUMFLT:
+		s := fmt.Sprintf("%v", val.toInterface())
+		self.stack.set(idx, stringValue(s))
 		return s, true
 	default:
 		return "", false
@@ -167,7 +187,7 @@ func (self *luaState) IsGoFunction(idx int) bool {
 	// 先拿到索引处的值
 	val := self.stack.get(idx)
 	// 判断是否能转换为闭包
-	if c, ok := val.(*closure); ok {
+	if c, ok := val.p.(*closure); ok {
 		// 判断是否是Go函数
 		return c.goFunc != nil
 	}
@@ -176,7 +196,7 @@ func (self *luaState) IsGoFunction(idx int) bool {
 
 func (self *luaState) ToGoFunction(idx int) GoFunction {
 	val := self.stack.get(idx)
-	if c, ok := val.(*closure); ok {
+	if c, ok := val.p.(*closure); ok {
 		return c.goFunc
 	}
 	return nil
@@ -184,17 +204,29 @@ func (self *luaState) ToGoFunction(idx int) GoFunction {
 
 // 将指定索引处的值转换为指针
 func (self *luaState) ToPointer(idx int) interface{} {
-	// todo
-	return self.stack.get(idx)
+	val := self.stack.get(idx)
+	if lu, ok := val.p.(lightUserdata); ok {
+		return lu.data
+	}
+	return val.toInterface()
+}
+
+// 如果指定索引处的值是完全用户数据或者轻量用户数据，返回它包装的宿主对象，否则返回nil
+// http://www.lua.org/manual/5.3/manual.html#lua_touserdata
+func (self *luaState) ToUserdata(idx int) interface{} {
+	switch x := self.stack.get(idx).p.(type) {
+	case *userdata:
+		return x.data
+	case lightUserdata:
+		return x.data
+	}
+	return nil
 }
 
 // 将指定索引处的值转换为线程
 func (self *luaState) ToThread(idx int) LuaState {
-	val := self.stack.get(idx)
-	if val != nil {
-		if thread, ok := val.(*luaState); ok {
-			return thread
-		}
+	if thread, ok := self.stack.get(idx).p.(*luaState); ok {
+		return thread
 	}
 	return nil
 }
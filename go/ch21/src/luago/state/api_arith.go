@@ -67,7 +67,7 @@ func (self *luaState) Arith(op api.ArithOp) {
 	operator := operators[op]
 
 	// 如果操作数都可以转成数字，那么进行常规的算术运算
-	if result := _arith(a, b, operator); result != nil {
+	if result := _arith(a, b, operator); !result.isNil() {
 		self.stack.push(result)
 		return
 	}
@@ -80,24 +80,42 @@ func (self *luaState) Arith(op api.ArithOp) {
 	}
 
 	// 找不到对应元方法就报错
-	panic("arithmetic error!")
+	self.arithError(a, b, operator)
+}
+
+// 报告算术运算错误，指出第一个不能参与运算的操作数
+func (self *luaState) arithError(a, b luaValue, op operator) {
+	if _, ok := convertToFloat(a); ok {
+		a = b
+	}
+	if op.floatFunc == nil { // 位运算
+		if _, ok := convertToFloat(a); ok {
+			self.runError("number has no integer representation")
+		}
+		self.runError("attempt to perform bitwise operation on a %s value", typeName(a))
+	}
+	self.runError("attempt to perform arithmetic on a %s value", typeName(a))
 }
 
 // 执行计算
 func _arith(a, b luaValue, op operator) luaValue {
-	if op.integerFunc != nil { // 整数运算
+	if op.floatFunc == nil { // 位运算：操作数必须能转换成整数
 		if x, ok := convertToInteger(a); ok {
 			if y, ok := convertToInteger(b); ok {
-				return op.integerFunc(x, y)
+				return intValue(op.integerFunc(x, y))
 			}
 		}
+		return luaValue{}
 	}
-	if op.floatFunc != nil {
-		if x, ok := convertToFloat(a); ok {
-			if y, ok := convertToFloat(b); ok {
-				return op.floatFunc(x, y)
-			}
+	if op.integerFunc != nil { // 算术运算：两个操作数都是整数时才进行整数运算
+		if a.tt == LUA_TNUMINT && b.tt == LUA_TNUMINT {
+			return intValue(op.integerFunc(a.integer(), b.integer()))
+		}
+	}
+	if x, ok := convertToFloat(a); ok {
+		if y, ok := convertToFloat(b); ok {
+			return floatValue(op.floatFunc(x, y))
 		}
 	}
-	return nil
+	return luaValue{}
 }
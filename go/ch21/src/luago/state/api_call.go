@@ -1,142 +1,357 @@
 package state
 
 import (
+	"fmt"
 	"go/ch21/src/luago/api"
 	"go/ch21/src/luago/binchunk"
 	"go/ch21/src/luago/compiler"
 	"go/ch21/src/luago/vm"
+	"strings"
 )
 
 // 加载二进制chunk，第一个参数是二进制chunk，第二个参数是chunk名字，第三个参数指定加载模式("b" 二进制 "t" 文本 "bt" 二进制或文本)
-func (self *luaState) Load(chunk []byte, chunkName, mode string) int {
+// 加载失败时把错误消息推入栈顶
+func (self *luaState) Load(chunk []byte, chunkName, mode string) (status int) {
+	// 编译器和二进制chunk解析器通过panic报告语法错误
+	defer func() {
+		if err := recover(); err != nil {
+			if luaErr, ok := err.(*LuaError); ok && luaErr.status == api.LUA_ERRMEM {
+				self.stack.push(luaErr.value)
+				status = api.LUA_ERRMEM
+				return
+			}
+			self.stack.push(stringValue(fmt.Sprintf("%v", err)))
+			status = api.LUA_ERRSYNTAX
+		}
+	}()
+
+	if self.opts.TextOnly {
+		mode = "t"
+	}
 	var proto *binchunk.Prototype
 	if binchunk.IsBinaryChunk(chunk) { // 如果是二进制chunk
+		checkMode(mode, "binary")
 		proto = binchunk.Undump(chunk) // 解析二进制chunk
 	} else {
+		checkMode(mode, "text")
 		proto = compiler.Compile(string(chunk), chunkName) // 编译文本chunk
 	}
 	c := newLuaClosure(proto)
-	self.stack.push(c)
+	self.stack.push(closureValue(c))
+	self.allocate(sizeClosure + len(c.upvals)*(8+sizeUpvalue) + protoTreeSize(proto))
 	// 判断是否需要Upvalue
 	if len(proto.Upvalues) > 0 {
-		env := self.registry.get(api.LUA_RIDX_GLOBALS) // 获取全局环境表
-		c.upvals[0] = &upvalue{&env}                   // 把全局环境表作为第一个Upvalue
+		for i := range c.upvals { // 二进制chunk的主函数可能有多个upvalue，初始值都是nil
+			var val luaValue
+			c.upvals[i] = &upvalue{&val}
+		}
+		env := self.registry.get(intValue(api.LUA_RIDX_GLOBALS)) // 获取全局环境表
+		c.upvals[0] = &upvalue{&env}                             // 把全局环境表作为第一个Upvalue
 	}
 	return api.LUA_OK
 }
 
-// 调用Lua函数
-// 第一个参数是参数个数，第二个参数是返回值个数
+// 检查chunk的类型是否是加载模式允许的，mode为空时不做限制
+// lua-5.3.4/src/ldo.c#checkmode()
+func checkMode(mode, x string) {
+	if mode != "" && !strings.Contains(mode, x[:1]) {
+		panic(fmt.Sprintf("attempt to load a %s chunk (mode is '%s')", x, mode))
+	}
+}
+
+// 把栈顶的Lua函数序列化成二进制chunk，strip为true时去掉调试信息
+// 栈顶不是Lua函数时返回nil
+// http://www.lua.org/manual/5.3/manual.html#lua_dump
+func (self *luaState) Dump(strip bool) []byte {
+	if c, ok := self.stack.get(-1).p.(*closure); ok && c.proto != nil {
+		return binchunk.Dump(c.proto, strip)
+	}
+	return nil
+}
+
+// 调用函数，第一个参数是参数个数，第二个参数是返回值个数
+// Go函数通过Call调用的函数不能挂起，需要挂起时使用CallK
 func (self *luaState) Call(nArgs, nResults int) {
-	// 根据索引取出函数，判断是否真的是Lua函数
+	self.CallK(nArgs, nResults, 0, nil)
+}
+
+// 调用函数，如果被调函数挂起，协程恢复运行后调用延续函数k完成当前Go函数的执行
+// http://www.lua.org/manual/5.3/manual.html#lua_callk
+func (self *luaState) CallK(nArgs, nResults int, ctx api.KContext, k api.KFunction) {
+	if k != nil && self.nny == 0 { /* need to prepare continuation? */
+		self.stack.k = k /* save continuation */
+		self.stack.ctx = ctx
+		self.call(nArgs, nResults) /* do the call */
+	} else { /* no continuation or no yieldable */
+		self.callNoYield(nArgs, nResults) /* just do the call */
+	}
+}
+
+// 当前调用帧正在执行的指令
+func (self *luaState) currentInst() vm.Instruction {
+	return vm.Instruction(self.stack.closure.proto.Code[self.stack.pc-1])
+}
+
+// 不允许被调函数挂起的调用
+// lua-5.3.4/src/ldo.c#luaD_callnoyield()
+func (self *luaState) callNoYield(nArgs, nResults int) {
+	self.nny++
+	self.call(nArgs, nResults)
+	self.nny--
+}
+
+// 从Go代码里调用函数，被调函数返回之后才返回
+// 每次调用都会让Go的调用栈变深，所以限制了嵌套的层数
+// lua-5.3.4/src/ldo.c#luaD_call()
+func (self *luaState) call(nArgs, nResults int) {
+	self.nCcalls++
+	if self.nCcalls >= LUAI_MAXCCALLS {
+		self.cStackError()
+	}
+	if self.preCall(nArgs, nResults, 0) { /* is a Lua function? */
+		n := self.runLuaClosure() /* call it */
+		if n == yielded {         // 外面还有Go代码在执行，只能通过panic回到Resume
+			panic(&LuaError{status: api.LUA_YIELD})
+		}
+		self.posCall(n)
+	}
+	self.nCcalls--
+}
+
+// 嵌套的Go调用太多了
+// lua-5.3.4/src/ldo.c#stackerror()
+func (self *luaState) cStackError() {
+	if self.nCcalls == LUAI_MAXCCALLS {
+		self.runError("C stack overflow")
+	} else if self.nCcalls >= LUAI_MAXCCALLS+(LUAI_MAXCCALLS>>3) {
+		/* error while handing stack error */
+		panic(self.newLuaError(api.LUA_ERRERR, stringValue("error while handling stack overflow")))
+	}
+}
+
+// 准备调用栈顶的函数：被调函数是Lua函数时压入它的调用帧，返回true，由runLuaClosure()执行它；
+// 是Go函数时直接执行，返回false，返回值已经按照nResults放在了栈顶。Go函数挂起时也返回true，
+// 它的调用帧留在栈里，由runLuaClosure()返回到Resume
+// 虚拟机执行调用指令时用它调用函数，所以Lua函数之间的调用不会让Go的调用栈变深
+// lua-5.3.4/src/ldo.c#luaD_precall()
+func (self *luaState) PreCall(nArgs, nResults int) bool {
+	return self.preCall(nArgs, nResults, CIST_VMCALL)
+}
+
+// 调用栈顶的函数，callStatus是被调用的Go函数的调用帧的状态
+func (self *luaState) preCall(nArgs, nResults, callStatus int) bool {
+	if self.gc.running {
+		self.runFinalizers() // 在安全的时机调用不可达对象的__gc
+	}
+	c, nArgs := self.funcToCall(nArgs)
+	if c.proto != nil {
+		//fmt.Printf("call %s<%d,%d>\n", c.proto.Source, c.proto.LineDefined, c.proto.LastLineDefined)
+		self.callLuaClosure(nArgs, nResults, c) // 调用Lua函数
+		return true
+	}
+	return self.callGoClosure(nArgs, nResults, c, callStatus) // 调用Go函数
+}
+
+// 根据索引取出被调函数，返回它和参数个数
+// 如果被调用值不是函数，就查找它的__call元方法，被调用值成为元方法的第一个参数
+// lua-5.3.4/src/ldo.c#tryfuncTM()
+func (self *luaState) funcToCall(nArgs int) (*closure, int) {
 	val := self.stack.get(-(nArgs + 1))
-	c, ok := val.(*closure)
+	c, ok := val.p.(*closure)
 	if !ok { // 如果被调用值不是函数，就查找并调用元方法
-		if mf := getMetafield(val, "__call", self); mf != nil {
-			if c, ok = mf.(*closure); ok {
+		if mf := getMetafield(val, "__call", self); !mf.isNil() {
+			if c, ok = mf.p.(*closure); ok {
 				self.stack.push(val)
 				self.Insert(-(nArgs + 2))
 				nArgs += 1
 			}
 		}
 	}
-	if ok {
-		if c.proto != nil {
-			//fmt.Printf("call %s<%d,%d>\n", c.proto.Source, c.proto.LineDefined, c.proto.LastLineDefined)
-			self.callLuaClosure(nArgs, nResults, c) // 调用Lua函数
-		} else {
-			self.callGoClosure(nArgs, nResults, c) // 调用Go函数
-		}
-	} else {
-		panic("not function!")
+	if !ok {
+		self.runError("attempt to call a %s value", typeName(val))
 	}
+	return c, nArgs
 }
 
-// 调用Lua函数
+// 为Lua函数创建调用帧，参数原地成为它的寄存器
 func (self *luaState) callLuaClosure(nArgs, nResults int, c *closure) {
-	// 拿到编译器为我们事先准备好的信息
-	nRegs := int(c.proto.MaxStackSize)
-	nParams := int(c.proto.NumParams)
-	isVararg := c.proto.IsVararg == 1
+	caller := self.stack
+	fn := caller.base + caller.top - nArgs - 1 // 被调函数在值栈中的位置
+	self.growStack(fn + 1 + nArgs + int(c.proto.MaxStackSize) + api.LUA_MINSTACK)
 
-	// 创建Lua栈帧
-	newStack := newLuaStack(nRegs+api.LUA_MINSTACK, self)
 	// 把闭包和调用帧联系起来
-	newStack.closure = c
+	frame := self.newFrame()
+	frame.closure = c
+	frame.nResults = nResults
+	// 把新的Lua栈帧压入Lua虚拟机栈，函数和参数从调用者的栈里移交给它
+	self.pushLuaStack(frame)
+	caller.top -= nArgs + 1
+	self.enterLuaClosure(frame, fn, nArgs)
+	if self.hookMask&api.LUA_MASKCALL != 0 {
+		self.hookCall()
+	}
+}
 
-	// 把参数传递给新的Lua栈帧
-	funcAndArgs := self.stack.popN(nArgs + 1) // 把函数和参数弹出
-	newStack.pushN(funcAndArgs[1:], nParams)  // 把参数传递给新的Lua栈帧
-	newStack.top = nRegs                      // 设置栈顶
-	if nArgs > nParams && isVararg {          // 如果参数个数大于参数个数，且是可变参数
-		newStack.varargs = funcAndArgs[nParams+1:] // 把多余的参数传递给可变参数
+// 让调用帧从值栈的fn处开始执行它的Lua函数，fn后面是nArgs个参数
+// 固定参数就是最前面的寄存器，缺少的参数是nil(值栈中没有使用的位置都是nil)，多余的参数清除掉；
+// 可变参数函数的固定参数复制到所有参数的后面，多余的参数留在原处作为可变参数
+// lua-5.3.4/src/ldo.c#adjust_varargs()
+func (self *luaState) enterLuaClosure(frame *luaStack, fn, nArgs int) {
+	proto := frame.closure.proto
+	nRegs := int(proto.MaxStackSize)
+	nParams := int(proto.NumParams)
+	vals := self.vals
+	base := fn + 1
+	frame.varargs = nil
+	if proto.IsVararg == 1 && nArgs > nParams {
+		base += nArgs
+		copy(vals[base:], vals[fn+1:fn+1+nParams])
+		for i := fn + 1; i < fn+1+nParams; i++ {
+			vals[i] = luaValue{} // GC
+		}
+		frame.varargs = vals[fn+1+nParams : base]
+	} else {
+		for i := base + nParams; i < base+nArgs; i++ {
+			vals[i] = luaValue{} // 多余的参数
+		}
 	}
+	frame.fn = fn
+	frame.base = base
+	frame.slots = vals[base : base+nRegs+api.LUA_MINSTACK]
+	frame.top = nRegs // 设置栈顶
+}
 
-	// 把新的Lua栈帧压入Lua虚拟机栈
-	self.pushLuaStack(newStack)
-	// 执行Lua函数
-	self.runLuaClosure()
-	// 弹出被调用帧
-	self.popLuaStack()
+// 调用Go函数，参数原地成为它的栈，Go函数挂起时返回true
+func (self *luaState) callGoClosure(nArgs, nResults int, c *closure, callStatus int) bool {
+	caller := self.stack
+	fn := caller.base + caller.top - nArgs - 1 // 被调函数在值栈中的位置
+	self.growStack(fn + 1 + nArgs + api.LUA_MINSTACK)
 
-	// 根据期望的返回值个数，从新的Lua栈帧中弹出返回值
-	if nResults != 0 {
-		results := newStack.popN(newStack.top - nRegs) // 弹出返回值
-		self.stack.check(len(results))                 // 检查栈空间
-		self.stack.pushN(results, nResults)            // 把返回值传递给调用者
+	// 把闭包和调用帧联系起来
+	frame := self.newFrame()
+	frame.closure = c
+	frame.nResults = nResults
+	frame.callStatus = callStatus
+	// 把新的Lua栈帧压入Lua虚拟机栈，函数和参数从调用者的栈里移交给它
+	self.pushLuaStack(frame)
+	caller.top -= nArgs + 1
+	frame.fn = fn
+	frame.base = fn + 1
+	frame.slots = self.vals[fn+1 : fn+1+nArgs+api.LUA_MINSTACK]
+	frame.top = nArgs
+	if self.hookMask&api.LUA_MASKCALL != 0 {
+		self.callHook(api.LUA_HOOKCALL, -1)
+	}
+	// 执行Go函数
+	r := c.goFunc(self)
+	if self.coStatus == api.LUA_YIELD { // 挂起了，调用帧留到恢复运行时再弹出
+		return true
 	}
+	// 弹出被调用帧，把返回值传递给调用者
+	self.posCall(r)
+	return false
 }
 
-// 调用Go函数
-func (self *luaState) callGoClosure(nArgs, nResults int, c *closure) {
-	// 创建Lua栈帧
-	newStack := newLuaStack(nArgs+api.LUA_MINSTACK, self)
-	// 把闭包和调用帧联系起来
-	newStack.closure = c
+// 尾调用栈顶的函数，被调函数是Lua函数时直接使用当前函数的调用帧，从它的第一条指令继续执行，返回true；
+// 是Go函数时和普通调用一样执行，返回false，它的返回值留在栈顶，由当前函数返回。
+// Go函数执行完就返回了，不会让调用栈变深，保留当前函数的调用帧，error()等函数看到的调用层级才是对的
+// lua-5.3.4/src/lvm.c#OP_TAILCALL
+func (self *luaState) TailCall(nArgs int) bool {
+	if self.gc.running {
+		self.runFinalizers() // 在安全的时机调用不可达对象的__gc
+	}
+	c, nArgs := self.funcToCall(nArgs)
+	if c.proto == nil {
+		return self.callGoClosure(nArgs, api.LUA_MULTRET, c, CIST_VMCALL)
+	}
 
-	// 拿到栈里的参数
-	args := self.stack.popN(nArgs)
-	// 压入调用帧
-	newStack.pushN(args, nArgs)
-	// 弹出函数名
-	self.stack.pop()
+	frame := self.stack
+	self.CloseUpvalues(1) /* close all upvalues from previous call */
+	fn := frame.fn
+	end := frame.base + frame.top
+	self.growStack(fn + 1 + nArgs + int(c.proto.MaxStackSize) + api.LUA_MINSTACK)
 
-	// 把新的Lua栈帧压入Lua虚拟机栈
-	self.pushLuaStack(newStack)
-	// 执行Go函数
-	r := c.goFunc(self)
-	// 弹出被调用帧
+	/* move down function and arguments */
+	vals := self.vals
+	copy(vals[fn:], vals[end-nArgs-1:end])
+	for i := fn + nArgs + 1; i < end; i++ {
+		vals[i] = luaValue{} // GC
+	}
+	// 用被调函数替换当前函数，调用者期望的返回值个数不变
+	frame.closure = c
+	frame.pc = 0
+	frame.callStatus |= CIST_TAIL
+	self.enterLuaClosure(frame, fn, nArgs)
+	if self.hookMask&api.LUA_MASKCALL != 0 {
+		self.hookCall()
+	}
+	return true
+}
+
+// 弹出当前调用帧，把栈顶的n个返回值按照期望的个数复制到被调函数所在的位置(主调帧的栈顶)，多退少补
+// lua-5.3.4/src/ldo.c#luaD_poscall()
+func (self *luaState) posCall(n int) {
+	if self.hookMask&(api.LUA_MASKRET|api.LUA_MASKLINE) != 0 {
+		if self.hookMask&api.LUA_MASKRET != 0 {
+			self.callHook(api.LUA_HOOKRET, -1) // 返回值还在被调帧的栈顶，钩子不会改变它们
+		}
+		self.oldPC = self.stack.prev.pc /* 'oldPC' for caller function */
+	}
+	callee := self.stack
+	caller := callee.prev
+	end := callee.base + callee.top
+	wanted := callee.nResults
+	if wanted == api.LUA_MULTRET {
+		wanted = n
+	}
+	caller.check(wanted)
 	self.popLuaStack()
 
-	// 把返回值压入主调用帧，多退少补
-	if nResults != 0 {
-		results := newStack.popN(r)
-		self.stack.check(len(results))
-		self.stack.pushN(results, nResults)
+	vals := self.vals
+	res := caller.base + caller.top
+	i := res + copy(vals[res:res+wanted], vals[end-n:end])
+	for ; i < end; i++ {
+		vals[i] = luaValue{} // 清除被调帧用过的位置，不够的返回值也是nil
 	}
+	caller.top += wanted
 }
 
-// 执行被调函数
-func (self *luaState) runLuaClosure() {
+// runLuaClosure()的返回值，表示调用指令调用的Go函数挂起了
+const yielded = -1
+
+// 执行当前调用帧的Lua函数，直到它返回，返回栈顶的返回值个数
+// 调用指令调用的Lua函数也在这个循环里执行：被调函数返回时弹出它的调用帧，
+// 完成调用者的调用指令，然后接着执行调用者
+// 调用指令调用的Go函数挂起时返回yielded，调用帧都留在栈里
+// lua-5.3.4/src/lvm.c#luaV_execute()
+func (self *luaState) runLuaClosure() int {
+	base := self.stack
 	for {
 		//printStack(self)
 		inst := vm.Instruction(self.Fetch())
+		if self.hookMask&(api.LUA_MASKLINE|api.LUA_MASKCOUNT) != 0 {
+			self.traceExec()
+		}
+		if self.limit.enabled {
+			self.checkLimits()
+		}
 		inst.Execute(self)
-		if inst.Opcode() == vm.OP_RETURN {
-			break
+		switch inst.Opcode() {
+		case vm.OP_RETURN:
+			n := self.stack.top - self.RegisterCount()
+			if self.stack == base { /* external invocation: return */
+				return n
+			}
+			self.posCall(n)                       /* invocation via reentry: continue execution */
+			vm.FinishOp(self.currentInst(), self) // 把返回值放进调用者的寄存器
+		case vm.OP_CALL, vm.OP_TAILCALL, vm.OP_TFORCALL:
+			if self.coStatus == api.LUA_YIELD {
+				return yielded
+			}
 		}
 	}
 }
 
-// 从栈顶弹出n个值
-func (self *luaStack) popN(n int) []luaValue {
-	vals := make([]luaValue, n)
-	for i := n - 1; i >= 0; i-- {
-		vals[i] = self.pop()
-	}
-	return vals
-}
-
 // 把n个值压入栈顶
 func (self *luaStack) pushN(vals []luaValue, n int) {
 	nVals := len(vals)
@@ -147,30 +362,109 @@ func (self *luaStack) pushN(vals []luaValue, n int) {
 		if i < nVals {
 			self.push(vals[i])
 		} else {
-			self.push(nil) // 压入nil补齐
+			self.push(luaValue{}) // 压入nil补齐
 		}
 	}
 }
 
-// 执行代码
-func (self *luaState) PCall(nArgs, nResults, msgh int) (status int) {
+// 以保护模式调用函数，msgh是消息处理函数的索引，0表示没有消息处理函数
+func (self *luaState) PCall(nArgs, nResults, msgh int) int {
+	return self.PCallK(nArgs, nResults, msgh, 0, nil)
+}
+
+// 以保护模式调用函数，如果被调函数挂起，协程恢复运行后调用延续函数k完成当前Go函数的执行
+// 恢复运行后再出错时，由Resume把错误交给延续函数处理
+// http://www.lua.org/manual/5.3/manual.html#lua_pcallk
+func (self *luaState) PCallK(nArgs, nResults, msgh int, ctx api.KContext, k api.KFunction) int {
+	caller := self.stack
+	oldTop := caller.top - (nArgs + 1) // 被调函数所在的位置
+	var handler luaValue
+	if msgh != 0 {
+		handler = self.stack.get(msgh)
+	}
+
+	if k == nil || self.nny > 0 { /* no continuation or no yieldable? */
+		return self.pcall(oldTop, handler, func() {
+			self.callNoYield(nArgs, nResults) /* do a 'conventional' protected call */
+		})
+	}
+	/* prepare continuation (after a yield the call is protected by 'resume') */
+	caller.k = k /* save continuation */
+	caller.ctx = ctx
+	caller.errFunc = handler /* save information for error recovery */
+	caller.oldTop = oldTop
+	caller.callStatus |= CIST_YPCALL /* function can do error recovery */
+	status := self.pcall(oldTop, handler, func() {
+		self.call(nArgs, nResults) /* do the call */
+	})
+	caller.callStatus &^= CIST_YPCALL
+	return status
+}
+
+// 在保护模式下执行f，出错时弹出出错的调用帧，把错误对象放在oldTop处
+// 挂起不是错误，继续向外传递给Resume
+// lua-5.3.4/src/ldo.c#luaD_pcall()
+func (self *luaState) pcall(oldTop int, handler luaValue, f func()) (status int) {
 	caller := self.stack
+	oldNny := self.nny
+	oldNCcalls := self.nCcalls
 	status = api.LUA_ERRRUN
 
 	// 定义一个匿名函数延时执行，用来做错误处理
 	defer func() {
 		if err := recover(); err != nil {
-			if msgh != 0 {
-				panic(err)
+			luaErr := self.toLuaError(err)
+			if luaErr.status == api.LUA_YIELD {
+				panic(luaErr)
 			}
-			for self.stack != caller {
-				self.popLuaStack()
+			// 出错的调用帧还没有弹出，消息处理函数可以借此生成调用栈回溯
+			if !handler.isNil() && luaErr.status == api.LUA_ERRRUN {
+				luaErr = self.callErrorHandler(handler, luaErr)
 			}
-			self.stack.push(err)
+			self.unwind(caller, oldTop)
+			self.nny = oldNny
+			self.nCcalls = oldNCcalls
+			self.stack.check(1)
+			self.stack.push(luaErr.value)
+			status = luaErr.status
 		}
 	}()
 
-	self.Call(nArgs, nResults)
+	f()
 	status = api.LUA_OK
 	return
 }
+
+// 调用消息处理函数，用它的返回值替换错误对象，如果消息处理函数本身出错，返回LUA_ERRERR
+func (self *luaState) callErrorHandler(handler luaValue, luaErr *LuaError) (result *LuaError) {
+	l := self.limit
+	oldMaxDepth := l.maxDepth
+	l.maxDepth += LUAI_EXTRACALLS // stack overflow之后消息处理函数还要能执行
+	defer func() {
+		l.maxDepth = oldMaxDepth
+		if err := recover(); err != nil {
+			result = self.newLuaError(api.LUA_ERRERR, stringValue("error in error handling"))
+		}
+	}()
+
+	self.stack.check(2)
+	self.stack.push(handler)
+	self.stack.push(luaErr.value)
+	self.callNoYield(1, 1)
+	luaErr.value = self.stack.pop()
+	return luaErr
+}
+
+// 把panic传出的值转换成Lua错误
+func (self *luaState) toLuaError(err interface{}) *LuaError {
+	switch x := err.(type) {
+	case *LuaError:
+		return x
+	case error: // Go运行时错误
+		return self.newLuaError(api.LUA_ERRRUN, stringValue(x.Error()))
+	case string:
+		return self.newLuaError(api.LUA_ERRRUN, stringValue(x))
+	default:
+		return self.newLuaError(api.LUA_ERRRUN, stringValue(fmt.Sprintf("%v", x)))
+	}
+}
@@ -0,0 +1,31 @@
+package state
+
+import (
+	"testing"
+
+	. "go/ch21/src/luago/api"
+)
+
+// 语法错误消息里的chunk名字和运行时错误一样经过chunkID转换
+func TestLoadSyntaxErrorChunkName(t *testing.T) {
+	tests := []struct {
+		chunk     string
+		chunkName string
+		want      string
+	}{
+		{"x = = 1", "@se.lua", "se.lua:1: "},
+		{"x = = 1", "=mychunk", "mychunk:1: "},
+		{"x = = 1", "x = = 1", `[string "x = = 1"]:1: `},
+		{"local s = 'abc", "=mychunk", "mychunk:1: unfinished string"},
+		{"local x = 1\nx = = 1", "local x = 1\nx = = 1", `[string "local x = 1..."]:2: `},
+	}
+	for _, tt := range tests {
+		ls := New()
+		if status := ls.Load([]byte(tt.chunk), tt.chunkName, "t"); status != LUA_ERRSYNTAX {
+			t.Fatalf("%q: status = %d, want LUA_ERRSYNTAX", tt.chunkName, status)
+		}
+		if msg := ls.ToString(-1); len(msg) < len(tt.want) || msg[:len(tt.want)] != tt.want {
+			t.Errorf("%q: error = %q, want prefix %q", tt.chunkName, msg, tt.want)
+		}
+	}
+}
@@ -3,7 +3,7 @@ package state
 import "go/ch21/src/luago/api"
 
 func (self *luaState) RawEqual(idx1, idx2 int) bool {
-	if self.stack.isValid(idx1) || self.stack.isValid(idx2) {
+	if !self.stack.isValid(idx1) || !self.stack.isValid(idx2) {
 		return false
 	}
 
@@ -29,37 +29,29 @@ func (self *luaState) Compare(idx1, idx2 int, op api.CompareOp) bool {
 }
 
 func _eq(a, b luaValue, ls *luaState) bool {
-	switch x := a.(type) {
-	case nil:
-		return b == nil
-	case bool:
-		y, ok := b.(bool)
-		return ok && x == y
-	case string:
-		y, ok := b.(string)
-		return ok && x == y
-	case int64:
-		switch y := b.(type) {
-		case int64:
-			return x == y
-		case float64:
-			return float64(x) == y
+	switch a.tt {
+	case LUA_TNUMINT:
+		switch b.tt {
+		case LUA_TNUMINT:
+			return a.n == b.n
+		case LUA_TNUMFLT:
+			return float64(a.integer()) == b.float()
 		default:
 			return false
 		}
-	case float64:
-		switch y := b.(type) {
-		case float64:
-			return x == y
-		case int64:
-			return x == float64(y)
+	case LUA_TNUMFLT:
+		switch b.tt {
+		case LUA_TNUMFLT:
+			return a.float() == b.float()
+		case LUA_TNUMINT:
+			return a.float() == float64(b.integer())
 		default:
 			return false
 		}
-	case *luaTable:
-		// 两个不同表直接比较：调用元方法
-		if y, ok := b.(*luaTable); ok && x != y && ls != nil {
-			if result, ok := callMetamethod(x, y, "__eq", ls); ok {
+	case api.LUA_TTABLE, api.LUA_TUSERDATA:
+		// 两个不同表或者完全用户数据直接比较：调用元方法
+		if a.tt == b.tt && a.p != b.p && ls != nil {
+			if result, ok := callMetamethod(a, b, "__eq", ls); ok {
 				return convertToBoolean(result)
 			}
 		}
@@ -70,59 +62,74 @@ func _eq(a, b luaValue, ls *luaState) bool {
 }
 
 func _lt(a, b luaValue, ls *luaState) bool {
-	switch x := a.(type) {
-	case string:
-		if y, ok := b.(string); ok {
-			return x < y
+	switch a.tt {
+	case api.LUA_TSTRING:
+		if b.tt == api.LUA_TSTRING {
+			return a.p.(string) < b.p.(string)
 		}
-	case int64:
-		switch y := b.(type) {
-		case int64:
-			return x < y
-		case float64:
-			return float64(x) < y
+	case LUA_TNUMINT:
+		switch b.tt {
+		case LUA_TNUMINT:
+			return a.integer() < b.integer()
+		case LUA_TNUMFLT:
+			return float64(a.integer()) < b.float()
 		}
-	case float64:
-		switch y := b.(type) {
-		case float64:
-			return x < y
-		case int64:
-			return x < float64(y)
+	case LUA_TNUMFLT:
+		switch b.tt {
+		case LUA_TNUMFLT:
+			return a.float() < b.float()
+		case LUA_TNUMINT:
+			return a.float() < float64(b.integer())
 		}
 	}
 	if result, ok := callMetamethod(a, b, "__lt", ls); ok {
 		return convertToBoolean(result)
 	} else {
-		panic("comparison error!")
+		ls.compareError(a, b)
+		return false
 	}
 }
 
 func _le(a, b luaValue, ls *luaState) bool {
-	switch x := a.(type) {
-	case string:
-		if y, ok := b.(string); ok {
-			return x <= y
+	switch a.tt {
+	case api.LUA_TSTRING:
+		if b.tt == api.LUA_TSTRING {
+			return a.p.(string) <= b.p.(string)
 		}
-	case int64:
-		switch y := b.(type) {
-		case int64:
-			return x <= y
-		case float64:
-			return float64(x) <= y
+	case LUA_TNUMINT:
+		switch b.tt {
+		case LUA_TNUMINT:
+			return a.integer() <= b.integer()
+		case LUA_TNUMFLT:
+			return float64(a.integer()) <= b.float()
 		}
-	case float64:
-		switch y := b.(type) {
-		case float64:
-			return x <= y
-		case int64:
-			return x <= float64(y)
+	case LUA_TNUMFLT:
+		switch b.tt {
+		case LUA_TNUMFLT:
+			return a.float() <= b.float()
+		case LUA_TNUMINT:
+			return a.float() <= float64(b.integer())
 		}
 	}
 	if result, ok := callMetamethod(a, b, "__le", ls); ok {
 		return convertToBoolean(result)
-	} else if result, ok := callMetamethod(b, a, "__lt", ls); ok {
+	}
+	// 没有__le时用not (b < a)代替，元方法挂起的话，协程恢复运行后要把它的结果取反
+	ls.stack.callStatus |= CIST_LEQ /* mark it is doing 'lt' for 'le' */
+	result, ok := callMetamethod(b, a, "__lt", ls)
+	ls.stack.callStatus &^= CIST_LEQ /* clear mark */
+	if ok {
 		return !convertToBoolean(result)
-	} else {
-		panic("comparison error!")
 	}
+	ls.compareError(a, b)
+	return false
+}
+
+// 报告比较运算错误
+func (self *luaState) compareError(a, b luaValue) {
+	t1, t2 := typeName(a), typeName(b)
+	if t1 == t2 {
+		self.runError("attempt to compare two %s values", t1)
+	}
+	self.runError("attempt to compare %s with %s", t1, t2)
 }
@@ -1,51 +1,247 @@
 package state
 
-import . "go/ch21/src/luago/api"
+import (
+	. "go/ch21/src/luago/api"
+	"go/ch21/src/luago/vm"
+)
 
 // 创建一个新的线程，把它推入栈顶，同时作为返回值返回
 func (self *luaState) NewThread() LuaState {
 	t := &luaState{
+		gc:       self.gc,
+		limit:    self.limit,
+		opts:     self.opts,
 		registry: self.registry,
+		nny:      1, // 只有在Resume中才可以挂起
+		/* new thread inherits hooks from its creator */
+		hook:          self.hook,
+		hookMask:      self.hookMask,
+		baseHookCount: self.baseHookCount,
+		hookCount:     self.baseHookCount,
+		allowHook:     true,
 	}
-	t.pushLuaStack(newLuaStack(LUA_MINSTACK, t))
-	self.stack.push(t)
+	t.initStack()
+	self.stack.push(threadValue(t))
+	self.allocate(sizeThread)
 	return t
 }
 
 // 让线程进入运行状态
+// 协程的调用帧都保存在自己的栈里。Lua函数调用的Go函数(比如coroutine.yield)挂起时，
+// 解释器循环直接返回到这里，其他情况下挂起通过panic回到这里。再次恢复运行时，
+// 从最上面的调用帧开始逐个完成被打断的调用，所以不需要借助goroutine
+// lua-5.3.4/src/ldo.c#lua_resume()
 func (self *luaState) Resume(from LuaState, nArgs int) int {
-	lsFrom := from.(*luaState)
-	if lsFrom.coChan == nil { // 首次使用前需要初始化
-		lsFrom.coChan = make(chan int)
-	}
-
-	if self.coChan == nil { // 首次使用前需要初始化
-		self.coChan = make(chan int)
-		self.coCaller = lsFrom
-		go func() { // 执行主函数
-			self.coStatus = self.PCall(nArgs, LUA_MULTRET, 0)
-			lsFrom.coChan <- 1 // 向通道中随意写一个数值
-		}()
-	} else {
-		// resume coroutine
-		if self.coStatus != LUA_YIELD { // todo
-			self.stack.push("cannot resume non-suspended coroutine")
-			return LUA_ERRRUN
+	if self.coStatus == LUA_OK { /* may be starting a coroutine */
+		if self.stack.prev != nil { /* not in base level? */
+			return self.resumeError("cannot resume non-suspended coroutine", nArgs)
 		}
-		self.coStatus = LUA_OK
-		self.coChan <- 1
+	} else if self.coStatus != LUA_YIELD {
+		return self.resumeError("cannot resume dead coroutine", nArgs)
 	}
 
-	<-lsFrom.coChan // 等待协程结束
-	return self.coStatus
+	self.callBase, self.nCcalls = 0, 1
+	if from, ok := from.(*luaState); ok { // 协程在恢复它的线程的Go调用栈上运行
+		self.callBase = from.callBase + from.nCalls
+		self.nCcalls = from.nCcalls + 1
+	}
+	if self.nCcalls >= LUAI_MAXCCALLS {
+		return self.resumeError("C stack overflow", nArgs)
+	}
+	self.nny = 0 /* allow yields */
+	luaErr := self.rawRunProtected(func() { self.resume(nArgs) })
+	/* continue running after recoverable errors */
+	for luaErr != nil && luaErr.status > LUA_YIELD {
+		frame := self.findPCall()
+		if frame == nil { /* no recovery point */
+			break
+		}
+		status := self.recoverPCall(frame, luaErr)
+		luaErr = self.rawRunProtected(func() {
+			self.finishCcall(status) /* finish 'PCallK' callee */
+			self.unroll()            /* run continuation */
+		})
+	}
+	self.nny = 1 /* do not allow yields */
+
+	if luaErr == nil {
+		return self.coStatus // 正常返回或者从解释器循环挂起
+	}
+	if luaErr.status > LUA_YIELD { /* unrecoverable error? */
+		self.coStatus = luaErr.status /* mark thread as 'dead' */
+		self.coErr = luaErr.value
+		self.stack.check(1)
+		self.stack.push(luaErr.value) /* push error message */
+	}
+	return luaErr.status
+}
+
+// 弹出传给协程的参数，把错误消息推入栈顶
+// lua-5.3.4/src/ldo.c#resume_error()
+func (self *luaState) resumeError(msg string, nArgs int) int {
+	self.SetTop(-nArgs - 1)           /* remove args from the stack */
+	self.stack.push(stringValue(msg)) /* push error message */
+	return LUA_ERRRUN
+}
+
+// 开始执行协程的主函数，或者从上次挂起的地方继续执行
+// lua-5.3.4/src/ldo.c#resume()
+func (self *luaState) resume(nArgs int) {
+	if self.coStatus == LUA_OK { /* starting a coroutine? */
+		if self.preCall(nArgs, LUA_MULTRET, 0) { /* just call its body */
+			if n := self.runLuaClosure(); n != yielded {
+				self.posCall(n)
+			}
+		}
+		return
+	}
+	/* resuming from previous yield */
+	self.coStatus = LUA_OK /* mark that it is running (again) */
+	frame := self.stack
+	frame.unhide()
+	if frame.k != nil { /* does it have a continuation function? */
+		nArgs = frame.k(self, LUA_YIELD, frame.ctx) /* call continuation */
+	}
+	self.posCall(nArgs) /* finish 'callGoClosure' */
+	self.unroll()       /* run continuation */
+}
+
+// 从最上面的调用帧开始，逐个完成被挂起打断的调用，直到协程的主函数返回
+// lua-5.3.4/src/ldo.c#unroll()
+func (self *luaState) unroll() {
+	for self.stack.prev != nil { /* something in the stack */
+		if !self.stack.isLua() { /* Go function? */
+			self.finishCcall(LUA_YIELD) /* complete its execution */
+		} else { /* Lua function */
+			self.finishOp()           /* finish interrupted instruction */
+			n := self.runLuaClosure() /* execute down to the end of the function */
+			if n == yielded {         // 又挂起了
+				return
+			}
+			self.posCall(n)
+		}
+	}
+}
+
+// 完成被挂起打断的指令，用__lt代替__le时先把元方法的结果取反
+// lua-5.3.4/src/lvm.c#luaV_finishOp()
+func (self *luaState) finishOp() {
+	frame := self.stack
+	if frame.callStatus&CIST_LEQ != 0 { /* "<=" using "<" instead? */
+		frame.callStatus &^= CIST_LEQ                              /* clear mark */
+		frame.set(-1, boolValue(!convertToBoolean(frame.get(-1)))) /* negate result */
+	}
+	vm.FinishOp(self.currentInst(), self)
+}
+
+// 调用Go函数的延续函数，由它完成被打断的Go函数
+// lua-5.3.4/src/ldo.c#finishCcall()
+func (self *luaState) finishCcall(status int) {
+	frame := self.stack
+	/* must have a continuation and must be able to call it */
+	if frame.k == nil {
+		panic("continuation expected!")
+	}
+	frame.callStatus &^= CIST_YPCALL      /* continuation is also inside the pcall */
+	frame.callStatus &^= CIST_VMCALL      // 延续函数挂起时要通过panic
+	n := frame.k(self, status, frame.ctx) /* call continuation function */
+	self.posCall(n)                       /* finish 'callGoClosure' */
+}
+
+// 查找最近的可挂起的pcall
+// lua-5.3.4/src/ldo.c#findpcall()
+func (self *luaState) findPCall() *luaStack {
+	for frame := self.stack; frame != nil; frame = frame.prev { /* search for a pcall */
+		if frame.callStatus&CIST_YPCALL != 0 {
+			return frame
+		}
+	}
+	return nil /* no pending pcall */
+}
+
+// 挂起过的协程再次出错时，pcall已经不在Go的调用栈上了，需要在这里完成它的错误处理：
+// 调用消息处理函数，弹出出错的调用帧，把错误对象放在被调函数所在的位置
+// lua-5.3.4/src/ldo.c#recover()
+func (self *luaState) recoverPCall(frame *luaStack, luaErr *LuaError) int {
+	if !frame.errFunc.isNil() && luaErr.status == LUA_ERRRUN {
+		luaErr = self.callErrorHandler(frame.errFunc, luaErr)
+	}
+	/* "finish" luaD_pcall */
+	self.unwind(frame, frame.oldTop)
+	frame.check(1)
+	frame.push(luaErr.value)
+	self.nny = 0 /* should be zero to be yieldable */
+	return luaErr.status
+}
+
+// 执行f，把抛出的错误返回，不弹出任何调用帧(挂起也是通过panic传递的)
+// lua-5.3.4/src/ldo.c#luaD_rawrunprotected()
+func (self *luaState) rawRunProtected(f func()) (luaErr *LuaError) {
+	oldNCcalls := self.nCcalls
+	defer func() {
+		if err := recover(); err != nil {
+			luaErr = self.toLuaError(err)
+			self.nCcalls = oldNCcalls
+		}
+	}()
+
+	f()
+	return nil
 }
 
 // 让线程进入挂起状态
-func (self *luaState) Yield(nResult int) int {
+func (self *luaState) Yield(nResults int) int {
+	return self.YieldK(nResults, 0, nil)
+}
+
+// 让线程进入挂起状态，栈顶的nResults个值传给Resume，Go函数应该这样调用: return ls.YieldK(n, ctx, k)
+// Lua函数调用的Go函数挂起时，YieldK返回，Go函数返回之后由解释器循环回到Resume；
+// 其他情况下挂起通过panic直接回到Resume，YieldK不会返回。恢复运行后，如果k不是nil，
+// 就调用k完成当前Go函数的执行，否则把传给Resume的值作为当前Go函数的返回值
+// http://www.lua.org/manual/5.3/manual.html#lua_yieldk
+// lua-5.3.4/src/ldo.c#lua_yieldk()
+func (self *luaState) YieldK(nResults int, ctx KContext, k KFunction) int {
+	if self.nny > 0 {
+		if !self.isMainThread() {
+			self.runError("attempt to yield across a C-call boundary")
+		}
+		self.runError("attempt to yield from outside a coroutine")
+	}
 	self.coStatus = LUA_YIELD
-	self.coCaller.coChan <- 1 // 通知协作方恢复运行
-	<-self.coChan             // 等待再次恢复运行
-	return self.coStatus
+	frame := self.stack
+	frame.k = k /* save continuation (if any) */
+	frame.ctx = ctx
+	frame.hide(frame.top - nResults) /* protect stack below results */
+	if frame.callStatus&CIST_VMCALL != 0 {
+		frame.callStatus &^= CIST_VMCALL // 延续函数再挂起时要通过panic
+		return 0
+	}
+	panic(&LuaError{status: LUA_YIELD})
+}
+
+// 关闭挂起或者已经死亡的线程：弹出所有调用帧并关闭其中的upvalue，让线程进入死亡状态
+// 线程因出错而死亡时返回原来的错误码，并把错误对象推入栈顶，否则返回LUA_OK
+// http://www.lua.org/manual/5.4/manual.html#lua_closethread
+// lua-5.4.6/src/lstate.c#luaE_resetthread()
+func (self *luaState) CloseThread() int {
+	base := self.stack
+	for base.prev != nil {
+		base = base.prev
+	}
+	self.unwind(base, 0) /* unwind frames */
+	self.nny = 1
+
+	status := self.coStatus
+	if status == LUA_YIELD {
+		status = LUA_OK
+	}
+	// 关闭之后是正常的死亡状态，错误只报告一次
+	self.coStatus = LUA_OK
+	if status != LUA_OK { /* real errors? */
+		self.stack.push(self.coErr)
+		self.coErr = luaValue{}
+	}
+	return status
 }
 
 // 返回当前线程状态
@@ -53,14 +249,7 @@ func (self *luaState) Status() int {
 	return self.coStatus
 }
 
-// 返回当前线程是否在调用中(简化版本，本来是用于调试的)
-func (self *luaState) GetStack() bool {
-	return self.stack.prev != nil
-}
-
+// http://www.lua.org/manual/5.3/manual.html#lua_isyieldable
 func (self *luaState) IsYieldable() bool {
-	if self.isMainThread() {
-		return false
-	}
-	return self.coStatus != LUA_YIELD // todo
+	return self.nny == 0
 }
@@ -0,0 +1,422 @@
+package state
+
+import (
+	"strings"
+
+	. "go/ch21/src/luago/api"
+	"go/ch21/src/luago/binchunk"
+	"go/ch21/src/luago/vm"
+)
+
+// 获取第level层调用帧，0是当前正在执行的函数，n+1层是调用第n层的函数，level超出调用栈的深度时返回false
+// http://www.lua.org/manual/5.3/manual.html#lua_getstack
+// lua-5.3.4/src/ldebug.c#lua_getstack()
+func (self *luaState) GetStack(level int, ar *LuaDebug) bool {
+	if level < 0 {
+		return false /* invalid (negative) level */
+	}
+	frame := self.getFrame(level)
+	if frame == nil {
+		return false
+	}
+	ar.CallInfo = frame
+	return true
+}
+
+// 根据what填充调试信息，what以'>'开头时从栈顶弹出一个函数并获取它的信息，否则获取ar所指的调用帧的信息
+// 'f'把函数推入栈顶，'L'把函数中有代码的行号组成的表推入栈顶，what中有无效选项时返回false
+// http://www.lua.org/manual/5.3/manual.html#lua_getinfo
+// lua-5.3.4/src/ldebug.c#lua_getinfo()
+func (self *luaState) GetInfo(what string, ar *LuaDebug) bool {
+	var frame *luaStack
+	var fn luaValue
+	if strings.HasPrefix(what, ">") {
+		fn = self.stack.pop()
+		what = what[1:] /* skip the '>' */
+		if fn.tt != LUA_TFUNCTION {
+			panic("function expected!")
+		}
+	} else {
+		frame, _ = ar.CallInfo.(*luaStack)
+		if frame == nil {
+			panic("invalid call info!")
+		}
+		if frame.closure != nil {
+			fn = closureValue(frame.closure)
+		}
+	}
+	c, _ := fn.p.(*closure)
+	status := auxGetInfo(what, ar, c, frame)
+	if strings.IndexByte(what, 'f') >= 0 {
+		self.stack.check(1)
+		self.stack.push(fn)
+	}
+	if strings.IndexByte(what, 'L') >= 0 {
+		self.stack.check(1)
+		self.stack.push(collectValidLines(c))
+	}
+	return status
+}
+
+// lua-5.3.4/src/ldebug.c#auxgetinfo()
+func auxGetInfo(what string, ar *LuaDebug, c *closure, frame *luaStack) bool {
+	status := true
+	for _, ch := range what {
+		switch ch {
+		case 'S':
+			funcInfo(ar, c)
+		case 'l':
+			ar.CurrentLine = -1
+			if frame != nil && frame.isLua() {
+				ar.CurrentLine = currentLine(c, frame.pc)
+			}
+		case 'u':
+			ar.NUps = 0
+			if c != nil {
+				ar.NUps = len(c.upvals)
+			}
+			if c == nil || c.proto == nil {
+				ar.IsVararg = true
+				ar.NParams = 0
+			} else {
+				ar.IsVararg = c.proto.IsVararg == 1
+				ar.NParams = int(c.proto.NumParams)
+			}
+		case 't':
+			ar.IsTailCall = frame != nil && frame.callStatus&CIST_TAIL != 0
+		case 'n':
+			ar.Name, ar.NameWhat = getFuncName(frame)
+		case 'L', 'f': /* handled by GetInfo */
+		default:
+			status = false /* invalid option */
+		}
+	}
+	return status
+}
+
+// lua-5.3.4/src/ldebug.c#funcinfo()
+func funcInfo(ar *LuaDebug, c *closure) {
+	if c == nil || c.proto == nil {
+		ar.Source = "=[C]"
+		ar.LineDefined = -1
+		ar.LastLineDefined = -1
+		ar.What = "C"
+	} else {
+		p := c.proto
+		ar.Source = p.Source
+		if ar.Source == "" {
+			ar.Source = "=?"
+		}
+		ar.LineDefined = int(p.LineDefined)
+		ar.LastLineDefined = int(p.LastLineDefined)
+		ar.What = "Lua"
+		if ar.LineDefined == 0 {
+			ar.What = "main"
+		}
+	}
+	ar.ShortSrc = binchunk.ChunkID(ar.Source)
+}
+
+// 返回一个表，函数中每一条指令对应的行号都是表的键，值都是true
+// lua-5.3.4/src/ldebug.c#collectvalidlines()
+func collectValidLines(c *closure) luaValue {
+	if c == nil || c.proto == nil {
+		return luaValue{}
+	}
+	lineInfo := c.proto.LineInfo
+	t := newLuaTable(0, len(lineInfo))
+	for _, line := range lineInfo {
+		if line > 0 { // 编译器生成的占位指令没有行号
+			t.put(intValue(int64(line)), boolValue(true))
+		}
+	}
+	return tableValue(t)
+}
+
+// 根据调用者正在执行的指令推测函数名
+// lua-5.3.4/src/ldebug.c#getfuncname()
+func getFuncName(frame *luaStack) (name, nameWhat string) {
+	if frame == nil || frame.prev == nil {
+		return "", "" /* no way to determine the name */
+	}
+	caller := frame.prev
+	if caller.callStatus&CIST_FIN != 0 { /* is this a finalizer? */
+		return "__gc", "metamethod" /* report it as such */
+	}
+	if frame.callStatus&CIST_TAIL != 0 { // 调用者的调用指令调用的不是这个函数
+		return "", ""
+	}
+	if caller.isLua() { /* is calling function a Lua function? */
+		if caller.callStatus&CIST_HOOKED != 0 { /* was it called inside a hook? */
+			return "?", "hook"
+		}
+		return funcNameFromCode(caller.closure.proto, caller.pc-1)
+	}
+	return "", ""
+}
+
+var tmNames = map[int]string{
+	vm.OP_ADD:    "add",
+	vm.OP_SUB:    "sub",
+	vm.OP_MUL:    "mul",
+	vm.OP_MOD:    "mod",
+	vm.OP_POW:    "pow",
+	vm.OP_DIV:    "div",
+	vm.OP_IDIV:   "idiv",
+	vm.OP_BAND:   "band",
+	vm.OP_BOR:    "bor",
+	vm.OP_BXOR:   "bxor",
+	vm.OP_SHL:    "shl",
+	vm.OP_SHR:    "shr",
+	vm.OP_UNM:    "unm",
+	vm.OP_BNOT:   "bnot",
+	vm.OP_LEN:    "len",
+	vm.OP_CONCAT: "concat",
+	vm.OP_EQ:     "eq",
+	vm.OP_LT:     "lt",
+	vm.OP_LE:     "le",
+	/* other instructions can do calls through metamethods */
+	vm.OP_SELF:     "index",
+	vm.OP_GETTABUP: "index",
+	vm.OP_GETTABLE: "index",
+	vm.OP_SETTABUP: "newindex",
+	vm.OP_SETTABLE: "newindex",
+}
+
+// lua-5.3.4/src/ldebug.c#funcnamefromcode()
+func funcNameFromCode(p *binchunk.Prototype, pc int) (name, nameWhat string) {
+	i := vm.Instruction(p.Code[pc]) /* calling instruction */
+	switch i.Opcode() {
+	case vm.OP_CALL, vm.OP_TAILCALL:
+		a, _, _ := i.ABC()
+		return getObjName(p, pc, a) /* get function name */
+	case vm.OP_TFORCALL: /* for iterator */
+		return "for iterator", "for iterator"
+	}
+	if tm, ok := tmNames[i.Opcode()]; ok {
+		return tm, "metamethod"
+	}
+	return "", "" /* else no useful name can be found */
+}
+
+// 通过符号执行找出是哪条指令把值放进了寄存器reg，由此推测值的名字
+// lua-5.3.4/src/ldebug.c#getobjname()
+func getObjName(p *binchunk.Prototype, lastPC, reg int) (name, nameWhat string) {
+	if name = localName(p, reg+1, lastPC); name != "" { /* is a local? */
+		return name, "local"
+	}
+	/* else try symbolic execution */
+	pc := findSetReg(p, lastPC, reg)
+	if pc == -1 { /* could not find instruction? */
+		return "", ""
+	}
+	i := vm.Instruction(p.Code[pc])
+	switch i.Opcode() {
+	case vm.OP_MOVE:
+		a, b, _ := i.ABC()
+		if b < a { /* move from 'b' to 'a' */
+			return getObjName(p, pc, b) /* get name for 'b' */
+		}
+	case vm.OP_GETTABUP, vm.OP_GETTABLE:
+		_, t, k := i.ABC() /* t: table index, k: key index */
+		var vn string      /* name of indexed variable */
+		if i.Opcode() == vm.OP_GETTABLE {
+			// 编译器先用GETUPVAL把_ENV放进寄存器再用GETTABLE访问全局变量，所以也要推测寄存器里的值的名字
+			// lua-5.4.6/src/ldebug.c#isEnv()
+			vn, _ = getObjName(p, pc, t)
+		} else {
+			vn = upvalName(p, t)
+		}
+		if vn == "_ENV" {
+			return kName(p, pc, k), "global"
+		}
+		return kName(p, pc, k), "field"
+	case vm.OP_GETUPVAL:
+		_, b, _ := i.ABC()
+		return upvalName(p, b), "upvalue"
+	case vm.OP_LOADK, vm.OP_LOADKX:
+		_, b := i.ABx()
+		if i.Opcode() == vm.OP_LOADKX {
+			b = vm.Instruction(p.Code[pc+1]).Ax()
+		}
+		if s, ok := p.Constants[b].(string); ok {
+			return s, "constant"
+		}
+	case vm.OP_SELF:
+		_, _, k := i.ABC()
+		return kName(p, pc, k), "method"
+	}
+	return "", "" /* could not find reasonable name */
+}
+
+// 返回RK(c)的名字，c是字符串常量或者值为字符串常量的寄存器时返回该字符串，否则返回"?"
+// lua-5.3.4/src/ldebug.c#kname()
+func kName(p *binchunk.Prototype, pc, c int) string {
+	if c > 0xFF { /* is 'c' a constant? */
+		if s, ok := p.Constants[c&0xFF].(string); ok {
+			return s /* literal constant */
+		}
+	} else { /* 'c' is a register */
+		if name, what := getObjName(p, pc, c); what == "constant" { /* found a constant name? */
+			return name
+		}
+	}
+	return "?" /* no reasonable name found */
+}
+
+// lua-5.3.4/src/ldebug.c#upvalname()
+func upvalName(p *binchunk.Prototype, uv int) string {
+	if uv < len(p.UpvalueNames) && p.UpvalueNames[uv] != "" {
+		return p.UpvalueNames[uv]
+	}
+	return "?"
+}
+
+// 找出lastPC之前最后一条修改寄存器reg的指令，如果这条指令在条件分支里，无法确定是哪条指令，返回-1
+// lua-5.3.4/src/ldebug.c#findsetreg()
+func findSetReg(p *binchunk.Prototype, lastPC, reg int) int {
+	setReg := -1   /* keep last instruction that changed 'reg' */
+	jmpTarget := 0 /* any code before this address is conditional */
+	for pc := 0; pc < lastPC; pc++ {
+		i := vm.Instruction(p.Code[pc])
+		a, b, _ := i.ABC()
+		changed := false
+		switch i.Opcode() {
+		case vm.OP_LOADNIL:
+			changed = a <= reg && reg <= a+b /* set registers from 'a' to 'a+b' */
+		case vm.OP_TFORCALL:
+			changed = reg >= a+2 /* affect all regs above its base */
+		case vm.OP_CALL, vm.OP_TAILCALL:
+			changed = reg >= a /* affect all registers above base */
+		case vm.OP_JMP:
+			_, sBx := i.AsBx()
+			dest := pc + 1 + sBx
+			/* jump is forward and do not skip 'lastpc'? */
+			if pc < dest && dest <= lastPC && dest > jmpTarget {
+				jmpTarget = dest /* update 'jmptarget' */
+			}
+		default:
+			changed = i.TestAMode() && reg == a /* any instruction that set A */
+		}
+		if changed {
+			if pc < jmpTarget { /* is code conditional (inside a jump)? */
+				setReg = -1 /* cannot know who sets that register */
+			} else {
+				setReg = pc /* current position sets that register */
+			}
+		}
+	}
+	return setReg
+}
+
+// 返回在指令pc处生效的第n个局部变量的名字，没有这个变量时返回空字符串
+// lua-5.3.4/src/lfunc.c#luaF_getlocalname()
+func localName(p *binchunk.Prototype, n, pc int) string {
+	for _, locVar := range p.LocVars {
+		if int(locVar.StartPC) > pc {
+			break
+		}
+		if pc < int(locVar.EndPC) { /* is variable active? */
+			n--
+			if n == 0 {
+				return locVar.VarName
+			}
+		}
+	}
+	return "" /* not found */
+}
+
+// 查找调用帧的第n个局部变量，返回它的名字和存放它的位置
+// n为负数时查找第-n个变长参数，局部变量表中没有的寄存器和Go函数的栈都叫做"(*temporary)"
+// lua-5.3.4/src/ldebug.c#luaG_findlocal()
+func findLocal(frame *luaStack, n int) (string, *luaValue) {
+	name := ""
+	if frame.isLua() {
+		if n < 0 { /* access to vararg values? */
+			return findVararg(frame, -n)
+		}
+		name = localName(frame.closure.proto, n, frame.pc-1)
+	}
+	if name == "" { /* no 'standard' name? */
+		if n > 0 && n <= frame.top { /* is 'n' inside 'ci' stack? */
+			name = "(*temporary)" /* generic name for any valid slot */
+		} else {
+			return "", nil /* no name */
+		}
+	}
+	return name, &frame.slots[n-1]
+}
+
+// lua-5.3.4/src/ldebug.c#findvararg()
+func findVararg(frame *luaStack, n int) (string, *luaValue) {
+	if n > len(frame.varargs) {
+		return "", nil /* no such vararg */
+	}
+	return "(*vararg)", &frame.varargs[n-1] /* generic name for any vararg */
+}
+
+// 把调用帧的第n个局部变量推入栈顶，返回变量名，没有这个变量时什么也不推入，第二个返回值是false
+// ar为nil时获取栈顶的函数的第n个参数的名字，什么也不推入
+// http://www.lua.org/manual/5.3/manual.html#lua_getlocal
+// lua-5.3.4/src/ldebug.c#lua_getlocal()
+func (self *luaState) GetLocal(ar *LuaDebug, n int) (string, bool) {
+	if ar == nil { /* information about non-active function? */
+		c, ok := self.stack.get(-1).p.(*closure)
+		if !ok || c.proto == nil { /* not a Lua function? */
+			return "", false
+		}
+		/* first pass: only parameters */
+		name := localName(c.proto, n, 0)
+		return name, name != ""
+	}
+	frame, _ := ar.CallInfo.(*luaStack)
+	if frame == nil {
+		panic("invalid call info!")
+	}
+	name, pos := findLocal(frame, n)
+	if pos == nil {
+		return "", false
+	}
+	self.stack.check(1)
+	self.stack.push(*pos)
+	return name, true
+}
+
+// 从栈顶弹出一个值，设置为调用帧的第n个局部变量，返回变量名，没有这个变量时不弹出任何值，第二个返回值是false
+// http://www.lua.org/manual/5.3/manual.html#lua_setlocal
+// lua-5.3.4/src/ldebug.c#lua_setlocal()
+func (self *luaState) SetLocal(ar *LuaDebug, n int) (string, bool) {
+	frame, _ := ar.CallInfo.(*luaStack)
+	if frame == nil {
+		panic("invalid call info!")
+	}
+	name, pos := findLocal(frame, n)
+	if pos == nil {
+		return "", false
+	}
+	*pos = self.stack.pop()
+	return name, true
+}
+
+// 返回指定索引处的函数的第n个upvalue的唯一标识，共享同一个upvalue的闭包得到的标识相同
+// http://www.lua.org/manual/5.3/manual.html#lua_upvalueid
+func (self *luaState) UpvalueId(funcIdx, n int) interface{} {
+	if uv, _, ok := auxUpvalue(self.stack.get(funcIdx), n); ok {
+		return uv
+	}
+	return nil
+}
+
+// 让funcIdx1处的Lua函数的第n1个upvalue引用funcIdx2处的Lua函数的第n2个upvalue
+// http://www.lua.org/manual/5.3/manual.html#lua_upvaluejoin
+func (self *luaState) UpvalueJoin(funcIdx1, n1, funcIdx2, n2 int) {
+	c1, ok1 := self.stack.get(funcIdx1).p.(*closure)
+	c2, ok2 := self.stack.get(funcIdx2).p.(*closure)
+	if !ok1 || !ok2 || c1.proto == nil || c2.proto == nil {
+		panic("Lua function expected!")
+	}
+	if n1 < 1 || n1 > len(c1.upvals) || n2 < 1 || n2 > len(c2.upvals) {
+		panic("invalid upvalue index!")
+	}
+	c1.upvals[n1-1] = c2.upvals[n2-1]
+}
@@ -0,0 +1,15 @@
+package state
+
+import "testing"
+
+// '>'只能由debug.getinfo自己添加，传给它时报告参数错误而不是Go的panic
+func TestGetInfoInvalidOption(t *testing.T) {
+	runScript(t, `
+		local ok, err = pcall(debug.getinfo, 1, ">")
+		assert(not ok and err:find("invalid option '>'"), err)
+		ok, err = pcall(debug.getinfo, print, ">S")
+		assert(not ok and err:find("invalid option '>'"), err)
+		ok, err = pcall(debug.getinfo, coroutine.create(print), 0, ">l")
+		assert(not ok and err:find("bad argument #3"), err)
+		assert(debug.getinfo(print, "S").what == "C")`)
+}
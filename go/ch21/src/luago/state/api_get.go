@@ -5,7 +5,8 @@ import "go/ch21/src/luago/api"
 // 创建一个空lua表，将其推入栈顶，两个参数指定数组部分和哈希表部分的初始大小
 func (self *luaState) CreateTable(nArr, nRec int) {
 	t := newLuaTable(nArr, nRec)
-	self.stack.push(t)
+	self.stack.push(tableValue(t))
+	self.allocate(sizeTable + nArr*sizeValue + nRec*sizeNode)
 }
 
 // 属于CreateTable的特殊情况，无法预估大小，所以直接创建一个空表
@@ -22,42 +23,43 @@ func (self *luaState) GetTable(idx int) api.LuaType {
 
 // 从表中取值，将值推入栈顶，raw表示是否忽略元方法
 func (self *luaState) getTable(t, k luaValue, raw bool) api.LuaType {
-	if tbl, ok := t.(*luaTable); ok {
+	if tbl, ok := t.p.(*luaTable); ok {
 		v := tbl.get(k)
 		// 如果t是表，表里有v或者需要忽略元方法，或者表里没有__index字段，直接返回
-		if raw || v != nil || !tbl.hasMetafield("__index") {
+		if raw || !v.isNil() || !tbl.hasMetafield("__index") {
 			self.stack.push(v)
 			return typeOf(v)
 		}
 	}
 	if !raw {
-		if mf := getMetafield(t, "__index", self); mf != nil {
-			switch x := mf.(type) {
-			case *luaTable: // 如果元方法是表，继续从表中取值
-				return self.getTable(x, k, raw)
-			case *closure: // 如果元方法是函数，调用函数
+		if mf := getMetafield(t, "__index", self); !mf.isNil() {
+			switch mf.tt {
+			case api.LUA_TTABLE: // 如果元方法是表，继续从表中取值
+				return self.getTable(mf, k, raw)
+			case api.LUA_TFUNCTION: // 如果元方法是函数，调用函数
 				self.stack.push(mf)
 				self.stack.push(t)
 				self.stack.push(k)
-				self.Call(2, 1)
+				self.callTM(2, 1)
 				v := self.stack.get(-1)
 				return typeOf(v)
 			}
 		}
 	}
-	panic("not a table!")
+	self.runError("attempt to index a %s value", typeName(t))
+	return api.LUA_TNONE
 }
 
 // 根据参数传入的字符串键从表中取值，将值推入栈顶
 func (self *luaState) GetField(idx int, k string) api.LuaType {
 	t := self.stack.get(idx)
-	return self.getTable(t, k, false)
+	return self.getTable(t, stringValue(k), false)
 }
 
 // 传入数字键从表中取值，将值推入栈顶
 func (self *luaState) GetI(idx int, i int64) api.LuaType {
 	t := self.stack.get(idx)
-	return self.getTable(t, i, false)
+	return self.getTable(t, intValue(i), false)
 }
 
 // 将t表的k对应的值压入栈顶
@@ -69,21 +71,33 @@ func (self *luaState) RawGet(idx int) api.LuaType {
 
 func (self *luaState) RawGetI(idx int, i int64) api.LuaType {
 	t := self.stack.get(idx)
-	return self.getTable(t, i, true)
+	return self.getTable(t, intValue(i), true)
 }
 
 // 把全局环境的某个字段推入栈顶
 func (self *luaState) GetGlobal(name string) api.LuaType {
-	t := self.registry.get(api.LUA_RIDX_GLOBALS)
-	return self.getTable(t, name, false)
+	t := self.registry.get(intValue(api.LUA_RIDX_GLOBALS))
+	return self.getTable(t, stringValue(name), false)
 }
 
 // 查看指定索引处是否有元表，如果有，将元表推入栈顶
 func (self *luaState) GetMetatable(idx int) bool {
 	val := self.stack.get(idx)
 	if mt := getMetatable(val, self); mt != nil {
-		self.stack.push(mt)
+		self.stack.push(tableValue(mt))
 		return true
 	}
 	return false
 }
+
+// 把指定索引处的完全用户数据的用户值推入栈顶，返回它的类型
+// http://www.lua.org/manual/5.3/manual.html#lua_getuservalue
+func (self *luaState) GetUserValue(idx int) api.LuaType {
+	val := self.stack.get(idx)
+	u, ok := val.p.(*userdata)
+	if !ok {
+		self.runError("full userdata expected, got %s", typeName(val))
+	}
+	self.stack.push(u.uservalue)
+	return typeOf(u.uservalue)
+}
@@ -0,0 +1,256 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+
+	. "go/ch21/src/luago/api"
+	"go/ch21/src/luago/internal/structs"
+)
+
+// Go值和Lua值之间的转换
+// Go -> Lua: 布尔值、整数、浮点数和字符串转换成对应的Lua值，整数一定是整数，浮点数一定是浮点数；
+// map转换成表，切片和数组转换成序列，结构体按照structs.Fields()给出的字段名转换成表；
+// 指针和接口转换成它们指向的值，GoFunction转换成Go函数，其他值包装成完全用户数据。
+// 同一个map、切片或者指针转换成同一个表，所以循环引用的Go值转换成循环引用的表；
+// 转换后是nil或者NaN的map键不能放进表里，会被跳过，引用了自己的非结构体指针再次遇到时转换成nil
+// Lua -> Go: 序列(键是1到n)转换成[]interface{}，键都是字符串的表转换成map[string]interface{}，
+// 其他的表转换成map[interface{}]interface{}，引用了自己的表不能转换
+
+// 把Go值转换成Lua值推入栈顶
+func (self *luaState) PushGoValue(v interface{}) {
+	m := &goMarshaler{ls: self, tables: map[goRef]*luaTable{}, pointers: map[goRef]bool{}}
+	self.stack.push(m.value(reflect.ValueOf(v)))
+}
+
+// 已经转换过的map、切片或者指针
+type goRef struct {
+	t   reflect.Type
+	ptr uintptr
+	len int
+}
+
+type goMarshaler struct {
+	ls       *luaState
+	tables   map[goRef]*luaTable // 已经转换成表的值
+	pointers map[goRef]bool      // 正在转换的指向非结构体的指针
+}
+
+func (self *goMarshaler) value(v reflect.Value) luaValue {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return luaValue{}
+	case reflect.Bool:
+		return boolValue(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return intValue(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return intValue(int64(v.Uint())) // 和Lua一样，超出范围的无符号整数会回绕
+	case reflect.Float32, reflect.Float64:
+		return floatValue(v.Float())
+	case reflect.String:
+		return self.string(v.String())
+	case reflect.Interface:
+		if v.IsNil() {
+			return luaValue{}
+		}
+		return self.value(v.Elem())
+	case reflect.Ptr:
+		if v.IsNil() {
+			return luaValue{}
+		}
+		if v.Elem().Kind() == reflect.Struct {
+			return self.table(v, func(t *luaTable) { self.fill(t, v.Elem()) })
+		}
+		// 指向其他类型的指针转换成它指向的值，引用了自己时没有可以对应的表，转换成nil
+		ref := goRef{v.Type(), v.Pointer(), 0}
+		if self.pointers[ref] {
+			return luaValue{}
+		}
+		self.pointers[ref] = true
+		defer delete(self.pointers, ref)
+		return self.value(v.Elem())
+	case reflect.Map:
+		if v.IsNil() {
+			return luaValue{}
+		}
+		return self.table(v, func(t *luaTable) {
+			iter := v.MapRange()
+			for iter.Next() {
+				self.set(t, self.value(iter.Key()), self.value(iter.Value()))
+			}
+		})
+	case reflect.Slice:
+		if v.IsNil() {
+			return luaValue{}
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 { // []byte
+			return self.string(string(v.Bytes()))
+		}
+		return self.table(v, func(t *luaTable) { self.fill(t, v) })
+	case reflect.Array, reflect.Struct:
+		t := self.newTable()
+		self.fill(t, v)
+		return tableValue(t)
+	case reflect.Func:
+		if v.IsNil() {
+			return luaValue{}
+		}
+		if f, ok := v.Interface().(GoFunction); ok {
+			self.ls.allocate(sizeClosure)
+			return closureValue(newGoClosure(f, 0))
+		}
+	}
+	self.ls.allocate(sizeUserdata)
+	return userdataValue(newUserdata(v.Interface()))
+}
+
+func (self *goMarshaler) string(s string) luaValue {
+	self.ls.allocate(sizeString + len(s))
+	return stringValue(s)
+}
+
+func (self *goMarshaler) newTable() *luaTable {
+	self.ls.allocate(sizeTable)
+	return newLuaTable(0, 0)
+}
+
+// 返回引用类型的值对应的表，第一次遇到时创建它并调用fill()填充
+// 表在填充之前就已经记录下来，所以循环引用的值也能转换
+func (self *goMarshaler) table(v reflect.Value, fill func(t *luaTable)) luaValue {
+	ref := goRef{v.Type(), v.Pointer(), 0}
+	if v.Kind() == reflect.Slice {
+		ref.len = v.Len()
+	}
+	if t, ok := self.tables[ref]; ok {
+		return tableValue(t)
+	}
+	t := self.newTable()
+	self.tables[ref] = t
+	fill(t)
+	return tableValue(t)
+}
+
+// 把结构体的字段、切片和数组的元素放进表里
+func (self *goMarshaler) fill(t *luaTable, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Struct:
+		for _, f := range structs.Fields(v.Type()) {
+			if field, err := v.FieldByIndexErr(f.Index); err == nil { // 嵌入的结构体指针为nil时跳过
+				self.set(t, stringValue(f.Name), self.value(field))
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			self.set(t, intValue(int64(i+1)), self.value(v.Index(i)))
+		}
+	}
+}
+
+// 把键值对放进表里，跳过不能作为键的nil和NaN，这样PushGoValue()不会抛出错误
+func (self *goMarshaler) set(t *luaTable, k, v luaValue) {
+	if k.isNil() || k.tt == LUA_TNUMFLT && math.IsNaN(k.float()) {
+		return
+	}
+	self.ls.setTable(tableValue(t), k, v, true)
+}
+
+// 把指定索引处的值转换成Go值
+func (self *luaState) ToGoValue(idx int) (interface{}, error) {
+	return toGoValue(self.stack.get(idx), map[*luaTable]bool{})
+}
+
+// visiting记录正在转换的表，用来发现引用了自己的表
+func toGoValue(val luaValue, visiting map[*luaTable]bool) (interface{}, error) {
+	switch x := val.toInterface().(type) {
+	case nil, bool, int64, float64, string:
+		return x, nil
+	case *luaTable:
+		if visiting[x] {
+			return nil, errors.New("cannot convert a table that contains itself")
+		}
+		visiting[x] = true
+		defer delete(visiting, x)
+		return tableToGo(x, visiting)
+	case *closure:
+		if x.goFunc != nil {
+			return x.goFunc, nil
+		}
+	case *userdata:
+		return x.data, nil
+	case lightUserdata:
+		return x.data, nil
+	case *luaState:
+		return LuaState(x), nil
+	}
+	return nil, fmt.Errorf("cannot convert a %s value", typeName(val))
+}
+
+func tableToGo(t *luaTable, visiting map[*luaTable]bool) (interface{}, error) {
+	n := int64(t.len())
+	count := int64(0)
+	isSeq, allStrings := n > 0, true
+	t.forEach(func(k, v luaValue) {
+		count++
+		if k.tt != LUA_TNUMINT || k.integer() < 1 || k.integer() > n {
+			isSeq = false
+		}
+		if k.tt != LUA_TSTRING {
+			allStrings = false
+		}
+	})
+
+	var err error
+	switch {
+	case isSeq && count == n:
+		arr := make([]interface{}, n)
+		t.forEach(func(k, v luaValue) {
+			if err == nil {
+				arr[k.integer()-1], err = toGoValue(v, visiting)
+				err = fieldError(k, err)
+			}
+		})
+		return arr, err
+	case allStrings: // 包括空表
+		m := make(map[string]interface{}, count)
+		t.forEach(func(k, v luaValue) {
+			if err == nil {
+				m[k.p.(string)], err = toGoValue(v, visiting)
+				err = fieldError(k, err)
+			}
+		})
+		return m, err
+	default:
+		m := make(map[interface{}]interface{}, count)
+		t.forEach(func(k, v luaValue) {
+			if err != nil {
+				return
+			}
+			var gk, gv interface{}
+			if typeOf(k) != LUA_TTABLE {
+				gk, err = toGoValue(k, visiting)
+			}
+			if gk == nil || !reflect.TypeOf(gk).Comparable() { // 表等转换后不能作为map的键
+				err = fmt.Errorf("cannot convert a %s key", typeName(k))
+				return
+			}
+			gv, err = toGoValue(v, visiting)
+			m[gk] = gv
+			err = fieldError(k, err)
+		})
+		return m, err
+	}
+}
+
+// 在错误消息前加上出错的键
+func fieldError(k luaValue, err error) error {
+	if err == nil {
+		return nil
+	}
+	if s, ok := k.p.(string); ok {
+		return fmt.Errorf("field '%s': %w", s, err)
+	}
+	return fmt.Errorf("[%v]: %w", k.toInterface(), err)
+}
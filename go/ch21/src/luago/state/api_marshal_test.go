@@ -0,0 +1,59 @@
+package state
+
+import (
+	"math"
+	"testing"
+)
+
+// 不能作为表键的map键被跳过，引用了自己的指针转换成nil，都不会在保护模式之外抛出错误
+func TestPushGoValueInvalidKeys(t *testing.T) {
+	var self interface{}
+	self = &self
+	tests := []struct {
+		name string
+		v    interface{}
+		want int // 表中条目的个数
+	}{
+		{"nil interface key", map[interface{}]int{nil: 1, "a": 2}, 1},
+		{"nil pointer key", map[*int]int{nil: 1}, 0},
+		{"NaN key", map[float64]int{math.NaN(): 1, 1.5: 2}, 1},
+		{"self-referencing pointer", map[string]interface{}{"self": self, "x": 1}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ls := New()
+			ls.PushGoValue(tt.v)
+			n := 0
+			ls.PushNil()
+			for ls.Next(-2) {
+				n++
+				ls.Pop(1)
+			}
+			if n != tt.want {
+				t.Fatalf("table has %d entries, want %d", n, tt.want)
+			}
+		})
+	}
+}
+
+type Base struct{ ID int }
+
+type Node struct {
+	Base
+	X    int `lua:"x"`
+	Skip int `lua:"-"`
+	Name string
+}
+
+// 结构体按照structs.Fields()给出的字段名转换成表，嵌入的结构体的字段提升到外层，它本身不是字段
+func TestPushGoValueStruct(t *testing.T) {
+	ls := New()
+	ls.OpenLibs()
+	ls.PushGoValue(Node{Base: Base{ID: 3}, X: 1, Skip: 2, Name: "a"})
+	ls.SetGlobal("v")
+	if ls.DoString(`
+		assert(v.x == 1 and v.Name == "a" and v.ID == 3 and v.Base == nil)
+		assert(v.X == nil and v.Skip == nil)`) {
+		t.Fatal(ls.ToString(-1))
+	}
+}
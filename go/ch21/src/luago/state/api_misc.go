@@ -1,31 +1,35 @@
 package state
 
-import "go/ch21/src/luago/number"
+import (
+	"go/ch21/src/luago/api"
+	"go/ch21/src/luago/number"
+)
 
 func (self *luaState) Len(idx int) {
 	val := self.stack.get(idx)
-	if s, ok := val.(string); ok { // 是否是字符串
-		self.stack.push(int64(len(s)))
+	if s, ok := val.p.(string); ok { // 是否是字符串
+		self.stack.push(intValue(int64(len(s))))
 	} else if result, ok := callMetamethod(val, val, "__len", self); ok { // 是否有元方法
 		self.stack.push(result)
-	} else if t, ok := val.(*luaTable); ok { // 如果找不到元方法，但值是表，结果就是表的长度
-		self.stack.push(int64(t.len()))
+	} else if t, ok := val.p.(*luaTable); ok { // 如果找不到元方法，但值是表，结果就是表的长度
+		self.stack.push(intValue(int64(t.len())))
 	} else {
-		panic("length error!")
+		self.runError("attempt to get length of a %s value", typeName(val))
 	}
 }
 
 // 从栈顶弹出n个值进行拼接
 func (self *luaState) Concat(n int) {
 	if n == 0 {
-		self.stack.push("")
+		self.stack.push(stringValue(""))
 	} else if n >= 2 {
 		for i := 1; i < n; i++ {
 			if self.IsString(-1) && self.IsString(-2) {
 				s2 := self.ToString(-1)
 				s1 := self.ToString(-2)
 				self.Pop(2)
-				self.stack.push(s1 + s2)
+				self.stack.push(stringValue(s1 + s2))
+				self.allocate(sizeString + len(s1) + len(s2))
 				continue
 			}
 			// 如果不是字符串，尝试使用元方法
@@ -35,7 +39,10 @@ func (self *luaState) Concat(n int) {
 				self.stack.push(result)
 				continue
 			}
-			panic("concatenation error!")
+			if t := typeOf(a); t == api.LUA_TSTRING || t == api.LUA_TNUMBER {
+				a = b // 指出不能拼接的那个值
+			}
+			self.runError("attempt to concatenate a %s value", typeName(a))
 		}
 	}
 }
@@ -43,9 +50,9 @@ func (self *luaState) Concat(n int) {
 // 根据键获取表的下一个键值对
 func (self *luaState) Next(idx int) bool {
 	val := self.stack.get(idx)
-	if t, ok := val.(*luaTable); ok {
+	if t, ok := val.p.(*luaTable); ok {
 		key := self.stack.pop()
-		if nextKey := t.nextKey(key); nextKey != nil {
+		if nextKey := t.nextKey(key); !nextKey.isNil() {
 			self.stack.push(nextKey)
 			self.stack.push(t.get(nextKey))
 			return true
@@ -55,9 +62,18 @@ func (self *luaState) Next(idx int) bool {
 	panic("table expected!")
 }
 
+// 把栈顶的值作为错误对象抛出
 func (self *luaState) Error() int {
+	return self.ErrorStatus(api.LUA_ERRRUN)
+}
+
+// 把栈顶的值作为错误对象抛出，用来原样传递从别的线程得到的错误，比如协程里超出执行限制的LUA_ERRLIMIT
+func (self *luaState) ErrorStatus(status int) int {
+	if status <= api.LUA_YIELD {
+		panic("invalid error status!")
+	}
 	err := self.stack.pop()
-	panic(err)
+	panic(self.newLuaError(status, err))
 }
 
 func (self *luaState) StringToNumber(s string) bool {
@@ -71,3 +87,42 @@ func (self *luaState) StringToNumber(s string) bool {
 	}
 	return false
 }
+
+// 获取闭包的第n个upvalue，返回upvalue的名字，Go函数的upvalue名字都是空字符串
+// lua-5.3.4/src/lapi.c#aux_upvalue()
+func auxUpvalue(val luaValue, n int) (*upvalue, string, bool) {
+	c, ok := val.p.(*closure)
+	if !ok || n < 1 || n > len(c.upvals) {
+		return nil, "", false
+	}
+	if c.proto == nil { // Go闭包
+		return c.upvals[n-1], "", true
+	}
+	name := "(*no name)"
+	if n <= len(c.proto.UpvalueNames) && c.proto.UpvalueNames[n-1] != "" {
+		name = c.proto.UpvalueNames[n-1]
+	}
+	return c.upvals[n-1], name, true
+}
+
+// 把指定索引处的函数的第n个upvalue推入栈顶，返回upvalue的名字
+// 索引无效时不推入任何值，第二个返回值是false
+// http://www.lua.org/manual/5.3/manual.html#lua_getupvalue
+func (self *luaState) GetUpvalue(funcIdx, n int) (string, bool) {
+	uv, name, ok := auxUpvalue(self.stack.get(funcIdx), n)
+	if ok {
+		self.stack.push(*uv.val)
+	}
+	return name, ok
+}
+
+// 从栈顶弹出一个值，设置为指定索引处的函数的第n个upvalue，返回upvalue的名字
+// 索引无效时不弹出任何值，第二个返回值是false
+// http://www.lua.org/manual/5.3/manual.html#lua_setupvalue
+func (self *luaState) SetUpvalue(funcIdx, n int) (string, bool) {
+	uv, name, ok := auxUpvalue(self.stack.get(funcIdx), n)
+	if ok {
+		*uv.val = self.stack.pop()
+	}
+	return name, ok
+}
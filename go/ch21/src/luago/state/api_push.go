@@ -6,37 +6,40 @@ import (
 )
 
 func (self *luaState) PushNil() {
-	self.stack.push(nil)
+	self.stack.push(luaValue{})
 }
 
 func (self *luaState) PushBoolean(b bool) {
-	self.stack.push(b)
+	self.stack.push(boolValue(b))
 }
 
 func (self *luaState) PushInteger(n int64) {
-	self.stack.push(n)
+	self.stack.push(intValue(n))
 }
 
 func (self *luaState) PushNumber(n float64) {
-	self.stack.push(n)
+	self.stack.push(floatValue(n))
 }
 
 func (self *luaState) PushString(s string) {
-	self.stack.push(s)
+	self.stack.push(stringValue(s))
+	self.allocate(sizeString + len(s))
 }
 
 func (self *luaState) PushFString(fmtStr string, a ...interface{}) {
 	str := fmt.Sprintf(fmtStr, a...)
-	self.stack.push(str)
+	self.stack.push(stringValue(str))
+	self.allocate(sizeString + len(str))
 }
 
 func (self *luaState) PushGoFunction(f api.GoFunction) {
-	self.stack.push(newGoClosure(f, 0))
+	self.stack.push(closureValue(newGoClosure(f, 0)))
+	self.allocate(sizeClosure)
 }
 
 // 把全局环境压入栈中
 func (self *luaState) PushGlobalTable() {
-	global := self.registry.get(api.LUA_RIDX_GLOBALS)
+	global := self.registry.get(intValue(api.LUA_RIDX_GLOBALS))
 	self.stack.push(global)
 }
 
@@ -51,11 +54,24 @@ func (self *luaState) PushGoClosure(f api.GoFunction, n int) {
 		closure.upvals[i-1] = &upvalue{&val}
 	}
 	// 将闭包压入栈中
-	self.stack.push(closure)
+	self.stack.push(closureValue(closure))
+	self.allocate(sizeClosure + n*(8+sizeUpvalue))
+}
+
+// 创建一个完全用户数据并推入栈顶，data是它所包装的宿主对象
+func (self *luaState) NewUserdata(data interface{}) {
+	self.stack.push(userdataValue(newUserdata(data)))
+	self.allocate(sizeUserdata)
+}
+
+// 把轻量用户数据推入栈顶，p必须是可比较的值，一般是指针
+// http://www.lua.org/manual/5.3/manual.html#lua_pushlightuserdata
+func (self *luaState) PushLightUserdata(p interface{}) {
+	self.stack.push(lightUserdataValue(newLightUserdata(p)))
 }
 
 // 把线程推入栈顶
 func (self *luaState) PushThread() bool {
-	self.stack.push(self)
+	self.stack.push(threadValue(self))
 	return self.isMainThread()
 }
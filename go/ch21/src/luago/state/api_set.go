@@ -1,6 +1,9 @@
 package state
 
-import "go/ch21/src/luago/api"
+import (
+	"go/ch21/src/luago/api"
+	"math"
+)
 
 // 把键值写入表，键和值都从栈顶弹出
 func (self *luaState) SetTable(idx int) {
@@ -11,42 +14,59 @@ func (self *luaState) SetTable(idx int) {
 }
 
 func (self *luaState) setTable(t, k, v luaValue, raw bool) {
-	if tbl, ok := t.(*luaTable); ok {
+	if tbl, ok := t.p.(*luaTable); ok {
 		// 如果t是表，表里有k，或者忽略元方法，或者没有元方法
-		if raw || tbl.get(k) != nil || !tbl.hasMetafield("__newindex") {
+		if raw || !tbl.get(k).isNil() || !tbl.hasMetafield("__newindex") {
+			self.checkTableKey(k)
+			size := tableSize(tbl)
 			tbl.put(k, v)
+			if grown := tableSize(tbl) - size; grown > 0 {
+				self.allocate(grown)
+			}
 			return
 		}
 	}
 	if !raw {
-		if mf := getMetafield(t, "__newindex", self); mf != nil {
-			switch x := mf.(type) {
-			case *luaTable: // 如果元方法是表，把k和v写入表
-				self.setTable(x, k, v, false)
-			case *closure: // 如果元方法是函数，调用函数
+		if mf := getMetafield(t, "__newindex", self); !mf.isNil() {
+			switch mf.tt {
+			case api.LUA_TTABLE: // 如果元方法是表，把k和v写入表
+				self.setTable(mf, k, v, false)
+				return
+			case api.LUA_TFUNCTION: // 如果元方法是函数，调用函数
+				self.stack.push(mf)
 				self.stack.push(t)
 				self.stack.push(k)
 				self.stack.push(v)
-				self.Call(3, 0)
+				self.callTM(3, 0)
 				return
 			}
 		}
 	}
-	panic("not a table!")
+	self.runError("attempt to index a %s value", typeName(t))
+}
+
+// nil和NaN不能作为表的键
+func (self *luaState) checkTableKey(k luaValue) {
+	if k.isNil() {
+		self.runError("table index is nil")
+	}
+	if k.tt == LUA_TNUMFLT && math.IsNaN(k.float()) {
+		self.runError("table index is NaN")
+	}
 }
 
 // 把值写入表，键从参数传入(字符串)，值从栈顶弹出
 func (self *luaState) SetField(idx int, k string) {
 	t := self.stack.get(idx)
 	v := self.stack.pop()
-	self.setTable(t, k, v, false)
+	self.setTable(t, stringValue(k), v, false)
 }
 
 // 把值写入表，键从参数传入(数字)，值从栈顶弹出
 func (self *luaState) SetI(idx int, i int64) {
 	t := self.stack.get(idx)
 	v := self.stack.pop()
-	self.setTable(t, i, v, false)
+	self.setTable(t, intValue(i), v, false)
 }
 
 func (self *luaState) RawSet(idx int) {
@@ -59,14 +79,14 @@ func (self *luaState) RawSet(idx int) {
 func (self *luaState) RawSetI(idx int, i int64) {
 	t := self.stack.get(idx)
 	v := self.stack.pop()
-	self.setTable(t, i, v, true)
+	self.setTable(t, intValue(i), v, true)
 }
 
 // 向全局变量写入一个值
 func (self *luaState) SetGlobal(name string) {
-	t := self.registry.get(api.LUA_RIDX_GLOBALS)
+	t := self.registry.get(intValue(api.LUA_RIDX_GLOBALS))
 	v := self.stack.pop()
-	self.setTable(t, name, v, false)
+	self.setTable(t, stringValue(name), v, false)
 }
 
 // 给全局环境注册Go函数值
@@ -83,11 +103,22 @@ func (self *luaState) SetMetatable(idx int) {
 	val := self.stack.get(idx)
 	// 从栈顶弹出表
 	mtVal := self.stack.pop()
-	if mtVal == nil { // 如果mtVal是nil，把元表val设为nil
+	if mtVal.isNil() { // 如果mtVal是nil，把元表val设为nil
 		setMetatable(val, nil, self)
-	} else if tbl, ok := mtVal.(*luaTable); ok { // 如果mtVal是表，把元表val设为mtVal
+	} else if tbl, ok := mtVal.p.(*luaTable); ok { // 如果mtVal是表，把元表val设为mtVal
 		setMetatable(val, tbl, self)
 	} else {
 		panic("table expected!")
 	}
 }
+
+// 从栈顶弹出一个值，把它设置为指定索引处的完全用户数据的用户值
+// http://www.lua.org/manual/5.3/manual.html#lua_setuservalue
+func (self *luaState) SetUserValue(idx int) {
+	val := self.stack.get(idx)
+	u, ok := val.p.(*userdata)
+	if !ok {
+		self.runError("full userdata expected, got %s", typeName(val))
+	}
+	u.uservalue = self.stack.pop()
+}
@@ -87,12 +87,20 @@ func (self *luaState) SetTop(idx int) {
 		}
 	} else if n < 0 {
 		for i := 0; i > n; i-- {
-			self.stack.push(nil)
+			self.stack.push(luaValue{})
 		}
 	}
 }
 
 func (self *luaState) XMove(to LuaState, n int) {
-	vals := self.stack.popN(n)
-	to.(*luaState).stack.pushN(vals, n)
+	if to == LuaState(self) {
+		return
+	}
+	from, dst := self.stack, to.(*luaState).stack
+	vals := from.slots[from.top-n : from.top]
+	for i, val := range vals {
+		dst.push(val)
+		vals[i] = luaValue{} // GC
+	}
+	from.top -= n
 }
@@ -3,17 +3,27 @@ package state
 import (
 	"fmt"
 	"go/ch21/src/luago/stdlib"
+	"io"
 	"os"
+	"strings"
 )
 
 import . "go/ch21/src/luago/api"
 
-// 增强报错函数
+// 增强报错函数，错误消息前会加上调用者的位置信息
 func (self *luaState) Error2(fmt string, a ...interface{}) int {
+	self.Where(1)               // 添加位置信息
 	self.PushFString(fmt, a...) // 添加个格式化
+	self.Concat(2)
 	return self.Error()
 }
 
+// 把指定层级函数的当前执行位置 `chunkname:currentline:` 推入栈顶
+// 0是当前正在执行的函数，1是调用当前函数的函数，以此类推
+func (self *luaState) Where(level int) {
+	self.PushString(self.where(self.getFrame(level)))
+}
+
 // 报参数错误
 func (self *luaState) ArgError(arg int, extraMsg string) int {
 	// bad argument #arg to 'funcname' (extramsg)
@@ -79,6 +89,30 @@ func (self *luaState) CheckString(arg int) string {
 	return s
 }
 
+// 如果参数是元表为注册表中tname的用户数据，返回它包装的Go值，否则返回nil
+func (self *luaState) TestUdata(arg int, tname string) interface{} {
+	if _, ok := self.stack.get(arg).p.(*userdata); ok {
+		if self.GetMetatable(arg) { /* does it have a metatable? */
+			self.GetField(LUA_REGISTRYINDEX, tname) /* get correct metatable */
+			same := self.RawEqual(-1, -2)
+			self.Pop(2) /* remove both metatables */
+			if same {
+				return self.ToUserdata(arg)
+			}
+		}
+	}
+	return nil /* value is not a userdata with a metatable */
+}
+
+// 确保参数是元表为注册表中tname的用户数据，返回它包装的Go值
+func (self *luaState) CheckUdata(arg int, tname string) interface{} {
+	data := self.TestUdata(arg, tname)
+	if data == nil {
+		self.typeError(arg, tname)
+	}
+	return data
+}
+
 // 对可选参数进行检查，如果可选参数有值，确保该值属于指定类型，否则返回默认值
 func (self *luaState) OptInteger(arg int, def int64) int64 {
 	if self.IsNoneOrNil(arg) {
@@ -122,9 +156,21 @@ func (self *luaState) LoadFile(filename string) int {
 
 // 加载文件
 func (self *luaState) LoadFileX(filename, mode string) int {
-	if data, err := os.ReadFile(filename); err == nil {
-		return self.Load(data, "@"+filename, mode)
+	if filename == "" { // 文件名为空时从标准输入读取
+		if data, err := io.ReadAll(os.Stdin); err == nil {
+			return self.Load(data, "=stdin", mode)
+		}
+		self.PushString("cannot read stdin")
+		return LUA_ERRFILE
 	}
+	if f, err := self.OpenFile(filename); err == nil {
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err == nil {
+			return self.Load(data, "@"+filename, mode)
+		}
+	}
+	self.PushString(fmt.Sprintf("cannot open %s", filename))
 	return LUA_ERRFILE
 }
 
@@ -234,25 +280,43 @@ func (self *luaState) CallMeta(obj int, event string) bool {
 
 // 开启标准库
 func (self *luaState) OpenLibs() {
-	// 声明要开启的标准库
-	libs := map[string]GoFunction{
-		"_G":        stdlib.OpenBaseLib,
-		"math":      stdlib.OpenMathLib,
-		"table":     stdlib.OpenTableLib,
-		"string":    stdlib.OpenStringLib,
-		"utf8":      stdlib.OpenUTF8Lib,
-		"os":        stdlib.OpenOSLib,
-		"package":   stdlib.OpenPackageLib,
-		"coroutine": stdlib.OpenCoroutineLib,
-	}
-
 	// 循环调用各个标准库的开启函数
-	for name, fun := range libs {
-		self.RequireF(name, fun, true)
+	for _, lib := range loadedLibs {
+		self.RequireF(lib.name, lib.open, true)
 		self.Pop(1)
 	}
 }
 
+// 开启一个标准库，基础库的名字是"_G"，没有这个标准库时返回false
+func (self *luaState) OpenLib(name string) bool {
+	for _, lib := range loadedLibs {
+		if lib.name == name {
+			self.RequireF(lib.name, lib.open, true)
+			self.Pop(1)
+			return true
+		}
+	}
+	return false
+}
+
+// 标准库，按照开启的顺序排列
+// lua-5.3.4/src/linit.c#loadedlibs
+var loadedLibs = []struct {
+	name string
+	open GoFunction
+}{
+	{"_G", stdlib.OpenBaseLib},
+	{"package", stdlib.OpenPackageLib},
+	{"coroutine", stdlib.OpenCoroutineLib},
+	{"table", stdlib.OpenTableLib},
+	{"io", stdlib.OpenIOLib},
+	{"os", stdlib.OpenOSLib},
+	{"string", stdlib.OpenStringLib},
+	{"math", stdlib.OpenMathLib},
+	{"utf8", stdlib.OpenUTF8Lib},
+	{"debug", stdlib.OpenDebugLib},
+}
+
 // 开启单个标准库
 func (self *luaState) RequireF(modname string, openf GoFunction, glb bool) {
 	self.GetSubTable(LUA_REGISTRYINDEX, "_LOADED")
@@ -299,6 +363,148 @@ func (self *luaState) SetFuncs(l FuncReg, nup int) {
 	self.Pop(nup) /* remove upvalues */
 }
 
+// 在注册表中创建名为tname的元表并推入栈顶，如果已经存在则返回false
+func (self *luaState) NewMetatable(tname string) bool {
+	if self.GetField(LUA_REGISTRYINDEX, tname) != LUA_TNIL {
+		return false /* leave previous value on top, but return false */
+	}
+	self.Pop(1)
+	self.CreateTable(0, 2) /* create metatable */
+	self.PushString(tname)
+	self.SetField(-2, "__name") /* metatable.__name = tname */
+	self.PushValue(-1)
+	self.SetField(LUA_REGISTRYINDEX, tname) /* registry.name = metatable */
+	return true
+}
+
+const (
+	LEVELS1 = 10 /* size of the first part of the stack */
+	LEVELS2 = 11 /* size of the second part of the stack */
+)
+
+// 把线程l1从第level层开始的调用栈回溯推入栈顶，msg不为空时放在回溯信息前面，层数太多时省略中间的部分
+// http://www.lua.org/manual/5.3/manual.html#luaL_traceback
+// lua-5.3.4/src/lauxlib.c#luaL_traceback()
+func (self *luaState) Traceback(l1 LuaState, msg string, level int) {
+	var ar LuaDebug
+	top := self.GetTop()
+	last := lastLevel(l1)
+	n1 := -1
+	if last-level > LEVELS1+LEVELS2 {
+		n1 = LEVELS1
+	}
+	if msg != "" {
+		self.PushString(msg + "\n")
+	}
+	self.CheckStack2(10, "")
+	self.PushString("stack traceback:")
+	for l1.GetStack(level, &ar) {
+		level++
+		if n1 == 0 { /* too many levels? */
+			self.PushString("\n\t...") /* add a '...' */
+			level = last - LEVELS2 + 1 /* and skip to last ones */
+		} else {
+			l1.GetInfo("Slnt", &ar)
+			self.PushString("\n\t" + ar.ShortSrc + ":")
+			if ar.CurrentLine > 0 {
+				self.PushFString("%d:", ar.CurrentLine)
+			}
+			self.PushString(" in ")
+			self.pushFuncName(&ar)
+			if ar.IsTailCall {
+				self.PushString("\n\t(...tail calls...)")
+			}
+			self.Concat(self.GetTop() - top)
+		}
+		n1--
+	}
+	self.Concat(self.GetTop() - top)
+}
+
+// 用二分查找确定调用栈的深度
+// lua-5.3.4/src/lauxlib.c#lastlevel()
+func lastLevel(ls LuaState) int {
+	var ar LuaDebug
+	li, le := 1, 1
+	/* find an upper bound */
+	for ls.GetStack(le, &ar) {
+		li = le
+		le *= 2
+	}
+	/* do a binary search */
+	for li < le {
+		m := (li + le) / 2
+		if ls.GetStack(m, &ar) {
+			li = m + 1
+		} else {
+			le = m
+		}
+	}
+	return le - 1
+}
+
+// 把函数的描述推入栈顶
+// lua-5.3.4/src/lauxlib.c#pushfuncname()
+func (self *luaState) pushFuncName(ar *LuaDebug) {
+	if self.pushGlobalFuncName(ar) { /* try first a global name */
+		self.PushFString("function '%s'", self.ToString(-1))
+		self.Remove(-2) /* remove name */
+	} else if ar.NameWhat != "" { /* is there a name from code? */
+		self.PushFString("%s '%s'", ar.NameWhat, ar.Name) /* use it */
+	} else if ar.What == "main" { /* main? */
+		self.PushString("main chunk")
+	} else if ar.What != "C" { /* for Lua functions, use <file:line> */
+		self.PushFString("function <%s:%d>", ar.ShortSrc, ar.LineDefined)
+	} else { /* nothing left... */
+		self.PushString("?")
+	}
+}
+
+// 在已加载的模块中查找函数，找到时把`模块名.函数名`推入栈顶
+// lua-5.3.4/src/lauxlib.c#pushglobalfuncname()
+func (self *luaState) pushGlobalFuncName(ar *LuaDebug) bool {
+	top := self.GetTop()
+	self.GetInfo("f", ar) /* push function */
+	self.GetField(LUA_REGISTRYINDEX, "_LOADED")
+	if self.findField(top+1, 2) {
+		name := self.ToString(-1)
+		if strings.HasPrefix(name, "_G.") { /* name start with '_G.'? */
+			self.PushString(name[3:]) /* push name without prefix */
+			self.Remove(-2)           /* remove original name */
+		}
+		self.Copy(-1, top+1) /* move name to proper place */
+		self.Pop(2)          /* remove pushed values */
+		return true
+	}
+	self.SetTop(top) /* remove function and global table */
+	return false
+}
+
+// 在栈顶的表中递归查找objIdx处的值，找到时把它的名字推入栈顶
+// lua-5.3.4/src/lauxlib.c#findfield()
+func (self *luaState) findField(objIdx, level int) bool {
+	if level == 0 || !self.IsTable(-1) {
+		return false /* not found */
+	}
+	self.PushNil()      /* start 'next' loop */
+	for self.Next(-2) { /* for each pair in table */
+		if self.Type(-2) == LUA_TSTRING { /* ignore non-string keys */
+			if self.RawEqual(objIdx, -1) { /* found object? */
+				self.Pop(1) /* remove value (but keep name) */
+				return true
+			} else if self.findField(objIdx, level-1) { /* try recursively */
+				self.Remove(-2) /* remove table (but keep name) */
+				self.PushString(".")
+				self.Insert(-2) /* place '.' between the two names */
+				self.Concat(3)
+				return true
+			}
+		}
+		self.Pop(1) /* remove value */
+	}
+	return false /* not found */
+}
+
 // int类型错误
 func (self *luaState) intError(arg int) {
 	if self.IsNumber(arg) {
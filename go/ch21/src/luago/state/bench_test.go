@@ -0,0 +1,83 @@
+package state
+
+import (
+	"testing"
+
+	. "go/ch21/src/luago/api"
+)
+
+// 脚本只编译一次，每次迭代执行一遍
+func benchScript(b *testing.B, script string) {
+	ls := New()
+	ls.OpenLibs()
+	if ls.LoadString(script) != LUA_OK {
+		b.Fatal(ls.ToString(-1))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ls.PushValue(-1)
+		if ls.PCall(0, 0, 0) != LUA_OK {
+			b.Fatal(ls.ToString(-1))
+		}
+	}
+}
+
+// 递归调用，和lua/ch21/call_bench.lua的fib(30)一样
+func BenchmarkFib30(b *testing.B) {
+	benchScript(b, `
+		local function fib(n)
+			if n < 2 then return n end
+			return fib(n - 1) + fib(n - 2)
+		end
+		assert(fib(30) == 832040)`)
+}
+
+// 通过元表调用方法，每次迭代调用20万次
+func BenchmarkMethodCalls(b *testing.B) {
+	benchScript(b, `
+		local Point = {}
+		Point.__index = Point
+		function Point.new(x, y) return setmetatable({x = x, y = y}, Point) end
+		function Point:getX() return self.x end
+		function Point:add(p) self.x, self.y = self.x + p.x, self.y + p.y; return self end
+		local p, d = Point.new(0, 0), Point.new(1, 2)
+		for _ = 1, 100000 do
+			p:add(d):getX()
+		end
+		assert(p.x == 100000)`)
+}
+
+// 下面的数值计算和lua/ch21/number_bench.lua一样，每次迭代循环100万次
+
+// 整数加法
+func BenchmarkIntegerSum(b *testing.B) {
+	benchScript(b, `
+		local sum = 0
+		for i = 1, 1000000 do sum = sum + i end
+		assert(sum == 500000500000)`)
+}
+
+// 整数乘法、取模和位运算
+func BenchmarkIntegerMix(b *testing.B) {
+	benchScript(b, `
+		local x = 1
+		for i = 1, 1000000 do x = (x * 31 + i) % 1000003 ~ (i & 255) end
+		assert(x >= 0)`)
+}
+
+// 浮点数运算
+func BenchmarkFloatArith(b *testing.B) {
+	benchScript(b, `
+		local x, y = 0.0, 1.5
+		for _ = 1, 1000000 do x = x * 0.5 + y / 3.0 - 0.25 end
+		assert(x > 0)`)
+}
+
+// 浮点数的for循环
+func BenchmarkFloatForLoop(b *testing.B) {
+	benchScript(b, `
+		local n = 0
+		for _ = 0.5, 1000000, 1.0 do n = n + 1 end
+		assert(n == 1000000)`)
+}
@@ -6,6 +6,7 @@ import "go/ch21/src/luago/api"
 // 闭包
 // proto和goFunc必须有一个不为空
 type closure struct {
+	gcObject
 	proto  *binchunk.Prototype // Lua函数原型
 	goFunc api.GoFunction      // Go函数原型
 	upvals []*upvalue          // upvalue表
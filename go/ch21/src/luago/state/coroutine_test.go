@@ -0,0 +1,210 @@
+package state
+
+import "testing"
+
+// 执行脚本，出错时报告错误消息
+func runScript(t *testing.T, script string) {
+	t.Helper()
+	ls := New()
+	ls.OpenLibs()
+	if ls.DoString(script) {
+		t.Fatal(ls.ToString(-1))
+	}
+}
+
+// 虚拟机调用的元方法可以挂起，协程恢复运行后完成被打断的指令
+func TestYieldInMetamethod(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+	}{
+		{"__index", `
+			local t = setmetatable({}, {__index = function(t, k) return coroutine.yield(k) end})
+			local co = coroutine.create(function() return t.foo end)
+			local ok, k = coroutine.resume(co)
+			assert(ok and k == "foo")
+			local ok, v = coroutine.resume(co, "bar")
+			assert(ok and v == "bar")
+			assert(coroutine.status(co) == "dead")`},
+		{"global", `
+			setmetatable(_G, {__index = function(t, k) return coroutine.yield(k) end})
+			local f = coroutine.wrap(function() local x = foo; return x, "done" end)
+			assert(f() == "foo")
+			local x, s = f(42)
+			assert(x == 42 and s == "done")`},
+		{"method call", `
+			local t = setmetatable({}, {__index = function(t, k)
+				coroutine.yield(k)
+				return function(self, x) return x + 1 end
+			end})
+			local f = coroutine.wrap(function() return t:inc(1) end)
+			assert(f() == "inc")
+			assert(f() == 2)`},
+		{"__newindex", `
+			local log = {}
+			local t = setmetatable({}, {__newindex = function(t, k, v)
+				log[#log + 1] = coroutine.yield(k) .. v
+			end})
+			local f = coroutine.wrap(function() t.x = 1; t.y = 2; return "done" end)
+			assert(f() == "x")
+			assert(f("x=") == "y")
+			assert(f("y=") == "done")
+			assert(log[1] == "x=1" and log[2] == "y=2")`},
+		{"arithmetic", `
+			local mt = {}
+			mt.__add = function(a, b) return coroutine.yield("add") end
+			mt.__unm = function(a) return coroutine.yield("unm") end
+			mt.__len = function(a) return coroutine.yield("len") end
+			local a = setmetatable({}, mt)
+			local f = coroutine.wrap(function()
+				local x = a + 1
+				local y = -a
+				local z = #a
+				return x * 100 + y * 10 + z
+			end)
+			assert(f() == "add")
+			assert(f(1) == "unm")
+			assert(f(2) == "len")
+			assert(f(3) == 123)`},
+		{"__concat", `
+			local a = setmetatable({}, {__concat = function(a, b)
+				return coroutine.yield("concat")
+			end})
+			local f = coroutine.wrap(function() return "x" .. a .. a .. "y" end)
+			assert(f() == "concat")
+			assert(f("A") == "concat")
+			assert(f("B") == "xB")`},
+		{"comparison", `
+			local mt = {}
+			mt.__eq = function(a, b) return coroutine.yield("eq") end
+			mt.__lt = function(a, b) return coroutine.yield("lt") end
+			local a, b = setmetatable({}, mt), setmetatable({}, mt)
+			local f = coroutine.wrap(function()
+				local r = {}
+				if a == b then r[#r + 1] = "eq" end
+				if a < b then r[#r + 1] = "lt" end
+				if a <= b then r[#r + 1] = "le" end -- 用not (b < a)代替
+				if not (a <= b) then r[#r + 1] = "not le" end
+				return table.concat(r, ",")
+			end)
+			assert(f() == "eq")
+			assert(f(true) == "lt")
+			assert(f(false) == "lt")
+			assert(f(false) == "lt")
+			assert(f(true) == "eq,le,not le")`},
+		{"__le", `
+			local a = setmetatable({}, {__le = function(a, b) return coroutine.yield("le") end})
+			local f = coroutine.wrap(function() return a <= 1, a <= 2 end)
+			assert(f() == "le")
+			assert(f(true) == "le")
+			local x, y = f(false)
+			assert(x == true and y == false)`},
+		{"not yieldable from Go", `
+			local t = setmetatable({}, {__index = coroutine.yield, __len = function() return 1 end})
+			local co = coroutine.create(function() return table.concat(t) end)
+			local ok, err = coroutine.resume(co)
+			assert(not ok and err:find("attempt to yield across a C%-call boundary"), err)`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runScript(t, tt.script)
+		})
+	}
+}
+
+// 出错死亡的协程关闭时报告错误，之后再关闭返回true
+func TestCloseDeadCoroutine(t *testing.T) {
+	runScript(t, `
+		local co = coroutine.create(function() error("oops", 0) end)
+		assert(not coroutine.resume(co))
+		local ok, err = coroutine.close(co)
+		assert(not ok and err == "oops", err)
+		assert(coroutine.close(co) == true)
+		assert(coroutine.status(co) == "dead")
+		local ok, err = coroutine.resume(co)
+		assert(not ok and err == "cannot resume dead coroutine", err)`)
+}
+
+// 调用指令调用的Go函数挂起时从解释器循环返回，恢复运行后完成调用指令
+func TestYieldFromCallInstruction(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+	}{
+		{"call", `
+			local co = coroutine.wrap(function(a)
+				local b, c = coroutine.yield(a + 1)
+				return b + c
+			end)
+			assert(co(1) == 2)
+			assert(co(3, 4) == 7)`},
+		{"tail call", `
+			local function deep(n)
+				if n == 0 then return coroutine.yield("bottom") end
+				return deep(n - 1)
+			end
+			local co = coroutine.wrap(function() return deep(10), "after" end)
+			assert(co() == "bottom")
+			local x, y = co("x")
+			assert(x == "x" and y == "after")`},
+		{"generic for", `
+			local co = coroutine.wrap(function()
+				local n = 0
+				for k, v in coroutine.yield do n = n + v end
+				return n
+			end)
+			co()
+			co("a", 1)
+			co("b", 2)
+			assert(co(nil) == 3)`},
+		{"inside pcall", `
+			local co = coroutine.wrap(function()
+				local ok, v = pcall(function()
+					local a = coroutine.yield(1)
+					local b = coroutine.yield(2)
+					error(a + b, 0)
+				end)
+				return ok, v
+			end)
+			assert(co() == 1)
+			assert(co(10) == 2)
+			local ok, v = co(20)
+			assert(ok == false and v == 30)`},
+		{"pcall of yield", `
+			local co = coroutine.wrap(function()
+				for i = 1, 3 do
+					local ok, v = pcall(coroutine.yield, i)
+					assert(ok and v == i * 10)
+				end
+				return "done"
+			end)
+			for i = 1, 3 do assert(co(i > 1 and (i - 1) * 10 or nil) == i) end
+			assert(co(30) == "done")`},
+		{"nested coroutines", `
+			local inner = coroutine.wrap(function()
+				coroutine.yield("i1")
+				return "i2"
+			end)
+			local outer = coroutine.wrap(function()
+				coroutine.yield(inner())
+				return inner()
+			end)
+			assert(outer() == "i1")
+			assert(outer() == "i2")`},
+		{"status", `
+			local co
+			co = coroutine.create(function()
+				assert(coroutine.status(co) == "running")
+				coroutine.yield()
+			end)
+			assert(coroutine.resume(co))
+			assert(coroutine.status(co) == "suspended")
+			assert(coroutine.resume(co))
+			assert(coroutine.status(co) == "dead")`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runScript(t, tt.script)
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package state
+
+import "testing"
+
+// 处于循环引用中的对象不会被Go执行终结器，完整的垃圾回收时也要调用它们的__gc
+func TestGCCycles(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+	}{
+		{"self reference", `
+			local n = 0
+			do
+				local t = setmetatable({}, {__gc = function(o) n = n + 1; assert(o.self == o) end})
+				t.self = t
+			end
+			collectgarbage()
+			assert(n == 1, n)
+			collectgarbage()
+			assert(n == 1, n)`},
+		{"own metatable", `
+			local n = 0
+			do
+				local t = {__gc = function() n = n + 1 end}
+				setmetatable(t, t)
+			end
+			collectgarbage()
+			assert(n == 1, n)`},
+		{"closure cycle", `
+			local n = 0
+			do
+				local a, b = {}, {}
+				a.f = function() return b end
+				b.f = function() return a end
+				setmetatable(a, {__gc = function() n = n + 1 end})
+				setmetatable(b, {__gc = function() n = n + 10 end})
+			end
+			collectgarbage()
+			assert(n == 11, n)`},
+		{"reachable cycle", `
+			local n = 0
+			local t = setmetatable({}, {__gc = function() n = n + 1 end})
+			t.self = t
+			keep = {t}
+			collectgarbage()
+			collectgarbage()
+			assert(n == 0, n)
+			keep = nil
+			t = nil
+			collectgarbage()
+			assert(n == 1, n)`},
+		{"resurrected", `
+			local saved
+			do
+				local t = setmetatable({}, {__gc = function(o) saved = o end})
+				t.self = t
+			end
+			collectgarbage()
+			assert(saved and saved.self == saved)`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runScript(t, tt.script)
+		})
+	}
+}
@@ -0,0 +1,18 @@
+package state
+
+import "testing"
+
+// 行钩子在函数体的每一行都会触发，包括只有return语句的最后一行
+func TestLineHook(t *testing.T) {
+	runScript(t, `local lines = {}
+local function f(x)
+	local y = x + 1
+	y = y * 2
+	return y
+end
+debug.sethook(function(_, line) lines[#lines + 1] = line end, "l")
+f(1)
+debug.sethook()
+local s = table.concat(lines, " ")
+assert(s == "8 3 4 5 9", s)`)
+}
@@ -0,0 +1,93 @@
+package state
+
+import (
+	"context"
+	"testing"
+
+	. "go/ch21/src/luago/api"
+)
+
+// 协程里超出执行限制时，错误码原样传给宿主，错误消息只有一个位置信息
+func TestLimitInCoroutine(t *testing.T) {
+	scripts := []string{
+		"coroutine.wrap(function() while true do end end)()",
+		"coroutine.resume(coroutine.create(function() while true do end end))",
+		"return coroutine.resume(coroutine.create(function() while true do end end))",
+		"local co = coroutine.wrap(function() coroutine.wrap(function() while true do end end)() end) co()",
+	}
+	want := `[string "probe"]:1: `
+	limits := []struct {
+		name string
+		set  func(ls LuaState)
+		msg  string
+	}{
+		{"instructions", func(ls LuaState) { ls.SetInstructionLimit(10000) }, "instruction limit exceeded"},
+		{"context", func(ls LuaState) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			ls.SetContext(ctx)
+		}, "context canceled"},
+	}
+	for _, limit := range limits {
+		for _, script := range scripts {
+			ls := New()
+			ls.OpenLibs()
+			limit.set(ls)
+			ls.Load([]byte(script), "probe", "t")
+			if status := ls.PCall(0, 0, 0); status != LUA_ERRLIMIT {
+				t.Errorf("%s: %s: status = %d, want LUA_ERRLIMIT", limit.name, script, status)
+			}
+			if msg := ls.ToString(-1); msg != want+limit.msg {
+				t.Errorf("%s: %s: message = %q, want %q", limit.name, script, msg, want+limit.msg)
+			}
+		}
+	}
+}
+
+// 调用深度超出限制是普通的运行时错误，消息处理函数可以生成调用栈回溯
+func TestCallDepthLimit(t *testing.T) {
+	ls := New()
+	ls.OpenLibs()
+	ls.SetCallDepthLimit(100)
+	ls.Load([]byte("local function r() return 1 + r() end r()"), "=probe", "t")
+	if status := ls.PCall(0, 0, 0); status != LUA_ERRRUN {
+		t.Fatalf("status = %d, want LUA_ERRRUN", status)
+	}
+	if msg := ls.ToString(-1); msg != "probe:1: stack overflow" {
+		t.Errorf("message = %q", msg)
+	}
+	ls.Pop(1)
+
+	if ls.DoString(`
+		local function r() return 1 + r() end
+		local ok, msg = xpcall(r, debug.traceback)
+		assert(not ok and msg:find("stack overflow") and msg:find("stack traceback:"), msg)
+		ok, msg = xpcall(r, function(m) return r() end)
+		assert(not ok and msg == "error in error handling", msg)
+		ok, msg = pcall(r)
+		assert(not ok and msg:find("stack overflow"), msg)`) {
+		t.Fatal(ls.ToString(-1))
+	}
+}
+
+// 长字符串每次创建都计入内存统计，构造很大结果的库函数在分配之前检查内存限制
+func TestMemoryLimitLongStrings(t *testing.T) {
+	scripts := []string{
+		"local s = string.rep('a', 1 << 20) local t = {} for i = 1, 100 do t[i] = s:upper() end",
+		"local t = {} for i = 1, 1000 do t[i] = string.rep('a', 1 << 16) end table.concat(t)",
+		"local s = string.rep('a', 1 << 20) local t = {} for i = 1, 100 do t[i] = s end table.concat(t)",
+		"local s = string.rep('a', 1 << 20) string.rep(s, 100)",
+		"local s = string.rep('a', 1 << 16) string.gsub(string.rep('x', 1000), 'x', s)",
+		"local s = string.rep('a', 1 << 20) local t = {} for i = 1, 100 do t[i] = s end string.format(string.rep('%s', 100), table.unpack(t))",
+		"local s = string.rep('a', 1 << 20) local t = {} for i = 1, 100 do t[i] = s end string.pack(string.rep('z', 100), table.unpack(t))",
+	}
+	for _, script := range scripts {
+		ls := New()
+		ls.OpenLibs()
+		ls.SetMemoryLimit(16 << 20)
+		ls.Load([]byte(script), "=probe", "t")
+		if status := ls.PCall(0, 0, 0); status != LUA_ERRMEM {
+			t.Errorf("%s: status = %d, want LUA_ERRMEM", script, status)
+		}
+	}
+}
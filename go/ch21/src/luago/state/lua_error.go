@@ -0,0 +1,129 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+
+	. "go/ch21/src/luago/api"
+	"go/ch21/src/luago/binchunk"
+)
+
+// Lua错误，通过panic在调用帧之间传递，由PCall捕获
+type LuaError struct {
+	status int         // 错误码 LUA_ERRRUN/LUA_ERRSYNTAX/LUA_ERRMEM...
+	value  luaValue    // 错误对象
+	frames []frameInfo // 抛出错误时的调用栈快照，用于生成回溯信息
+}
+
+// 调用帧快照
+type frameInfo struct {
+	closure *closure
+	pc      int
+}
+
+// 创建错误，同时记录当前的调用栈
+func (self *luaState) newLuaError(status int, value luaValue) *LuaError {
+	err := &LuaError{status: status, value: value}
+	for stack := self.stack; stack.prev != nil; stack = stack.prev {
+		err.frames = append(err.frames, frameInfo{stack.closure, stack.pc})
+	}
+	return err
+}
+
+// 错误码
+func (self *LuaError) Status() int {
+	return self.status
+}
+
+// 错误对象
+func (self *LuaError) Value() interface{} {
+	return self.value.toInterface()
+}
+
+// 实现error接口
+func (self *LuaError) Error() string {
+	switch self.value.tt {
+	case LUA_TSTRING:
+		return self.value.p.(string)
+	case LUA_TNUMINT, LUA_TNUMFLT:
+		return fmt.Sprintf("%v", self.value.toInterface())
+	case LUA_TNIL:
+		return "nil"
+	default:
+		return fmt.Sprintf("(error object is a %s value)", typeName(self.value))
+	}
+}
+
+// 抛出错误时的调用栈回溯
+func (self *LuaError) Traceback() string {
+	return formatTraceback(self.frames)
+}
+
+// 抛出运行时错误，如果当前正在执行Lua函数，在消息前加上`chunkname:line:`
+func (self *luaState) runError(format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	if self.stack.closure != nil && self.stack.closure.proto != nil {
+		msg = self.where(self.stack) + msg
+	}
+	panic(self.newLuaError(LUA_ERRRUN, stringValue(msg)))
+}
+
+// 返回调用帧当前执行位置的描述 `chunkname:currentline:`
+func (self *luaState) where(stack *luaStack) string {
+	if stack != nil && stack.closure != nil && stack.closure.proto != nil {
+		if line := currentLine(stack.closure, stack.pc); line > 0 {
+			return fmt.Sprintf("%s:%d: ", binchunk.ChunkID(stack.closure.proto.Source), line)
+		}
+	}
+	return ""
+}
+
+// 根据层级获取调用帧，0是当前正在执行的函数，1是调用当前函数的函数，以此类推
+func (self *luaState) getFrame(level int) *luaStack {
+	stack := self.stack
+	for ; level > 0 && stack != nil; level-- {
+		stack = stack.prev
+	}
+	if stack == nil || stack.prev == nil { // 最底层的栈不属于任何函数
+		return nil
+	}
+	return stack
+}
+
+// 返回正在执行的指令对应的行号，没有行号信息时返回-1
+func currentLine(c *closure, pc int) int {
+	if c.proto == nil {
+		return -1
+	}
+	lineInfo := c.proto.LineInfo
+	if pc > 0 && pc <= len(lineInfo) {
+		return int(lineInfo[pc-1]) // Fetch之后pc已经指向下一条指令
+	}
+	return -1
+}
+
+// 生成调用栈回溯信息
+func formatTraceback(frames []frameInfo) string {
+	var sb strings.Builder
+	sb.WriteString("stack traceback:")
+	for _, frame := range frames {
+		sb.WriteString("\n\t")
+		c := frame.closure
+		if c == nil || c.proto == nil {
+			sb.WriteString("[C]: in ?")
+			continue
+		}
+		source := binchunk.ChunkID(c.proto.Source)
+		if line := currentLine(c, frame.pc); line > 0 {
+			sb.WriteString(fmt.Sprintf("%s:%d:", source, line))
+		} else {
+			sb.WriteString(source + ":")
+		}
+		if c.proto.LineDefined == 0 {
+			sb.WriteString(" in main chunk")
+		} else {
+			sb.WriteString(fmt.Sprintf(" in function <%s:%d>", source, c.proto.LineDefined))
+		}
+	}
+	return sb.String()
+}
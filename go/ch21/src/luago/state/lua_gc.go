@@ -0,0 +1,325 @@
+package state
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+	"weak"
+
+	. "go/ch21/src/luago/api"
+)
+
+// Lua的值都是普通的Go对象，由Go的垃圾回收器回收。
+// 这里在它的基础上实现__gc元方法、弱表和collectgarbage:
+//   - 设置了带__gc的元表的对象会设置一个Go终结器，终结器只把对象放入队列，
+//     __gc元方法由虚拟机在调用函数时或者collectgarbage时调用
+//   - 弱表通过weak.Pointer引用可回收对象，弱键表(ephemeron表)的值保存在键对象里，
+//     所以只有键还活着的时候值才是可达的
+//
+//   - Go不会执行处于循环引用中的对象的终结器，所以完整的垃圾回收(collectgarbage())时，
+//     从根对象出发统计一遍活着的对象，没有被标记到的带__gc的对象就是循环引用中的垃圾，
+//     去掉它的Go终结器，直接放入队列。自动回收时不做这一步，循环引用中的对象的__gc
+//     要等到下一次完整的垃圾回收才会被调用
+
+// 垃圾回收器的状态，由同一个Lua状态机的所有线程共享
+type gcState struct {
+	mu          sync.Mutex
+	tobefnz     []luaValue  // 已经不可达，等待调用__gc的对象
+	pending     atomic.Bool // tobefnz是否非空
+	running     bool        // 是否自动调用__gc，collectgarbage("stop")/("restart")
+	inFinalizer bool        // 是否正在调用__gc，防止重入
+	pause       int         // 间歇率，决定多久统计一次内存，Go的垃圾回收器自己决定回收时机
+	stepmul     int         // 步进倍率
+	weakTables  []weak.Pointer[luaTable]
+	finobj      []luaValue // 设置了Go终结器的对象的弱引用，用来找出循环引用中的垃圾
+
+	// 内存统计，见lua_mem.go
+	totalBytes int64  // 估算的内存使用量
+	estimate   int64  // 上一次统计出来的活着的对象的大小
+	threshold  int64  // totalBytes超过它时统计活着的对象
+	memLimit   int64  // 内存上限，0表示不限制
+	epoch      uint32 // census编号，用来判断对象在本次统计中是否已经计入
+}
+
+func newGCState() *gcState {
+	g := &gcState{
+		running: true,
+		pause:   LUAI_GCPAUSE,
+		stepmul: LUAI_GCMUL,
+	}
+	g.setThreshold()
+	return g
+}
+
+const (
+	LUAI_GCPAUSE = 200 /* 200% */
+	LUAI_GCMUL   = 200 /* GC runs 'twice the speed' of memory allocation */
+)
+
+// 可回收对象(表、闭包、完全用户数据和线程)的公共部分
+type gcObject struct {
+	finalizer  bool                                // 是否已经设置了Go终结器
+	marked     uint32                              // 最近一次被统计到时的census编号
+	ephemerons map[weak.Pointer[luaTable]]luaValue // 以该对象为键的弱键表中的值
+}
+
+func (self *gcObject) object() *gcObject {
+	return self
+}
+
+// 可回收对象，弱表只对可回收对象起作用，字符串和数字等值不会从弱表中删除
+type collectable interface {
+	object() *gcObject
+}
+
+// 可回收对象的弱引用，同一个对象的弱引用总是相等的，所以可以作为表的键
+type weakRef[T any] struct {
+	p weak.Pointer[T]
+}
+
+type weakValue interface {
+	value() luaValue
+}
+
+// 返回被引用的对象，对象已经被回收时返回nil
+func (self weakRef[T]) value() luaValue {
+	if p := self.p.Value(); p != nil {
+		return valueOf(p)
+	}
+	return luaValue{}
+}
+
+// 如果是可回收对象，返回它的弱引用，否则原样返回
+func makeWeak(val luaValue) luaValue {
+	switch x := val.p.(type) {
+	case *luaTable:
+		return luaValue{tt: LUA_TWEAKREF, p: weakRef[luaTable]{weak.Make(x)}}
+	case *closure:
+		return luaValue{tt: LUA_TWEAKREF, p: weakRef[closure]{weak.Make(x)}}
+	case *userdata:
+		return luaValue{tt: LUA_TWEAKREF, p: weakRef[userdata]{weak.Make(x)}}
+	case *luaState:
+		return luaValue{tt: LUA_TWEAKREF, p: weakRef[luaState]{weak.Make(x)}}
+	}
+	return val
+}
+
+// 如果是弱引用，返回被引用的对象，否则原样返回
+func strongValue(val luaValue) luaValue {
+	if val.tt == LUA_TWEAKREF {
+		return val.p.(weakValue).value()
+	}
+	return val
+}
+
+// 设置元表时，如果元表有__gc字段，让Go在对象不可达时把它放入队列
+// lua-5.3.4/src/lgc.c#luaC_checkfinalizer()
+func (self *gcState) checkFinalizer(val luaValue, mt *luaTable) {
+	if mt == nil || mt.get(stringValue("__gc")).isNil() { /* or no finalizer */
+		return
+	}
+	switch x := val.p.(type) {
+	case *luaTable:
+		if !x.finalizer { /* not already marked */
+			x.finalizer = true
+			runtime.SetFinalizer(x, func(t *luaTable) { self.enqueue(tableValue(t)) })
+			self.finobj = append(self.finobj, makeWeak(val))
+		}
+	case *userdata:
+		if !x.finalizer {
+			x.finalizer = true
+			runtime.SetFinalizer(x, func(u *userdata) { self.enqueue(userdataValue(u)) })
+			self.finobj = append(self.finobj, makeWeak(val))
+		}
+	}
+}
+
+// 在统计活着的对象之后调用，把没有被标记到的带__gc的对象放入队列
+// Go的终结器已经执行过的对象的弱引用是nil，剩下的没有被标记的对象处于循环引用中
+// lua-5.3.4/src/lgc.c#separatetobefnz()
+func (self *gcState) separateTobefnz() {
+	live := self.finobj[:0]
+	for _, ref := range self.finobj {
+		val := strongValue(ref)
+		if val.isNil() { /* already collected or finalized */
+			continue
+		}
+		if val.p.(collectable).object().marked == self.epoch { /* not being collected? */
+			live = append(live, ref)
+			continue
+		}
+		runtime.SetFinalizer(val.p, nil) // 调用__gc之后就是普通的垃圾，Go可以回收循环引用
+		self.enqueue(val)
+	}
+	for i := len(live); i < len(self.finobj); i++ {
+		self.finobj[i] = luaValue{}
+	}
+	self.finobj = live
+}
+
+// 在Go的终结器goroutine中调用，对象因此复活，直到__gc被调用之后才能真正被回收
+func (self *gcState) enqueue(val luaValue) {
+	self.mu.Lock()
+	self.tobefnz = append(self.tobefnz, val)
+	self.pending.Store(true)
+	self.mu.Unlock()
+}
+
+// 取出一个等待调用__gc的对象
+func (self *gcState) udata2finalize() luaValue {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if len(self.tobefnz) == 0 {
+		self.pending.Store(false)
+		return luaValue{}
+	}
+	val := self.tobefnz[0]
+	self.tobefnz[0] = luaValue{}
+	self.tobefnz = self.tobefnz[1:]
+	return val
+}
+
+// 记录弱表，完整的垃圾回收之后清理其中已经被回收的条目
+func (self *gcState) addWeakTable(t *luaTable) {
+	self.weakTables = append(self.weakTables, t.weakSelf)
+}
+
+// 清理所有弱表
+// lua-5.3.4/src/lgc.c#clearkeys()
+func (self *gcState) clearWeakTables() {
+	live := self.weakTables[:0]
+	for _, p := range self.weakTables {
+		if t := p.Value(); t != nil {
+			t.clearWeak()
+			live = append(live, p)
+		}
+	}
+	for i := len(live); i < len(self.weakTables); i++ {
+		self.weakTables[i] = weak.Pointer[luaTable]{}
+	}
+	self.weakTables = live
+}
+
+// 调用已经不可达的对象的__gc元方法
+// lua-5.3.4/src/lgc.c#callallpendingfinalizers()
+func (self *luaState) runFinalizers() {
+	g := self.gc
+	if g.inFinalizer || !g.pending.Load() {
+		return
+	}
+	g.inFinalizer = true
+	defer func() { g.inFinalizer = false }()
+	for val := g.udata2finalize(); !val.isNil(); val = g.udata2finalize() {
+		self.gcTM(val)
+	}
+}
+
+// 以保护模式调用对象的__gc元方法，出错时抛出LUA_ERRGCMM错误
+// lua-5.3.4/src/lgc.c#GCTM()
+func (self *luaState) gcTM(val luaValue) {
+	tm := getMetafield(val, "__gc", self)
+	if typeOf(tm) != LUA_TFUNCTION { /* is there a finalizer? */
+		return
+	}
+	stack := self.stack
+	stack.check(2)
+	stack.push(tm)  /* push finalizer... */
+	stack.push(val) /* ... and its argument */
+	// 标记调用帧正在调用终结器，调试信息据此给出函数名
+	stack.callStatus |= CIST_FIN
+	status := self.pcall(stack.top-2, luaValue{}, func() {
+		self.callNoYield(1, 0)
+	})
+	stack.callStatus &^= CIST_FIN
+
+	if status == LUA_ERRLIMIT { // 超出执行限制的错误原样传出去
+		panic(self.newLuaError(status, self.stack.pop()))
+	}
+	if status != LUA_OK { /* error while running __gc? */
+		msg := "no message"
+		if s, ok := self.stack.pop().p.(string); ok {
+			msg = s
+		}
+		panic(self.newLuaError(LUA_ERRGCMM, stringValue(fmt.Sprintf("error in __gc metamethod (%s)", msg))))
+	}
+}
+
+// 执行一次完整的垃圾回收：调用所有已经不可达的对象的__gc，然后清理弱表
+// lua-5.3.4/src/lgc.c#luaC_fullgc()
+func (self *luaState) fullGC() {
+	waitFinalizers()
+	self.census() // 完整的回收从API调用，所有活着的对象都在栈上或者注册表里
+	self.gc.separateTobefnz()
+	self.runFinalizers()
+	self.gc.clearWeakTables()
+	self.shrinkStack()
+	self.census()
+}
+
+// runtime.GC()只负责找出不可达的对象，把它们的终结器放入队列，终结器在单独的goroutine里依次执行。
+// 第一个哨兵的终结器执行时，本次回收放入队列的终结器已经全部被取走；第二个哨兵在这之后才放入队列，
+// 所以它的终结器执行时，本次回收的终结器都已经执行完了
+func waitFinalizers() {
+	for i := 0; i < 2; i++ {
+		done := newSentinel()
+		runtime.GC()
+		select {
+		case <-done:
+		case <-time.After(time.Second): // 哨兵没有被回收，不再等待
+		}
+	}
+}
+
+type sentinel struct {
+	done chan struct{}
+}
+
+//go:noinline
+func newSentinel() chan struct{} {
+	s := &sentinel{make(chan struct{})}
+	runtime.SetFinalizer(s, func(s *sentinel) { close(s.done) })
+	return s.done
+}
+
+// 控制垃圾回收器
+// http://www.lua.org/manual/5.3/manual.html#lua_gc
+// lua-5.3.4/src/lapi.c#lua_gc()
+func (self *luaState) GC(what, data int) int {
+	g := self.gc
+	switch what {
+	case LUA_GCSTOP:
+		g.running = false
+		g.setThreshold()
+	case LUA_GCRESTART:
+		g.running = true
+		g.setThreshold()
+	case LUA_GCCOLLECT:
+		self.fullGC()
+	case LUA_GCCOUNT:
+		/* GC values are expressed in Kbytes: #bytes/2^10 */
+		return int(g.totalBytes >> 10)
+	case LUA_GCCOUNTB:
+		return int(g.totalBytes & 0x3ff)
+	case LUA_GCSTEP:
+		// Go的垃圾回收不能分步执行，每一步都是一次完整的回收
+		self.fullGC()
+		return 1 /* a step always finishes a cycle */
+	case LUA_GCSETPAUSE:
+		data, g.pause = g.pause, data
+		g.setThreshold()
+		return data
+	case LUA_GCSETSTEPMUL:
+		data, g.stepmul = g.stepmul, data
+		return data
+	case LUA_GCISRUNNING:
+		if g.running {
+			return 1
+		}
+		return 0
+	default:
+		return -1 /* invalid option */
+	}
+	return 0
+}
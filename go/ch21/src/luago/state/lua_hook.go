@@ -0,0 +1,105 @@
+package state
+
+import . "go/ch21/src/luago/api"
+
+// 设置调试钩子，f为nil或者mask为0时关闭钩子
+// http://www.lua.org/manual/5.3/manual.html#lua_sethook
+// lua-5.3.4/src/ldebug.c#lua_sethook()
+func (self *luaState) SetHook(f LuaHook, mask, count int) {
+	if f == nil || mask == 0 { /* turn off hooks? */
+		mask = 0
+		f = nil
+	}
+	if self.stack.isLua() {
+		self.oldPC = self.stack.pc
+	}
+	self.hook = f
+	self.baseHookCount = count
+	self.hookCount = count /* reset hook count */
+	self.hookMask = mask
+}
+
+// http://www.lua.org/manual/5.3/manual.html#lua_gethook
+func (self *luaState) GetHook() LuaHook {
+	return self.hook
+}
+
+// http://www.lua.org/manual/5.3/manual.html#lua_gethookmask
+func (self *luaState) GetHookMask() int {
+	return self.hookMask
+}
+
+// http://www.lua.org/manual/5.3/manual.html#lua_gethookcount
+func (self *luaState) GetHookCount() int {
+	return self.baseHookCount
+}
+
+// 调用钩子函数，钩子看到的当前调用帧就是触发事件的函数的调用帧
+// 钩子执行期间不能挂起，也不会再触发钩子，钩子压入栈中的值会被清除
+// lua-5.3.4/src/ldo.c#luaD_hook()
+func (self *luaState) callHook(event, line int) {
+	hook := self.hook
+	if hook == nil || !self.allowHook { /* make sure there is a hook */
+		return
+	}
+	frame := self.stack
+	top := frame.top
+	ar := &LuaDebug{Event: event, CurrentLine: line, CallInfo: frame}
+	frame.check(LUA_MINSTACK) /* ensure minimum stack size */
+	self.allowHook = false    /* cannot call hooks inside a hook */
+	self.nny++
+	frame.callStatus |= CIST_HOOKED
+	defer func() { // 钩子抛出错误时也要恢复
+		self.allowHook = true
+		self.nny--
+		frame.callStatus &^= CIST_HOOKED
+	}()
+
+	hook(self, ar)
+	for frame.top > top {
+		frame.pop()
+	}
+}
+
+// 刚进入Lua函数时调用call钩子，尾调用的函数调用tail call钩子
+// lua-5.3.4/src/ldo.c#callhook()
+func (self *luaState) hookCall() {
+	frame := self.stack
+	hook := LUA_HOOKCALL
+	if frame.callStatus&CIST_TAIL != 0 {
+		hook = LUA_HOOKTAILCALL
+	}
+	frame.pc++ /* hooks assume 'pc' is already incremented */
+	self.callHook(hook, -1)
+	frame.pc-- /* correct 'pc' */
+}
+
+// 每条指令执行之前调用，在合适的时候调用count和line钩子
+// lua-5.3.4/src/ldebug.c#luaG_traceexec()
+func (self *luaState) traceExec() {
+	frame := self.stack
+	mask := self.hookMask
+	self.hookCount--
+	countHook := self.hookCount == 0 && mask&LUA_MASKCOUNT != 0
+	if countHook {
+		self.hookCount = self.baseHookCount /* reset count */
+	} else if mask&LUA_MASKLINE == 0 {
+		return /* no line hook and count != 0; nothing to be done */
+	}
+	if countHook {
+		self.callHook(LUA_HOOKCOUNT, -1) /* call count hook */
+	}
+	if mask&LUA_MASKLINE != 0 {
+		c := frame.closure
+		npc := frame.pc - 1 // Fetch之后pc已经指向下一条指令
+		newLine := currentLine(c, frame.pc)
+		if npc == 0 || /* call linehook when enter a new function, */
+			frame.pc <= self.oldPC || /* when jump back (loop), or when */
+			newLine != currentLine(c, self.oldPC) { /* enter a new line */
+			if newLine > 0 { // 编译器生成的第0条占位指令没有行号
+				self.callHook(LUA_HOOKLINE, newLine) /* call line hook */
+			}
+		}
+	}
+	self.oldPC = frame.pc
+}
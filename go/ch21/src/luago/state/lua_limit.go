@@ -0,0 +1,87 @@
+package state
+
+import (
+	"context"
+
+	. "go/ch21/src/luago/api"
+)
+
+/* default limit for nested calls (Lua and Go functions) */
+const LUAI_MAXCALLS = 200000
+
+/* extra call depth for message handlers after a stack overflow */
+const LUAI_EXTRACALLS = 200
+
+/* maximum depth for nested Go calls (metamethods, Go functions calling Lua, resumes) */
+const LUAI_MAXCCALLS = 200
+
+/* check the context once every LUAI_CTXCHECK instructions */
+const LUAI_CTXCHECK = 1024
+
+// 执行限制，用来运行不可信的脚本
+// 指令数和上下文超出限制时抛出LUA_ERRLIMIT错误。这两个限制一旦触发，之后的每条指令都会
+// 再次抛出错误，所以脚本里的pcall拦不住它；宿主重新设置限制之后，状态可以继续使用。
+// 调用深度超出限制时和Lua一样抛出普通的"stack overflow"运行时错误
+type execLimit struct {
+	enabled  bool            // 是否设置了指令数或者上下文限制，解释器循环只检查这个字段
+	ctx      context.Context // 执行上下文
+	ctxErr   error           // 上下文被取消或者超时的原因
+	maxInsts int64           // 最多执行的指令数，0表示不限制
+	nInsts   int64           // 已经执行的指令数
+	maxDepth int             // 最大调用深度
+}
+
+func newExecLimit() *execLimit {
+	return &execLimit{maxDepth: LUAI_MAXCALLS}
+}
+
+func (self *execLimit) update() {
+	self.enabled = self.ctx != nil || self.maxInsts > 0
+}
+
+// 设置执行上下文，nil表示不限制
+func (self *luaState) SetContext(ctx context.Context) {
+	self.limit.ctx = ctx
+	self.limit.ctxErr = nil
+	self.limit.update()
+}
+
+// 设置最多执行的指令数，同时把计数清零，n<=0表示不限制
+func (self *luaState) SetInstructionLimit(n int64) {
+	if n < 0 {
+		n = 0
+	}
+	self.limit.maxInsts = n
+	self.limit.nInsts = 0
+	self.limit.update()
+}
+
+// 设置最大调用深度，n<=0表示使用默认值
+func (self *luaState) SetCallDepthLimit(n int) {
+	if n <= 0 {
+		n = LUAI_MAXCALLS
+	}
+	self.limit.maxDepth = n
+}
+
+// 每条指令执行之前调用，检查指令数和上下文
+func (self *luaState) checkLimits() {
+	l := self.limit
+	l.nInsts++
+	if l.maxInsts > 0 && l.nInsts > l.maxInsts {
+		self.limitError("instruction limit exceeded")
+	}
+	if l.ctx != nil {
+		if l.ctxErr == nil && l.nInsts%LUAI_CTXCHECK == 0 {
+			l.ctxErr = l.ctx.Err()
+		}
+		if l.ctxErr != nil {
+			self.limitError(l.ctxErr.Error())
+		}
+	}
+}
+
+// 抛出LUA_ERRLIMIT错误
+func (self *luaState) limitError(msg string) {
+	panic(self.newLuaError(LUA_ERRLIMIT, stringValue(self.where(self.stack)+msg)))
+}
@@ -0,0 +1,297 @@
+package state
+
+import (
+	"math"
+	"unsafe"
+
+	. "go/ch21/src/luago/api"
+	"go/ch21/src/luago/binchunk"
+	"go/ch21/src/luago/vm"
+)
+
+// 内存统计
+// Go不会告诉我们某个Lua状态机占用了多少内存，所以这里只做估算：
+// 创建表、字符串、闭包和调用帧，以及表变大的时候，把估算的字节数加到totalBytes上。
+// 对象变成垃圾时并不减少totalBytes，而是在它超过阈值时从根对象出发统计一遍
+// 活着的对象的大小(census)，用统计结果替换totalBytes，就像Lua的垃圾回收一样。
+// 设置了内存上限时，统计之后仍然超出上限就抛出LUA_ERRMEM错误
+
+/* approximate sizes of objects (in bytes) */
+const (
+	sizeValue    = 32  // 一个Lua值(luaValue)
+	sizeNode     = 72  // 哈希表里的一个条目
+	sizeString   = 24  // 字符串的头部
+	sizeTable    = 88  // luaTable
+	sizeClosure  = 48  // closure
+	sizeUpvalue  = 24  // upvalue
+	sizeUserdata = 48  // userdata，不包括宿主对象
+	sizeThread   = 200 // luaState
+	sizeStack    = 200 // luaStack
+	sizeProto    = 160 // Prototype
+)
+
+/* minimum threshold for a census */
+const LUAI_GCMINTHRESHOLD = 4 << 20
+
+// 内存不足
+func (self *luaState) memError() {
+	panic(self.newLuaError(LUA_ERRMEM, stringValue("not enough memory")))
+}
+
+// 记录新分配的n个字节，超过阈值时统计活着的对象
+func (self *luaState) allocate(n int) {
+	g := self.gc
+	g.totalBytes += int64(n)
+	if g.totalBytes > g.threshold {
+		self.checkMemory()
+	}
+}
+
+// 记录释放的n个字节，只用于确定已经不再使用的调用帧
+func (self *luaState) free(n int) {
+	self.gc.totalBytes -= int64(n)
+}
+
+// lua-5.3.4/src/lgc.c#luaC_step()
+func (self *luaState) checkMemory() {
+	g := self.gc
+	overLimit := g.memLimit > 0 && g.totalBytes > g.memLimit
+	if g.running || overLimit { // 超出上限时即使停止了垃圾回收也要统计(emergency)
+		self.census()
+	}
+	if g.memLimit > 0 && g.totalBytes > g.memLimit {
+		self.memError()
+	}
+}
+
+// 根据上一次统计的结果设置下一次统计的阈值
+// lua-5.3.4/src/lgc.c#setpause()
+func (self *gcState) setThreshold() {
+	threshold := int64(math.MaxInt64)
+	if self.running {
+		estimate := self.estimate
+		if estimate < LUAI_GCMINTHRESHOLD {
+			estimate = LUAI_GCMINTHRESHOLD
+		}
+		threshold = estimate / 100 * int64(self.pause)
+	}
+	if self.memLimit > 0 && self.memLimit < threshold {
+		threshold = self.memLimit
+	}
+	self.threshold = threshold
+}
+
+// 限制估算的内存使用量，n<=0表示不限制
+func (self *luaState) SetMemoryLimit(n int64) {
+	if n < 0 {
+		n = 0
+	}
+	self.gc.memLimit = n
+	self.gc.setThreshold()
+}
+
+// 估算的内存使用量，包括还没有统计出来的垃圾
+func (self *luaState) MemoryInUse() int64 {
+	return self.gc.totalBytes
+}
+
+// 检查还能不能再分配n个字节，Go函数在构造很大的对象之前可以先调用它
+func (self *luaState) CheckMemory(n int) {
+	g := self.gc
+	if g.memLimit > 0 && g.totalBytes+int64(n) > g.memLimit {
+		self.census()
+		if g.totalBytes+int64(n) > g.memLimit {
+			self.memError()
+		}
+	}
+}
+
+// 从注册表和当前线程出发，统计所有活着的对象的大小
+// lua-5.3.4/src/lgc.c#propagateall()
+func (self *luaState) census() {
+	g := self.gc
+	g.epoch++
+	c := &memCensus{epoch: g.epoch, seen: map[interface{}]bool{}}
+	c.mark(tableValue(self.registry))
+	c.mark(threadValue(self))
+	g.mu.Lock()
+	for _, val := range g.tobefnz { // 等待调用__gc的对象也还活着
+		c.mark(val)
+	}
+	g.mu.Unlock()
+	for len(c.gray) > 0 {
+		val := c.gray[len(c.gray)-1]
+		c.gray = c.gray[:len(c.gray)-1]
+		c.propagate(val)
+	}
+	g.totalBytes = c.total
+	g.estimate = c.total
+	g.setThreshold()
+}
+
+type memCensus struct {
+	epoch uint32
+	seen  map[interface{}]bool // 已经计入的字符串、upvalue和函数原型，长字符串用longString作为键
+	gray  []luaValue           // 已经计入大小、还没有遍历引用的对象
+	total int64
+}
+
+// 把对象本身的大小计入总数，可回收对象放入gray等待遍历
+// lua-5.3.4/src/lgc.c#reallymarkobject()
+func (self *memCensus) mark(val luaValue) {
+	switch x := val.p.(type) {
+	case string:
+		// Lua只把短字符串放在字符串表里，相同的短字符串只计算一次；
+		// 长字符串每次创建都是一个新对象，同一个长字符串被多处引用时才只计算一次
+		var key interface{} = x
+		if len(x) > binchunk.LUAI_MAXSHORTLEN {
+			key = longString{unsafe.StringData(x), len(x)}
+		}
+		if !self.seen[key] {
+			self.seen[key] = true
+			self.total += int64(sizeString + len(x))
+		}
+	case collectable:
+		if obj := x.object(); obj.marked != self.epoch {
+			obj.marked = self.epoch
+			self.gray = append(self.gray, val)
+		}
+	}
+}
+
+// 长字符串的身份是它的内容所在的内存
+type longString struct {
+	data *byte
+	n    int
+}
+
+// 遍历对象引用的其他对象
+// lua-5.3.4/src/lgc.c#propagatemark()
+func (self *memCensus) propagate(val luaValue) {
+	switch x := val.p.(type) {
+	case *luaTable:
+		self.total += int64(tableSize(x))
+		if x.metatable != nil {
+			self.mark(tableValue(x.metatable))
+		}
+		if x.isWeak() {
+			if !x.weakKeys { // 弱键表的值在遍历键对象时计入
+				x.forEach(func(k, v luaValue) { self.mark(k) })
+			}
+			break
+		}
+		for _, v := range x.arr {
+			self.mark(v)
+		}
+		for k, v := range x.strs {
+			self.mark(stringValue(k))
+			self.mark(v)
+		}
+		for k, v := range x._map {
+			self.mark(k)
+			self.mark(v)
+		}
+	case *closure:
+		self.total += int64(sizeClosure + len(x.upvals)*8)
+		if x.proto != nil {
+			self.markProto(x.proto)
+		}
+		for _, uv := range x.upvals {
+			if uv != nil && !self.seen[uv] {
+				self.seen[uv] = true
+				self.total += sizeUpvalue
+				self.mark(*uv.val)
+			}
+		}
+	case *userdata:
+		self.total += sizeUserdata
+		if x.metatable != nil {
+			self.mark(tableValue(x.metatable))
+		}
+		self.mark(x.uservalue)
+	case *luaState:
+		self.total += int64(sizeThread + len(x.vals)*sizeValue)
+		self.mark(x.coErr)
+		// 每个调用帧用过的位置在它的函数和被调帧的函数之间，包括可变参数和挂起时隐藏的值
+		end := x.stack.base + x.stack.top
+		for stack := x.stack; stack != nil; stack = stack.prev {
+			self.total += sizeStack
+			if stack.closure != nil {
+				self.mark(closureValue(stack.closure))
+			}
+			self.mark(stack.errFunc)
+			if stack != x.stack {
+				end = stack.liveTop(end)
+			}
+			for _, v := range x.vals[stack.fn+1 : end] {
+				self.mark(v)
+			}
+			end = stack.fn
+		}
+	}
+	// 弱键表的值保存在键对象里
+	for _, v := range val.p.(collectable).object().ephemerons {
+		self.mark(v)
+	}
+}
+
+// 调用帧里还活着的值的上限，end是被调帧的函数所在的位置
+// 执行调用指令的Lua函数只有被调函数下面的寄存器还活着，参数已经复制给了被调帧，
+// 更高的寄存器里是用过的临时值，就像Lua只标记到栈顶一样
+func (self *luaStack) liveTop(end int) int {
+	if !self.isLua() || self.callStatus&CIST_HOOKED != 0 || self.pc == 0 {
+		return end
+	}
+	i := vm.Instruction(self.closure.proto.Code[self.pc-1])
+	a, _, _ := i.ABC()
+	switch i.Opcode() {
+	case vm.OP_CALL:
+		return self.base + a
+	case vm.OP_TFORCALL:
+		return self.base + a + 3
+	}
+	return end
+}
+
+// 函数原型和它的子函数原型
+func (self *memCensus) markProto(p *binchunk.Prototype) {
+	if self.seen[p] {
+		return
+	}
+	self.seen[p] = true
+	self.total += int64(protoSize(p))
+	for _, k := range p.Constants {
+		self.mark(valueOf(k))
+	}
+	for _, sub := range p.Protos {
+		self.markProto(sub)
+	}
+}
+
+// 表的大小，数组部分按容量计算
+func tableSize(t *luaTable) int {
+	return sizeTable + cap(t.arr)*sizeValue + (len(t.strs)+len(t._map))*sizeNode
+}
+
+// 函数原型的大小，不包括常量表里的字符串和子函数原型
+// lua-5.3.4/src/lfunc.c#luaF_freeproto()
+func protoSize(p *binchunk.Prototype) int {
+	return sizeProto + len(p.Source) +
+		len(p.Code)*4 + len(p.LineInfo)*4 +
+		len(p.Constants)*sizeValue + len(p.Protos)*8 +
+		len(p.Upvalues)*16 + len(p.LocVars)*16
+}
+
+// 函数原型和它所有的子函数原型的大小，加载chunk时使用
+func protoTreeSize(p *binchunk.Prototype) int {
+	size := protoSize(p)
+	for _, k := range p.Constants {
+		if s, ok := k.(string); ok {
+			size += sizeString + len(s)
+		}
+	}
+	for _, sub := range p.Protos {
+		size += protoTreeSize(sub)
+	}
+	return size
+}
@@ -0,0 +1,94 @@
+package state
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	. "go/ch21/src/luago/api"
+)
+
+// 创建Lua状态机时的选项，零值和New()+OpenLibs()一样：开启所有标准库，使用操作系统的文件系统
+type Options struct {
+	// 要开启的标准库，基础库的名字是"_G"，nil表示开启所有标准库
+	Libs []string
+	// 开启标准库之后删除的函数，格式是"库名.函数名"，基础库的函数可以只写函数名，如"os.exit"、"dofile"
+	Exclude []string
+	// 是否只允许加载文本chunk，为true时load、loadfile和require都不能加载二进制chunk
+	TextOnly bool
+	// 虚拟文件系统，require、loadfile和dofile从这里读取文件，nil表示使用操作系统的文件系统
+	// io库不受它的影响，不应该让不可信的脚本使用io库
+	FS fs.FS
+}
+
+// 运行不可信的脚本时使用的选项：不开启io和debug库，删除可以退出进程、执行命令、修改文件和读取环境变量的函数，
+// 只允许加载文本chunk。fsys是require使用的虚拟文件系统，为nil时只能require预加载的模块，
+// 同时删除loadfile和dofile
+func SandboxOptions(fsys fs.FS) Options {
+	opts := Options{
+		Libs: []string{"_G", "package", "coroutine", "table", "os", "string", "math", "utf8"},
+		Exclude: []string{
+			"os.exit", "os.execute", "os.remove", "os.rename", "os.tmpname", "os.getenv",
+		},
+		TextOnly: true,
+		FS:       fsys,
+	}
+	if fsys == nil {
+		opts.Exclude = append(opts.Exclude, "dofile", "loadfile")
+		opts.FS = emptyFS{}
+	}
+	return opts
+}
+
+// 不包含任何文件的文件系统
+type emptyFS struct{}
+
+func (emptyFS) Open(name string) (fs.File, error) {
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// 根据选项创建LuaState实例并开启标准库
+func NewWithOptions(opts Options) LuaState {
+	ls := New().(*luaState)
+	ls.opts = &opts
+	if opts.Libs == nil {
+		ls.OpenLibs()
+	} else {
+		for _, name := range opts.Libs {
+			if !ls.OpenLib(name) {
+				panic(fmt.Sprintf("unknown library '%s'", name))
+			}
+		}
+	}
+	for _, name := range opts.Exclude {
+		ls.exclude(name)
+	}
+	return ls
+}
+
+// 删除已经开启的标准库里的函数
+func (self *luaState) exclude(name string) {
+	libName, funcName := "_G", name
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		libName, funcName = name[:i], name[i+1:]
+	}
+	self.GetSubTable(LUA_REGISTRYINDEX, "_LOADED")
+	if self.GetField(-1, libName) == LUA_TTABLE { /* library is open? */
+		self.PushNil()
+		self.SetField(-2, funcName)
+	}
+	self.Pop(2)
+}
+
+// 打开文件，创建状态机时指定了虚拟文件系统的话就在虚拟文件系统里打开
+func (self *luaState) OpenFile(filename string) (fs.File, error) {
+	if fsys := self.opts.FS; fsys != nil {
+		// 虚拟文件系统使用不以'/'开头的斜杠分隔的路径，"./a.lua"和"/a.lua"都是"a.lua"
+		name := strings.TrimPrefix(path.Clean(filepath.ToSlash(filename)), "/")
+		return fsys.Open(name)
+	}
+	return os.Open(filename)
+}
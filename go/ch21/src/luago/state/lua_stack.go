@@ -2,33 +2,53 @@ package state
 
 import "go/ch21/src/luago/api"
 
-// lua栈
+// lua栈(调用帧)
+// 线程的所有调用帧共用一个值栈(luaState.vals)，每个调用帧的栈只是其中的一段：
+// 调用者把函数和参数压入自己的栈顶，参数原地成为被调函数的栈底，返回值也原地复制回调用者的栈顶，
+// 所以调用函数不需要为栈分配内存
 type luaStack struct {
-	slots   []luaValue // 栈的数据
+	slots   []luaValue // 栈的数据，是值栈从base开始的一段
+	base    int        // slots[0]在值栈中的位置
+	fn      int        // 被调函数在值栈中的位置
 	top     int        // 栈顶
 	prev    *luaStack
+	next    *luaStack  // 弹出后留下来重新使用的调用帧
 	closure *closure   // 当前栈对应的闭包
-	varargs []luaValue // 可变参数
+	varargs []luaValue // 可变参数，在值栈中紧挨着base的下面
 	pc      int
 	state   *luaState
 	openuvs map[int]*upvalue // 存放所有打开的upvalue
+	// 协程挂起和恢复需要的信息
+	nResults   int           // 调用者期望的返回值个数
+	k          api.KFunction // Go函数的延续函数
+	ctx        api.KContext  // 延续函数的上下文
+	callStatus int           // 调用状态
+	errFunc    luaValue      // 可挂起的pcall的消息处理函数
+	oldTop     int           // 可挂起的pcall的被调函数所在的位置
+	hidden     int           // 挂起时隐藏起来的栈底的值的个数，只有挂起传出的值留在栈里
 }
 
-// 创建指定容量的栈
-func newLuaStack(size int, state *luaState) *luaStack {
-	return &luaStack{
-		slots: make([]luaValue, size),
-		top:   0,
-		state: state,
-	}
+/* bits in callStatus */
+const (
+	CIST_YPCALL = 1 << iota /* call is a yieldable protected call */
+	CIST_FIN                /* the function being called is a finalizer */
+	CIST_HOOKED             /* call is running a debug hook */
+	CIST_TAIL               /* call was tail called */
+	CIST_LEQ                /* using __lt for __le */
+	CIST_VMCALL             // 调用指令调用的Go函数，挂起时可以直接返回到解释器循环
+)
+
+// 是否是Lua函数的调用帧
+func (self *luaStack) isLua() bool {
+	return self.closure != nil && self.closure.proto != nil
 }
 
 // 检查空闲空间是否还可以容纳至少n个值
 func (self *luaStack) check(n int) {
-	free := len(self.slots) - self.top
 	// 如果空闲空间不足，则扩容
-	for i := free; i < n; i++ {
-		self.slots = append(self.slots, nil)
+	if size := self.top + n; size > len(self.slots) {
+		self.state.growStack(self.base + size)
+		self.slots = self.state.vals[self.base : self.base+size]
 	}
 }
 
@@ -36,7 +56,7 @@ func (self *luaStack) check(n int) {
 func (self *luaStack) push(val luaValue) {
 	// 如果溢出。终止
 	if self.top == len(self.slots) {
-		panic("stack overflow!")
+		self.state.runError("stack overflow")
 	}
 	self.slots[self.top] = val
 	self.top++
@@ -50,7 +70,7 @@ func (self *luaStack) pop() luaValue {
 	}
 	self.top--
 	val := self.slots[self.top]
-	self.slots[self.top] = nil // GC
+	self.slots[self.top] = luaValue{} // GC
 	return val
 }
 
@@ -85,18 +105,18 @@ func (self *luaStack) get(idx int) luaValue {
 		uvidx := api.LUA_REGISTRYINDEX - idx - 1
 		c := self.closure
 		if c == nil || uvidx >= len(c.upvals) {
-			return nil
+			return luaValue{}
 		}
 		return *(c.upvals[uvidx].val)
 	}
 	if idx == api.LUA_REGISTRYINDEX {
-		return self.state.registry
+		return tableValue(self.state.registry)
 	}
 	absIds := self.absIndex(idx)
 	if absIds > 0 && absIds <= self.top {
 		return self.slots[absIds-1]
 	}
-	return nil
+	return luaValue{}
 }
 
 // 根据索引设置栈里的值
@@ -112,7 +132,7 @@ func (self *luaStack) set(idx int, val luaValue) {
 	}
 	// 判断是否是注册表
 	if idx == api.LUA_REGISTRYINDEX {
-		self.state.registry = val.(*luaTable)
+		self.state.registry = val.p.(*luaTable)
 		return
 	}
 	absIds := self.absIndex(idx)
@@ -133,3 +153,34 @@ func (self *luaStack) reverse(from, to int) {
 		to--
 	}
 }
+
+// 挂起时隐藏栈底的n个值，只留下传给Resume的值
+func (self *luaStack) hide(n int) {
+	self.hidden = n
+	self.base += n
+	self.slots = self.slots[n:]
+	self.top -= n
+}
+
+// 恢复运行时把隐藏的值放回栈底
+func (self *luaStack) unhide() {
+	n := self.hidden
+	self.base -= n
+	self.slots = self.state.vals[self.base : self.base+n+len(self.slots)]
+	self.top += n
+	self.hidden = 0
+}
+
+// 关闭在level处及其上面的寄存器中打开的upvalue，把变量的值复制出来
+// lua-5.3.4/src/lfunc.c#luaF_close()
+func (self *luaStack) closeUpvalues(level int) {
+	for i, openuv := range self.openuvs {
+		if i >= level {
+			// 关闭Upvalue
+			val := *openuv.val
+			openuv.val = &val
+			// 从openuvs表中删除该Upvalue
+			delete(self.openuvs, i)
+		}
+	}
+}
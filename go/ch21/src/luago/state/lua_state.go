@@ -3,40 +3,159 @@ package state
 import . "go/ch21/src/luago/api"
 
 type luaState struct {
-	registry *luaTable // 注册表
+	gcObject
+	gc       *gcState   // 垃圾回收器的状态，所有线程共享
+	limit    *execLimit // 执行限制，所有线程共享
+	opts     *Options   // 创建状态机时的选项，所有线程共享
+	registry *luaTable  // 注册表
+	vals     []luaValue // 值栈，所有调用帧的栈都是它的一段
 	stack    *luaStack
-	coCaller *luaState // 调用协程的协程
-	coStatus int       // 协程状态
-	coChan   chan int  // 协程通道
+	coStatus int      // 协程状态
+	coErr    luaValue // 协程因出错而死亡时的错误对象
+	nny      int      // 不可挂起的调用的层数，为0时才可以挂起
+	nCalls   int      // 当前线程的调用帧数
+	callBase int      // 恢复协程时外面已有的调用深度
+	nCcalls  int      // 嵌套的Resume的层数
+
+	// 调试钩子
+	hook          LuaHook // 钩子函数，每个线程单独设置
+	hookMask      int     // 事件掩码
+	baseHookCount int     // 计数钩子的间隔
+	hookCount     int     // 距离下一次计数钩子还要执行的指令数
+	allowHook     bool    // 钩子执行期间不再触发钩子
+	oldPC         int     // 上一次跟踪的指令位置，用来判断是否进入了新的一行
 }
 
 // 创建LuaState实例
 func New() LuaState {
-	ls := &luaState{}
+	ls := &luaState{nny: 1, gc: newGCState(), limit: newExecLimit(), opts: &Options{}, allowHook: true} // 主线程不可挂起
 
 	registry := newLuaTable(8, 0)
-	registry.put(LUA_RIDX_MAINTHREAD, ls)
-	registry.put(LUA_RIDX_GLOBALS, newLuaTable(0, 20)) // 全局环境
+	registry.put(intValue(LUA_RIDX_MAINTHREAD), threadValue(ls))
+	registry.put(intValue(LUA_RIDX_GLOBALS), tableValue(newLuaTable(0, 20))) // 全局环境
 
 	ls.registry = registry
-	ls.pushLuaStack(newLuaStack(LUA_MINSTACK, ls)) // 创建Lua栈
+	ls.initStack() // 创建Lua栈
 	return ls
 }
 
+/* size of the value array of a new thread */
+const BASIC_STACK_SIZE = 2 * LUA_MINSTACK
+
+// 创建值栈和最底层的调用帧，最底层的调用帧不属于任何函数
+// lua-5.3.4/src/lstate.c#stack_init()
+func (self *luaState) initStack() {
+	self.vals = make([]luaValue, BASIC_STACK_SIZE)
+	self.pushLuaStack(&luaStack{slots: self.vals[:LUA_MINSTACK], fn: -1, state: self})
+	self.allocate(BASIC_STACK_SIZE * sizeValue)
+}
+
+// 取得一个调用帧，上次弹出的调用帧会被重新使用
+// lua-5.3.4/src/lstate.c#luaE_extendCI()
+func (self *luaState) newFrame() *luaStack {
+	frame := self.stack.next
+	if frame == nil {
+		frame = &luaStack{state: self}
+		self.stack.next = frame
+	}
+	return frame
+}
+
 // 向头部添加一个调用帧
 func (self *luaState) pushLuaStack(stack *luaStack) {
+	if self.callBase+self.nCalls >= self.limit.maxDepth {
+		self.runError("stack overflow")
+	}
+	self.allocate(sizeStack)
 	stack.prev = self.stack
 	self.stack = stack
+	self.nCalls++
 }
 
-// 从头部移除一个调用帧
+// 从头部移除一个调用帧，关闭它打开的upvalue
+// 调用帧清空后留下来重新使用，它在值栈中用过的位置由调用者清除
 func (self *luaState) popLuaStack() {
 	stack := self.stack
+	if len(stack.openuvs) > 0 {
+		stack.closeUpvalues(0)
+	}
 	self.stack = stack.prev
-	stack.prev = nil
+	self.nCalls--
+	self.free(sizeStack)
+	*stack = luaStack{state: self, next: stack.next} // GC
+}
+
+// 弹出frame上面的调用帧，把frame的栈顶设置为top，清除值栈中上面的值
+func (self *luaState) unwind(frame *luaStack, top int) {
+	end := frame.base + len(frame.slots)
+	for self.stack != frame {
+		if e := self.stack.base + len(self.stack.slots); e > end {
+			end = e
+		}
+		self.popLuaStack()
+	}
+	vals := self.vals
+	for i := frame.base + top; i < end; i++ {
+		vals[i] = luaValue{} // GC
+	}
+	frame.top = top
+}
+
+// 保证值栈可以容纳end个值，不够时扩容
+// lua-5.3.4/src/ldo.c#luaD_growstack()
+func (self *luaState) growStack(end int) {
+	if end > len(self.vals) {
+		size := 2 * len(self.vals)
+		if size < end {
+			size = end
+		}
+		self.reallocStack(size)
+	}
+}
+
+// 把值栈换成大小为size的新数组，让调用帧的栈、可变参数和打开的upvalue都指向新数组
+// lua-5.3.4/src/ldo.c#luaD_reallocstack()
+func (self *luaState) reallocStack(size int) {
+	if delta := size - len(self.vals); delta > 0 {
+		self.allocate(delta * sizeValue)
+	} else {
+		self.free(-delta * sizeValue)
+	}
+	vals := make([]luaValue, size)
+	copy(vals, self.vals)
+	self.vals = vals
+	/* correct stack */
+	for frame := self.stack; frame != nil; frame = frame.prev {
+		frame.slots = vals[frame.base : frame.base+len(frame.slots)]
+		if n := len(frame.varargs); n > 0 {
+			frame.varargs = vals[frame.base-n : frame.base]
+		}
+		for i, openuv := range frame.openuvs {
+			openuv.val = &vals[frame.base+i]
+		}
+	}
+}
+
+// 深度递归结束以后，值栈和留下来的调用帧可能比需要的多很多，完整的垃圾回收时释放它们
+// lua-5.3.4/src/ldo.c#luaD_shrinkstack()
+func (self *luaState) shrinkStack() {
+	inuse := 0
+	for frame := self.stack; frame != nil; frame = frame.prev {
+		if end := frame.base + len(frame.slots); end > inuse {
+			inuse = end
+		}
+	}
+	goodSize := inuse + inuse/8 + 2*LUA_MINSTACK
+	if goodSize < BASIC_STACK_SIZE {
+		goodSize = BASIC_STACK_SIZE
+	}
+	if len(self.vals) > 2*goodSize {
+		self.reallocStack(goodSize)
+	}
+	self.stack.next = nil /* free unused CallInfo's */
 }
 
 // 判断是否是主线程
 func (self *luaState) isMainThread() bool {
-	return self.registry.get(LUA_RIDX_MAINTHREAD) == self
+	return self.registry.get(intValue(LUA_RIDX_MAINTHREAD)).p == self
 }
@@ -1,38 +1,70 @@
 package state
 
 import (
+	"go/ch21/src/luago/api"
 	"go/ch21/src/luago/number"
 	"math"
+	"weak"
 )
 
+// 表分成数组部分和哈希部分，和Lua一样：
+//   - 键在[1, len(arr)]范围内的整数总是放在数组部分，数组中间可以有nil
+//   - 其他键放在哈希部分，哈希部分的条目数超过hsize时重新计算两部分的大小(rehash)，
+//     数组部分取使用率超过一半的最大的2的幂，放不进数组的键留在哈希部分
 type luaTable struct {
-	metatable *luaTable             // 元表
-	arr       []luaValue            // 数组
-	_map      map[luaValue]luaValue // map
-	keys      map[luaValue]luaValue // key集合
-	changed   bool                  // 是否改变
+	gcObject
+	metatable  *luaTable             // 元表
+	arr        []luaValue            // 数组部分，长度就是数组部分的大小
+	strs       map[string]luaValue   // 字符串键，单独存放以加快字段访问
+	_map       map[luaValue]luaValue // 其他的键
+	hsize      int                   // 哈希部分(strs和_map)的容量，总是0或者2的幂
+	keys       map[luaValue]luaValue // key集合
+	changed    bool                  // 是否改变
+	weakKeys   bool                  // 是否是弱键表，__mode包含'k'
+	weakValues bool                  // 是否是弱值表，__mode包含'v'
+	weakSelf   weak.Pointer[luaTable]
 }
 
+/*
+** MAXABITS is the largest integer such that MAXASIZE fits in an
+** unsigned int.
+ */
+const MAXABITS = 31
+
+/*
+** MAXASIZE is the maximum size of the array part. It is the largest
+** power of 2 such that its size fits in an unsigned int.
+ */
+const MAXASIZE = 1 << MAXABITS
+
 // 创建一个空的表，接受两个参数来预估表的用途和容量。
+// lua-5.3.4/src/ltable.c#luaH_resize()
 func newLuaTable(nArr, nRec int) *luaTable {
 	t := &luaTable{}
 	// 数组
 	if nArr > 0 {
-		t.arr = make([]luaValue, 0, nArr)
+		t.arr = make([]luaValue, nArr)
 	}
-	// map
+	// map，构造器里的记录字段通常都是字符串键
 	if nRec > 0 {
-		t._map = make(map[luaValue]luaValue, nRec)
+		t.strs = make(map[string]luaValue, nRec)
+		t.hsize = 1 << ceilLog2(nRec)
 	}
 	return t
 }
 
 // 获取表中指定键的值
 func (self *luaTable) get(key luaValue) luaValue {
+	if self.isWeak() {
+		return self.getWeak(key)
+	}
+	if key.tt == api.LUA_TSTRING {
+		return self.strs[key.p.(string)]
+	}
 	// 如果能转成整数(或者本身是整数) 并且索引在数组范围内 则从数组中取值
 	key = _floatToInteger(key)
-	if idx, ok := key.(int64); ok {
-		if idx >= 1 && idx <= int64(len(self.arr)) {
+	if key.tt == LUA_TNUMINT {
+		if idx := key.integer(); idx >= 1 && idx <= int64(len(self.arr)) {
 			return self.arr[idx-1]
 		}
 	}
@@ -41,9 +73,9 @@ func (self *luaTable) get(key luaValue) luaValue {
 }
 
 func _floatToInteger(key luaValue) luaValue {
-	if i, ok := key.(float64); ok {
-		if i, ok := number.FloatToInteger(i); ok {
-			return i
+	if key.tt == LUA_TNUMFLT {
+		if i, ok := number.FloatToInteger(key.float()); ok {
+			return intValue(i)
 		}
 	}
 	return key
@@ -51,99 +83,277 @@ func _floatToInteger(key luaValue) luaValue {
 
 func (self *luaTable) put(key, val luaValue) {
 	// 先判断是否是nil或nan
-	if key == nil {
+	if key.isNil() {
 		panic("table index is nil!")
 	}
-	if f, ok := key.(float64); ok && math.IsNaN(f) {
+	if key.tt == LUA_TNUMFLT && math.IsNaN(key.float()) {
 		panic("table index is NaN!")
 	}
 	key = _floatToInteger(key)
-	if idx, ok := key.(int64); ok {
-		arrLne := int64(len(self.arr))
-		// 如果索引在数组范围内 则放入数组
-		if idx >= 1 && idx <= arrLne {
+	if self.isWeak() {
+		self.putWeak(key, val)
+		return
+	}
+	// 如果索引在数组范围内 则放入数组
+	if key.tt == LUA_TNUMINT {
+		if idx := key.integer(); idx >= 1 && idx <= int64(len(self.arr)) {
 			self.arr[idx-1] = val
-			// 如果nil在数组的末尾，删除末尾全部的nil
-			if idx == arrLne && val == nil {
-				self._shrinkArray()
-			}
 			return
 		}
-		// 如果索引在数组范围外 则放入map
-		if idx == arrLne+1 {
+	}
+	// 如果值是nil，删除，节约空间
+	if val.isNil() {
+		if key.tt == api.LUA_TSTRING {
+			delete(self.strs, key.p.(string))
+		} else {
 			delete(self._map, key)
-			if val != nil {
-				self.arr = append(self.arr, val)
-				// 动态扩展数组
-				self._expandArray()
-			}
-			return
 		}
+		return
 	}
-	// 如果值不是nil，写入，否则删除，节约空间
-	if val != nil {
+	self._putHash(key, val)
+	// 新的键让哈希部分超出了容量，重新计算数组部分和哈希部分的大小
+	// lua-5.3.4/src/ltable.c#luaH_newkey()
+	if len(self.strs)+len(self._map) > self.hsize {
+		self.rehash()
+	}
+}
+
+// 把条目放入哈希部分，值不能是nil
+func (self *luaTable) _putHash(key, val luaValue) {
+	if key.tt == api.LUA_TSTRING {
+		if self.strs == nil {
+			self.strs = make(map[string]luaValue, 8)
+		}
+		self.strs[key.p.(string)] = val
+	} else {
 		if self._map == nil {
 			self._map = make(map[luaValue]luaValue, 8)
 		}
 		self._map[key] = val
-	} else {
-		delete(self._map, key)
 	}
 }
 
-// 删除末尾的nil
-func (self *luaTable) _shrinkArray() {
-	for i := len(self.arr) - 1; i >= 0; i-- {
-		if self.arr[i] != nil {
-			break
+// 统计表里的整数键，重新计算数组部分和哈希部分的大小，新的键已经放在哈希部分里了
+// lua-5.3.4/src/ltable.c#rehash()
+func (self *luaTable) rehash() {
+	var nums [MAXABITS + 1]int    /* nums[i] = number of keys 'k' where 2^(i - 1) < k <= 2^i */
+	na := self.numUseArray(&nums) /* count keys in array part */
+	totalUse := na                /* all those keys are integer keys */
+	na += self.numUseHash(&nums)  /* count keys in hash part */
+	totalUse += len(self.strs) + len(self._map)
+	/* compute new size for array part */
+	asize, na := computeSizes(&nums, na)
+	/* resize the table to new computed sizes */
+	self.resize(asize, totalUse-na)
+}
+
+// 统计数组部分每个区间(2^(lg-1), 2^lg]里非nil的元素个数
+// lua-5.3.4/src/ltable.c#numusearray()
+func (self *luaTable) numUseArray(nums *[MAXABITS + 1]int) int {
+	ause := 0 /* summation of 'nums' */
+	i := 1    /* count to traverse all array keys */
+	/* traverse each slice */
+	for lg, ttlg := 0, 1; lg <= MAXABITS; lg, ttlg = lg+1, ttlg*2 {
+		lc := 0 /* counter */
+		lim := ttlg
+		if lim > len(self.arr) {
+			lim = len(self.arr) /* adjust upper limit */
+			if i > lim {
+				break /* no more elements to count */
+			}
 		}
-		self.arr = self.arr[0:i]
+		/* count elements in range (2^(lg - 1), 2^lg] */
+		for ; i <= lim; i++ {
+			if !self.arr[i-1].isNil() {
+				lc++
+			}
+		}
+		nums[lg] += lc
+		ause += lc
 	}
+	return ause
 }
 
-// 动态扩展数组
-func (self *luaTable) _expandArray() {
-	for idx := int64(len(self.arr)) + 1; true; idx++ {
-		if val, found := self._map[idx]; found {
-			self.arr = append(self.arr, val)
-			delete(self._map, idx)
-		} else {
-			break
+// 统计哈希部分中可以放进数组部分的整数键，字符串键不用看
+// lua-5.3.4/src/ltable.c#numusehash()
+func (self *luaTable) numUseHash(nums *[MAXABITS + 1]int) int {
+	ause := 0 /* elements added to 'nums' (can go to array part) */
+	for k := range self._map {
+		if k.tt == LUA_TNUMINT {
+			ause += countInt(k.integer(), nums)
 		}
 	}
+	return ause
 }
 
-// 长度
+// lua-5.3.4/src/ltable.c#countint()
+func countInt(key int64, nums *[MAXABITS + 1]int) int {
+	if key >= 1 && key <= MAXASIZE { /* is 'key' an appropriate array index? */
+		nums[ceilLog2(int(key))]++ /* count as such */
+		return 1
+	}
+	return 0
+}
+
+/*
+** Compute the optimal size for the array part of table 't'. 'nums' is a
+** "count array" where 'nums[i]' is the number of integers in the table
+** between 2^(i - 1) + 1 and 2^i. 'pna' enters with the total number of
+** integer keys in the table and leaves with the number of keys that
+** will go to the array part; return the optimal size.
+ */
+// lua-5.3.4/src/ltable.c#computesizes()
+func computeSizes(nums *[MAXABITS + 1]int, pna int) (optimal, na int) {
+	a := 0 /* number of elements smaller than 2^i */
+	/* loop while keys can fill more than half of total size */
+	for i, twotoi := 0, 1; i <= MAXABITS && pna > twotoi/2; i, twotoi = i+1, twotoi*2 {
+		if nums[i] > 0 {
+			a += nums[i]
+			if a > twotoi/2 { /* more than half elements present? */
+				optimal = twotoi /* optimal size (till now) */
+				na = a           /* all elements up to 'optimal' will go to array part */
+			}
+		}
+	}
+	return
+}
+
+// 调整数组部分的大小，多出来的元素移到哈希部分，哈希部分里落在数组范围内的整数键移到数组部分
+// lua-5.3.4/src/ltable.c#luaH_resize()
+func (self *luaTable) resize(nasize, nhsize int) {
+	oldasize := len(self.arr)
+	self.hsize = 0
+	if nhsize > 0 {
+		self.hsize = 1 << ceilLog2(nhsize)
+	}
+	if nasize < oldasize { /* array part must shrink? */
+		/* re-insert vanishing slice */
+		for i := nasize; i < oldasize; i++ {
+			if v := self.arr[i]; !v.isNil() {
+				self._putHash(intValue(int64(i+1)), v)
+			}
+		}
+		self.arr = append([]luaValue(nil), self.arr[:nasize]...)
+	} else if nasize > oldasize { /* array part must grow? */
+		arr := make([]luaValue, nasize)
+		copy(arr, self.arr)
+		self.arr = arr
+		/* re-insert elements from hash part */
+		for k, v := range self._map {
+			if k.tt == LUA_TNUMINT {
+				if idx := k.integer(); idx > int64(oldasize) && idx <= int64(nasize) {
+					arr[idx-1] = v
+					delete(self._map, k)
+				}
+			}
+		}
+	}
+}
+
+// ceil(log2(x))
+// lua-5.3.4/src/lobject.c#luaO_ceillog2()
+func ceilLog2(x int) int {
+	l := 0
+	for x--; x > 0; x >>= 1 {
+		l++
+	}
+	return l
+}
+
+// 长度，返回表的一个边界：t[n]不是nil并且t[n+1]是nil的非负整数n(t[1]是nil时n可以是0)。
+// 数组部分的最后一个元素是nil时，边界一定在数组部分里，否则到哈希部分继续查找
+// lua-5.3.4/src/ltable.c#luaH_getn()
 func (self *luaTable) len() int {
-	return len(self.arr)
+	j := len(self.arr)
+	if j > 0 && self.arr[j-1].isNil() {
+		/* there is a boundary in the array part: (binary) search for it */
+		i := 0
+		for j-i > 1 {
+			m := (i + j) / 2
+			if self.arr[m-1].isNil() {
+				j = m
+			} else {
+				i = m
+			}
+		}
+		return i
+	}
+	/* else must find a boundary in hash part */
+	if len(self._map) == 0 { /* hash part has no integer keys? */
+		return j /* that is easy... */
+	}
+	return int(self.unboundSearch(int64(j)))
+}
+
+// lua-5.3.4/src/ltable.c#unbound_search()
+func (self *luaTable) unboundSearch(j int64) int64 {
+	i := j /* i is zero or a present index */
+	j++
+	/* find 'i' and 'j' such that i is present and j is not */
+	for !self.get(intValue(j)).isNil() {
+		i = j
+		if j > math.MaxInt64/2 { /* overflow? */
+			/* table was built with bad purposes: resort to linear search */
+			i = 1
+			for !self.get(intValue(i)).isNil() {
+				i++
+			}
+			return i - 1
+		}
+		j *= 2
+	}
+	/* now do a binary search between them */
+	for j-i > 1 {
+		m := (i + j) / 2
+		if self.get(intValue(m)).isNil() {
+			j = m
+		} else {
+			i = m
+		}
+	}
+	return i
 }
 
 func (self *luaTable) hasMetafield(fieldName string) bool {
 	return self.metatable != nil &&
-		self.metatable.get(fieldName) != nil
+		!self.metatable.get(stringValue(fieldName)).isNil()
 }
 
 // 根据传入键返回表的下一个键
 func (self *luaTable) nextKey(key luaValue) luaValue {
-	if self.keys == nil || key == nil {
+	if self.keys == nil || key.isNil() {
 		self.initKeys()
 		self.changed = false
 	}
-	return self.keys[key]
+	if self.isWeak() {
+		return self.nextWeakKey(key)
+	}
+	// 遍历时被赋值为nil的字段已经不在表里了，跳过它们
+	next := self.keys[key]
+	for !next.isNil() && self.get(next).isNil() {
+		next = self.keys[next]
+	}
+	return next
 }
 
 func (self *luaTable) initKeys() {
 	// 记录表的键和下一个键的关系
-	self.keys = make(map[luaValue]luaValue, len(self.arr)+len(self._map))
-	var prevKey luaValue = nil
+	self.keys = make(map[luaValue]luaValue, len(self.arr)+len(self.strs)+len(self._map))
+	var prevKey luaValue
 	for i, v := range self.arr { // 数组部分
-		if v != nil {
-			self.keys[prevKey] = int64(i + 1)
-			prevKey = int64(i + 1)
+		if !v.isNil() {
+			self.keys[prevKey] = intValue(int64(i + 1))
+			prevKey = intValue(int64(i + 1))
+		}
+	}
+	for k, v := range self.strs { // 表部分
+		if !v.isNil() {
+			self.keys[prevKey] = stringValue(k)
+			prevKey = stringValue(k)
 		}
 	}
-	for k, v := range self._map { // 表部分
-		if v != nil {
+	for k, v := range self._map {
+		if !v.isNil() {
 			self.keys[prevKey] = k
 			prevKey = k
 		}
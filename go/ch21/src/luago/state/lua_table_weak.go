@@ -0,0 +1,147 @@
+package state
+
+import (
+	"strings"
+	"weak"
+)
+
+// 弱表
+// 弱表不使用数组部分，所有条目都放在map里。弱键表的可回收键、弱值表的可回收值都以弱引用的形式保存；
+// 只有弱键的表是ephemeron表，它的值保存在键对象里，map里只放一个占位符，
+// 这样值只能通过活着的键访问到，值引用了键也不会阻止键被回收
+
+func (self *luaTable) isWeak() bool {
+	return self.weakKeys || self.weakValues
+}
+
+// 根据元表的__mode字段设置表的模式，模式改变时重新放入所有条目
+func (self *luaTable) setMode(mt *luaTable, g *gcState) {
+	weakKeys, weakValues := false, false
+	if mt != nil {
+		if mode, ok := mt.get(stringValue("__mode")).p.(string); ok {
+			weakKeys = strings.IndexByte(mode, 'k') >= 0
+			weakValues = strings.IndexByte(mode, 'v') >= 0
+		}
+	}
+	if weakKeys == self.weakKeys && weakValues == self.weakValues {
+		return
+	}
+
+	var keys, vals []luaValue
+	self.forEach(func(k, v luaValue) {
+		keys = append(keys, k)
+		vals = append(vals, v)
+		if self.weakKeys && !self.weakValues { // 删除保存在键对象里的值
+			if obj, ok := k.p.(collectable); ok {
+				delete(obj.object().ephemerons, self.weakSelf)
+			}
+		}
+	})
+	self.arr, self.strs, self._map, self.keys = nil, nil, nil, nil
+	self.hsize = 0
+	self.weakKeys, self.weakValues = weakKeys, weakValues
+	if self.isWeak() && self.weakSelf == (weak.Pointer[luaTable]{}) {
+		self.weakSelf = weak.Make(self)
+		g.addWeakTable(self)
+	}
+	for i, k := range keys {
+		self.put(k, vals[i])
+	}
+}
+
+// 遍历表中所有还活着的条目
+func (self *luaTable) forEach(f func(k, v luaValue)) {
+	for i, v := range self.arr {
+		if !v.isNil() {
+			f(intValue(int64(i+1)), v)
+		}
+	}
+	for k, v := range self.strs {
+		f(stringValue(k), v)
+	}
+	for k, v := range self._map {
+		if k, v = self.strongEntry(k, v); !k.isNil() && !v.isNil() {
+			f(k, v)
+		}
+	}
+}
+
+// 把map中保存的条目转换成Lua值，键或值已经被回收时返回nil
+func (self *luaTable) strongEntry(k, v luaValue) (luaValue, luaValue) {
+	if k = strongValue(k); k.isNil() {
+		return luaValue{}, luaValue{}
+	}
+	if v.tt == LUA_TEPHEMERON {
+		return k, k.p.(collectable).object().ephemerons[self.weakSelf]
+	}
+	return k, strongValue(v)
+}
+
+func (self *luaTable) getWeak(key luaValue) luaValue {
+	key = _floatToInteger(key)
+	if obj, ok := key.p.(collectable); ok && self.weakKeys {
+		if !self.weakValues { // ephemeron表
+			return obj.object().ephemerons[self.weakSelf]
+		}
+		key = makeWeak(key)
+	}
+	return strongValue(self._map[key])
+}
+
+func (self *luaTable) putWeak(key, val luaValue) {
+	if obj, ok := key.p.(collectable); ok && self.weakKeys {
+		wk := makeWeak(key)
+		if !self.weakValues { // ephemeron表，值由键对象持有
+			o := obj.object()
+			if val.isNil() {
+				delete(o.ephemerons, self.weakSelf)
+				delete(self._map, wk)
+				return
+			}
+			if o.ephemerons == nil {
+				o.ephemerons = make(map[weak.Pointer[luaTable]]luaValue)
+			}
+			o.ephemerons[self.weakSelf] = val
+			val = luaValue{tt: LUA_TEPHEMERON}
+		}
+		key = wk
+	}
+	if val.isNil() {
+		delete(self._map, key)
+		return
+	}
+	if self.weakValues {
+		val = makeWeak(val)
+	}
+	if self._map == nil {
+		self._map = make(map[luaValue]luaValue, 8)
+	}
+	self._map[key] = val
+}
+
+// keys里保存的是map中的键(可能是弱引用)，跳过已经被回收的条目
+func (self *luaTable) nextWeakKey(key luaValue) luaValue {
+	if self.weakKeys {
+		key = makeWeak(key)
+	}
+	for next := self.keys[key]; !next.isNil(); next = self.keys[next] {
+		if k, v := self.strongEntry(next, self._map[next]); !k.isNil() && !v.isNil() {
+			return k
+		}
+	}
+	return luaValue{}
+}
+
+// 删除已经被回收的条目
+// lua-5.3.4/src/lgc.c#clearvalues()
+func (self *luaTable) clearWeak() {
+	if !self.isWeak() {
+		return
+	}
+	// keys不需要重建，正在进行的遍历会跳过被删除的条目
+	for k, v := range self._map {
+		if sk, sv := self.strongEntry(k, v); sk.isNil() || sv.isNil() {
+			delete(self._map, k)
+		}
+	}
+}
@@ -4,54 +4,160 @@ import (
 	"fmt"
 	"go/ch21/src/luago/api"
 	"go/ch21/src/luago/number"
+	"math"
 )
 
-type luaValue interface{}
+// Lua值
+// 类型标签加上64位的数据和一个引用：整数、浮点数(按位保存)和布尔值直接放在n里，
+// 放进寄存器和表里都不需要装箱；字符串、表、闭包、用户数据和线程放在p里。
+// luaValue{}就是nil，两个值可以用==比较(整数和浮点数除外)，也可以作为map的键
+type luaValue struct {
+	tt api.LuaType // 类型标签，低4位是基本类型
+	n  uint64      // 整数、浮点数和布尔值
+	p  interface{} // 字符串和引用类型的值
+}
 
-func typeOf(val luaValue) api.LuaType {
-	switch val.(type) {
+/* variant tags for numbers */
+const (
+	LUA_TNUMFLT = api.LUA_TNUMBER | (0 << 4) /* float numbers */
+	LUA_TNUMINT = api.LUA_TNUMBER | (1 << 4) /* integer numbers */
+)
+
+/* tags for values that only appear inside weak tables */
+const (
+	LUA_TWEAKREF   = api.LUA_TTHREAD + 1 + iota // 可回收对象的弱引用
+	LUA_TEPHEMERON                              // ephemeron表的值的占位符
+)
+
+func boolValue(b bool) luaValue {
+	if b {
+		return luaValue{tt: api.LUA_TBOOLEAN, n: 1}
+	}
+	return luaValue{tt: api.LUA_TBOOLEAN}
+}
+
+func intValue(i int64) luaValue {
+	return luaValue{tt: LUA_TNUMINT, n: uint64(i)}
+}
+
+func floatValue(f float64) luaValue {
+	return luaValue{tt: LUA_TNUMFLT, n: math.Float64bits(f)}
+}
+
+func stringValue(s string) luaValue {
+	return luaValue{tt: api.LUA_TSTRING, p: s}
+}
+
+func tableValue(t *luaTable) luaValue {
+	return luaValue{tt: api.LUA_TTABLE, p: t}
+}
+
+func closureValue(c *closure) luaValue {
+	return luaValue{tt: api.LUA_TFUNCTION, p: c}
+}
+
+func userdataValue(u *userdata) luaValue {
+	return luaValue{tt: api.LUA_TUSERDATA, p: u}
+}
+
+func lightUserdataValue(lu lightUserdata) luaValue {
+	return luaValue{tt: api.LUA_TLIGHTUSERDATA, p: lu}
+}
+
+func threadValue(ls *luaState) luaValue {
+	return luaValue{tt: api.LUA_TTHREAD, p: ls}
+}
+
+// 把Go值转换成Lua值，Go值必须是Lua值的某种表示(函数原型的常量、toInterface()的结果等)
+func valueOf(x interface{}) luaValue {
+	switch v := x.(type) {
 	case nil:
-		return api.LUA_TNIL
+		return luaValue{}
+	case luaValue:
+		return v
 	case bool:
-		return api.LUA_TBOOLEAN
+		return boolValue(v)
 	case int64:
-		return api.LUA_TNUMBER
+		return intValue(v)
 	case float64:
-		return api.LUA_TNUMBER
+		return floatValue(v)
 	case string:
-		return api.LUA_TSTRING
+		return luaValue{tt: api.LUA_TSTRING, p: x} // 直接使用x，不用再次装箱
 	case *luaTable:
-		return api.LUA_TTABLE
+		return tableValue(v)
 	case *closure:
-		return api.LUA_TFUNCTION
+		return closureValue(v)
+	case *userdata:
+		return userdataValue(v)
+	case lightUserdata:
+		return lightUserdataValue(v)
 	case *luaState:
-		return api.LUA_TTHREAD
+		return threadValue(v)
+	default:
+		panic(fmt.Sprintf("not a Lua value: %T", x))
+	}
+}
+
+// 把Lua值转换成interface{}：nil、bool、int64、float64、string或者对象本身
+func (self luaValue) toInterface() interface{} {
+	switch self.tt {
+	case api.LUA_TBOOLEAN:
+		return self.n != 0
+	case LUA_TNUMINT:
+		return int64(self.n)
+	case LUA_TNUMFLT:
+		return math.Float64frombits(self.n)
 	default:
-		panic("todo!")
+		return self.p
 	}
 }
 
+func (self luaValue) isNil() bool {
+	return self.tt == api.LUA_TNIL
+}
+
+// 整数值，只能在标签是LUA_TNUMINT时使用
+func (self luaValue) integer() int64 {
+	return int64(self.n)
+}
+
+// 浮点数值，只能在标签是LUA_TNUMFLT时使用
+func (self luaValue) float() float64 {
+	return math.Float64frombits(self.n)
+}
+
+func typeOf(val luaValue) api.LuaType {
+	return val.tt & 0x0F
+}
+
 func convertToFloat(val luaValue) (float64, bool) {
-	switch x := val.(type) {
-	case int64:
-		return float64(x), true
-	case float64:
-		return x, true
-	case string:
-		return number.ParseFloat(x)
+	switch val.tt {
+	case LUA_TNUMINT:
+		return float64(val.integer()), true
+	case LUA_TNUMFLT:
+		return val.float(), true
+	case api.LUA_TSTRING:
+		return number.ParseFloat(val.p.(string))
 	default:
 		return 0, false
 	}
 }
 
 func convertToInteger(val luaValue) (int64, bool) {
-	switch x := val.(type) {
-	case int64:
-		return x, true
-	case float64:
-		return int64(x), true
-	case string:
-		return number.ParseInteger(x)
+	switch val.tt {
+	case LUA_TNUMINT:
+		return val.integer(), true
+	case LUA_TNUMFLT:
+		return number.FloatToInteger(val.float()) // 只有整数值的浮点数才能转换
+	case api.LUA_TSTRING:
+		x := val.p.(string)
+		if i, ok := number.ParseInteger(x); ok {
+			return i, true
+		}
+		if f, ok := number.ParseFloat(x); ok {
+			return number.FloatToInteger(f)
+		}
+		return 0, false
 	default:
 		return 0, false
 	}
@@ -60,25 +166,36 @@ func convertToInteger(val luaValue) (int64, bool) {
 // 给值关联元表
 func setMetatable(val luaValue, mt *luaTable, ls *luaState) {
 	// 先判断是否是表，如果是表，直接修改其元表字段
-	if t, ok := val.(*luaTable); ok {
+	if t, ok := val.p.(*luaTable); ok {
 		t.metatable = mt
+		t.setMode(mt, ls.gc)
+		ls.gc.checkFinalizer(val, mt)
+		return
+	}
+	// 用户数据也有各自的元表
+	if u, ok := val.p.(*userdata); ok {
+		u.metatable = mt
+		ls.gc.checkFinalizer(val, mt)
 		return
 	}
 	// 否则把元表存储到注册表
 	key := fmt.Sprintf("_MT%d", typeOf(val))
-	ls.registry.put(key, mt)
+	ls.registry.put(stringValue(key), tableValue(mt))
 }
 
 // 返回与给定值关联的元表
 func getMetatable(val luaValue, ls *luaState) *luaTable {
 	// 如果是表，直接返回其元表字段
-	if t, ok := val.(*luaTable); ok {
+	if t, ok := val.p.(*luaTable); ok {
 		return t.metatable
 	}
+	if u, ok := val.p.(*userdata); ok {
+		return u.metatable
+	}
 	// 否则从注册表中取出元表，还要判断是否存在
 	key := fmt.Sprintf("_MT%d", typeOf(val))
-	if mt := ls.registry.get(key); mt != nil {
-		return mt.(*luaTable)
+	if mt, ok := ls.registry.get(stringValue(key)).p.(*luaTable); ok {
+		return mt
 	}
 	return nil
 }
@@ -88,9 +205,9 @@ func getMetatable(val luaValue, ls *luaState) *luaTable {
 func callMetamethod(a, b luaValue, mmName string, ls *luaState) (luaValue, bool) {
 	var mm luaValue
 	// 依次查看操作数a和b是否有对应的元方法
-	if mm = getMetafield(a, mmName, ls); mm == nil {
-		if mm = getMetafield(b, mmName, ls); mm == nil {
-			return nil, false
+	if mm = getMetafield(a, mmName, ls); mm.isNil() {
+		if mm = getMetafield(b, mmName, ls); mm.isNil() {
+			return luaValue{}, false
 		}
 	}
 
@@ -100,14 +217,24 @@ func callMetamethod(a, b luaValue, mmName string, ls *luaState) (luaValue, bool)
 	ls.stack.push(a)
 	ls.stack.push(b)
 	// 调用
-	ls.Call(2, 1)
+	ls.callTM(2, 1)
 	return ls.stack.pop(), true
 }
 
+// 调用栈顶的元方法，虚拟机执行指令时调用的元方法可以挂起，协程恢复运行后由FinishOp()完成被打断的指令
+// lua-5.3.4/src/ltm.c#luaT_callTM()
+func (self *luaState) callTM(nArgs, nResults int) {
+	if self.stack.isLua() { /* metamethod may yield only when called from Lua code */
+		self.call(nArgs, nResults)
+	} else {
+		self.callNoYield(nArgs, nResults)
+	}
+}
+
 // 获取元方法
 func getMetafield(val luaValue, fieldName string, ls *luaState) luaValue {
 	if mt := getMetatable(val, ls); mt != nil {
-		return mt.get(fieldName)
+		return mt.get(stringValue(fieldName))
 	}
-	return nil
+	return luaValue{}
 }
@@ -19,7 +19,7 @@ func (self *luaState) Fetch() uint32 {
 // 从常量表取出一个常量值，然后推入栈顶
 func (self *luaState) GetConst(idx int) {
 	c := self.stack.closure.proto.Constants[idx]
-	self.stack.push(c)
+	self.stack.push(valueOf(c))
 }
 
 func (self *luaState) GetRK(rk int) {
@@ -51,7 +51,8 @@ func (self *luaState) LoadProto(idx int) {
 	stack := self.stack
 	subProto := stack.closure.proto.Protos[idx]
 	closure := newLuaClosure(subProto)
-	stack.push(closure)
+	stack.push(closureValue(closure))
+	self.allocate(sizeClosure + len(closure.upvals)*8)
 	// 遍历子函数的upvalue表
 	// 将子函数原型转换为闭包，并确保闭包中的Upvalue能够正确地引用外部变量。
 	for i, uvInfo := range subProto.Upvalues {
@@ -79,13 +80,5 @@ func (self *luaState) LoadProto(idx int) {
 
 // 关闭指定索引处的Upvalue
 func (self *luaState) CloseUpvalues(a int) {
-	for i, openuv := range self.stack.openuvs {
-		if i >= a-1 {
-			// 关闭Upvalue
-			val := *openuv.val
-			openuv.val = &val
-			// 从openuvs表中删除该Upvalue
-			delete(self.stack.openuvs, i)
-		}
-	}
+	self.stack.closeUpvalues(a - 1)
 }
@@ -0,0 +1,161 @@
+package state
+
+import (
+	"runtime/debug"
+	"testing"
+
+	. "go/ch21/src/luago/api"
+)
+
+// Lua函数之间的调用在同一个分派循环里执行，不占用Go的调用栈，递归深度只受调用深度限制
+func TestDeepRecursion(t *testing.T) {
+	old := debug.SetMaxStack(16 << 20) // 每层递归都占用Go的调用栈时会超出这个限制
+	defer debug.SetMaxStack(old)
+	runScript(t, `
+		local function sum(n) if n == 0 then return 0 end return n + sum(n - 1) end
+		assert(sum(190000) == 190000 * 190001 // 2)
+
+		local function inf(n) return 1 + inf(n + 1) end
+		for i = 1, 2 do
+			local ok, err = pcall(inf, 1)
+			assert(not ok and err:find("stack overflow"), err)
+		end
+		assert(sum(100) == 5050)
+
+		local co = coroutine.wrap(function(n)
+			local function down(i)
+				if i == 0 then return coroutine.yield("bottom") end
+				return 1 + down(i - 1)
+			end
+			return down(n)
+		end)
+		assert(co(100000) == "bottom")
+		assert(co(0) == 100000)
+
+		-- 元方法和Go函数仍然是可重入的，嵌套太深时抛出"C stack overflow"错误
+		local t = setmetatable({}, {__index = function(t, k) return t[k + 1] end})
+		local ok, err = pcall(function() return t[1] end)
+		assert(not ok and err:find("C stack overflow"), err)
+		local mt = {__add = function(a, b) return b == 0 and 0 or a + (b - 1) end}
+		assert(setmetatable({}, mt) + 100 == 0)`)
+}
+
+// 错误穿过多层Lua函数调用传给最近的pcall，调用帧都被弹出，错误位置和调用栈回溯都是正确的
+func TestErrorAcrossLuaCalls(t *testing.T) {
+	ls := New()
+	ls.OpenLibs()
+	ls.SetCallDepthLimit(100)
+	ls.Register("depth", frameDepth)
+	ls.Load([]byte(`local function c(x) return x.y + 1 end
+local function b(x) return c(x) * 2 end
+local function a(x) local r = b(x) return r end
+return a(nil)`), "=test", "t")
+	if status := ls.PCall(0, 0, 0); status != LUA_ERRRUN {
+		t.Fatalf("status = %d, want LUA_ERRRUN", status)
+	}
+	if msg := ls.ToString(-1); msg != "test:1: attempt to index a nil value" {
+		t.Errorf("message = %q", msg)
+	}
+	ls.Pop(1)
+
+	if ls.DoString(`
+		local d0 = depth()
+		local function c(n) if n == 0 then error({code = 42}) end return c(n - 1) + 1 end
+		local function b(n) return (c(n)) end
+		local ok, err = pcall(b, 50)
+		assert(not ok and err.code == 42)
+		assert(depth() == d0)
+
+		-- 错误层级指向调用者
+		local function check(x) if type(x) ~= "number" then error("number expected", 2) end return x end
+		local function use() return check("a") + 1 end
+		ok, err = pcall(use)
+		assert(not ok and err:find(":11: number expected"), err)
+
+		-- 中间的pcall捕获错误之后，外层的调用继续执行
+		local function mid(n)
+			local ok, err = pcall(c, n)
+			return ok, err and err.code, depth()
+		end
+		local function outer() local ok, code, d = mid(10) return ok, code, d, depth() end
+		local ok2, code, dmid, douter = outer()
+		assert(ok2 == false and code == 42 and dmid == douter + 1)
+
+		-- 消息处理函数在出错的地方运行，调用栈回溯包含所有的Lua函数
+		local function f3() error("deep") end
+		local function f2() f3() end
+		local function f1() f2() end
+		ok, err = xpcall(f1, debug.traceback)
+		assert(not ok and err:find("deep"), err)
+		assert(err:find("in upvalue 'f3'") and err:find("in upvalue 'f2'") and err:find("in function <"), err)
+
+		-- 错误穿过Go函数和元方法
+		local t = setmetatable({}, {__index = function(t, k) return c(0) end})
+		ok, err = pcall(function() return t.x end)
+		assert(not ok and err.code == 42)
+		ok, err = pcall(table.sort, {3, 2, 1}, function(a, b) return c(0) end)
+		assert(not ok and err.code == 42)
+		assert(depth() == d0)`) {
+		t.Fatal(ls.ToString(-1))
+	}
+}
+
+// 钩子看到分派循环里的每一次调用和返回，协程在嵌套的Lua调用中挂起和恢复时也是这样
+func TestHooksInDispatchLoop(t *testing.T) {
+	runScript(t, `
+		local events = {}
+		local function hook(event) events[event] = (events[event] or 0) + 1 end
+		local function fib(n) if n < 2 then return n end return fib(n - 1) + fib(n - 2) end
+		local function tail(n) if n == 0 then return 0 end return tail(n - 1) end
+		debug.sethook(hook, "cr")
+		fib(10)
+		tail(10)
+		debug.sethook()
+		-- fib调用了177次，tail调用了1次，尾调用了10次，sethook自己也产生一次返回和一次调用
+		assert(events.call == 177 + 1 + 1 and events["tail call"] == 10, events.call)
+		assert(events["return"] == 177 + 1 + 1, events["return"])
+
+		-- 协程有自己的钩子，在嵌套的Lua调用中挂起后恢复，钩子照常触发
+		local co = coroutine.create(function()
+			local calls = 0
+			debug.sethook(function(event) if event == "call" then calls = calls + 1 end end, "c")
+			local function down(n)
+				if n == 0 then return coroutine.yield(calls) end
+				return 1 + down(n - 1)
+			end
+			local r = down(5)
+			local c = calls
+			debug.sethook()
+			return r, c
+		end)
+		local ok, calls = coroutine.resume(co)
+		assert(ok and calls == 6, calls)
+		local ok, r, c = coroutine.resume(co, 0)
+		assert(ok and r == 5 and c == 7, c) -- 还有coroutine.yield()的调用
+
+		-- 计数钩子在嵌套的Lua调用中照常触发，钩子抛出的错误穿过这些调用
+		co = coroutine.create(function()
+			local function count(n) if n == 0 then return 0 end return 1 + count(n - 1) end
+			return count(1000)
+		end)
+		local ticks = 0
+		debug.sethook(co, function() ticks = ticks + 1 end, "", 100)
+		local ok, r = coroutine.resume(co)
+		assert(ok and r == 1000 and ticks > 10, ticks)
+		local function loop(n) return 1 + loop(n + 1) end
+		ok, r = pcall(function()
+			debug.sethook(function() error("stop", 0) end, "", 1000)
+			return loop(1)
+		end)
+		debug.sethook()
+		assert(not ok and r == "stop", r)
+
+		-- 行钩子在调用者恢复执行时继续按行触发
+		local lines = {}
+		local function f() return 1 end
+		debug.sethook(function(_, line) lines[#lines + 1] = line end, "l")
+		local x = f()
+		x = x + 1
+		debug.sethook()
+		assert(#lines == 4, table.concat(lines, " "))`)
+}
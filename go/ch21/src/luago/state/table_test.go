@@ -0,0 +1,185 @@
+package state
+
+import (
+	"fmt"
+	"testing"
+)
+
+// 检查表的不变式：数组部分范围内的整数键不在哈希部分里，并且所有的键都能取到对应的值
+func checkTable(t *testing.T, tbl *luaTable, want map[int64]int64) {
+	t.Helper()
+	for k := range tbl._map {
+		if k.tt == LUA_TNUMINT && k.integer() >= 1 && k.integer() <= int64(len(tbl.arr)) {
+			t.Errorf("key %d is in the hash part, array size is %d", k.integer(), len(tbl.arr))
+		}
+	}
+	for k, v := range want {
+		if got := tbl.get(intValue(k)); got.tt != LUA_TNUMINT || got.integer() != v {
+			t.Errorf("t[%d] = %v, want %d", k, got.toInterface(), v)
+		}
+	}
+}
+
+// 哈希部分超出容量时重新计算数组部分的大小，整数键在两部分之间迁移
+func TestTableRehash(t *testing.T) {
+	tests := []struct {
+		name  string
+		keys  []int64
+		arr   int // 期望的数组部分大小
+		nhash int // 期望的哈希部分里的整数键个数
+	}{
+		{"in order", seq(1, 100, 1), 128, 0},
+		{"reverse", seq(100, 1, -1), 128, 0},
+		{"sparse", []int64{1, 2, 3, 1000, 2000, 3000, 4000}, 4, 4},
+		{"half empty", seq(1, 99, 2), 1, 49}, // 使用率不超过一半的区间不放进数组部分
+		{"negative and zero", []int64{-3, -2, -1, 0, 1, 2}, 2, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tbl := newLuaTable(0, 0)
+			want := map[int64]int64{}
+			for _, k := range tt.keys {
+				tbl.put(intValue(k), intValue(k*10))
+				want[k] = k * 10
+			}
+			tbl.rehash() // 最后一个键不一定触发了rehash
+			checkTable(t, tbl, want)
+			if len(tbl.arr) != tt.arr || len(tbl._map) != tt.nhash {
+				t.Errorf("array size = %d, hash keys = %d, want %d and %d",
+					len(tbl.arr), len(tbl._map), tt.arr, tt.nhash)
+			}
+		})
+	}
+
+	// 数组部分的大部分元素被删除之后，rehash把数组部分缩小，剩下的元素移到哈希部分
+	tbl := newLuaTable(64, 0)
+	want := map[int64]int64{}
+	for k := int64(1); k <= 64; k++ {
+		tbl.put(intValue(k), intValue(k))
+	}
+	for k := int64(1); k <= 64; k++ {
+		if k%16 != 0 {
+			tbl.put(intValue(k), luaValue{})
+		} else {
+			want[k] = k
+		}
+	}
+	for i := 0; i < 4; i++ {
+		tbl.put(stringValue(fmt.Sprint("s", i)), intValue(int64(i)))
+	}
+	tbl.rehash()
+	checkTable(t, tbl, want)
+	if len(tbl.arr) != 0 || len(tbl._map) != 4 || len(tbl.strs) != 4 {
+		t.Errorf("array size = %d, hash keys = %d, string keys = %d", len(tbl.arr), len(tbl._map), len(tbl.strs))
+	}
+
+	// 浮点数键如果是整数，和对应的整数键是同一个键
+	tbl = newLuaTable(0, 0)
+	for k := 1; k <= 8; k++ {
+		tbl.put(floatValue(float64(k)), intValue(int64(k)))
+	}
+	tbl.rehash()
+	checkTable(t, tbl, map[int64]int64{1: 1, 8: 8})
+	if len(tbl.arr) != 8 {
+		t.Errorf("array size = %d, want 8", len(tbl.arr))
+	}
+}
+
+func seq(from, to, step int64) []int64 {
+	var s []int64
+	for i := from; step > 0 && i <= to || step < 0 && i >= to; i += step {
+		s = append(s, i)
+	}
+	return s
+}
+
+// #t返回一个边界：t[n]不是nil并且t[n+1]是nil，t[1]是nil时可以是0
+func TestTableBorder(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+	}{
+		{"holes in array", "return {1, 2, nil, 4}"},
+		{"leading nils", "return {nil, nil, 3}"},
+		{"trailing nil", "return {1, 2, 3, nil}"},
+		{"all nil", "return {nil, nil, nil}"},
+		{"empty", "return {}"},
+		{"array continues in hash", "local t = {1, 2, 3, 4} t[5] = 5 t[6] = 6 t[100] = 100 return t"},
+		{"holes after removal", "local t = {} for i = 1, 100 do t[i] = i end for i = 1, 100, 3 do t[i] = nil end return t"},
+		{"only hash", "local t = {} t[2] = 2 t[3] = 3 t[10] = 10 return t"},
+		{"reverse with hole", "local t = {} for i = 20, 1, -1 do if i ~= 7 then t[i] = i end end return t"},
+		{"large key", "local t = {1, 2, 3} t[1 << 40] = 1 return t"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ls := New()
+			if ls.DoString(tt.script) {
+				t.Fatal(ls.ToString(-1))
+			}
+			tbl := ls.(*luaState).stack.get(-1).p.(*luaTable)
+			n := int64(tbl.len())
+			if n < 0 || n > 0 && tbl.get(intValue(n)).isNil() || !tbl.get(intValue(n+1)).isNil() {
+				t.Errorf("#t = %d is not a border", n)
+			}
+		})
+	}
+}
+
+// 遍历的时候可以给已有的字段赋值，包括赋值为nil，每个键都只遍历一次
+func TestTableNextWhileAssigning(t *testing.T) {
+	runScript(t, `
+		local function build()
+			local t = {}
+			for i = 1, 50 do t[i] = i end
+			for i = 1, 50 do t["k" .. i] = i end
+			for i = 1, 10 do t[i * 1000] = i end
+			t[1.5] = 1.5
+			return t
+		end
+		local function count(t) local n = 0 for _ in pairs(t) do n = n + 1 end return n end
+
+		-- 修改当前的字段
+		local t, seen = build(), {}
+		for k, v in pairs(t) do
+			assert(not seen[k], k)
+			seen[k] = true
+			t[k] = v * 2
+		end
+		assert(count(seen) == 111)
+		for k, v in pairs(build()) do assert(t[k] == v * 2, k) end
+
+		-- 删除当前的字段
+		t, seen = build(), {}
+		for k in pairs(t) do
+			assert(not seen[k], k)
+			seen[k] = true
+			t[k] = nil
+		end
+		assert(count(seen) == 111 and next(t) == nil)
+
+		-- 删除还没有遍历到的字段，它们不会再出现
+		t, seen = build(), {}
+		local removed, n = {}, 0
+		for k, v in pairs(t) do
+			assert(not removed[k] and v ~= nil, k)
+			seen[k], n = true, n + 1
+			for k2 in pairs(build()) do
+				if not seen[k2] and not removed[k2] and n % 3 == 0 then
+					t[k2], removed[k2] = nil, true
+					break
+				end
+			end
+		end
+
+		-- 用next直接遍历，中间修改和删除数组部分和哈希部分的字段
+		t = build()
+		local k, v = next(t)
+		n = 0
+		while k do
+			n = n + 1
+			if type(k) == "number" and k % 2 == 0 then t[k] = nil else t[k] = "x" end
+			k, v = next(t, k)
+		end
+		assert(n == 111)
+		for k, v in pairs(t) do assert(v == "x", k) end`)
+}
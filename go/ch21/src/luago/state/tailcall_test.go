@@ -0,0 +1,70 @@
+package state
+
+import (
+	"testing"
+
+	. "go/ch21/src/luago/api"
+)
+
+// 调用栈中调用帧的个数
+func frameDepth(ls LuaState) int {
+	n := 0
+	for frame := ls.(*luaState).stack; frame.prev != nil; frame = frame.prev {
+		n++
+	}
+	ls.PushInteger(int64(n))
+	return 1
+}
+
+// 尾调用复用调用帧，很深的尾递归在很小的调用深度限制下也能运行，调用帧的个数保持不变
+func TestTailCallDepth(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+	}{
+		{"mutual recursion", `
+			local isEven, isOdd
+			function isEven(n) if n == 0 then return true, depth() end return isOdd(n - 1) end
+			function isOdd(n) if n == 0 then return false, depth() end return isEven(n - 1) end
+			local even, d = isEven(100000)
+			local _, d0 = isEven(0)
+			assert(even == true and d == d0, d .. " ~= " .. d0)`},
+		{"go callee", `
+			local function f(n) if n == 0 then return depth() end return f(n - 1) end
+			local function g(n) return f(n) end
+			assert(g(100000) == g(0))
+			local function h(n) if n == 0 then return select("#", 1, 2, 3) end return h(n - 1) end
+			assert(h(100000) == 3)`},
+		{"go callee in arguments", `
+			local k = 0
+			local function tick(n) k = k + 1 if n == 0 then return k end return tick(math.max(n - 1, 0)) end
+			assert(tick(100000) == 100001)`},
+		{"vararg", `
+			local function va(n, ...)
+				if n == 0 then return depth(), select("#", ...) end
+				return va(n - 1, ...)
+			end
+			local d, nv = va(100000, 1, 2, 3)
+			assert(d == va(0) and nv == 3)`},
+		{"debug.getinfo", `
+			local function levels()
+				local level = 1
+				while debug.getinfo(level, "l") do level = level + 1 end
+				return level
+			end
+			local function f(n) if n == 0 then return levels(), debug.getinfo(1, "t").istailcall end return f(n - 1) end
+			local d, tail = f(100000)
+			assert(d == f(0) and tail == true)`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ls := New()
+			ls.OpenLibs()
+			ls.SetCallDepthLimit(20)
+			ls.Register("depth", frameDepth)
+			if ls.DoString(tt.script) {
+				t.Fatal(ls.ToString(-1))
+			}
+		})
+	}
+}
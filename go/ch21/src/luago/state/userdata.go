@@ -0,0 +1,28 @@
+package state
+
+import "reflect"
+
+// 完全用户数据，用来把Go对象交给Lua，每个用户数据都可以有自己的元表和用户值
+type userdata struct {
+	gcObject
+	metatable *luaTable   // 元表
+	uservalue luaValue    // 关联的Lua值，可以通过SetUserValue()/GetUserValue()访问
+	data      interface{} // 宿主对象
+}
+
+func newUserdata(data interface{}) *userdata {
+	return &userdata{data: data}
+}
+
+// 轻量用户数据，只是一个Go值，按值比较，所有轻量用户数据共享同一个元表
+type lightUserdata struct {
+	data interface{}
+}
+
+func newLightUserdata(data interface{}) lightUserdata {
+	// 轻量用户数据可以作为表的键，也可以直接比较，所以必须是可比较的值(一般是指针)
+	if data != nil && !reflect.TypeOf(data).Comparable() {
+		panic("light userdata must be comparable!")
+	}
+	return lightUserdata{data}
+}
@@ -28,6 +28,8 @@ var baseFuncs = map[string]GoFunction{
 	"type":         baseType,
 	"tostring":     baseToString,
 	"tonumber":     baseToNumber,
+
+	"collectgarbage": baseCollectGarbage,
 	/* placeholders */
 	"_G":       nil,
 	"_VERSION": nil,
@@ -93,9 +95,9 @@ func baseError(ls LuaState) int {
 	level := int(ls.OptInteger(2, 1))
 	ls.SetTop(1)
 	if ls.Type(1) == LUA_TSTRING && level > 0 {
-		// ls.Where(level) /* add extra information */
-		// ls.PushValue(1)
-		// ls.Concat(2)
+		ls.Where(level) /* add extra information */
+		ls.PushValue(1)
+		ls.Concat(2)
 	}
 	return ls.Error()
 }
@@ -185,16 +187,52 @@ func baseLoad(ls LuaState) int {
 		chunkname := ls.OptString(2, chunk)
 		status = ls.Load([]byte(chunk), chunkname, mode)
 	} else { /* loading from a reader function */
-		panic("loading from a reader function") // todo
+		chunkname := ls.OptString(2, "=(load)")
+		ls.CheckType(1, LUA_TFUNCTION)
+		// 编译器需要完整的源代码，所以先在保护模式下读出所有片段，读取函数出错时load返回错误
+		ls.PushGoFunction(genericReader)
+		ls.PushValue(1)
+		if status = ls.PCall(1, 1, 0); status == LUA_OK {
+			chunk = ls.ToString(-1)
+			ls.Pop(1)
+			status = ls.Load([]byte(chunk), chunkname, mode)
+		}
 	}
 	return loadAux(ls, status, env)
 }
 
+// 反复调用读取函数，直到返回nil或者空字符串，把所有片段连接起来推入栈顶
+// lua-5.3.4/src/lbaselib.c#generic_reader()
+func genericReader(ls LuaState) int {
+	var buf []byte
+	for {
+		ls.CheckStack2(2, "too many nested functions")
+		ls.PushValue(1) /* get function */
+		ls.Call(0, 1)   /* call it */
+		if ls.IsNil(-1) {
+			break /* that's the end */
+		} else if !ls.IsString(-1) {
+			ls.Error2("reader function must return a string")
+		}
+		piece := ls.ToString(-1)
+		ls.Pop(1)
+		if piece == "" {
+			break
+		}
+		buf = append(buf, piece...)
+	}
+	ls.PushString(string(buf))
+	return 1
+}
+
 // lua-5.3.4/src/lbaselib.c#load_aux()
 func loadAux(ls LuaState, status, envIdx int) int {
 	if status == LUA_OK {
 		if envIdx != 0 { /* 'env' parameter? */
-			panic("todo!")
+			ls.PushValue(envIdx)                    /* environment for loaded function */
+			if _, ok := ls.SetUpvalue(-2, 1); !ok { /* set it as 1st upvalue */
+				ls.Pop(1) /* remove 'env' if not used by previous call */
+			}
 		}
 		return 1
 	} else { /* error (message is on top of the stack) */
@@ -209,7 +247,7 @@ func loadAux(ls LuaState, status, envIdx int) int {
 // lua-5.3.4/src/lbaselib.c#luaB_loadfile()
 func baseLoadFile(ls LuaState) int {
 	fname := ls.OptString(1, "")
-	mode := ls.OptString(1, "bt")
+	mode := ls.OptString(2, "bt")
 	env := 0 /* 'env' index or 0 if no 'env' */
 	if !ls.IsNone(3) {
 		env = 3
@@ -222,29 +260,80 @@ func baseLoadFile(ls LuaState) int {
 // http://www.lua.org/manual/5.3/manual.html#pdf-dofile
 // lua-5.3.4/src/lbaselib.c#luaB_dofile()
 func baseDoFile(ls LuaState) int {
-	fname := ls.OptString(1, "bt")
+	fname := ls.OptString(1, "")
 	ls.SetTop(1)
 	if ls.LoadFile(fname) != LUA_OK {
 		return ls.Error()
 	}
-	ls.Call(0, LUA_MULTRET)
+	ls.CallK(0, LUA_MULTRET, 0, doFileCont)
+	return doFileCont(ls, 0, 0)
+}
+
+// lua-5.3.4/src/lbaselib.c#dofilecont()
+func doFileCont(ls LuaState, d1 int, d2 KContext) int {
 	return ls.GetTop() - 1
 }
 
 // pcall (f [, arg1, ···])
 // http://www.lua.org/manual/5.3/manual.html#pdf-pcall
+// lua-5.3.4/src/lbaselib.c#luaB_pcall()
 func basePCall(ls LuaState) int {
-	nArgs := ls.GetTop() - 1
-	status := ls.PCall(nArgs, -1, 0)
-	ls.PushBoolean(status == LUA_OK)
-	ls.Insert(1)
-	return ls.GetTop()
+	ls.CheckAny(1)
+	ls.PushBoolean(true) /* first result if no errors */
+	ls.Insert(1)         /* put it in place */
+	status := ls.PCallK(ls.GetTop()-2, LUA_MULTRET, 0, 0, finishPCall)
+	return finishPCall(ls, status, 0)
 }
 
 // xpcall (f, msgh [, arg1, ···])
 // http://www.lua.org/manual/5.3/manual.html#pdf-xpcall
+// lua-5.3.4/src/lbaselib.c#luaB_xpcall()
 func baseXPCall(ls LuaState) int {
-	panic("todo!")
+	n := ls.GetTop()
+	ls.CheckType(2, LUA_TFUNCTION) /* check error function */
+	ls.PushBoolean(true)           /* first result */
+	ls.PushValue(1)                /* function */
+	ls.Rotate(3, 2)                /* move them below function's arguments */
+	status := ls.PCallK(n-2, LUA_MULTRET, 2, 2, finishPCall)
+	return finishPCall(ls, status, 2)
+}
+
+// pcall和xpcall的延续函数，被调函数挂起后也通过它返回结果
+// lua-5.3.4/src/lbaselib.c#finishpcall()
+func finishPCall(ls LuaState, status int, extra KContext) int {
+	if status != LUA_OK && status != LUA_YIELD { /* error? */
+		ls.PushBoolean(false) /* first result (false) */
+		ls.PushValue(-2)      /* error message */
+		return 2              /* return false, msg */
+	}
+	return ls.GetTop() - int(extra) /* return all results */
+}
+
+// collectgarbage ([opt [, arg]])
+// http://www.lua.org/manual/5.3/manual.html#pdf-collectgarbage
+// lua-5.3.4/src/lbaselib.c#luaB_collectgarbage()
+func baseCollectGarbage(ls LuaState) int {
+	opts := map[string]int{
+		"stop": LUA_GCSTOP, "restart": LUA_GCRESTART, "collect": LUA_GCCOLLECT,
+		"count": LUA_GCCOUNT, "step": LUA_GCSTEP, "setpause": LUA_GCSETPAUSE,
+		"setstepmul": LUA_GCSETSTEPMUL, "isrunning": LUA_GCISRUNNING,
+	}
+	o, ok := opts[ls.OptString(1, "collect")]
+	if !ok {
+		return ls.ArgError(1, "invalid option '"+ls.ToString(1)+"'")
+	}
+	ex := int(ls.OptInteger(2, 0))
+	res := ls.GC(o, ex)
+	switch o {
+	case LUA_GCCOUNT:
+		b := ls.GC(LUA_GCCOUNTB, 0)
+		ls.PushNumber(float64(res) + float64(b)/1024)
+	case LUA_GCSTEP, LUA_GCISRUNNING:
+		ls.PushBoolean(res != 0)
+	default:
+		ls.PushInteger(int64(res))
+	}
+	return 1
 }
 
 // getmetatable (object)
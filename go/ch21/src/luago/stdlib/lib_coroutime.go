@@ -10,13 +10,31 @@ var coFuncs = map[string]GoFunction{
 	"isyieldable": coYieldable, // 判断协程是否可挂起
 	"running":     coRunning,   // 获取当前协程
 	"wrap":        coWrap,      // 创建一个协程包装器
+	"close":       coClose,     // 关闭一个协程
 }
 
+/* coroutine status */
+const (
+	COS_RUN   = iota /* running */
+	COS_DEAD         /* dead */
+	COS_YIELD        /* suspended */
+	COS_NORM         /* normal */
+)
+
+var statName = []string{"running", "dead", "suspended", "normal"}
+
 func OpenCoroutineLib(ls LuaState) int {
 	ls.NewLib(coFuncs)
 	return 1
 }
 
+// lua-5.3.4/src/lcorolib.c#getco()
+func getCo(ls LuaState) LuaState {
+	co := ls.ToThread(1)
+	ls.ArgCheck(co != nil, 1, "coroutine expected")
+	return co
+}
+
 // coroutine.create (f)
 // http://www.lua.org/manual/5.3/manual.html#pdf-coroutine.create
 // lua-5.3.4/src/lcorolib.c#luaB_cocreate()
@@ -32,9 +50,7 @@ func coCreate(ls LuaState) int {
 // http://www.lua.org/manual/5.3/manual.html#pdf-coroutine.resume
 // lua-5.3.4/src/lcorolib.c#luaB_coresume()
 func coResume(ls LuaState) int {
-	co := ls.ToThread(1)
-	ls.ArgCheck(co != nil, 1, "thread expected")
-
+	co := getCo(ls)
 	if r := _auxResume(ls, co, ls.GetTop()-1); r < 0 {
 		ls.PushBoolean(false)
 		ls.Insert(-2)
@@ -83,28 +99,31 @@ func coYield(ls LuaState) int {
 // http://www.lua.org/manual/5.3/manual.html#pdf-coroutine.status
 // lua-5.3.4/src/lcorolib.c#luaB_costatus()
 func coStatus(ls LuaState) int {
-	co := ls.ToThread(1)
-	ls.ArgCheck(co != nil, 1, "thread expected")
+	co := getCo(ls)
+	ls.PushString(statName[auxStatus(ls, co)])
+	return 1
+}
+
+// lua-5.4.6/src/lcorolib.c#auxstatus()
+func auxStatus(ls, co LuaState) int {
 	if ls == co {
-		ls.PushString("running")
-	} else {
-		switch co.Status() {
-		case LUA_YIELD:
-			ls.PushString("suspended")
-		case LUA_OK:
-			if co.GetStack() { /* does it have frames? */
-				ls.PushString("normal") /* it is running */
-			} else if co.GetTop() == 0 {
-				ls.PushString("dead")
-			} else {
-				ls.PushString("suspended")
-			}
-		default: /* some error occurred */
-			ls.PushString("dead")
+		return COS_RUN
+	}
+	switch co.Status() {
+	case LUA_YIELD:
+		return COS_YIELD
+	case LUA_OK:
+		var ar LuaDebug
+		if co.GetStack(0, &ar) { /* does it have frames? */
+			return COS_NORM /* it is running */
+		} else if co.GetTop() == 0 {
+			return COS_DEAD
+		} else {
+			return COS_YIELD /* initial state */
 		}
+	default: /* some error occurred */
+		return COS_DEAD
 	}
-
-	return 1
 }
 
 // coroutine.isyieldable ()
@@ -124,6 +143,55 @@ func coRunning(ls LuaState) int {
 
 // coroutine.wrap (f)
 // http://www.lua.org/manual/5.3/manual.html#pdf-coroutine.wrap
+// lua-5.3.4/src/lcorolib.c#luaB_cowrap()
 func coWrap(ls LuaState) int {
-	panic("todo: coWrap!")
+	coCreate(ls)
+	ls.PushGoClosure(auxWrap, 1)
+	return 1
+}
+
+// wrap返回的函数，协程出错时关闭协程，在错误消息前加上位置信息后继续抛出
+// lua-5.4.6/src/lcorolib.c#auxwrap()
+func auxWrap(ls LuaState) int {
+	co := ls.ToThread(LuaUpvalueIndex(1))
+	r := _auxResume(ls, co, ls.GetTop())
+	if r >= 0 {
+		return r
+	}
+	/* error object is on top */
+	// 出错的协程保留着调用帧，已经关闭过的协程再次调用时只报告不能恢复
+	var ar LuaDebug
+	stat := co.Status()
+	if stat != LUA_OK && stat != LUA_YIELD && co.GetStack(0, &ar) { /* error in the coroutine? */
+		co.CloseThread() /* unwind its frames */
+		co.XMove(ls, 1)  /* move error message to the caller */
+	}
+	if stat == LUA_ERRLIMIT { // 超出执行限制的错误已经带有位置信息，连同错误码一起原样传出去
+		return ls.ErrorStatus(stat)
+	}
+	if ls.Type(-1) == LUA_TSTRING { /* error object is a string? */
+		ls.Where(1) /* get extra info, if available */
+		ls.Insert(-2)
+		ls.Concat(2)
+	}
+	return ls.Error() /* propagate error */
+}
+
+// coroutine.close (co)
+// http://www.lua.org/manual/5.4/manual.html#pdf-coroutine.close
+// lua-5.4.6/src/lcorolib.c#luaB_close()
+func coClose(ls LuaState) int {
+	co := getCo(ls)
+	switch status := auxStatus(ls, co); status {
+	case COS_DEAD, COS_YIELD:
+		if co.CloseThread() == LUA_OK {
+			ls.PushBoolean(true)
+			return 1
+		}
+		ls.PushBoolean(false)
+		co.XMove(ls, 1) /* move error message */
+		return 2
+	default: /* normal or running coroutine */
+		return ls.Error2("cannot close a %s coroutine", statName[status])
+	}
 }
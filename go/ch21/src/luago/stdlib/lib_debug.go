@@ -0,0 +1,467 @@
+package stdlib
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	. "go/ch21/src/luago/api"
+)
+
+var dbLib = map[string]GoFunction{
+	"debug":        dbDebug,
+	"getuservalue": dbGetUserValue,
+	"gethook":      dbGetHook,
+	"getinfo":      dbGetInfo,
+	"getlocal":     dbGetLocal,
+	"getregistry":  dbGetRegistry,
+	"getmetatable": dbGetMetatable,
+	"getupvalue":   dbGetUpvalue,
+	"upvaluejoin":  dbUpvalueJoin,
+	"upvalueid":    dbUpvalueId,
+	"setuservalue": dbSetUserValue,
+	"sethook":      dbSetHook,
+	"setlocal":     dbSetLocal,
+	"setmetatable": dbSetMetatable,
+	"setupvalue":   dbSetUpvalue,
+	"traceback":    dbTraceback,
+}
+
+func OpenDebugLib(ls LuaState) int {
+	ls.NewLib(dbLib)
+	return 1
+}
+
+// debug.getregistry ()
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.getregistry
+// lua-5.3.4/src/ldblib.c#db_getregistry()
+func dbGetRegistry(ls LuaState) int {
+	ls.PushValue(LUA_REGISTRYINDEX)
+	return 1
+}
+
+// debug.getmetatable (value)
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.getmetatable
+// lua-5.3.4/src/ldblib.c#db_getmetatable()
+func dbGetMetatable(ls LuaState) int {
+	ls.CheckAny(1)
+	if !ls.GetMetatable(1) {
+		ls.PushNil() /* no metatable */
+	}
+	return 1
+}
+
+// debug.setmetatable (value, table)
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.setmetatable
+// lua-5.3.4/src/ldblib.c#db_setmetatable()
+func dbSetMetatable(ls LuaState) int {
+	t := ls.Type(2)
+	ls.ArgCheck(t == LUA_TNIL || t == LUA_TTABLE, 2, "nil or table expected")
+	ls.SetTop(2)
+	ls.SetMetatable(1)
+	return 1 /* return 1st argument */
+}
+
+// debug.getuservalue (u)
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.getuservalue
+// lua-5.3.4/src/ldblib.c#db_getuservalue()
+func dbGetUserValue(ls LuaState) int {
+	if ls.Type(1) != LUA_TUSERDATA {
+		ls.PushNil()
+	} else {
+		ls.GetUserValue(1)
+	}
+	return 1
+}
+
+// debug.setuservalue (udata, value)
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.setuservalue
+// lua-5.3.4/src/ldblib.c#db_setuservalue()
+func dbSetUserValue(ls LuaState) int {
+	ls.CheckType(1, LUA_TUSERDATA)
+	ls.CheckAny(2)
+	ls.SetTop(2)
+	ls.SetUserValue(1)
+	return 1
+}
+
+// 第一个参数是线程时，调试函数作用于这个线程，其余参数依次后移
+// lua-5.3.4/src/ldblib.c#getthread()
+func getThread(ls LuaState) (LuaState, int) {
+	if ls.IsThread(1) {
+		return ls.ToThread(1), 1
+	}
+	return ls, 0 /* function will operate over current thread */
+}
+
+// 检查另一个线程的栈空间
+// lua-5.3.4/src/ldblib.c#checkstack()
+func checkStack(ls, l1 LuaState, n int) {
+	if ls != l1 && !l1.CheckStack(n) {
+		ls.Error2("stack overflow")
+	}
+}
+
+// 把l1栈顶的值(getinfo推入的函数或者行号表)设置为表的字段
+// lua-5.3.4/src/ldblib.c#treatstackoption()
+func treatStackOption(ls, l1 LuaState, fname string) {
+	if ls == l1 {
+		ls.Rotate(-2, 1) /* exchange object and table */
+	} else {
+		l1.XMove(ls, 1) /* move object to the "main" stack */
+	}
+	ls.SetField(-2, fname) /* put object into table */
+}
+
+// debug.getinfo ([thread,] f [, what])
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.getinfo
+// lua-5.3.4/src/ldblib.c#db_getinfo()
+func dbGetInfo(ls LuaState) int {
+	var ar LuaDebug
+	l1, arg := getThread(ls)
+	options := ls.OptString(arg+2, "flnStu")
+	ls.ArgCheck(!strings.HasPrefix(options, ">"), arg+2, "invalid option '>'") // '>'由这里根据参数类型添加
+	checkStack(ls, l1, 3)
+	if ls.IsFunction(arg + 1) { /* info about a function? */
+		options = ">" + options /* add '>' to 'options' */
+		ls.PushValue(arg + 1)   /* move function to 'l1' stack */
+		ls.XMove(l1, 1)
+	} else { /* stack level */
+		if !l1.GetStack(int(ls.CheckInteger(arg+1)), &ar) {
+			ls.PushNil() /* level out of range */
+			return 1
+		}
+	}
+	if !l1.GetInfo(options, &ar) {
+		return ls.ArgError(arg+2, "invalid option")
+	}
+	ls.NewTable() /* table to collect results */
+	if strings.IndexByte(options, 'S') >= 0 {
+		ls.PushString(ar.Source)
+		ls.SetField(-2, "source")
+		ls.PushString(ar.ShortSrc)
+		ls.SetField(-2, "short_src")
+		ls.PushInteger(int64(ar.LineDefined))
+		ls.SetField(-2, "linedefined")
+		ls.PushInteger(int64(ar.LastLineDefined))
+		ls.SetField(-2, "lastlinedefined")
+		ls.PushString(ar.What)
+		ls.SetField(-2, "what")
+	}
+	if strings.IndexByte(options, 'l') >= 0 {
+		ls.PushInteger(int64(ar.CurrentLine))
+		ls.SetField(-2, "currentline")
+	}
+	if strings.IndexByte(options, 'u') >= 0 {
+		ls.PushInteger(int64(ar.NUps))
+		ls.SetField(-2, "nups")
+		ls.PushInteger(int64(ar.NParams))
+		ls.SetField(-2, "nparams")
+		ls.PushBoolean(ar.IsVararg)
+		ls.SetField(-2, "isvararg")
+	}
+	if strings.IndexByte(options, 'n') >= 0 {
+		if ar.Name != "" { // 没有名字时name字段为nil
+			ls.PushString(ar.Name)
+			ls.SetField(-2, "name")
+		}
+		ls.PushString(ar.NameWhat)
+		ls.SetField(-2, "namewhat")
+	}
+	if strings.IndexByte(options, 't') >= 0 {
+		ls.PushBoolean(ar.IsTailCall)
+		ls.SetField(-2, "istailcall")
+	}
+	if strings.IndexByte(options, 'L') >= 0 {
+		treatStackOption(ls, l1, "activelines")
+	}
+	if strings.IndexByte(options, 'f') >= 0 {
+		treatStackOption(ls, l1, "func")
+	}
+	return 1 /* return table */
+}
+
+// debug.getlocal ([thread,] f, local)
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.getlocal
+// lua-5.3.4/src/ldblib.c#db_getlocal()
+func dbGetLocal(ls LuaState) int {
+	var ar LuaDebug
+	l1, arg := getThread(ls)
+	nvar := int(ls.CheckInteger(arg + 2)) /* local-variable index */
+	if ls.IsFunction(arg + 1) {           /* function argument? */
+		ls.PushValue(arg + 1) /* push function */
+		if name, ok := ls.GetLocal(nil, nvar); ok {
+			ls.PushString(name) /* push local name */
+		} else {
+			ls.PushNil()
+		}
+		return 1 /* return only name (there is no value) */
+	}
+	/* stack-level argument */
+	level := int(ls.CheckInteger(arg + 1))
+	if !l1.GetStack(level, &ar) { /* out of range? */
+		return ls.ArgError(arg+1, "level out of range")
+	}
+	checkStack(ls, l1, 1)
+	if name, ok := l1.GetLocal(&ar, nvar); ok {
+		l1.XMove(ls, 1)     /* move local value */
+		ls.PushString(name) /* push name */
+		ls.Rotate(-2, 1)    /* re-order */
+		return 2
+	}
+	ls.PushNil() /* no name (nor value) */
+	return 1
+}
+
+// debug.setlocal ([thread,] level, local, value)
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.setlocal
+// lua-5.3.4/src/ldblib.c#db_setlocal()
+func dbSetLocal(ls LuaState) int {
+	var ar LuaDebug
+	l1, arg := getThread(ls)
+	level := int(ls.CheckInteger(arg + 1))
+	nvar := int(ls.CheckInteger(arg + 2))
+	if !l1.GetStack(level, &ar) { /* out of range? */
+		return ls.ArgError(arg+1, "level out of range")
+	}
+	ls.CheckAny(arg + 3)
+	ls.SetTop(arg + 3)
+	checkStack(ls, l1, 1)
+	ls.XMove(l1, 1)
+	if name, ok := l1.SetLocal(&ar, nvar); ok {
+		ls.PushString(name)
+	} else {
+		l1.Pop(1) /* pop value (if not popped by 'SetLocal') */
+		ls.PushNil()
+	}
+	return 1
+}
+
+// get (if 'get' is true) or set an upvalue from a closure
+// lua-5.3.4/src/ldblib.c#auxupvalue()
+func auxUpvalue(ls LuaState, get bool) int {
+	n := int(ls.CheckInteger(2))   /* upvalue index */
+	ls.CheckType(1, LUA_TFUNCTION) /* closure */
+	if get {
+		name, ok := ls.GetUpvalue(1, n)
+		if !ok {
+			return 0
+		}
+		ls.PushString(name)
+		ls.Insert(-2)
+		return 2
+	}
+	name, ok := ls.SetUpvalue(1, n)
+	if !ok {
+		return 0
+	}
+	ls.PushString(name)
+	return 1
+}
+
+// debug.getupvalue (f, up)
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.getupvalue
+// lua-5.3.4/src/ldblib.c#db_getupvalue()
+func dbGetUpvalue(ls LuaState) int {
+	return auxUpvalue(ls, true)
+}
+
+// debug.setupvalue (f, up, value)
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.setupvalue
+// lua-5.3.4/src/ldblib.c#db_setupvalue()
+func dbSetUpvalue(ls LuaState) int {
+	ls.CheckAny(3)
+	return auxUpvalue(ls, false)
+}
+
+// 检查第argf个参数是函数，第argnup个参数是它的有效upvalue索引
+// lua-5.3.4/src/ldblib.c#checkupval()
+func checkUpval(ls LuaState, argf, argnup int) int {
+	nup := int(ls.CheckInteger(argnup)) /* upvalue index */
+	ls.CheckType(argf, LUA_TFUNCTION)   /* closure */
+	_, ok := ls.GetUpvalue(argf, nup)
+	ls.ArgCheck(ok, argnup, "invalid upvalue index")
+	ls.Pop(1) /* remove upvalue value */
+	return nup
+}
+
+// debug.upvalueid (f, n)
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.upvalueid
+// lua-5.3.4/src/ldblib.c#db_upvalueid()
+func dbUpvalueId(ls LuaState) int {
+	n := checkUpval(ls, 1, 2)
+	ls.PushLightUserdata(ls.UpvalueId(1, n))
+	return 1
+}
+
+// debug.upvaluejoin (f1, n1, f2, n2)
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.upvaluejoin
+// lua-5.3.4/src/ldblib.c#db_upvaluejoin()
+func dbUpvalueJoin(ls LuaState) int {
+	n1 := checkUpval(ls, 1, 2)
+	n2 := checkUpval(ls, 3, 4)
+	ls.ArgCheck(!ls.IsGoFunction(1), 1, "Lua function expected")
+	ls.ArgCheck(!ls.IsGoFunction(3), 3, "Lua function expected")
+	ls.UpvalueJoin(1, n1, 3, n2)
+	return 0
+}
+
+/*
+** The hook table at registry[HOOKKEY] maps threads to their current
+** hook function. (We only need the unique address of 'HOOKKEY'.)
+ */
+const HOOKKEY = "_HKEY"
+
+var hookNames = []string{"call", "return", "line", "count", "tail call"}
+
+// 调用debug.sethook设置的Lua钩子函数，参数是事件名和当前行号
+// lua-5.3.4/src/ldblib.c#hookf()
+func hookf(ls LuaState, ar *LuaDebug) {
+	ls.GetField(LUA_REGISTRYINDEX, HOOKKEY)
+	ls.PushThread()
+	if ls.RawGet(-2) == LUA_TFUNCTION { /* is there a hook function? */
+		ls.PushString(hookNames[ar.Event]) /* push event name */
+		if ar.CurrentLine >= 0 {
+			ls.PushInteger(int64(ar.CurrentLine)) /* push current line */
+		} else {
+			ls.PushNil()
+		}
+		ls.GetInfo("lS", ar)
+		ls.Call(2, 0) /* call hook function */
+	}
+}
+
+// 把字符串形式的掩码转换成事件掩码
+// lua-5.3.4/src/ldblib.c#makemask()
+func makeMask(smask string, count int) int {
+	mask := 0
+	if strings.IndexByte(smask, 'c') >= 0 {
+		mask |= LUA_MASKCALL
+	}
+	if strings.IndexByte(smask, 'r') >= 0 {
+		mask |= LUA_MASKRET
+	}
+	if strings.IndexByte(smask, 'l') >= 0 {
+		mask |= LUA_MASKLINE
+	}
+	if count > 0 {
+		mask |= LUA_MASKCOUNT
+	}
+	return mask
+}
+
+// 把事件掩码转换成字符串
+// lua-5.3.4/src/ldblib.c#unmakemask()
+func unmakeMask(mask int) string {
+	smask := ""
+	if mask&LUA_MASKCALL != 0 {
+		smask += "c"
+	}
+	if mask&LUA_MASKRET != 0 {
+		smask += "r"
+	}
+	if mask&LUA_MASKLINE != 0 {
+		smask += "l"
+	}
+	return smask
+}
+
+// debug.sethook ([thread,] hook, mask [, count])
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.sethook
+// lua-5.3.4/src/ldblib.c#db_sethook()
+func dbSetHook(ls LuaState) int {
+	var mask, count int
+	var fn LuaHook
+	l1, arg := getThread(ls)
+	if ls.IsNoneOrNil(arg + 1) { /* no hook? */
+		ls.SetTop(arg + 1)
+		fn, mask, count = nil, 0, 0 /* turn off hooks */
+	} else {
+		smask := ls.CheckString(arg + 2)
+		ls.CheckType(arg+1, LUA_TFUNCTION)
+		count = int(ls.OptInteger(arg+3, 0))
+		fn, mask = hookf, makeMask(smask, count)
+	}
+	if ls.GetField(LUA_REGISTRYINDEX, HOOKKEY) == LUA_TNIL {
+		ls.Pop(1)
+		ls.CreateTable(0, 2) /* create a hook table */
+		ls.PushValue(-1)
+		ls.SetField(LUA_REGISTRYINDEX, HOOKKEY) /* set it in position */
+		ls.PushString("k")
+		ls.SetField(-2, "__mode") /** hooktable.__mode = "k" */
+		ls.PushValue(-1)
+		ls.SetMetatable(-2) /* setmetatable(hooktable) = hooktable */
+	}
+	checkStack(ls, l1, 1)
+	l1.PushThread()
+	l1.XMove(ls, 1)       /* key (thread) */
+	ls.PushValue(arg + 1) /* value (hook function) */
+	ls.RawSet(-3)         /* hooktable[l1] = new Lua hook */
+	l1.SetHook(fn, mask, count)
+	return 0
+}
+
+// debug.gethook ([thread])
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.gethook
+// lua-5.3.4/src/ldblib.c#db_gethook()
+func dbGetHook(ls LuaState) int {
+	l1, _ := getThread(ls)
+	mask := l1.GetHookMask()
+	hook := l1.GetHook()
+	if hook == nil { /* no hook? */
+		ls.PushNil()
+	} else if reflect.ValueOf(hook).Pointer() != reflect.ValueOf(hookf).Pointer() { /* external hook? */
+		ls.PushString("external hook")
+	} else { /* hook table must exist */
+		ls.GetField(LUA_REGISTRYINDEX, HOOKKEY)
+		checkStack(ls, l1, 1)
+		l1.PushThread()
+		l1.XMove(ls, 1)
+		ls.RawGet(-2) /* 1st result = hooktable[l1] */
+		ls.Remove(-2) /* remove hook table */
+	}
+	ls.PushString(unmakeMask(mask))          /* 2nd result = mask */
+	ls.PushInteger(int64(l1.GetHookCount())) /* 3rd result = count */
+	return 3
+}
+
+// 交互式调试时从标准输入读取命令
+var dbStdin = bufio.NewReader(os.Stdin)
+
+// debug.debug ()
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.debug
+// lua-5.3.4/src/ldblib.c#db_debug()
+func dbDebug(ls LuaState) int {
+	for {
+		fmt.Fprint(os.Stderr, "lua_debug> ")
+		line, err := dbStdin.ReadString('\n')
+		if (err != nil && line == "") || line == "cont\n" {
+			return 0
+		}
+		if ls.Load([]byte(line), "=(debug command)", "bt") != LUA_OK ||
+			ls.PCall(0, 0, 0) != LUA_OK {
+			fmt.Fprintln(os.Stderr, ls.ToString(-1))
+		}
+		ls.SetTop(0) /* remove eventual returns */
+	}
+}
+
+// debug.traceback ([thread,] [message [, level]])
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.traceback
+// lua-5.3.4/src/ldblib.c#db_traceback()
+func dbTraceback(ls LuaState) int {
+	l1, arg := getThread(ls)
+	msg, ok := ls.ToStringX(arg + 1)
+	if !ok && !ls.IsNoneOrNil(arg+1) { /* non-string 'msg'? */
+		ls.PushValue(arg + 1) /* return it untouched */
+	} else {
+		level := 0
+		if ls == l1 {
+			level = 1
+		}
+		ls.Traceback(l1, msg, int(ls.OptInteger(arg+2, int64(level))))
+	}
+	return 1
+}
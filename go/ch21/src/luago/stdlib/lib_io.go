@@ -0,0 +1,844 @@
+package stdlib
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	. "go/ch21/src/luago/api"
+)
+
+/* key, in the registry, for the metatable of file handles */
+const LUA_FILEHANDLE = "FILE*"
+
+/* keys, in the registry, for the default input and output files */
+const (
+	IO_INPUT  = "_IO_input"
+	IO_OUTPUT = "_IO_output"
+)
+
+// 文件句柄，作为用户数据交给Lua
+type luaStream struct {
+	file    *os.File
+	reader  *bufio.Reader // 读缓冲
+	writer  *bufio.Writer // 写缓冲，nil表示不缓冲
+	lineBuf bool          // 是否行缓冲
+	cmd     *exec.Cmd     // io.popen创建的进程
+	tmp     string        // io.tmpfile创建的临时文件，关闭时删除
+	closef  GoFunction    // 关闭函数，nil表示已经关闭
+}
+
+var ioLib = map[string]GoFunction{
+	"close":   ioClose,
+	"flush":   ioFlush,
+	"input":   ioInput,
+	"lines":   ioLines,
+	"open":    ioOpen,
+	"output":  ioOutput,
+	"popen":   ioPopen,
+	"read":    ioRead,
+	"tmpfile": ioTmpFile,
+	"type":    ioType,
+	"write":   ioWrite,
+}
+
+// 文件句柄的方法
+var fileMethods = map[string]GoFunction{
+	"close":      ioClose,
+	"flush":      fFlush,
+	"lines":      fLines,
+	"read":       fRead,
+	"seek":       fSeek,
+	"setvbuf":    fSetVBuf,
+	"write":      fWrite,
+	"__gc":       fGC,
+	"__close":    fGC,
+	"__tostring": fToString,
+}
+
+func OpenIOLib(ls LuaState) int {
+	ls.NewLib(ioLib) /* new module */
+	createMeta(ls)
+	/* create (and set) default files */
+	createStdFile(ls, os.Stdin, IO_INPUT, "stdin")
+	createStdFile(ls, os.Stdout, IO_OUTPUT, "stdout")
+	createStdFile(ls, os.Stderr, "", "stderr")
+	return 1
+}
+
+// 创建文件句柄的元表
+// lua-5.3.4/src/liolib.c#createmeta()
+func createMeta(ls LuaState) {
+	ls.NewMetatable(LUA_FILEHANDLE) /* create metatable for file handles */
+	ls.PushValue(-1)                /* push metatable */
+	ls.SetField(-2, "__index")      /* metatable.__index = metatable */
+	ls.SetFuncs(fileMethods, 0)     /* add file methods to new metatable */
+	ls.Pop(1)                       /* pop new metatable */
+}
+
+// lua-5.3.4/src/liolib.c#createstdfile()
+func createStdFile(ls LuaState, f *os.File, k, fname string) {
+	p := newPrefile(ls)
+	p.file = f
+	p.closef = ioNoClose
+	if k != "" {
+		ls.PushValue(-1)
+		ls.SetField(LUA_REGISTRYINDEX, k) /* add file to registry */
+	}
+	ls.SetField(-2, fname) /* add file to module */
+}
+
+// 创建一个还没有打开文件的句柄并推入栈顶
+// lua-5.3.4/src/liolib.c#newprefile()
+func newPrefile(ls LuaState) *luaStream {
+	p := &luaStream{}
+	ls.NewUserdata(p)
+	ls.GetField(LUA_REGISTRYINDEX, LUA_FILEHANDLE)
+	ls.SetMetatable(-2)
+	return p
+}
+
+// 创建一个文件句柄，关闭函数为普通的文件关闭
+func newFile(ls LuaState) *luaStream {
+	p := newPrefile(ls)
+	p.closef = ioFClose
+	return p
+}
+
+func toStream(ls LuaState) *luaStream {
+	return ls.CheckUdata(1, LUA_FILEHANDLE).(*luaStream)
+}
+
+func isClosed(p *luaStream) bool {
+	return p.closef == nil
+}
+
+// 确保参数是没有关闭的文件
+// lua-5.3.4/src/liolib.c#tofile()
+func toFile(ls LuaState) *luaStream {
+	p := toStream(ls)
+	if isClosed(p) {
+		ls.Error2("attempt to use a closed file")
+	}
+	return p
+}
+
+// 调用文件的关闭函数
+// lua-5.3.4/src/liolib.c#aux_close()
+func auxClose(ls LuaState) int {
+	p := toStream(ls)
+	cf := p.closef
+	p.closef = nil /* mark stream as closed */
+	return cf(ls)  /* close it */
+}
+
+// 标准文件不能关闭
+func ioNoClose(ls LuaState) int {
+	p := toStream(ls)
+	p.closef = ioNoClose /* keep file opened */
+	ls.PushNil()
+	ls.PushString("cannot close standard file")
+	return 2
+}
+
+// 关闭普通文件
+func ioFClose(ls LuaState) int {
+	p := toStream(ls)
+	err := p.flush()
+	if e := p.file.Close(); err == nil {
+		err = e
+	}
+	if p.tmp != "" {
+		os.Remove(p.tmp)
+	}
+	return fileResult(ls, err, "")
+}
+
+// 关闭io.popen打开的文件，返回进程的退出状态
+// lua-5.3.4/src/liolib.c#io_pclose()
+func ioPClose(ls LuaState) int {
+	p := toStream(ls)
+	p.flush()
+	p.file.Close()
+	return execResult(ls, p.cmd.Wait())
+}
+
+// io.close ([file])
+// file:close ()
+// http://www.lua.org/manual/5.3/manual.html#pdf-io.close
+// lua-5.3.4/src/liolib.c#io_close()
+func ioClose(ls LuaState) int {
+	if ls.IsNone(1) { /* no argument? */
+		ls.GetField(LUA_REGISTRYINDEX, IO_OUTPUT) /* use standard output */
+	}
+	toFile(ls) /* make sure argument is an open stream */
+	return auxClose(ls)
+}
+
+// 句柄被回收或者离开作用域时关闭文件
+// lua-5.3.4/src/liolib.c#f_gc()
+func fGC(ls LuaState) int {
+	p := toStream(ls)
+	if !isClosed(p) && p.file != nil {
+		auxClose(ls) /* ignore closed and incompletely open files */
+	}
+	return 0
+}
+
+// lua-5.3.4/src/liolib.c#f_tostring()
+func fToString(ls LuaState) int {
+	p := toStream(ls)
+	if isClosed(p) {
+		ls.PushString("file (closed)")
+	} else {
+		ls.PushString(fmt.Sprintf("file (%p)", p))
+	}
+	return 1
+}
+
+// io.open (filename [, mode])
+// http://www.lua.org/manual/5.3/manual.html#pdf-io.open
+// lua-5.3.4/src/liolib.c#io_open()
+func ioOpen(ls LuaState) int {
+	filename := ls.CheckString(1)
+	mode := ls.OptString(2, "r")
+	flag, ok := fileFlag(mode)
+	ls.ArgCheck(ok, 2, "invalid mode")
+	p := newFile(ls)
+	f, err := os.OpenFile(filename, flag, 0666)
+	if err != nil {
+		return fileResult(ls, err, filename)
+	}
+	p.file = f
+	return 1
+}
+
+// 把C风格的打开模式转换成os.OpenFile的标志
+// lua-5.3.4/src/liolib.c#l_checkmode()
+func fileFlag(mode string) (int, bool) {
+	m := strings.TrimSuffix(mode, "b")
+	switch strings.Replace(m, "+b", "+", 1) {
+	case "r":
+		return os.O_RDONLY, true
+	case "w":
+		return os.O_WRONLY | os.O_CREATE | os.O_TRUNC, true
+	case "a":
+		return os.O_WRONLY | os.O_CREATE | os.O_APPEND, true
+	case "r+":
+		return os.O_RDWR, true
+	case "w+":
+		return os.O_RDWR | os.O_CREATE | os.O_TRUNC, true
+	case "a+":
+		return os.O_RDWR | os.O_CREATE | os.O_APPEND, true
+	}
+	return 0, false
+}
+
+// io.popen (prog [, mode])
+// http://www.lua.org/manual/5.3/manual.html#pdf-io.popen
+// lua-5.3.4/src/liolib.c#io_popen()
+func ioPopen(ls LuaState) int {
+	prog := ls.CheckString(1)
+	mode := ls.OptString(2, "r")
+	ls.ArgCheck(mode == "r" || mode == "w", 2, "invalid mode")
+	p := newPrefile(ls)
+	cmd := exec.Command("/bin/sh", "-c", prog)
+	cmd.Stderr = os.Stderr
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fileResult(ls, err, prog)
+	}
+	if mode == "r" {
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = w
+		p.file = r
+	} else {
+		cmd.Stdin = r
+		cmd.Stdout = os.Stdout
+		p.file = w
+	}
+	if err := cmd.Start(); err != nil {
+		r.Close()
+		w.Close()
+		return fileResult(ls, err, prog)
+	}
+	if mode == "r" { /* the child process owns the other end of the pipe */
+		w.Close()
+	} else {
+		r.Close()
+	}
+	p.cmd = cmd
+	p.closef = ioPClose
+	return 1
+}
+
+// io.tmpfile ()
+// http://www.lua.org/manual/5.3/manual.html#pdf-io.tmpfile
+// lua-5.3.4/src/liolib.c#io_tmpfile()
+func ioTmpFile(ls LuaState) int {
+	p := newFile(ls)
+	f, err := os.CreateTemp("", "lua_")
+	if err != nil {
+		return fileResult(ls, err, "")
+	}
+	p.file = f
+	p.tmp = f.Name()
+	return 1
+}
+
+// io.type (obj)
+// http://www.lua.org/manual/5.3/manual.html#pdf-io.type
+// lua-5.3.4/src/liolib.c#io_type()
+func ioType(ls LuaState) int {
+	ls.CheckAny(1)
+	if data := ls.TestUdata(1, LUA_FILEHANDLE); data == nil {
+		ls.PushNil() /* not a file */
+	} else if isClosed(data.(*luaStream)) {
+		ls.PushString("closed file")
+	} else {
+		ls.PushString("file")
+	}
+	return 1
+}
+
+// 获取默认输入/输出文件
+// lua-5.3.4/src/liolib.c#getiofile()
+func getIOFile(ls LuaState, findex string) *luaStream {
+	ls.GetField(LUA_REGISTRYINDEX, findex)
+	p := ls.ToUserdata(-1).(*luaStream)
+	if isClosed(p) {
+		ls.Error2("standard %s file is closed", findex[len("_IO_"):])
+	}
+	return p
+}
+
+// 设置或者获取默认输入/输出文件
+// lua-5.3.4/src/liolib.c#g_iofile()
+func gIOFile(ls LuaState, f, mode string) int {
+	if !ls.IsNoneOrNil(1) {
+		if filename, ok := ls.ToStringX(1); ok && ls.Type(1) == LUA_TSTRING {
+			flag, _ := fileFlag(mode)
+			p := newFile(ls)
+			file, err := os.OpenFile(filename, flag, 0666)
+			if err != nil {
+				ls.Error2("cannot open file '%s' (%s)", filename, unwrapError(err))
+			}
+			p.file = file
+		} else {
+			toFile(ls) /* check that it's a valid file handle */
+			ls.PushValue(1)
+		}
+		ls.SetField(LUA_REGISTRYINDEX, f)
+	}
+	/* return current value */
+	ls.GetField(LUA_REGISTRYINDEX, f)
+	return 1
+}
+
+// io.input ([file])
+// http://www.lua.org/manual/5.3/manual.html#pdf-io.input
+func ioInput(ls LuaState) int {
+	return gIOFile(ls, IO_INPUT, "r")
+}
+
+// io.output ([file])
+// http://www.lua.org/manual/5.3/manual.html#pdf-io.output
+func ioOutput(ls LuaState) int {
+	return gIOFile(ls, IO_OUTPUT, "w")
+}
+
+// 创建逐行读取文件的迭代器，文件和读取格式作为upvalue
+// lua-5.3.4/src/liolib.c#aux_lines()
+func auxLines(ls LuaState, toclose bool) {
+	n := ls.GetTop() - 1 /* number of arguments to read */
+	ls.ArgCheck(n <= 250, 252, "too many arguments")
+	ls.PushInteger(int64(n)) /* number of arguments to read */
+	ls.PushBoolean(toclose)  /* close/not close file when finished */
+	ls.Rotate(2, 2)          /* move 'n' and 'toclose' to their positions */
+	ls.PushGoClosure(ioReadline, 3+n)
+}
+
+// file:lines (···)
+// http://www.lua.org/manual/5.3/manual.html#pdf-file:lines
+func fLines(ls LuaState) int {
+	toFile(ls) /* check that it's a valid file handle */
+	auxLines(ls, false)
+	return 1
+}
+
+// io.lines ([filename, ···])
+// http://www.lua.org/manual/5.3/manual.html#pdf-io.lines
+// lua-5.3.4/src/liolib.c#io_lines()
+func ioLines(ls LuaState) int {
+	toclose := false
+	if ls.IsNone(1) {
+		ls.PushNil() /* at least one argument */
+	}
+	if ls.IsNil(1) { /* no file name? */
+		ls.GetField(LUA_REGISTRYINDEX, IO_INPUT) /* get default input */
+		ls.Replace(1)                            /* put it at index 1 */
+		toFile(ls)                               /* check that it's a valid file handle */
+	} else { /* open a new file */
+		filename := ls.CheckString(1)
+		flag, _ := fileFlag("r")
+		p := newFile(ls)
+		file, err := os.OpenFile(filename, flag, 0666)
+		if err != nil { // 和io.open一样报告文件名
+			ls.Error2("%s: %s", filename, unwrapError(err))
+		}
+		p.file = file
+		ls.Replace(1) /* put file at index 1 */
+		toclose = true
+	}
+	auxLines(ls, toclose)
+	return 1
+}
+
+// 迭代器函数
+// lua-5.3.4/src/liolib.c#io_readline()
+func ioReadline(ls LuaState) int {
+	p := ls.ToUserdata(LuaUpvalueIndex(1)).(*luaStream)
+	n := int(ls.ToInteger(LuaUpvalueIndex(2)))
+	if isClosed(p) { /* file is already closed? */
+		return ls.Error2("file is already closed")
+	}
+	ls.SetTop(1)
+	ls.CheckStack2(n, "too many arguments")
+	for i := 1; i <= n; i++ { /* push arguments to 'g_read' */
+		ls.PushValue(LuaUpvalueIndex(3 + i))
+	}
+	n = gRead(ls, p, 2)   /* 'n' is number of results */
+	if ls.ToBoolean(-n) { /* read at least one value? */
+		return n /* return them */
+	}
+	/* first result is nil: EOF or error */
+	if n > 1 { /* is there error information? */
+		/* 2nd result is error message */
+		return ls.Error2("%s", ls.ToString(-n+1))
+	}
+	if ls.ToBoolean(LuaUpvalueIndex(3)) { /* generate error? */
+		ls.SetTop(0)
+		ls.PushValue(LuaUpvalueIndex(1))
+		auxClose(ls) /* close it */
+	}
+	return 0
+}
+
+// io.read (···)
+// http://www.lua.org/manual/5.3/manual.html#pdf-io.read
+func ioRead(ls LuaState) int {
+	return gRead(ls, getIOFile(ls, IO_INPUT), 1)
+}
+
+// file:read (···)
+// http://www.lua.org/manual/5.3/manual.html#pdf-file:read
+func fRead(ls LuaState) int {
+	return gRead(ls, toFile(ls), 2)
+}
+
+// 按照格式依次读取，从first开始的参数是读取格式
+// lua-5.3.4/src/liolib.c#g_read()
+func gRead(ls LuaState, p *luaStream, first int) int {
+	nargs := ls.GetTop() - 1
+	if err := p.flush(); err != nil {
+		return fileResult(ls, err, "")
+	}
+	r := p.getReader()
+	success := true
+	var err error
+	n := first
+	if nargs == 0 { /* no arguments? */
+		success, err = readLine(ls, r, true)
+		n = first + 1 /* to return 1 result */
+	} else {
+		/* ensure stack space for all results and for auxlib's buffer */
+		ls.CheckStack2(nargs+LUA_MINSTACK, "too many arguments")
+		for ; nargs > 0 && success; n, nargs = n+1, nargs-1 {
+			if ls.Type(n) == LUA_TNUMBER {
+				l := ls.CheckInteger(n)
+				if l == 0 {
+					success = testEOF(r)
+					ls.PushString("")
+				} else {
+					success, err = readChars(ls, r, l)
+				}
+			} else {
+				format := strings.TrimPrefix(ls.CheckString(n), "*") /* skip optional '*' (for compatibility) */
+				switch {
+				case strings.HasPrefix(format, "n"): /* number */
+					success = readNumber(ls, r)
+				case strings.HasPrefix(format, "l"): /* line */
+					success, err = readLine(ls, r, true)
+				case strings.HasPrefix(format, "L"): /* line with end-of-line */
+					success, err = readLine(ls, r, false)
+				case strings.HasPrefix(format, "a"): /* file */
+					err = readAll(ls, r)
+					success = true /* always success */
+				default:
+					return ls.ArgError(n, "invalid format")
+				}
+			}
+		}
+	}
+	if err != nil {
+		return fileResult(ls, err, "")
+	}
+	if !success {
+		ls.Pop(1)    /* remove last result */
+		ls.PushNil() /* push nil instead */
+	}
+	return n - first
+}
+
+// 判断是否已经到达文件末尾
+func testEOF(r *bufio.Reader) bool {
+	_, err := r.Peek(1)
+	return err == nil
+}
+
+// 读取一行，chop表示是否去掉行尾的换行符
+// lua-5.3.4/src/liolib.c#read_line()
+func readLine(ls LuaState, r *bufio.Reader, chop bool) (bool, error) {
+	line, err := r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	if chop {
+		line = strings.TrimSuffix(line, "\n")
+	}
+	ls.PushString(line)
+	/* return ok if read something (either a newline or something else) */
+	return err == nil || len(line) > 0, nil
+}
+
+// 读取n个字节
+// lua-5.3.4/src/liolib.c#read_chars()
+func readChars(ls LuaState, r *bufio.Reader, n int64) (bool, error) {
+	buf := make([]byte, n)
+	nr, err := io.ReadFull(r, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	ls.PushString(string(buf[:nr]))
+	return nr > 0, nil /* true iff read something */
+}
+
+// 读取文件剩余的全部内容
+// lua-5.3.4/src/liolib.c#read_all()
+func readAll(ls LuaState, r *bufio.Reader) error {
+	data, err := io.ReadAll(r)
+	ls.PushString(string(data))
+	return err
+}
+
+// 最长的数字
+const L_MAXLENNUM = 200
+
+// 读取数字时使用的辅助结构
+// lua-5.3.4/src/liolib.c#RN
+type rn struct {
+	r    *bufio.Reader
+	c    byte   /* current character (look ahead) */
+	eof  bool   /* no more characters */
+	buff []byte /* buffer for numeral */
+}
+
+// 把当前字符加入缓冲区并读取下一个字符
+// lua-5.3.4/src/liolib.c#nextc()
+func (self *rn) nextc() bool {
+	if len(self.buff) >= L_MAXLENNUM { /* buffer overflow? */
+		self.buff = self.buff[:0] /* invalidate result */
+		return false              /* fail */
+	}
+	self.buff = append(self.buff, self.c) /* save current char */
+	self.read()                           /* read next one */
+	return true
+}
+
+func (self *rn) read() {
+	c, err := self.r.ReadByte()
+	self.c, self.eof = c, err != nil
+}
+
+// 如果当前字符属于set，接受它
+// lua-5.3.4/src/liolib.c#test2()
+func (self *rn) test2(set string) bool {
+	if !self.eof && strings.IndexByte(set, self.c) >= 0 {
+		return self.nextc()
+	}
+	return false
+}
+
+// 读取一串数字
+// lua-5.3.4/src/liolib.c#readdigits()
+func (self *rn) readDigits(hex bool) int {
+	count := 0
+	for !self.eof && isDigitOf(self.c, hex) && self.nextc() {
+		count++
+	}
+	return count
+}
+
+func isDigitOf(c byte, hex bool) bool {
+	if c >= '0' && c <= '9' {
+		return true
+	}
+	return hex && (c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F')
+}
+
+// 按照Lua的数字语法读取尽可能长的数字，然后转换成数字
+// lua-5.3.4/src/liolib.c#read_number()
+func readNumber(ls LuaState, r *bufio.Reader) bool {
+	rn := &rn{r: r}
+	count := 0
+	hex := false
+	rn.read()
+	for !rn.eof && isSpace(rn.c) { /* skip spaces */
+		rn.read()
+	}
+	rn.test2("-+")      /* optional signal */
+	if rn.test2("00") { /* leading zero? */
+		if rn.test2("xX") {
+			hex = true /* numeral is hexadecimal */
+		} else {
+			count = 1 /* count initial '0' as a valid digit */
+		}
+	}
+	count += rn.readDigits(hex) /* integral part */
+	if rn.test2(".") {          /* decimal point? */
+		count += rn.readDigits(hex) /* fractional part */
+	}
+	if count > 0 { /* exponent mark? */
+		exp := "eE"
+		if hex {
+			exp = "pP"
+		}
+		if rn.test2(exp) {
+			rn.test2("-+") /* exponent signal */
+			rn.readDigits(false)
+		}
+	}
+	if !rn.eof {
+		r.UnreadByte() /* unread look-ahead char */
+	}
+	if ls.StringToNumber(string(rn.buff)) {
+		return true /* ok */
+	}
+	/* invalid format */
+	ls.PushNil() /* "result" to be removed */
+	return false /* read fails */
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+// io.write (···)
+// http://www.lua.org/manual/5.3/manual.html#pdf-io.write
+func ioWrite(ls LuaState) int {
+	return gWrite(ls, getIOFile(ls, IO_OUTPUT), 1)
+}
+
+// file:write (···)
+// http://www.lua.org/manual/5.3/manual.html#pdf-file:write
+func fWrite(ls LuaState) int {
+	p := toFile(ls)
+	ls.PushValue(1) /* push file at the stack top (to be returned) */
+	return gWrite(ls, p, 2)
+}
+
+// 依次写入参数，成功时返回文件
+// lua-5.3.4/src/liolib.c#g_write()
+func gWrite(ls LuaState, p *luaStream, arg int) int {
+	nargs := ls.GetTop() - arg
+	if p.writer == nil {
+		p.syncReader()
+	}
+	var err error
+	for ; nargs > 0 && err == nil; arg, nargs = arg+1, nargs-1 {
+		var s string
+		if ls.Type(arg) == LUA_TNUMBER {
+			/* optimization: could be done exactly as for strings */
+			if ls.IsInteger(arg) {
+				s = fmt.Sprintf("%d", ls.ToInteger(arg))
+			} else {
+				s = fmt.Sprintf("%.14g", ls.ToNumber(arg))
+			}
+		} else {
+			s = ls.CheckString(arg)
+		}
+		err = p.write(s)
+	}
+	if err == nil {
+		return 1 /* file handle already on stack top */
+	}
+	return fileResult(ls, err, "")
+}
+
+// file:seek ([whence [, offset]])
+// http://www.lua.org/manual/5.3/manual.html#pdf-file:seek
+// lua-5.3.4/src/liolib.c#f_seek()
+func fSeek(ls LuaState) int {
+	whences := map[string]int{"set": io.SeekStart, "cur": io.SeekCurrent, "end": io.SeekEnd}
+	p := toFile(ls)
+	op, ok := whences[ls.OptString(2, "cur")]
+	if !ok {
+		return ls.ArgError(2, "invalid option '"+ls.ToString(2)+"'")
+	}
+	offset := ls.OptInteger(3, 0)
+	if err := p.flush(); err != nil {
+		return fileResult(ls, err, "")
+	}
+	if op == io.SeekCurrent && p.reader != nil {
+		offset -= int64(p.reader.Buffered()) /* data read ahead is not consumed yet */
+	}
+	pos, err := p.file.Seek(offset, op)
+	if err != nil {
+		return fileResult(ls, err, "") /* error */
+	}
+	if p.reader != nil {
+		p.reader.Reset(p.file)
+	}
+	ls.PushInteger(pos)
+	return 1
+}
+
+// file:setvbuf (mode [, size])
+// http://www.lua.org/manual/5.3/manual.html#pdf-file:setvbuf
+// lua-5.3.4/src/liolib.c#f_setvbuf()
+func fSetVBuf(ls LuaState) int {
+	p := toFile(ls)
+	mode := ls.CheckString(2)
+	size := int(ls.OptInteger(3, 4096))
+	if err := p.flush(); err != nil {
+		return fileResult(ls, err, "")
+	}
+	switch mode {
+	case "no":
+		p.writer = nil
+	case "full", "line":
+		p.writer = bufio.NewWriterSize(p.file, size)
+		p.lineBuf = mode == "line"
+	default:
+		return ls.ArgError(2, "invalid option '"+mode+"'")
+	}
+	ls.PushBoolean(true)
+	return 1
+}
+
+// io.flush ()
+// http://www.lua.org/manual/5.3/manual.html#pdf-io.flush
+func ioFlush(ls LuaState) int {
+	return fileResult(ls, getIOFile(ls, IO_OUTPUT).flush(), "")
+}
+
+// file:flush ()
+// http://www.lua.org/manual/5.3/manual.html#pdf-file:flush
+func fFlush(ls LuaState) int {
+	return fileResult(ls, toFile(ls).flush(), "")
+}
+
+// 获取读缓冲，第一次读取时创建
+func (self *luaStream) getReader() *bufio.Reader {
+	if self.reader == nil {
+		self.reader = bufio.NewReader(self.file)
+	}
+	return self.reader
+}
+
+// 写入之前把预读但没有消耗的数据退回文件，保证写入位置正确
+func (self *luaStream) syncReader() {
+	if self.reader != nil && self.reader.Buffered() > 0 {
+		self.file.Seek(-int64(self.reader.Buffered()), io.SeekCurrent)
+		self.reader.Reset(self.file)
+	}
+}
+
+func (self *luaStream) write(s string) error {
+	if self.writer == nil {
+		_, err := io.WriteString(self.file, s)
+		return err
+	}
+	if _, err := self.writer.WriteString(s); err != nil {
+		return err
+	}
+	if self.lineBuf && strings.IndexByte(s, '\n') >= 0 {
+		return self.writer.Flush()
+	}
+	return nil
+}
+
+// 把写缓冲中的数据写入文件
+func (self *luaStream) flush() error {
+	if self.writer != nil && self.writer.Buffered() > 0 {
+		self.syncReader()
+		return self.writer.Flush()
+	}
+	return nil
+}
+
+// 返回文件操作的结果，成功时返回true，失败时返回nil、错误消息和错误码
+// lua-5.3.4/src/lauxlib.c#luaL_fileresult()
+func fileResult(ls LuaState, err error, fname string) int {
+	if err == nil {
+		ls.PushBoolean(true)
+		return 1
+	}
+	ls.PushNil()
+	if fname != "" {
+		ls.PushString(fname + ": " + unwrapError(err))
+	} else {
+		ls.PushString(unwrapError(err))
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		ls.PushInteger(int64(errno))
+	} else {
+		ls.PushInteger(0)
+	}
+	return 3
+}
+
+// 返回进程的退出状态
+// lua-5.3.4/src/lauxlib.c#luaL_execresult()
+func execResult(ls LuaState, err error) int {
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return fileResult(ls, err, "")
+	}
+	stat, what := 0, "exit" /* type of termination */
+	if exitErr != nil {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			stat, what = int(ws.Signal()), "signal"
+		} else {
+			stat = exitErr.ExitCode()
+		}
+	}
+	if what == "exit" && stat == 0 { /* successful termination? */
+		ls.PushBoolean(true)
+	} else {
+		ls.PushNil()
+	}
+	ls.PushString(what)
+	ls.PushInteger(int64(stat))
+	return 3 /* return true/nil,what,code */
+}
+
+// 去掉Go错误中的操作和路径信息，只保留类似strerror的描述
+func unwrapError(err error) string {
+	var errno syscall.Errno
+	if errors.As(err, &errno) { // Go的系统错误描述是小写的，strerror首字母大写
+		msg := errno.Error()
+		return strings.ToUpper(msg[:1]) + msg[1:]
+	}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err.Error()
+	}
+	return err.Error()
+}
@@ -93,7 +93,7 @@ func luaSearcher(ls LuaState) int {
 		ls.Error2("'package.path' must be a string")
 	}
 
-	filename, errMsg := _searchPath(name, path, ".", LUA_DIRSEP)
+	filename, errMsg := _searchPath(ls, name, path, ".", LUA_DIRSEP)
 	if errMsg != "" {
 		ls.PushString(errMsg)
 		return 1
@@ -111,11 +111,11 @@ func luaSearcher(ls LuaState) int {
 
 // 封装了一个搜索路径的函数
 func pkgSearchPath(ls LuaState) int {
-	name := ls.CheckString(1)                                                // 模块名
-	path := ls.CheckString(2)                                                // 搜索路径
-	sep := ls.OptString(3, ".")                                              // 路径分隔符
-	rep := ls.OptString(4, LUA_DIRSEP)                                       // 目录分隔符
-	if filename, errMsg := _searchPath(name, path, sep, rep); errMsg == "" { // 搜索成功
+	name := ls.CheckString(1)                                                    // 模块名
+	path := ls.CheckString(2)                                                    // 搜索路径
+	sep := ls.OptString(3, ".")                                                  // 路径分隔符
+	rep := ls.OptString(4, LUA_DIRSEP)                                           // 目录分隔符
+	if filename, errMsg := _searchPath(ls, name, path, sep, rep); errMsg == "" { // 搜索成功
 		ls.PushString(filename)
 		return 1
 	} else { // 搜索失败
@@ -127,14 +127,16 @@ func pkgSearchPath(ls LuaState) int {
 
 // 在搜索路径中搜索Lua文件
 // 参数：文件名，路径字符串，路径分隔符，目录分隔符
-func _searchPath(name, path, sep, dirSep string) (filename, errMsg string) {
+// 文件通过ls.OpenFile()打开，所以状态机有虚拟文件系统时在其中搜索
+func _searchPath(ls LuaState, name, path, sep, dirSep string) (filename, errMsg string) {
 	if sep != "" {
 		name = strings.Replace(name, sep, dirSep, -1) // 将路径分隔符替换为目录分隔符
 	}
 
 	for _, filename := range strings.Split(path, LUA_PATH_SEP) { // 将路径拆分为多个路径
 		filename = strings.Replace(filename, LUA_PATH_MARK, name, -1)
-		if _, err := os.Stat(filename); !os.IsNotExist(err) { // 检查路径是否存在
+		if f, err := ls.OpenFile(filename); err == nil { // 检查文件是否可读
+			f.Close()
 			return filename, ""
 		}
 		errMsg += "\n\tno file '" + filename + "'"
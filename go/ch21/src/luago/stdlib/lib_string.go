@@ -1,6 +1,6 @@
 package stdlib
 
-import "fmt"
+import "math"
 import "strings"
 import . "go/ch21/src/luago/api"
 
@@ -65,6 +65,11 @@ func strRep(ls LuaState) int {
 	} else if n == 1 {
 		ls.PushString(s)
 	} else {
+		l, lsep := int64(len(s)), int64(len(sep))
+		if l+lsep > 0 && n > math.MaxInt64/(l+lsep) { /* may overflow? */
+			return ls.Error2("resulting string too large")
+		}
+		ls.CheckMemory(int(n*(l+lsep) - lsep))
 		a := make([]string, n)
 		for i := 0; i < int(n); i++ {
 			a[i] = s
@@ -188,122 +193,213 @@ func strChar(ls LuaState) int {
 // http://www.lua.org/manual/5.3/manual.html#pdf-string.dump
 // lua-5.3.4/src/lstrlib.c#str_dump()
 func strDump(ls LuaState) int {
-	// strip := ls.ToBoolean(2)
-	// ls.CheckType(1, LUA_TFUNCTION)
-	// ls.SetTop(1)
-	// ls.PushString(string(ls.Dump(strip)))
-	// return 1
-	panic("todo: strDump!")
+	strip := ls.ToBoolean(2)
+	ls.CheckType(1, LUA_TFUNCTION)
+	ls.SetTop(1)
+	chunk := ls.Dump(strip)
+	if chunk == nil {
+		return ls.Error2("unable to dump given function")
+	}
+	ls.PushString(string(chunk))
+	return 1
 }
 
 /* PACK/UNPACK */
 
 // string.packsize (fmt)
 // http://www.lua.org/manual/5.3/manual.html#pdf-string.packsize
+// lua-5.3.4/src/lstrlib.c#str_packsize()
 func strPackSize(ls LuaState) int {
-	fmt := ls.CheckString(1)
-	if fmt == "j" {
-		ls.PushInteger(8) // todo
-	} else {
-		panic("todo: strPackSize!")
+	h := newPackHeader(ls, ls.CheckString(1)) /* format string */
+	totalsize := 0                            /* accumulate total size of result */
+	for h.fmt != "" {
+		opt, size, ntoalign := h.getDetails(totalsize)
+		size += ntoalign /* total space used by option */
+		ls.ArgCheck(totalsize <= MAXSIZE-size, 1, "format result too large")
+		totalsize += size
+		if opt == kString || opt == kZstr {
+			ls.ArgError(1, "variable-length format")
+		}
 	}
+	ls.PushInteger(int64(totalsize))
 	return 1
 }
 
 // string.pack (fmt, v1, v2, ···)
 // http://www.lua.org/manual/5.3/manual.html#pdf-string.pack
+// lua-5.3.4/src/lstrlib.c#str_pack()
 func strPack(ls LuaState) int {
-	panic("todo: strPack!")
+	h := newPackHeader(ls, ls.CheckString(1))
+	var b []byte
+	arg := 1
+	totalsize := 0
+	for h.fmt != "" {
+		opt, size, ntoalign := h.getDetails(totalsize)
+		ls.CheckMemory(len(b) + ntoalign + size) // 结果还没有计入内存统计
+		totalsize += ntoalign + size
+		for ; ntoalign > 0; ntoalign-- {
+			b = append(b, LUAL_PACKPADBYTE) /* fill alignment */
+		}
+		arg++
+		switch opt {
+		case kInt: /* signed integers */
+			n := ls.CheckInteger(arg)
+			if size < SZINT { /* need overflow check? */
+				lim := int64(1) << (size*NB - 1)
+				ls.ArgCheck(-lim <= n && n < lim, arg, "integer overflow")
+			}
+			b = packInt(b, uint64(n), h.islittle, size, n < 0)
+		case kUint: /* unsigned integers */
+			n := ls.CheckInteger(arg)
+			if size < SZINT { /* need overflow check? */
+				ls.ArgCheck(uint64(n) < uint64(1)<<(size*NB), arg, "unsigned overflow")
+			}
+			b = packInt(b, uint64(n), h.islittle, size, false)
+		case kFloat: /* floating-point options */
+			b = packFloat(b, ls.CheckNumber(arg), h.islittle, size)
+		case kChar: /* fixed-size string */
+			s := ls.CheckString(arg)
+			ls.ArgCheck(len(s) <= size, arg, "string longer than given size")
+			b = append(b, s...)              /* add string */
+			for l := len(s); l < size; l++ { /* pad extra space */
+				b = append(b, LUAL_PACKPADBYTE)
+			}
+		case kString: /* strings with length count */
+			s := ls.CheckString(arg)
+			ls.ArgCheck(size >= SIZEOF_SIZE_T || uint64(len(s)) < uint64(1)<<(size*NB),
+				arg, "string length does not fit in given size")
+			b = packInt(b, uint64(len(s)), h.islittle, size, false) /* pack length */
+			ls.CheckMemory(len(b) + len(s))
+			b = append(b, s...)
+			totalsize += len(s)
+		case kZstr: /* zero-terminated string */
+			s := ls.CheckString(arg)
+			ls.ArgCheck(strings.IndexByte(s, 0) < 0, arg, "string contains zeros")
+			ls.CheckMemory(len(b) + len(s) + 1)
+			b = append(b, s...)
+			b = append(b, 0) /* add zero at the end */
+			totalsize += len(s) + 1
+		case kPadding:
+			b = append(b, LUAL_PACKPADBYTE)
+			arg-- /* undo increment */
+		case kPaddalign, kNop:
+			arg-- /* undo increment */
+		}
+	}
+	ls.PushString(string(b))
+	return 1
 }
 
 // string.unpack (fmt, s [, pos])
 // http://www.lua.org/manual/5.3/manual.html#pdf-string.unpack
+// lua-5.3.4/src/lstrlib.c#str_unpack()
 func strUnpack(ls LuaState) int {
-	panic("todo: strUnpack!")
+	h := newPackHeader(ls, ls.CheckString(1))
+	data := ls.CheckString(2)
+	ld := len(data)
+	pos := posRelat(ls.OptInteger(3, 1), ld) - 1
+	n := 0 /* number of results */
+	ls.ArgCheck(pos >= 0 && pos <= ld, 3, "initial position out of string")
+	for h.fmt != "" {
+		opt, size, ntoalign := h.getDetails(pos)
+		if ntoalign+size > ld-pos {
+			ls.ArgError(2, "data string too short")
+		}
+		pos += ntoalign /* skip alignment */
+		/* stack space for item + next position */
+		ls.CheckStack2(2, "too many results")
+		n++
+		switch opt {
+		case kInt, kUint:
+			res := unpackInt(ls, data[pos:], h.islittle, size, opt == kInt)
+			ls.PushInteger(res)
+		case kFloat:
+			ls.PushNumber(unpackFloat(ls, data[pos:], h.islittle, size))
+		case kChar:
+			ls.PushString(data[pos : pos+size])
+		case kString:
+			l := uint64(unpackInt(ls, data[pos:], h.islittle, size, false))
+			ls.ArgCheck(l <= uint64(ld-pos-size), 2, "data string too short")
+			ls.PushString(data[pos+size : pos+size+int(l)])
+			pos += int(l) /* skip string */
+		case kZstr:
+			l := strings.IndexByte(data[pos:], 0)
+			ls.ArgCheck(l >= 0, 2, "unfinished string for format 'z'")
+			ls.PushString(data[pos : pos+l])
+			pos += l + 1 /* skip string plus final '\0' */
+		case kPaddalign, kPadding, kNop:
+			n-- /* undo increment */
+		}
+		pos += size
+	}
+	ls.PushInteger(int64(pos + 1)) /* next position */
+	return n + 1
 }
 
 /* STRING FORMAT */
 
 // string.format (formatstring, ···)
 // http://www.lua.org/manual/5.3/manual.html#pdf-string.format
+// lua-5.3.4/src/lstrlib.c#str_format()
 func strFormat(ls LuaState) int {
-	fmtStr := ls.CheckString(1)
-	if len(fmtStr) <= 1 || strings.IndexByte(fmtStr, '%') < 0 {
-		ls.PushString(fmtStr)
-		return 1
-	}
-
-	argIdx := 1
-	arr := parseFmtStr(fmtStr)
-	for i, s := range arr {
-		if s[0] == '%' {
-			if s == "%%" {
-				arr[i] = "%"
-			} else {
-				argIdx += 1
-				arr[i] = _fmtArg(s, ls, argIdx)
+	top := ls.GetTop()
+	arg := 1
+	strfrmt := ls.CheckString(arg)
+	var b strings.Builder
+	for strfrmt != "" {
+		if strfrmt[0] != L_ESC {
+			b.WriteByte(strfrmt[0])
+			strfrmt = strfrmt[1:]
+		} else if len(strfrmt) > 1 && strfrmt[1] == L_ESC {
+			b.WriteByte(L_ESC) /* %% */
+			strfrmt = strfrmt[2:]
+		} else { /* format item */
+			if arg++; arg > top {
+				ls.ArgError(arg, "no value")
+			}
+			var spec *fmtSpec
+			var item string
+			spec, strfrmt = scanFormat(ls, strfrmt[1:])
+			switch spec.conv {
+			case 'c':
+				item = formatChar(spec, ls.CheckInteger(arg))
+			case 'd', 'i', 'o', 'u', 'x', 'X':
+				item = formatInt(spec, ls.CheckInteger(arg))
+			case 'a', 'A':
+				item = formatHexFloat(spec, ls.CheckNumber(arg))
+			case 'e', 'E', 'f', 'g', 'G':
+				item = formatFloat(spec, ls.CheckNumber(arg))
+			case 'q':
+				item = formatLiteral(ls, arg)
+			case 's':
+				item = formatString(ls, spec, arg)
+			default: /* also treat cases 'pnLlh' */
+				return ls.Error2("invalid option '%%%c' to 'format'", spec.conv)
 			}
+			ls.CheckMemory(b.Len() + len(item)) // 结果还没有计入内存统计
+			b.WriteString(item)
 		}
 	}
-
-	ls.PushString(strings.Join(arr, ""))
+	ls.PushString(b.String())
 	return 1
 }
 
-func _fmtArg(tag string, ls LuaState, argIdx int) string {
-	switch tag[len(tag)-1] { // specifier
-	case 'c': // character
-		return string([]byte{byte(ls.ToInteger(argIdx))})
-	case 'i':
-		tag = tag[:len(tag)-1] + "d" // %i -> %d
-		return fmt.Sprintf(tag, ls.ToInteger(argIdx))
-	case 'd', 'o': // integer, octal
-		return fmt.Sprintf(tag, ls.ToInteger(argIdx))
-	case 'u': // unsigned integer
-		tag = tag[:len(tag)-1] + "d" // %u -> %d
-		return fmt.Sprintf(tag, uint(ls.ToInteger(argIdx)))
-	case 'x', 'X': // hex integer
-		return fmt.Sprintf(tag, uint(ls.ToInteger(argIdx)))
-	case 'f': // float
-		return fmt.Sprintf(tag, ls.ToNumber(argIdx))
-	case 's', 'q': // string
-		return fmt.Sprintf(tag, ls.ToString2(argIdx))
-	default:
-		panic("todo! tag=" + tag)
-	}
-}
-
 /* PATTERN MATCHING */
 
 // string.find (s, pattern [, init [, plain]])
 // http://www.lua.org/manual/5.3/manual.html#pdf-string.find
 func strFind(ls LuaState) int {
-	s := ls.CheckString(1)
-	sLen := len(s)
-	pattern := ls.CheckString(2)
-	init := posRelat(ls.OptInteger(3, 1), sLen)
-	if init < 1 {
-		init = 1
-	} else if init > sLen+1 { /* start after string's end? */
-		ls.PushNil()
-		return 1
-	}
-	plain := ls.ToBoolean(4)
-
-	start, end := find(s, pattern, init, plain)
-
-	if start < 0 {
-		ls.PushNil()
-		return 1
-	}
-	ls.PushInteger(int64(start))
-	ls.PushInteger(int64(end))
-	return 2
+	return strFindAux(ls, true)
 }
 
 // string.match (s, pattern [, init])
 // http://www.lua.org/manual/5.3/manual.html#pdf-string.match
 func strMatch(ls LuaState) int {
+	return strFindAux(ls, false)
+}
+
+// lua-5.3.4/src/lstrlib.c#str_find_aux()
+func strFindAux(ls LuaState, find bool) int {
 	s := ls.CheckString(1)
 	sLen := len(s)
 	pattern := ls.CheckString(2)
@@ -311,62 +407,163 @@ func strMatch(ls LuaState) int {
 	if init < 1 {
 		init = 1
 	} else if init > sLen+1 { /* start after string's end? */
-		ls.PushNil()
+		ls.PushNil() /* cannot find anything */
 		return 1
 	}
-
-	captures := match(s, pattern, init)
-
-	if captures == nil {
-		ls.PushNil()
-		return 1
+	/* explicit request or no special characters? */
+	if find && (ls.ToBoolean(4) || !strings.ContainsAny(pattern, SPECIALS)) {
+		/* do a plain search */
+		if idx := strings.Index(s[init-1:], pattern); idx >= 0 {
+			ls.PushInteger(int64(init + idx))
+			ls.PushInteger(int64(init + idx + len(pattern) - 1))
+			return 2
+		}
 	} else {
-		for i := 0; i < len(captures); i += 2 {
-			capture := s[captures[i]:captures[i+1]]
-			ls.PushString(capture)
+		anchor := strings.HasPrefix(pattern, "^")
+		if anchor {
+			pattern = pattern[1:] /* skip anchor character */
+		}
+		ms := newMatchState(ls, s, pattern)
+		for s1 := init - 1; s1 <= sLen; s1++ {
+			ms.reprepstate()
+			if e := ms.doMatch(s1, 0); e != -1 {
+				if find {
+					ls.PushInteger(int64(s1 + 1)) /* start */
+					ls.PushInteger(int64(e))      /* end */
+					return ms.pushCaptures(-1, 0) + 2
+				}
+				return ms.pushCaptures(s1, e)
+			}
+			if anchor {
+				break
+			}
 		}
-		return len(captures) / 2
 	}
-}
-
-// string.gsub (s, pattern, repl [, n])
-// http://www.lua.org/manual/5.3/manual.html#pdf-string.gsub
-func strGsub(ls LuaState) int {
-	s := ls.CheckString(1)
-	pattern := ls.CheckString(2)
-	repl := ls.CheckString(3) // todo
-	n := int(ls.OptInteger(4, -1))
-
-	newStr, nMatches := gsub(s, pattern, repl, n)
-	ls.PushString(newStr)
-	ls.PushInteger(int64(nMatches))
-	return 2
+	ls.PushNil() /* not found */
+	return 1
 }
 
 // string.gmatch (s, pattern)
 // http://www.lua.org/manual/5.3/manual.html#pdf-string.gmatch
+// lua-5.3.4/src/lstrlib.c#gmatch()
 func strGmatch(ls LuaState) int {
 	s := ls.CheckString(1)
 	pattern := ls.CheckString(2)
+	ms := newMatchState(ls, s, pattern)
+	src, lastMatch := 0, -1
 
 	gmatchAux := func(ls LuaState) int {
-		captures := match(s, pattern, 1)
-		if captures != nil {
-			for i := 0; i < len(captures); i += 2 {
-				capture := s[captures[i]:captures[i+1]]
-				ls.PushString(capture)
+		ms.ls = ls
+		for ; src <= len(s); src++ {
+			ms.reprepstate()
+			if e := ms.doMatch(src, 0); e != -1 && e != lastMatch {
+				start := src
+				src, lastMatch = e, e
+				return ms.pushCaptures(start, e)
 			}
-			s = s[captures[len(captures)-1]:]
-			return len(captures) / 2
-		} else {
-			return 0
 		}
+		return 0 /* not found */
 	}
 
 	ls.PushGoFunction(gmatchAux)
 	return 1
 }
 
+// string.gsub (s, pattern, repl [, n])
+// http://www.lua.org/manual/5.3/manual.html#pdf-string.gsub
+// lua-5.3.4/src/lstrlib.c#str_gsub()
+func strGsub(ls LuaState) int {
+	src := ls.CheckString(1)
+	pattern := ls.CheckString(2)
+	tr := ls.Type(3)
+	maxS := ls.OptInteger(4, int64(len(src)+1))
+	ls.ArgCheck(tr == LUA_TNUMBER || tr == LUA_TSTRING ||
+		tr == LUA_TFUNCTION || tr == LUA_TTABLE, 3,
+		"string/function/table expected")
+
+	anchor := strings.HasPrefix(pattern, "^")
+	if anchor {
+		pattern = pattern[1:] /* skip anchor character */
+	}
+	ms := newMatchState(ls, src, pattern)
+	var b strings.Builder
+	s, lastMatch := 0, -1
+	n := int64(0)
+	for n < maxS {
+		ms.reprepstate()
+		if e := ms.doMatch(s, 0); e != -1 && e != lastMatch { /* match? */
+			n++
+			ms.addValue(&b, s, e, tr) /* add replacement to buffer */
+			ls.CheckMemory(b.Len())   // 结果还没有计入内存统计
+			s, lastMatch = e, e
+		} else if s < len(src) { /* otherwise, skip one character */
+			b.WriteByte(src[s])
+			s++
+		} else {
+			break /* end of subject */
+		}
+		if anchor {
+			break
+		}
+	}
+	b.WriteString(src[s:])
+	ls.PushString(b.String())
+	ls.PushInteger(n) /* number of substitutions */
+	return 2
+}
+
+// 把替换字符串中的%0-%9替换成对应的捕获
+// lua-5.3.4/src/lstrlib.c#add_s()
+func (self *matchState) addS(b *strings.Builder, s, e int) {
+	ls := self.ls
+	news := ls.ToString(3)
+	for i := 0; i < len(news); i++ {
+		if news[i] != L_ESC {
+			b.WriteByte(news[i])
+			continue
+		}
+		i++ /* skip ESC */
+		if i >= len(news) || !isDigit(news[i]) {
+			if i >= len(news) || news[i] != L_ESC {
+				ls.Error2("invalid use of '%c' in replacement string", L_ESC)
+			}
+			b.WriteByte(news[i])
+		} else if news[i] == '0' {
+			b.WriteString(self.src[s:e])
+		} else {
+			self.pushOneCapture(int(news[i]-'1'), s, e)
+			b.WriteString(ls.ToString2(-1)) /* if number, convert it to string */
+			ls.Pop(2)                       /* remove original value and its string */
+		}
+	}
+}
+
+// 根据替换值的类型计算替换结果
+// lua-5.3.4/src/lstrlib.c#add_value()
+func (self *matchState) addValue(b *strings.Builder, s, e int, tr LuaType) {
+	ls := self.ls
+	switch tr {
+	case LUA_TFUNCTION: /* call the function */
+		ls.PushValue(3)
+		n := self.pushCaptures(s, e)
+		ls.Call(n, 1)
+	case LUA_TTABLE: /* index the table */
+		self.pushOneCapture(0, s, e)
+		ls.GetTable(3)
+	default: /* LUA_TNUMBER or LUA_TSTRING */
+		self.addS(b, s, e)
+		return
+	}
+	if !ls.ToBoolean(-1) { /* nil or false? */
+		b.WriteString(self.src[s:e]) /* keep original text */
+	} else if !ls.IsString(-1) {
+		ls.Error2("invalid replacement value (a %s)", ls.TypeName2(-1))
+	} else {
+		b.WriteString(ls.ToString(-1)) /* add result to accumulator */
+	}
+	ls.Pop(1)
+}
+
 /* helper */
 
 /* translate a relative string position: negative means back from end */
@@ -124,17 +124,22 @@ func tabConcat(ls LuaState) int {
 		return 1
 	}
 
-	buf := make([]string, j-i+1)
+	var b strings.Builder
 	for k := i; k > 0 && k <= j; k++ {
 		ls.GetI(1, k)
 		if !ls.IsString(-1) {
 			ls.Error2("invalid value (%s) at index %d in table for 'concat'",
 				ls.TypeName2(-1), i)
 		}
-		buf[k-i] = ls.ToString(-1)
+		s := ls.ToString(-1)
+		ls.CheckMemory(b.Len() + len(s) + len(sep)) // 结果还没有计入内存统计
+		b.WriteString(s)
+		if k < j {
+			b.WriteString(sep)
+		}
 		ls.Pop(1)
 	}
-	ls.PushString(strings.Join(buf, sep))
+	ls.PushString(b.String())
 
 	return 1
 }
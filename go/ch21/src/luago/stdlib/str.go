@@ -1,115 +1,251 @@
 package stdlib
 
-import "regexp"
-import "strings"
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	. "go/ch21/src/luago/api"
+)
+
+/*
+** {======================================================
+** STRING FORMAT
+** =======================================================
+ */
+
+/* valid flags in a format specification */
+const L_FMTFLAGS = "-+ #0"
+
+// 格式说明 %[flags][width][.precision]conversion
+type fmtSpec struct {
+	flags     string
+	width     int
+	precision int // -1表示没有指定精度
+	conv      byte
+}
 
-// tag = %[flags][width][.precision]specifier
-var tagPattern = regexp.MustCompile(`%[ #+-0]?[0-9]*(\.[0-9]+)?[cdeEfgGioqsuxX%]`)
+func (self *fmtSpec) hasFlag(flag byte) bool {
+	return strings.IndexByte(self.flags, flag) >= 0
+}
 
-func parseFmtStr(fmt string) []string {
-	if fmt == "" || strings.IndexByte(fmt, '%') < 0 {
-		return []string{fmt}
+// 转换成Go的格式字符串，conv是Go的格式动词
+func (self *fmtSpec) goFormat(conv byte) string {
+	form := "%" + self.flags
+	if self.width > 0 {
+		form += strconv.Itoa(self.width)
 	}
+	if self.precision >= 0 {
+		form += "." + strconv.Itoa(self.precision)
+	}
+	return form + string(conv)
+}
 
-	parsed := make([]string, 0, len(fmt)/2)
-	for {
-		if fmt == "" {
-			break
-		}
-
-		loc := tagPattern.FindStringIndex(fmt)
-		if loc == nil {
-			parsed = append(parsed, fmt)
-			break
-		}
-
-		head := fmt[:loc[0]]
-		tag := fmt[loc[0]:loc[1]]
-		tail := fmt[loc[1]:]
-
-		if head != "" {
-			parsed = append(parsed, head)
-		}
-		parsed = append(parsed, tag)
-		fmt = tail
+// 解析格式说明，strfrmt是'%'之后的部分，返回格式说明和剩余的格式字符串
+// lua-5.3.4/src/lstrlib.c#scanformat()
+func scanFormat(ls LuaState, strfrmt string) (*fmtSpec, string) {
+	spec := &fmtSpec{precision: -1}
+	p := 0
+	for p < len(strfrmt) && strings.IndexByte(L_FMTFLAGS, strfrmt[p]) >= 0 {
+		p++ /* skip flags */
+	}
+	if p > len(L_FMTFLAGS) {
+		ls.Error2("invalid format (repeated flags)")
+	}
+	spec.flags = strfrmt[:p]
+	spec.width, p = scanDigits(strfrmt, p) /* skip width */
+	if p < len(strfrmt) && strfrmt[p] == '.' {
+		spec.precision, p = scanDigits(strfrmt, p+1) /* skip precision */
 	}
-	return parsed
+	if p < len(strfrmt) && isDigit(strfrmt[p]) {
+		ls.Error2("invalid format (width or precision too long)")
+	}
+	if p < len(strfrmt) {
+		spec.conv = strfrmt[p]
+		p++
+	}
+	return spec, strfrmt[p:]
 }
 
-func find(s, pattern string, init int, plain bool) (start, end int) {
-	tail := s
-	if init > 1 {
-		tail = s[init-1:]
+// 读取最多两位数字
+func scanDigits(s string, p int) (int, int) {
+	n := 0
+	for i := 0; i < 2 && p < len(s) && isDigit(s[p]); i++ {
+		n = n*10 + int(s[p]-'0')
+		p++
 	}
+	return n, p
+}
 
-	if plain {
-		start = strings.Index(tail, pattern)
-		end = start + len(pattern) - 1
-	} else {
-		re, err := _compile(pattern)
-		if err != "" {
-			panic(err) // todo
-		} else {
-			loc := re.FindStringIndex(tail)
-			if loc == nil {
-				start, end = -1, -1
-			} else {
-				start, end = loc[0], loc[1]-1
-			}
-		}
+// 按照宽度填充字符串，C语言的宽度和精度都以字节为单位
+func padString(spec *fmtSpec, s string) string {
+	if len(s) >= spec.width {
+		return s
 	}
-	if start >= 0 {
-		start += len(s) - len(tail) + 1
-		end += len(s) - len(tail) + 1
+	padding := strings.Repeat(" ", spec.width-len(s))
+	if spec.hasFlag('-') {
+		return s + padding
 	}
+	return padding + s
+}
 
-	return
+// %c
+func formatChar(spec *fmtSpec, c int64) string {
+	return padString(spec, string([]byte{byte(c)}))
 }
 
-func match(s, pattern string, init int) []int {
-	tail := s
-	if init > 1 {
-		tail = s[init-1:]
+// %d %i %o %u %x %X
+func formatInt(spec *fmtSpec, n int64) string {
+	switch spec.conv {
+	case 'd', 'i':
+		return fmt.Sprintf(spec.goFormat('d'), n)
+	case 'u':
+		return fmt.Sprintf(spec.goFormat('d'), uint64(n))
+	default: // 'o' 'x' 'X' 把整数看作无符号数
+		return fmt.Sprintf(spec.goFormat(spec.conv), uint64(n))
 	}
+}
 
-	re, err := _compile(pattern)
-	if err != "" {
-		panic(err) // todo
-	} else {
-		found := re.FindStringSubmatchIndex(tail)
-		if len(found) > 2 {
-			return found[2:]
-		} else {
-			return found
+// %e %E %f %g %G
+func formatFloat(spec *fmtSpec, n float64) string {
+	if math.IsInf(n, 0) || math.IsNaN(n) {
+		return formatNonFinite(spec, n)
+	}
+	conv := spec.conv
+	if (conv == 'g' || conv == 'G') && spec.precision < 0 {
+		// C语言的%g默认精度是6，Go默认使用最短表示
+		s := *spec
+		s.precision = 6
+		return fmt.Sprintf(s.goFormat(conv), n)
+	}
+	return fmt.Sprintf(spec.goFormat(conv), n)
+}
+
+// 按照C语言的方式输出inf和nan
+func formatNonFinite(spec *fmtSpec, n float64) string {
+	var s string
+	switch {
+	case math.IsNaN(n):
+		s = "nan"
+	case n > 0:
+		s = "inf"
+		if spec.hasFlag('+') {
+			s = "+inf"
+		} else if spec.hasFlag(' ') {
+			s = " inf"
 		}
+	default:
+		s = "-inf"
 	}
+	if spec.conv >= 'A' && spec.conv <= 'Z' {
+		s = strings.ToUpper(s)
+	}
+	return padString(spec, s)
 }
 
-// todo
-func gsub(s, pattern, repl string, n int) (string, int) {
-	re, err := _compile(pattern)
-	if err != "" {
-		panic(err) // todo
-	} else {
-		indexes := re.FindAllStringIndex(s, n)
-		if indexes == nil {
-			return s, 0
+// %a %A 十六进制浮点数
+// lua-5.3.4/src/lstrlib.c#lua_number2strx()
+func formatHexFloat(spec *fmtSpec, n float64) string {
+	if math.IsInf(n, 0) || math.IsNaN(n) {
+		return formatNonFinite(spec, n)
+	}
+	s := strconv.FormatFloat(n, 'x', spec.precision, 64)
+	// Go的指数至少有两位数字，C语言没有这个限制：0x1p+00 -> 0x1p+0
+	if i := strings.IndexByte(s, 'p'); i >= 0 && s[i+2] == '0' && len(s) > i+3 {
+		s = s[:i+2] + s[i+3:]
+	}
+	if spec.hasFlag('#') && !strings.Contains(s, ".") {
+		i := strings.IndexByte(s, 'p')
+		s = s[:i] + "." + s[i:]
+	}
+	if !math.Signbit(n) {
+		if spec.hasFlag('+') {
+			s = "+" + s
+		} else if spec.hasFlag(' ') {
+			s = " " + s
 		}
+	}
+	if spec.conv == 'A' {
+		s = strings.ToUpper(s)
+	}
+	if spec.hasFlag('0') && !spec.hasFlag('-') && len(s) < spec.width {
+		i := strings.Index(strings.ToLower(s), "0x") + 2 // 在0x之后填充0
+		s = s[:i] + strings.Repeat("0", spec.width-len(s)) + s[i:]
+	}
+	return padString(spec, s)
+}
 
-		nMatches := len(indexes)
-		lastEnd := indexes[nMatches-1][1]
-		head, tail := s[:lastEnd], s[lastEnd:]
+// %s
+func formatString(ls LuaState, spec *fmtSpec, arg int) string {
+	s := ls.ToString2(arg)
+	ls.Pop(1) /* remove result from 'luaL_tolstring' */
+	if spec.flags == "" && spec.width == 0 && spec.precision < 0 {
+		return s /* keep entire string */
+	}
+	ls.ArgCheck(strings.IndexByte(s, 0) < 0, arg, "string contains zeros")
+	if spec.precision >= 0 && len(s) > spec.precision {
+		s = s[:spec.precision]
+	}
+	return padString(spec, s)
+}
 
-		newHead := re.ReplaceAllString(head, repl)
-		return newHead + tail, nMatches
+// %q 把值转换成Lua字面量
+// lua-5.3.4/src/lstrlib.c#addliteral()
+func formatLiteral(ls LuaState, arg int) string {
+	switch ls.Type(arg) {
+	case LUA_TSTRING:
+		return quoteString(ls.ToString(arg))
+	case LUA_TNUMBER:
+		if !ls.IsInteger(arg) { /* float? */
+			n := ls.ToNumber(arg)
+			switch {
+			case math.IsInf(n, 1):
+				return "1e9999"
+			case math.IsInf(n, -1):
+				return "-1e9999"
+			case math.IsNaN(n):
+				return "(0/0)"
+			}
+			/* write as hexa ('%a') */
+			return formatHexFloat(&fmtSpec{precision: -1, conv: 'a'}, n)
+		}
+		n := ls.ToInteger(arg)
+		if n == math.MinInt64 { /* corner case? */
+			return fmt.Sprintf("0x%x", uint64(n)) /* use hexa */
+		}
+		return strconv.FormatInt(n, 10)
+	case LUA_TNIL, LUA_TBOOLEAN:
+		s := ls.ToString2(arg)
+		ls.Pop(1)
+		return s
+	default:
+		ls.ArgError(arg, "value has no literal form")
+		return ""
 	}
 }
 
-func _compile(pattern string) (*regexp.Regexp, string) {
-	re, err := regexp.Compile(pattern)
-	if err != nil {
-		return nil, err.Error() // todo
-	} else {
-		return re, ""
+// lua-5.3.4/src/lstrlib.c#addquoted()
+func quoteString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '"' || c == '\\' || c == '\n' {
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		} else if c < 32 || c == 127 { // iscntrl
+			if i+1 < len(s) && isDigit(s[i+1]) {
+				fmt.Fprintf(&b, "\\%03d", c)
+			} else {
+				fmt.Fprintf(&b, "\\%d", c)
+			}
+		} else {
+			b.WriteByte(c)
+		}
 	}
+	b.WriteByte('"')
+	return b.String()
 }
+
+/* }====================================================== */
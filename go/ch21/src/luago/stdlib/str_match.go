@@ -0,0 +1,431 @@
+package stdlib
+
+import . "go/ch21/src/luago/api"
+
+/*
+** {======================================================
+** PATTERN MATCHING
+** =======================================================
+ */
+
+const (
+	LUA_MAXCAPTURES = 32  // 最多的捕获数量
+	MAXCCALLS       = 200 // doMatch最大的递归深度
+	CAP_UNFINISHED  = -1  // 捕获还没有结束
+	CAP_POSITION    = -2  // 位置捕获 ()
+	L_ESC           = '%'
+	SPECIALS        = "^$*+?.([%-"
+)
+
+// 匹配状态，字符串和模式都用下标表示位置，-1表示匹配失败(相当于C里的NULL)
+// lua-5.3.4/src/lstrlib.c#MatchState
+type matchState struct {
+	matchdepth int    /* control for recursive depth (to avoid C stack overflow) */
+	src        string /* subject */
+	pattern    string
+	ls         LuaState
+	level      int /* total number of captures (finished or unfinished) */
+	capture    [LUA_MAXCAPTURES]struct {
+		init int
+		len  int
+	}
+}
+
+// lua-5.3.4/src/lstrlib.c#prepstate()
+func newMatchState(ls LuaState, src, pattern string) *matchState {
+	return &matchState{ls: ls, src: src, pattern: pattern}
+}
+
+// 每次尝试匹配之前重置状态
+// lua-5.3.4/src/lstrlib.c#reprepstate()
+func (self *matchState) reprepstate() {
+	self.level = 0
+	self.matchdepth = MAXCCALLS
+}
+
+// lua-5.3.4/src/lstrlib.c#check_capture()
+func (self *matchState) checkCapture(l byte) int {
+	i := int(l) - '1'
+	if i < 0 || i >= self.level || self.capture[i].len == CAP_UNFINISHED {
+		self.ls.Error2("invalid capture index %%%d", i+1)
+	}
+	return i
+}
+
+// lua-5.3.4/src/lstrlib.c#capture_to_close()
+func (self *matchState) captureToClose() int {
+	level := self.level - 1
+	for ; level >= 0; level-- {
+		if self.capture[level].len == CAP_UNFINISHED {
+			return level
+		}
+	}
+	self.ls.Error2("invalid pattern capture")
+	return 0
+}
+
+// 返回字符类之后的位置
+// lua-5.3.4/src/lstrlib.c#classEnd()
+func (self *matchState) classEnd(p int) int {
+	pattern := self.pattern
+	c := pattern[p]
+	p++
+	if c == L_ESC {
+		if p >= len(pattern) {
+			self.ls.Error2("malformed pattern (ends with '%%')")
+		}
+		return p + 1
+	}
+	if c == '[' {
+		if p < len(pattern) && pattern[p] == '^' {
+			p++
+		}
+		for { /* look for a ']' */
+			if p >= len(pattern) {
+				self.ls.Error2("malformed pattern (missing ']')")
+			}
+			c := pattern[p]
+			p++
+			if c == L_ESC && p < len(pattern) {
+				p++ /* skip escapes (e.g. '%]') */
+			}
+			if p < len(pattern) && pattern[p] == ']' {
+				break
+			}
+		}
+		return p + 1
+	}
+	return p
+}
+
+// 判断字符c是否属于字符类%cl
+// lua-5.3.4/src/lstrlib.c#match_class()
+func matchClass(c, cl byte) bool {
+	var res bool
+	switch toLower(cl) {
+	case 'a':
+		res = isAlpha(c)
+	case 'c':
+		res = c < 32 || c == 127
+	case 'd':
+		res = isDigit(c)
+	case 'g':
+		res = c > 32 && c < 127
+	case 'l':
+		res = c >= 'a' && c <= 'z'
+	case 'p':
+		res = isPunct(c)
+	case 's':
+		res = c == ' ' || c >= '\t' && c <= '\r'
+	case 'u':
+		res = c >= 'A' && c <= 'Z'
+	case 'w':
+		res = isAlpha(c) || isDigit(c)
+	case 'x':
+		res = isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+	case 'z': /* deprecated option */
+		res = c == 0
+	default:
+		return cl == c
+	}
+	if cl >= 'A' && cl <= 'Z' { // 大写表示补集
+		return !res
+	}
+	return res
+}
+
+func isAlpha(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isPunct(c byte) bool {
+	return c > 32 && c < 127 && !isAlpha(c) && !isDigit(c)
+}
+
+func toLower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + ('a' - 'A')
+	}
+	return c
+}
+
+// 判断字符c是否属于字符集[...]，p指向'['，ec指向']'
+// lua-5.3.4/src/lstrlib.c#matchbracketclass()
+func (self *matchState) matchBracketClass(c byte, p, ec int) bool {
+	pattern := self.pattern
+	sig := true
+	if pattern[p+1] == '^' {
+		sig = false
+		p++ /* skip the '^' */
+	}
+	for p++; p < ec; p++ {
+		if pattern[p] == L_ESC {
+			p++
+			if matchClass(c, pattern[p]) {
+				return sig
+			}
+		} else if pattern[p+1] == '-' && p+2 < ec {
+			p += 2
+			if pattern[p-2] <= c && c <= pattern[p] {
+				return sig
+			}
+		} else if pattern[p] == c {
+			return sig
+		}
+	}
+	return !sig
+}
+
+// lua-5.3.4/src/lstrlib.c#singlematch()
+func (self *matchState) singleMatch(s, p, ep int) bool {
+	if s >= len(self.src) {
+		return false
+	}
+	c := self.src[s]
+	switch self.pattern[p] {
+	case '.':
+		return true /* matches any char */
+	case L_ESC:
+		return matchClass(c, self.pattern[p+1])
+	case '[':
+		return self.matchBracketClass(c, p, ep-1)
+	default:
+		return self.pattern[p] == c
+	}
+}
+
+// %bxy
+// lua-5.3.4/src/lstrlib.c#matchbalance()
+func (self *matchState) matchBalance(s, p int) int {
+	if p+1 >= len(self.pattern) {
+		self.ls.Error2("malformed pattern (missing arguments to '%%b')")
+	}
+	if s >= len(self.src) || self.src[s] != self.pattern[p] {
+		return -1
+	}
+	b, e := self.pattern[p], self.pattern[p+1]
+	cont := 1
+	for s++; s < len(self.src); s++ {
+		if self.src[s] == e {
+			if cont--; cont == 0 {
+				return s + 1
+			}
+		} else if self.src[s] == b {
+			cont++
+		}
+	}
+	return -1 /* string ends out of balance */
+}
+
+// 贪婪匹配 * +
+// lua-5.3.4/src/lstrlib.c#max_expand()
+func (self *matchState) maxExpand(s, p, ep int) int {
+	i := 0 /* counts maximum expand for item */
+	for self.singleMatch(s+i, p, ep) {
+		i++
+	}
+	/* keeps trying to match with the maximum repetitions */
+	for ; i >= 0; i-- {
+		if res := self.doMatch(s+i, ep+1); res != -1 {
+			return res
+		}
+	}
+	return -1
+}
+
+// 非贪婪匹配 -
+// lua-5.3.4/src/lstrlib.c#min_expand()
+func (self *matchState) minExpand(s, p, ep int) int {
+	for {
+		if res := self.doMatch(s, ep+1); res != -1 {
+			return res
+		} else if self.singleMatch(s, p, ep) {
+			s++ /* try with one more repetition */
+		} else {
+			return -1
+		}
+	}
+}
+
+// lua-5.3.4/src/lstrlib.c#start_capture()
+func (self *matchState) startCapture(s, p, what int) int {
+	if self.level >= LUA_MAXCAPTURES {
+		self.ls.Error2("too many captures")
+	}
+	self.capture[self.level].init = s
+	self.capture[self.level].len = what
+	self.level++
+	res := self.doMatch(s, p)
+	if res == -1 { /* match failed? */
+		self.level-- /* undo capture */
+	}
+	return res
+}
+
+// lua-5.3.4/src/lstrlib.c#end_capture()
+func (self *matchState) endCapture(s, p int) int {
+	l := self.captureToClose()
+	self.capture[l].len = s - self.capture[l].init /* close capture */
+	res := self.doMatch(s, p)
+	if res == -1 { /* match failed? */
+		self.capture[l].len = CAP_UNFINISHED /* undo capture */
+	}
+	return res
+}
+
+// 反向引用 %1-%9
+// lua-5.3.4/src/lstrlib.c#match_capture()
+func (self *matchState) matchCapture(s int, l byte) int {
+	i := self.checkCapture(l)
+	init, n := self.capture[i].init, self.capture[i].len
+	if n < 0 { // 位置捕获，在C里size_t的比较会失败
+		return -1
+	}
+	if len(self.src)-s >= n && self.src[init:init+n] == self.src[s:s+n] {
+		return s + n
+	}
+	return -1
+}
+
+// 从src的s处开始匹配模式的p处，返回匹配结束的位置，失败时返回-1
+// lua-5.3.4/src/lstrlib.c#match()
+func (self *matchState) doMatch(s, p int) int {
+	if self.matchdepth--; self.matchdepth == 0 {
+		self.ls.Error2("pattern too complex")
+	}
+	s = self._doMatch(s, p)
+	self.matchdepth++
+	return s
+}
+
+func (self *matchState) _doMatch(s, p int) int {
+	pattern := self.pattern
+	for p != len(pattern) { /* end of pattern? */
+		switch pattern[p] {
+		case '(': /* start capture */
+			if p+1 < len(pattern) && pattern[p+1] == ')' { /* position capture? */
+				return self.startCapture(s, p+2, CAP_POSITION)
+			}
+			return self.startCapture(s, p+1, CAP_UNFINISHED)
+		case ')': /* end capture */
+			return self.endCapture(s, p+1)
+		case '$':
+			if p+1 == len(pattern) { /* is the '$' the last char in pattern? */
+				if s == len(self.src) { /* check end of string */
+					return s
+				}
+				return -1
+			} /* else go to default */
+		case L_ESC: /* escaped sequences not in the format class[*+?-]? */
+			if p+1 < len(pattern) {
+				switch pattern[p+1] {
+				case 'b': /* balanced string? */
+					if s = self.matchBalance(s, p+2); s != -1 {
+						p += 4
+						continue /* return match(ms, s, p + 4); */
+					} /* else fail (s == NULL) */
+					return -1
+				case 'f': /* frontier? */
+					p += 2
+					if p >= len(pattern) || pattern[p] != '[' {
+						self.ls.Error2("missing '[' after '%%f' in pattern")
+					}
+					ep := self.classEnd(p) /* points to what is next */
+					var previous, current byte
+					if s > 0 {
+						previous = self.src[s-1]
+					}
+					if s < len(self.src) {
+						current = self.src[s]
+					}
+					if !self.matchBracketClass(previous, p, ep-1) &&
+						self.matchBracketClass(current, p, ep-1) {
+						p = ep
+						continue /* return match(ms, s, ep); */
+					}
+					return -1 /* match failed */
+				case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9': /* capture results (%0-%9)? */
+					if s = self.matchCapture(s, pattern[p+1]); s != -1 {
+						p += 2
+						continue /* return match(ms, s, p + 2) */
+					}
+					return -1
+				} /* else go to default */
+			}
+		}
+		/* default: pattern class plus optional suffix */
+		ep := self.classEnd(p) /* points to optional suffix */
+		var epc byte
+		if ep < len(pattern) {
+			epc = pattern[ep]
+		}
+		/* does not match at least once? */
+		if !self.singleMatch(s, p, ep) {
+			if epc == '*' || epc == '?' || epc == '-' { /* accept empty? */
+				p = ep + 1
+				continue /* return match(ms, s, ep + 1); */
+			}
+			return -1 /* '+' or no suffix */
+		}
+		/* matched once */
+		switch epc { /* handle optional suffix */
+		case '?': /* optional */
+			if res := self.doMatch(s+1, ep+1); res != -1 {
+				return res
+			}
+			p = ep + 1
+		case '+': /* 1 or more repetitions */
+			return self.maxExpand(s+1, p, ep)
+		case '*': /* 0 or more repetitions */
+			return self.maxExpand(s, p, ep)
+		case '-': /* 0 or more repetitions (minimum) */
+			return self.minExpand(s, p, ep)
+		default: /* no suffix */
+			s++
+			p = ep
+		}
+	}
+	return s
+}
+
+// 把第i个捕获推入栈顶，没有捕获时第0个捕获是整个匹配[s, e)
+// lua-5.3.4/src/lstrlib.c#push_onecapture()
+func (self *matchState) pushOneCapture(i, s, e int) {
+	if i >= self.level {
+		if i == 0 { /* ms->level == 0, too */
+			self.ls.PushString(self.src[s:e]) /* add whole match */
+		} else {
+			self.ls.Error2("invalid capture index %%%d", i+1)
+		}
+	} else {
+		init, l := self.capture[i].init, self.capture[i].len
+		if l == CAP_UNFINISHED {
+			self.ls.Error2("unfinished capture")
+		}
+		if l == CAP_POSITION {
+			self.ls.PushInteger(int64(init + 1))
+		} else {
+			self.ls.PushString(self.src[init : init+l])
+		}
+	}
+}
+
+// 把全部捕获推入栈顶，s为-1时表示不需要整个匹配
+// lua-5.3.4/src/lstrlib.c#push_captures()
+func (self *matchState) pushCaptures(s, e int) int {
+	nlevels := self.level
+	if nlevels == 0 && s != -1 {
+		nlevels = 1
+	}
+	self.ls.CheckStack2(nlevels, "too many captures")
+	for i := 0; i < nlevels; i++ {
+		self.pushOneCapture(i, s, e)
+	}
+	return nlevels /* number of strings pushed */
+}
+
+/* }====================================================== */
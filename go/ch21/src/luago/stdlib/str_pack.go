@@ -0,0 +1,252 @@
+package stdlib
+
+import (
+	"math"
+	"unsafe"
+
+	. "go/ch21/src/luago/api"
+)
+
+/*
+** {======================================================
+** PACK/UNPACK
+** =======================================================
+ */
+
+const (
+	MAXINTSIZE       = 16          /* maximum size for the binary representation of an integer */
+	NB               = 8           /* number of bits in a character */
+	MC               = 0xFF        /* mask for one character (NB 1's) */
+	SZINT            = 8           /* size of a lua_Integer */
+	MAXALIGN         = 8           /* maximum alignment: offsetof(struct cD, u) */
+	MAXSIZE          = math.MaxInt /* maximum size of a string */
+	LUAL_PACKPADBYTE = 0x00        /* value used for padding */
+	SIZEOF_INT       = 4
+	SIZEOF_SIZE_T    = 8
+)
+
+// 本机是否是小端字节序
+var nativeLittle = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// 格式选项的种类
+// lua-5.3.4/src/lstrlib.c#KOption
+type kOption int
+
+const (
+	kInt       kOption = iota /* signed integers */
+	kUint                     /* unsigned integers */
+	kFloat                    /* floating-point numbers */
+	kChar                     /* fixed-length strings */
+	kString                   /* strings with prefixed length */
+	kZstr                     /* zero-terminated strings */
+	kPadding                  /* padding */
+	kPaddalign                /* padding for alignment */
+	kNop                      /* no-op (configuration or spaces) */
+)
+
+// 读取格式字符串的状态
+// lua-5.3.4/src/lstrlib.c#Header
+type packHeader struct {
+	ls       LuaState
+	fmt      string // 剩余的格式字符串
+	islittle bool
+	maxalign int
+}
+
+// lua-5.3.4/src/lstrlib.c#initheader()
+func newPackHeader(ls LuaState, fmt string) *packHeader {
+	return &packHeader{ls: ls, fmt: fmt, islittle: nativeLittle, maxalign: 1}
+}
+
+// 读取可选的数字，没有数字时返回df
+// lua-5.3.4/src/lstrlib.c#getnum()
+func (self *packHeader) getNum(df int) int {
+	if self.fmt == "" || !isDigit(self.fmt[0]) { /* no number? */
+		return df /* return default value */
+	}
+	a := 0
+	for {
+		a = a*10 + int(self.fmt[0]-'0')
+		self.fmt = self.fmt[1:]
+		if self.fmt == "" || !isDigit(self.fmt[0]) || a > (MAXSIZE-9)/10 {
+			return a
+		}
+	}
+}
+
+// 读取整数大小，并检查是否在[1, MAXINTSIZE]之间
+// lua-5.3.4/src/lstrlib.c#getnumlimit()
+func (self *packHeader) getNumLimit(df int) int {
+	sz := self.getNum(df)
+	if sz > MAXINTSIZE || sz <= 0 {
+		self.ls.Error2("integral size (%d) out of limits [1,%d]", sz, MAXINTSIZE)
+	}
+	return sz
+}
+
+// 读取一个格式选项，返回它的种类和大小
+// lua-5.3.4/src/lstrlib.c#getoption()
+func (self *packHeader) getOption() (kOption, int) {
+	opt := self.fmt[0]
+	self.fmt = self.fmt[1:]
+	switch opt {
+	case 'b':
+		return kInt, 1
+	case 'B':
+		return kUint, 1
+	case 'h':
+		return kInt, 2
+	case 'H':
+		return kUint, 2
+	case 'l', 'j':
+		return kInt, 8
+	case 'L', 'J', 'T':
+		return kUint, 8
+	case 'f':
+		return kFloat, 4
+	case 'd', 'n':
+		return kFloat, 8
+	case 'i':
+		return kInt, self.getNumLimit(SIZEOF_INT)
+	case 'I':
+		return kUint, self.getNumLimit(SIZEOF_INT)
+	case 's':
+		return kString, self.getNumLimit(SIZEOF_SIZE_T)
+	case 'c':
+		size := self.getNum(-1)
+		if size == -1 {
+			self.ls.Error2("missing size for format option 'c'")
+		}
+		return kChar, size
+	case 'z':
+		return kZstr, 0
+	case 'x':
+		return kPadding, 1
+	case 'X':
+		return kPaddalign, 0
+	case ' ':
+	case '<':
+		self.islittle = true
+	case '>':
+		self.islittle = false
+	case '=':
+		self.islittle = nativeLittle
+	case '!':
+		self.maxalign = self.getNumLimit(MAXALIGN)
+	default:
+		self.ls.Error2("invalid format option '%c'", opt)
+	}
+	return kNop, 0
+}
+
+// 读取一个格式选项，同时计算在totalsize处需要填充多少字节才能对齐
+// lua-5.3.4/src/lstrlib.c#getdetails()
+func (self *packHeader) getDetails(totalsize int) (opt kOption, size, ntoalign int) {
+	opt, size = self.getOption()
+	align := size          /* usually, alignment follows size */
+	if opt == kPaddalign { /* 'X' gets alignment from following option */
+		if self.fmt == "" {
+			self.ls.ArgError(1, "invalid next option for option 'X'")
+		} else if nextOpt, nextAlign := self.getOption(); nextOpt == kChar || nextAlign == 0 {
+			self.ls.ArgError(1, "invalid next option for option 'X'")
+		} else {
+			align = nextAlign
+		}
+	}
+	if align <= 1 || opt == kChar { /* need no alignment? */
+		ntoalign = 0
+	} else {
+		if align > self.maxalign { /* enforce maximum alignment */
+			align = self.maxalign
+		}
+		if align&(align-1) != 0 { /* is 'align' not a power of 2? */
+			self.ls.ArgError(1, "format asks for alignment not power of 2")
+		}
+		ntoalign = (align - totalsize&(align-1)) & (align - 1)
+	}
+	return
+}
+
+// 把整数n按照字节序写成size个字节，neg表示是否需要符号扩展
+// lua-5.3.4/src/lstrlib.c#packint()
+func packInt(buf []byte, n uint64, islittle bool, size int, neg bool) []byte {
+	buff := make([]byte, size)
+	for i := 0; i < size; i++ {
+		b := byte(n & MC)
+		if i >= SZINT { /* negative number need sign extension? */
+			b = 0
+			if neg {
+				b = MC
+			}
+		}
+		if islittle {
+			buff[i] = b
+		} else {
+			buff[size-1-i] = b
+		}
+		n >>= NB
+	}
+	return append(buf, buff...)
+}
+
+// 按照字节序读取size个字节的整数
+// lua-5.3.4/src/lstrlib.c#unpackint()
+func unpackInt(ls LuaState, str string, islittle bool, size int, issigned bool) int64 {
+	res := uint64(0)
+	limit := size
+	if limit > SZINT {
+		limit = SZINT
+	}
+	at := func(i int) byte {
+		if islittle {
+			return str[i]
+		}
+		return str[size-1-i]
+	}
+	for i := limit - 1; i >= 0; i-- {
+		res <<= NB
+		res |= uint64(at(i))
+	}
+	if size < SZINT { /* real size smaller than lua_Integer? */
+		if issigned { /* needs sign extension? */
+			mask := uint64(1) << (size*NB - 1)
+			res = (res ^ mask) - mask /* do sign extension */
+		}
+	} else if size > SZINT { /* must check unread bytes */
+		mask := byte(0)
+		if issigned && int64(res) < 0 {
+			mask = MC
+		}
+		for i := limit; i < size; i++ {
+			if at(i) != mask {
+				ls.Error2("%d-byte integer does not fit into Lua Integer", size)
+			}
+		}
+	}
+	return int64(res)
+}
+
+// 把浮点数按照字节序写成size(4或者8)个字节
+func packFloat(buf []byte, n float64, islittle bool, size int) []byte {
+	var bits uint64
+	if size == 4 {
+		bits = uint64(math.Float32bits(float32(n)))
+	} else {
+		bits = math.Float64bits(n)
+	}
+	return packInt(buf, bits, islittle, size, false)
+}
+
+// 按照字节序读取size(4或者8)个字节的浮点数
+func unpackFloat(ls LuaState, str string, islittle bool, size int) float64 {
+	bits := uint64(unpackInt(ls, str, islittle, size, false))
+	if size == 4 {
+		return float64(math.Float32frombits(uint32(bits)))
+	}
+	return math.Float64frombits(bits)
+}
+
+/* }====================================================== */
@@ -20,8 +20,9 @@ func call(i Instruction, vm api.LuaVM) {
 	a += 1
 
 	nArgs := _pushFuncAndArgs(a, b, vm) // 把参数和函数压入栈顶
-	vm.Call(nArgs, c-1)                 // 调用函数
-	_popResults(a, c, vm)               // 弹出返回值
+	if !vm.PreCall(nArgs, c-1) {        // 调用函数，Lua函数返回之后由FinishOp()弹出返回值
+		_popResults(a, c, vm) // 弹出Go函数的返回值
+	}
 }
 
 // 把参数和函数压入栈顶
@@ -100,15 +101,16 @@ func vararg(i Instruction, vm api.LuaVM) {
 	}
 }
 
-// 尾调用优化
+// 尾调用 return R(A)(R(A+1), ... ,R(A+B-1))
+// 被调的Lua函数替换当前函数的调用帧，所以无限的尾递归也不会让调用栈变深
 func tailCall(i Instruction, vm api.LuaVM) {
 	a, b, _ := i.ABC()
 	a += 1
 
-	c := 0
 	nArgs := _pushFuncAndArgs(a, b, vm) // 把参数和函数压入栈顶
-	vm.Call(nArgs, c-1)                 // 调用函数
-	_popResults(a, c, vm)               // 弹出返回值
+	if !vm.TailCall(nArgs) {            // 用被调函数替换当前函数
+		_popResults(a, 0, vm) // 调用的是Go函数，由后面的RETURN指令返回它的返回值
+	}
 }
 
 // SELF指令 用来优化语法糖，把对象和方法拷贝到连续的两个寄存器中，这样在调用方法时就不需要再次拷贝了(节约一条指令)
@@ -129,6 +131,40 @@ func tForCall(i Instruction, vm api.LuaVM) {
 	a += 1
 
 	_pushFuncAndArgs(a, 3, vm) // 把函数和参数压入栈顶
-	vm.Call(2, c)              // 调用函数
-	_popResults(a+3, c+1, vm)  // 弹出返回值
+	if !vm.PreCall(2, c) {     // 调用函数
+		_popResults(a+3, c+1, vm) // 弹出返回值
+	}
+}
+
+// 完成被打断的指令，被调函数(或者元方法)的返回值已经在栈顶
+// 调用指令调用的Lua函数返回时，或者协程恢复运行后调用
+// lua-5.3.4/src/lvm.c#luaV_finishOp()
+func FinishOp(i Instruction, vm api.LuaVM) {
+	a, _, c := i.ABC()
+	a += 1
+
+	switch i.Opcode() {
+	case OP_ADD, OP_SUB, OP_MUL, OP_MOD, OP_POW, OP_DIV, OP_IDIV,
+		OP_BAND, OP_BOR, OP_BXOR, OP_SHL, OP_SHR, OP_UNM, OP_BNOT,
+		OP_LEN, OP_GETTABUP, OP_GETTABLE, OP_SELF:
+		vm.Replace(a) // 元方法的结果放进寄存器A
+	case OP_CONCAT:
+		n := vm.GetTop() - vm.RegisterCount() // 还没有拼接的值，最上面的是元方法的结果
+		vm.Concat(n)                          // 拼接剩下的值
+		vm.Replace(a)
+	case OP_EQ, OP_LT, OP_LE:
+		res := vm.ToBoolean(-1)
+		vm.Pop(3)                                      // 弹出元方法的结果和两个操作数
+		if cond, _, _ := i.ABC(); res != (cond != 0) { // 和_compare()一样，比较结果和A不匹配则跳过下一条指令
+			vm.AddPC(1)
+		}
+	case OP_SETTABUP, OP_SETTABLE:
+		// __newindex没有返回值，不需要做什么
+	case OP_CALL:
+		_popResults(a, c, vm)
+	case OP_TAILCALL:
+		_popResults(a, 0, vm)
+	case OP_TFORCALL:
+		_popResults(a+3, c+1, vm)
+	}
 }
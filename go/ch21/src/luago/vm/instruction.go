@@ -56,6 +56,11 @@ func (self Instruction) CMode() byte {
 	return opcodes[self.Opcode()].argCMode
 }
 
+// 返回指令是否会修改寄存器A
+func (self Instruction) TestAMode() bool {
+	return opcodes[self.Opcode()].setAFlag == 1
+}
+
 func (self Instruction) Execute(vm api.LuaVM) {
 	action := opcodes[self.Opcode()].action
 	//println("action:", opcodes[self.Opcode()].name)
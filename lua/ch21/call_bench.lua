@@ -0,0 +1,82 @@
+---
+--- 函数调用的性能测试，用法：luago call_bench.lua [fib的参数]
+---
+local N = tonumber(arg and arg[1]) or 30
+
+local function bench(name, calls, f)
+    local start = os.clock()
+    f()
+    local elapsed = os.clock() - start
+    print(string.format("%-20s %10d  %8.3fs  %10.0f calls/s", name, calls, elapsed, calls / elapsed))
+end
+
+-- fib(n)一共调用fib的次数
+local function fibCalls(n)
+    local a, b = 1, 1
+    for _ = 2, n do a, b = b, a + b + 1 end
+    return b
+end
+local CALLS = fibCalls(N)
+
+-- 递归调用
+bench("fib(" .. N .. ")", CALLS, function()
+    local function fib(n)
+        if n < 2 then return n end
+        return fib(n - 1) + fib(n - 2)
+    end
+    assert(fib(N) > 0)
+end)
+
+-- 通过元表调用方法
+bench("method calls", CALLS, function()
+    local Point = {}
+    Point.__index = Point
+    function Point.new(x, y) return setmetatable({x = x, y = y}, Point) end
+    function Point:getX() return self.x end
+    function Point:add(p) self.x, self.y = self.x + p.x, self.y + p.y; return self end
+    local p, d = Point.new(0, 0), Point.new(1, 2)
+    for _ = 1, CALLS // 2 do
+        p:add(d):getX()
+    end
+    assert(p.x == CALLS // 2)
+end)
+
+-- 继承链上的方法调用
+bench("inherited methods", CALLS, function()
+    local Base = {}
+    Base.__index = Base
+    function Base:area() return 0 end
+    function Base:describe() return self:area() end
+    local Rect = setmetatable({}, Base)
+    Rect.__index = Rect
+    function Rect:area() return self.w * self.h end
+    local r = setmetatable({w = 2, h = 3}, Rect)
+    local sum = 0
+    for _ = 1, CALLS // 2 do sum = sum + r:describe() end
+    assert(sum == 6 * (CALLS // 2))
+end)
+
+-- 多个参数和返回值
+bench("multiple results", CALLS, function()
+    local function swap(a, b, c) return c, b, a end
+    local x, y, z = 1, 2, 3
+    for _ = 1, CALLS do x, y, z = swap(x, y, z) end
+    assert(y == 2)
+end)
+
+-- 可变参数
+bench("vararg calls", CALLS, function()
+    local function count(...) return select("#", ...) end
+    local function pass(...) return count(...) end
+    local n = 0
+    for _ = 1, CALLS // 2 do n = n + pass(1, 2, 3) end
+    assert(n == 3 * (CALLS // 2))
+end)
+
+-- 调用Go函数
+bench("Go function calls", CALLS, function()
+    local abs = math.abs
+    local sum = 0
+    for i = 1, CALLS do sum = sum + abs(-i) end
+    assert(sum > 0)
+end)
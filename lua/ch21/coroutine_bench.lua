@@ -0,0 +1,63 @@
+---
+--- 协程切换的性能测试，用法：luago coroutine_bench.lua [次数]
+---
+local N = tonumber(arg and arg[1]) or 200000
+
+local function bench(name, f)
+    local start = os.clock()
+    f()
+    local elapsed = os.clock() - start
+    print(string.format("%-20s %10d  %8.3fs  %10.0f ops/s", name, N, elapsed, N / elapsed))
+end
+
+-- 反复恢复和挂起同一个协程
+bench("resume/yield", function()
+    local co = coroutine.create(function()
+        while true do coroutine.yield() end
+    end)
+    for _ = 1, N do coroutine.resume(co) end
+end)
+
+-- 在挂起和恢复时传递参数
+bench("resume/yield args", function()
+    local co = coroutine.create(function(a, b)
+        while true do a, b = coroutine.yield(b, a) end
+    end)
+    for i = 1, N do coroutine.resume(co, i, "x") end
+end)
+
+-- 挂起点在多层Lua函数调用之下
+bench("deep yield", function()
+    local function deep(n)
+        if n == 0 then return coroutine.yield() end
+        return deep(n - 1)
+    end
+    local co = coroutine.create(function()
+        while true do deep(10) end
+    end)
+    for _ = 1, N do coroutine.resume(co) end
+end)
+
+-- 在pcall中挂起
+bench("yield across pcall", function()
+    local co = coroutine.create(function()
+        while true do pcall(coroutine.yield) end
+    end)
+    for _ = 1, N do coroutine.resume(co) end
+end)
+
+-- 每次都创建新的协程
+bench("create/resume", function()
+    local f = function(x) return x end
+    for i = 1, N do coroutine.resume(coroutine.create(f), i) end
+end)
+
+-- 创建大量挂起后不再恢复的协程
+bench("create suspended", function()
+    local cos = {}
+    for i = 1, N do
+        local co = coroutine.create(function() coroutine.yield() end)
+        coroutine.resume(co)
+        cos[i] = co
+    end
+end)
@@ -0,0 +1,68 @@
+---
+--- 数值计算的性能测试，用法：luago number_bench.lua [循环次数]
+---
+local N = tonumber(arg and arg[1]) or 10000000
+
+local function bench(name, ops, f)
+    local start = os.clock()
+    f()
+    local elapsed = os.clock() - start
+    print(string.format("%-20s %10d  %8.3fs  %10.0f ops/s", name, ops, elapsed, ops / elapsed))
+end
+
+-- 整数加法
+bench("integer sum", N, function()
+    local sum = 0
+    for i = 1, N do sum = sum + i end
+    assert(sum == N * (N + 1) // 2)
+end)
+
+-- 整数乘法、取模和位运算
+bench("integer mix", N, function()
+    local x = 1
+    for i = 1, N do x = (x * 31 + i) % 1000003 ~ (i & 255) end
+    assert(x >= 0)
+end)
+
+-- 浮点数运算
+bench("float arithmetic", N, function()
+    local x, y = 0.0, 1.5
+    for _ = 1, N do x = x * 0.5 + y / 3.0 - 0.25 end
+    assert(x > 0)
+end)
+
+-- 浮点数的for循环
+bench("float for loop", N, function()
+    local n = 0
+    for _ = 0.5, N, 1.0 do n = n + 1 end
+    assert(n == N)
+end)
+
+-- 整数和浮点数混合运算以及比较
+bench("mandelbrot", N, function()
+    local size = math.floor(math.sqrt(N / 50))
+    local inside = 0
+    for y = 0, size - 1 do
+        local ci = 2.0 * y / size - 1.0
+        for x = 0, size - 1 do
+            local cr = 2.0 * x / size - 1.5
+            local zr, zi = 0.0, 0.0
+            local i = 0
+            while i < 50 and zr * zr + zi * zi < 4.0 do
+                zr, zi = zr * zr - zi * zi + cr, 2.0 * zr * zi + ci
+                i = i + 1
+            end
+            if i == 50 then inside = inside + 1 end
+        end
+    end
+    assert(inside > 0)
+end)
+
+-- 用数字填充表然后求和
+bench("table fill and sum", N, function()
+    local t = {}
+    for i = 1, N // 2 do t[i] = i * 0.5 end
+    local sum = 0
+    for i = 1, #t do sum = sum + t[i] end
+    assert(sum > 0)
+end)
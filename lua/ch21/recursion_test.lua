@@ -0,0 +1,58 @@
+---
+--- 深递归测试，用法：luago recursion_test.lua
+--- Lua函数之间的调用不占用Go的调用栈，递归深度只受调用深度限制，超出时抛出"stack overflow"错误
+---
+
+-- 接近默认限制(200000层)的递归
+local function sum(n)
+    if n == 0 then return 0 end
+    return n + sum(n - 1)
+end
+local start = os.clock()
+assert(sum(190000) == 190000 * 190001 // 2)
+print(string.format("recursion depth 190000: %.3fs", os.clock() - start))
+
+-- 超出限制时得到普通的Lua错误，之后还可以继续运行
+local function inf(n) return 1 + inf(n + 1) end
+local ok, err = pcall(inf, 1)
+assert(not ok and err:find("stack overflow"), err)
+ok, err = pcall(inf, 1)
+assert(not ok and err:find("stack overflow"), err)
+assert(sum(100) == 5050)
+
+-- 在协程里深递归
+local co = coroutine.wrap(function(n)
+    local function down(i)
+        if i == 0 then return coroutine.yield("bottom") end
+        return 1 + down(i - 1)
+    end
+    return down(n)
+end)
+assert(co(100000) == "bottom")
+assert(co(0) == 100000)
+
+-- 通过元方法和Go函数递归会占用Go的调用栈，嵌套太深时抛出"C stack overflow"错误
+local t = setmetatable({}, {__index = function(t, k) return t[k + 1] end})
+ok, err = pcall(function() return t[1] end)
+assert(not ok and err:find("C stack overflow"), err)
+local function pc(n) return select(2, pcall(pc, n + 1)) end
+ok, err = pcall(pc, 1)
+assert(ok and tostring(err):find("C stack overflow"), err)
+local depth = 0
+local function viaSort()
+    depth = depth + 1
+    table.sort({2, 1}, function(a, b) viaSort() return a < b end)
+end
+ok, err = pcall(viaSort)
+assert(not ok and err:find("C stack overflow") and depth < 250, err)
+
+-- 不太深的元方法递归可以正常执行
+local fib = setmetatable({}, {__index = function(t, n)
+    if n < 2 then return n end
+    local v = t[n - 1] + t[n - 2]
+    rawset(t, n, v)
+    return v
+end})
+assert(fib[80] == 23416728348467685)
+
+print("ok")
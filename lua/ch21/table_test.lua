@@ -0,0 +1,112 @@
+---
+--- 表的数组部分和长度测试，用法：luago table_test.lua [元素个数]
+--- 整数键不管以什么顺序放入，只要足够密集就会移到数组部分；#t总是返回表的一个边界
+---
+local N = tonumber(arg and arg[1]) or 100000
+
+-- n是t的边界：t[n]不是nil(n为0时除外)，并且t[n+1]是nil
+local function isBorder(t, n)
+    return (n == 0 or t[n] ~= nil) and t[n + 1] == nil
+end
+
+-- 构造器和数组中间的nil
+assert(#{} == 0)
+assert(#{1, 2, 3} == 3)
+assert(#{1, 2, 3, nil} == 3)
+assert(#{1, 2, nil, 4} == 4)
+assert(#{nil, nil, 3} == 3)
+assert(#{n = 1, 1, 2} == 2)
+
+-- 从末尾删除元素
+local t = {1, 2, 3}
+t[3] = nil; assert(#t == 2)
+t[2] = nil; assert(#t == 1)
+t[1] = nil; assert(#t == 0)
+t[1] = 1; assert(#t == 1)
+
+-- 浮点数键转换成整数
+t = {}
+t[1.0], t[2], t[3.0] = "a", "b", "c"
+assert(#t == 3 and t[1] == "a" and t[3] == "c")
+
+-- 稀疏的整数键不会让长度跳过空洞
+t = {1, 2}
+t[1000] = 1000
+assert(#t == 2)
+
+-- 各种顺序填充的表，长度都是边界
+local function fill(order)
+    local t = {}
+    if order == "forward" then
+        for i = 1, N do t[i] = i end
+    elseif order == "reverse" then
+        for i = N, 1, -1 do t[i] = i end
+    elseif order == "odd first" then
+        for i = 1, N, 2 do t[i] = i end
+        for i = 2, N, 2 do t[i] = i end
+    else -- 夹杂着字符串键
+        for i = 1, N do t[i] = i; t["k" .. i % 100] = i end
+    end
+    return t
+end
+
+local function sizeOf(f)
+    collectgarbage()
+    local before = collectgarbage("count")
+    local t = f()
+    collectgarbage()
+    return collectgarbage("count") - before, t
+end
+
+local forwardSize = sizeOf(function() return fill("forward") end)
+for _, order in ipairs({"forward", "reverse", "odd first", "mixed"}) do
+    local start = os.clock()
+    local size, t = sizeOf(function() return fill(order) end)
+    assert(#t == N, order)
+    local n = 0
+    for k, v in pairs(t) do
+        if math.type(k) == "integer" then
+            assert(k == v); n = n + 1
+        end
+    end
+    assert(n == N, order)
+    -- 逆序填充的表也有数组部分，占用的内存和顺序填充的差不多
+    assert(size < forwardSize * 1.5, order .. " uses " .. size .. "KB")
+    print(string.format("%-10s %8d keys  %8.0fKB  %.3fs", order, N, size, os.clock() - start))
+end
+
+-- 删除任意元素后长度仍然是边界
+t = fill("forward")
+local seed = 12345
+for _ = 1, 1000 do
+    seed = (seed * 1103515245 + 12345) % 2147483648
+    t[seed % N + 1] = nil
+    assert(isBorder(t, #t))
+end
+
+-- 队列：从头部删除、在尾部添加
+t = {}
+local head, tail = 1, 0
+for i = 1, N do
+    tail = tail + 1; t[tail] = i
+    if i % 3 ~= 0 then
+        t[head] = nil; head = head + 1
+    end
+    assert(isBorder(t, #t))
+end
+for i = head, tail do assert(t[i] == t[head] + i - head) end
+
+-- table库的函数依赖长度
+t = {}
+for i = 1, 100 do table.insert(t, 1, i) end
+assert(#t == 100 and t[1] == 100 and t[100] == 1)
+for _ = 1, 50 do table.remove(t, 1) end
+assert(#t == 50 and t[1] == 50)
+assert(select("#", table.unpack(t)) == 50)
+
+-- 弱表没有数组部分
+t = setmetatable({}, {__mode = "v"})
+for i = N // 100, 1, -1 do t[i] = {} end
+assert(isBorder(t, #t))
+
+print("ok")
@@ -0,0 +1,126 @@
+---
+--- 尾调用测试，用法：luago tailcall_test.lua [次数]
+--- 尾调用复用调用帧，所以任意深度的尾递归都只占用常数大小的栈
+---
+local N = tonumber(arg and arg[1]) or 10000000
+
+-- 调用栈的深度
+local function depth()
+    local level = 1
+    while debug.getinfo(level, "l") do level = level + 1 end
+    return level
+end
+
+-- 互相尾调用的两个函数
+local isEven, isOdd
+function isEven(n, d)
+    if n == 0 then return true, depth() - d end
+    return isOdd(n - 1, d)
+end
+function isOdd(n, d)
+    if n == 0 then return false, depth() - d end
+    return isEven(n - 1, d)
+end
+
+local start = os.clock()
+local even, grown = isEven(N, depth())
+assert(even == (N % 2 == 0))
+assert(grown <= 1, "stack grew by " .. grown)
+print(string.format("%d mutual tail calls: %.3fs, stack grew by %d", N, os.clock() - start, grown))
+
+-- 状态机：每个状态尾调用下一个状态
+local function run(n)
+    local s1, s2, s3
+    function s1(i, acc) if i == 0 then return acc end return s2(i - 1, acc + 1) end
+    function s2(i, acc) return s3(i, acc * 1) end
+    function s3(i, acc) return s1(i, acc) end
+    return s1(n, 0)
+end
+assert(run(1000000) == 1000000)
+
+-- CPS风格
+local function fact(n, k)
+    if n == 0 then return k(1) end
+    return fact(n - 1, function(v) return k(n * v) end)
+end
+assert(fact(20, function(v) return v end) == 2432902008176640000)
+
+-- 尾调用Go函数，Go函数返回之后当前函数立即返回，调用栈也不会变深
+local function count(n)
+    if n == 0 then return select("#", 1, 2, 3) end
+    return count(n - 1)
+end
+assert(count(1000000) == 3)
+local function tostr(n) return tostring(n) end
+assert(tostr(42) == "42")
+local function pick(...) return select(2, ...) end
+assert(pick(1, 2, 3) == 2)
+
+-- 变长参数和返回值个数
+local function va(n, ...)
+    if n == 0 then return ... end
+    return va(n - 1, ...)
+end
+local a, b, c = va(100000, 1, nil, 3)
+assert(a == 1 and b == nil and c == 3)
+assert(select("#", va(10)) == 0)
+local t = {va(10, 1, 2, 3, 4, 5)}
+assert(#t == 5)
+
+-- 通过__call尾调用
+local obj = setmetatable({}, {__call = function(self, n)
+    if n == 0 then return "done" end
+    return self(n - 1)
+end})
+local function callObj(n) return obj(n) end
+assert(callObj(100000) == "done")
+
+-- upvalue在尾调用之前关闭
+local function mk(x)
+    local function get() return x end
+    x = x + 1
+    return (function(f) return f end)(get)
+end
+assert(mk(1)() == 2)
+
+-- 在尾调用的函数里挂起
+local co = coroutine.wrap(function(n)
+    local function loop(i)
+        if i > n then return "end" end
+        coroutine.yield(i)
+        return loop(i + 1)
+    end
+    return loop(1)
+end)
+assert(co(3) == 1 and co() == 2 and co() == 3 and co() == "end")
+local co2 = coroutine.wrap(function() return coroutine.yield(1) end)
+assert(co2() == 1 and co2("x") == "x")
+
+-- 被替换掉的函数不出现在调用栈回溯里
+local function inner() local tb = debug.traceback("tb", 1) return tb end
+local function outer() return inner() end
+local tb = outer()
+assert(tb:find("%(%.%.%.tail calls%.%.%.%)"), tb)
+local function info() local ar = debug.getinfo(1, "t") return ar.istailcall end
+local function callInfo() return info() end
+assert(callInfo() == true)
+assert(info() == false)
+
+-- 调试钩子收到tail call事件
+local events = {}
+local function g() return 1 end
+local function f() return g() end
+debug.sethook(function(e) events[#events + 1] = e end, "cr")
+f()
+debug.sethook()
+assert(table.concat(events, ","):find("call,tail call,return"), table.concat(events, ","))
+
+-- 尾调用出错
+local ok, err = pcall(function() return nil + 1 end)
+assert(not ok and err:find("arithmetic"))
+ok, err = pcall(function() local x return x() end)
+assert(not ok and err:find("attempt to call a nil value"))
+ok, err = pcall(function() return error("boom") end)
+assert(not ok and err:find("tailcall_test.lua:%d+: boom"), err)
+
+print("ok")